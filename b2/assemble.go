@@ -0,0 +1,277 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// minPartSize is the smallest part, other than the last, that B2 accepts.
+	minPartSize = 5e6
+
+	// maxPartSize is the largest part B2 accepts.
+	maxPartSize = 5e9
+
+	// maxParts is the largest number of parts B2 allows in a large file.
+	maxParts = 10000
+)
+
+// A Piece is a contiguous section of an object built by Assemble.
+type Piece struct {
+	r    io.Reader
+	o    *Object
+	off  int64
+	size int64
+}
+
+// ReaderPiece returns a Piece of size bytes read from r.
+func ReaderPiece(r io.Reader, size int64) Piece {
+	return Piece{r: r, size: size}
+}
+
+// SectionPiece returns a Piece of size bytes read from r, beginning at offset.
+// An *os.File is an io.ReaderAt.
+func SectionPiece(r io.ReaderAt, offset, size int64) Piece {
+	return ReaderPiece(io.NewSectionReader(r, offset, size), size)
+}
+
+// ObjectPiece returns a Piece of size bytes of an existing object, beginning
+// at offset.  If size is negative, the Piece extends to the end of the
+// object.  The object must be in the same account, but may be in another
+// bucket.
+func ObjectPiece(o *Object, offset, size int64) Piece {
+	return Piece{o: o, off: offset, size: size}
+}
+
+// part is a single part of an assembled object.  It is either read from r or
+// copied from the file src.
+type part struct {
+	n    int
+	r    io.Reader
+	src  string
+	off  int64
+	size int64
+}
+
+// splitRange divides size bytes into as few ranges of at most max bytes as
+// possible, and returns the offset and length of each.  The ranges are of
+// nearly equal length, so that none is too small to be a part.
+func splitRange(size, max int64) [][2]int64 {
+	n := (size + max - 1) / max
+	var rs [][2]int64
+	for i := int64(0); i < n; i++ {
+		off := size * i / n
+		end := size * (i + 1) / n
+		rs = append(rs, [2]int64{off, end - off})
+	}
+	return rs
+}
+
+// Assemble writes an object made from the given pieces, in order.  Data read
+// from local pieces is uploaded, and large sections of existing objects are
+// copied within B2 without being downloaded, so an object can be built from,
+// for example, a locally generated header followed by several gigabytes of
+// previously uploaded media.
+//
+// Sections of existing objects smaller than 5MB can't be copied, and are
+// downloaded and uploaded again instead.  Every run of consecutive local data
+// that is followed by a copied section must be at least 5MB.
+//
+// Local pieces are read in order, ChunkSize bytes at a time, and parts are
+// uploaded or copied ConcurrentUploads at a time; these and the object's
+// attributes are set with opts as for NewWriter.  If Assemble fails, the
+// upload is left unfinished.
+func (o *Object) Assemble(ctx context.Context, pieces []Piece, opts ...WriterOption) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := o.NewWriter(ctx, opts...)
+	csize := int64(w.ChunkSize)
+	if csize == 0 {
+		csize = 1e8
+	}
+	if w.ConcurrentUploads < 1 {
+		w.ConcurrentUploads = 1
+	}
+
+	var (
+		parts  []part
+		local  []io.Reader
+		lsize  int64
+		copies bool
+	)
+	// flush splits the pending local data into parts.  A remainder smaller
+	// than the minimum part size is added to the part before it.
+	flush := func() {
+		if lsize == 0 {
+			return
+		}
+		r := io.MultiReader(local...)
+		for lsize > 0 {
+			n := csize
+			if lsize-n < minPartSize && lsize <= maxPartSize {
+				n = lsize
+			}
+			if n > lsize {
+				n = lsize
+			}
+			parts = append(parts, part{n: len(parts) + 1, r: r, size: n})
+			lsize -= n
+		}
+		local = nil
+	}
+	for _, p := range pieces {
+		if p.o == nil {
+			local = append(local, p.r)
+			lsize += p.size
+			continue
+		}
+		if p.size < 0 {
+			attrs, err := p.o.Attrs(ctx)
+			if err != nil {
+				return err
+			}
+			p.size = attrs.Size - p.off
+		}
+		if p.size < minPartSize {
+			rr := p.o.NewRangeReader(ctx, p.off, p.size)
+			defer rr.Close()
+			local = append(local, rr)
+			lsize += p.size
+			continue
+		}
+		if lsize > 0 && lsize < minPartSize {
+			return fmt.Errorf("%s: %d bytes of local data precede a copied section; the minimum is %d", o.name, lsize, int64(minPartSize))
+		}
+		flush()
+		if err := p.o.ensure(ctx); err != nil {
+			return err
+		}
+		copies = true
+		for _, r := range splitRange(p.size, maxPartSize) {
+			parts = append(parts, part{n: len(parts) + 1, src: p.o.f.id(), off: p.off + r[0], size: r[1]})
+		}
+	}
+	if !copies {
+		// Nothing can be copied, so this is just an ordinary upload.
+		if _, err := copyContext(ctx, w, io.MultiReader(local...)); err != nil {
+			// Cancel first, so that Close doesn't commit what was read.
+			cancel()
+			w.Close()
+			return err
+		}
+		return w.Close()
+	}
+	flush()
+	if len(parts) > maxParts {
+		return fmt.Errorf("%s: %d parts exceeds the limit of %d", o.name, len(parts), maxParts)
+	}
+
+	ct := w.contentType
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+	f, err := o.b.b.startLargeFile(ctx, o.name, ct, w.info)
+	if err != nil {
+		return err
+	}
+	lf := newLargeFile(o.b, o.name, f)
+
+	type job struct {
+		p   part
+		buf writeBuffer
+	}
+	ch := make(chan job)
+	var (
+		wg   sync.WaitGroup
+		emux sync.Mutex
+		rerr error
+	)
+	setErr := func(err error) {
+		emux.Lock()
+		defer emux.Unlock()
+		if rerr == nil {
+			rerr = err
+			cancel()
+		}
+	}
+	for i := 0; i < w.ConcurrentUploads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range ch {
+				var err error
+				if j.buf == nil {
+					_, err = lf.f.copyPart(ctx, j.p.src, j.p.off, j.p.size, j.p.n)
+				} else {
+					var r readResetter
+					r, err = j.buf.Reader()
+					if err == nil {
+						err = lf.upload(ctx, r, j.buf.Hash(), j.buf.Len(), j.p.n)
+					}
+					j.buf.Close()
+				}
+				if err != nil {
+					setErr(err)
+				}
+			}
+		}()
+	}
+	for _, p := range parts {
+		j := job{p: p}
+		if p.r != nil {
+			// Local pieces are read here, in order, so that plain readers
+			// work; the uploads themselves happen concurrently.
+			buf := newMemoryBuffer()
+			n, err := copyContext(ctx, buf, io.LimitReader(p.r, p.size))
+			if err == nil && n < p.size {
+				err = fmt.Errorf("%s: part %d: read %d of %d bytes: %v", o.name, p.n, n, p.size, io.ErrUnexpectedEOF)
+			}
+			if err != nil {
+				buf.Close()
+				setErr(err)
+				break
+			}
+			j.buf = buf
+		}
+		select {
+		case ch <- j:
+		case <-ctx.Done():
+			if j.buf != nil {
+				j.buf.Close()
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(ch)
+	wg.Wait()
+	if rerr != nil {
+		return rerr
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	obj, err := lf.Finish(ctx)
+	if err != nil {
+		return err
+	}
+	o.f = obj.f
+	return nil
+}
@@ -0,0 +1,66 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/kurin/blazer/internal/blog"
+)
+
+// cleanupTimeout bounds the work WriteAtomic does to remove its temporary
+// object, which must happen even when the caller's context is done.
+var cleanupTimeout = time.Minute
+
+// WriteAtomic writes o so that it is never seen partially written.  fn is
+// called with a Writer for a temporary object beside o, named with a random
+// ".tmp-" suffix; fn should write the contents but not close the Writer.  If
+// fn returns nil, the temporary object is committed and copied within B2 to
+// o, which appears all at once.
+//
+// Whether or not it succeeds, the temporary object is removed before
+// WriteAtomic returns, even if ctx is cancelled, and any large file upload
+// is cancelled.  The options are applied to the Writer.
+func WriteAtomic(ctx context.Context, o *Object, fn func(*Writer) error, opts ...WriterOption) error {
+	tmp := o.b.Object(fmt.Sprintf("%s.tmp-%016x", o.name, rand.Int63()))
+	w := tmp.NewWriter(ctx, opts...)
+	err := fn(w)
+	if err != nil {
+		w.cancel()
+		w.Close()
+	} else {
+		err = w.Close()
+	}
+	if err == nil {
+		err = tmp.CopyTo(ctx, o)
+	}
+
+	cctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+	switch {
+	case tmp.f != nil:
+		if derr := tmp.Delete(cctx); derr != nil {
+			blog.V(1).Infof("b2 atomic write %s: delete %s: %v", o.name, tmp.name, derr)
+		}
+	case w.file != nil:
+		if cerr := w.file.Cancel(cctx); cerr != nil {
+			blog.V(1).Infof("b2 atomic write %s: cancel %s: %v", o.name, tmp.name, cerr)
+		}
+	}
+	return err
+}
@@ -29,12 +29,15 @@ package b2
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"regexp"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -47,6 +50,9 @@ type Client struct {
 	sWriters map[string]*Writer
 	sReaders map[string]*Reader
 	sMethods []methodCounter
+	sOps     map[string]*OpStats
+	sTLS     map[string]*TLSStats
+	sReqs    map[string]*RequestInfo
 	opts     clientOptions
 }
 
@@ -68,9 +74,38 @@ func NewClient(ctx context.Context, account, key string, opts ...ClientOption) (
 	for _, f := range opts {
 		f(&c.opts)
 	}
+	if c.opts.scratch != nil {
+		c.opts.scratch.clean()
+	}
+	if c.opts.pins != nil {
+		if c.opts.proxy != nil {
+			return nil, errors.New("b2: PinHosts cannot be used with Proxy")
+		}
+		api := c.opts.apiBase
+		if api == "" {
+			api = defaultAPIBase
+		}
+		if err := c.opts.pins.pin(ctx, api); err != nil {
+			return nil, err
+		}
+	}
+	if c.opts.proxy != nil || c.opts.dial != nil || c.opts.uploadDial != nil || c.opts.localAddr != nil || c.opts.pins != nil {
+		if c.opts.transport != nil {
+			return nil, errors.New("b2: Proxy, DialContext, UploadDialContext, LocalAddr, and PinHosts cannot be used with Transport")
+		}
+		c.opts.transport = c.opts.newTransport()
+	}
 	if err := c.backend.authorizeAccount(ctx, account, key, c.opts); err != nil {
 		return nil, err
 	}
+	if c.opts.pins != nil {
+		api, download := c.backend.endpoints()
+		for _, u := range []string{api, download} {
+			if err := c.opts.pins.pin(ctx, u); err != nil {
+				return nil, err
+			}
+		}
+	}
 	return c, nil
 }
 
@@ -83,6 +118,18 @@ type clientOptions struct {
 	apiBase         string
 	userAgents      []string
 	writerOpts      []WriterOption
+	readerOpts      []ReaderOption
+	scratch         *scratchCleaner
+	retry           *RetryPolicy
+	keepUnknown     bool
+	proxy           *url.URL
+	dial            func(ctx context.Context, network, addr string) (net.Conn, error)
+	uploadDial      func(ctx context.Context, network, addr string) (net.Conn, error)
+	localAddr       net.IP
+	pins            *hostPins
+	transfers       *scheduler
+	bandwidth       *Limiter
+	onResponse      func(*RequestInfo)
 }
 
 // A ClientOption allows callers to adjust various per-client settings.
@@ -108,12 +155,115 @@ func APIBase(url string) ClientOption {
 
 // Transport sets the underlying HTTP transport mechanism.  If unset,
 // http.DefaultTransport is used.
+//
+// Every request passed to rt carries the context given to the method that
+// caused it, including requests made by Writers and Readers in the
+// background, and requests to retry or reauthorize.  Values the caller
+// attaches to that context, such as request or tenant IDs, are therefore
+// available from the request's Context method for logging and metrics.
 func Transport(rt http.RoundTripper) ClientOption {
 	return func(c *clientOptions) {
 		c.transport = rt
 	}
 }
 
+// Proxy sends all of the client's requests, including uploads and downloads,
+// through the HTTP or SOCKS5 proxy at u.  By default, the proxy given by the
+// environment is used, as with http.DefaultTransport.  Proxy cannot be used
+// with Transport; callers providing their own transport should configure it
+// directly.
+func Proxy(u *url.URL) ClientOption {
+	return func(c *clientOptions) {
+		c.proxy = u
+	}
+}
+
+// DialContext makes the client open all of its connections with dial.  This
+// can be used, for example, to bind connections to a particular interface,
+// or to tunnel them.  Like Proxy, DialContext cannot be used with Transport.
+func DialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) ClientOption {
+	return func(c *clientOptions) {
+		c.dial = dial
+	}
+}
+
+// LocalAddr makes the client open all of its connections, for API calls,
+// uploads, and downloads alike, from the local address ip.  On a host with
+// several interfaces, this selects the one B2 traffic leaves by.  LocalAddr
+// applies to the client's own dialer, and so has no effect on connections
+// made by a dialer given to DialContext or UploadDialContext, which should
+// set their own address; like them, it cannot be used with Transport.
+func LocalAddr(ip net.IP) ClientOption {
+	return func(c *clientOptions) {
+		c.localAddr = ip
+	}
+}
+
+// UploadDialContext makes the client open the connections that carry uploads
+// with dial, rather than with the dialer used for everything else.  B2 sends
+// uploads to hosts of its choosing, apart from the API and download hosts, so
+// this allows them to be resolved differently, as in split-horizon DNS, or to
+// leave by a particular interface.  Like Proxy, UploadDialContext cannot be
+// used with Transport.
+func UploadDialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) ClientOption {
+	return func(c *clientOptions) {
+		c.uploadDial = dial
+	}
+}
+
+// uploadKey marks the contexts of upload requests, for UploadDialContext.
+type uploadKey struct{}
+
+// newTransport returns a transport like http.DefaultTransport, but with the
+// proxy and dialer from c.
+func (c *clientOptions) newTransport() *http.Transport {
+	d := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if c.localAddr != nil {
+		d.LocalAddr = &net.TCPAddr{IP: c.localAddr}
+	}
+	t := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           d.DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	if c.proxy != nil {
+		t.Proxy = http.ProxyURL(c.proxy)
+	}
+	if c.dial != nil {
+		t.DialContext = c.dial
+	}
+	if c.uploadDial != nil {
+		dial := t.DialContext
+		t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if up, _ := ctx.Value(uploadKey{}).(bool); up {
+				return c.uploadDial(ctx, network, addr)
+			}
+			return dial(ctx, network, addr)
+		}
+	}
+	if c.pins != nil {
+		t.DialContext = c.pins.dialer(t.DialContext)
+	}
+	return t
+}
+
+// KeepUnknownFields makes the client keep any fields in B2's responses that
+// this package doesn't recognize, and report them in Attrs.Unknown and
+// BucketAttrs.Unknown.  This allows features that B2 has added since this
+// package was written to be used before they are supported directly.  Each
+// response is decoded twice, so this is not free.
+func KeepUnknownFields() ClientOption {
+	return func(c *clientOptions) {
+		c.keepUnknown = true
+	}
+}
+
 // FailSomeUploads requests intermittent upload failures from the B2 service.
 // This is mostly useful for testing.
 func FailSomeUploads() ClientOption {
@@ -138,6 +288,17 @@ func ForceCapExceeded() ClientOption {
 	}
 }
 
+// OnResponse calls fn with the details of every response B2 sends, including
+// errors, so that request identifiers can be logged as they arrive.  It is
+// called from the goroutine that made the request, and so may be called
+// concurrently; fn must not modify the RequestInfo.  Requests that receive no
+// response are not reported.
+func OnResponse(fn func(*RequestInfo)) ClientOption {
+	return func(c *clientOptions) {
+		c.onResponse = fn
+	}
+}
+
 func client(cl *Client) ClientOption {
 	return func(c *clientOptions) {
 		c.client = cl
@@ -151,6 +312,12 @@ type clientTransport struct {
 
 func (ct *clientTransport) RoundTrip(r *http.Request) (*http.Response, error) {
 	m := r.Header.Get("X-Blazer-Method")
+	if m == "b2_upload_file" || m == "b2_upload_part" {
+		r = r.WithContext(context.WithValue(r.Context(), uploadKey{}, true))
+	}
+	if m != "" && ct.client != nil {
+		r = r.WithContext(ct.client.traceTLS(r.Context(), r.URL.Host))
+	}
 	t := ct.rt
 	if t == nil {
 		t = http.DefaultTransport
@@ -158,20 +325,30 @@ func (ct *clientTransport) RoundTrip(r *http.Request) (*http.Response, error) {
 	b := time.Now()
 	resp, err := t.RoundTrip(r)
 	e := time.Now()
+	if m != "" && ct.client != nil {
+		ct.client.recordOp(m, resp, err)
+	}
 	if err != nil {
 		return resp, err
 	}
 	if m != "" && ct.client != nil {
+		ri := responseInfo(resp)
 		ct.client.slock.Lock()
-		m := method{
-			name:     m,
-			duration: e.Sub(b),
-			status:   resp.StatusCode,
-		}
 		for _, counter := range ct.client.sMethods {
-			counter.record(m)
+			counter.record(method{
+				name:     m,
+				duration: e.Sub(b),
+				status:   resp.StatusCode,
+			})
+		}
+		if ct.client.sReqs == nil {
+			ct.client.sReqs = make(map[string]*RequestInfo)
 		}
+		ct.client.sReqs[m] = ri
 		ct.client.slock.Unlock()
+		if fn := ct.client.opts.onResponse; fn != nil {
+			fn(ri)
+		}
 	}
 	return resp, nil
 }
@@ -183,6 +360,10 @@ type Bucket struct {
 
 	c       *Client
 	urlPool *urlPool
+
+	writerOpts []WriterOption
+	readerOpts []ReaderOption
+	policies   []Policy
 }
 
 type BucketType string
@@ -196,6 +377,14 @@ const (
 
 // BucketAttrs holds a bucket's metadata attributes.
 type BucketAttrs struct {
+	// Name, ID, and Revision identify the bucket and the version of its
+	// attributes.  They are reported by bucket.Attrs and ignored by
+	// bucket.Update and Client.NewBucket.  B2 increments Revision with every
+	// update.
+	Name     string
+	ID       string
+	Revision int
+
 	// Type lists or sets the new bucket type.  If Type is UnknownType during a
 	// bucket.Update, the type is not changed.
 	Type BucketType
@@ -209,6 +398,17 @@ type BucketAttrs struct {
 	// the rules are not modified.  A bucket's rules can be removed by updating
 	// with an empty slice.
 	LifecycleRules []LifecycleRule
+
+	// Reports or sets the bucket's CORS rules, which let web pages on other
+	// origins, such as a browser uploading directly to B2, use the bucket.
+	// If nil during a bucket.Update, the rules are not modified.  A bucket's
+	// rules can be removed by updating with an empty slice.
+	CORSRules []CORSRule
+
+	// Unknown holds any fields B2 returned for the bucket that this package
+	// does not yet understand.  It is only set for clients created with
+	// KeepUnknownFields, and is ignored by bucket.Update.
+	Unknown map[string]interface{}
 }
 
 // A LifecycleRule describes an object's life cycle, namely how many days after
@@ -220,7 +420,7 @@ type LifecycleRule struct {
 	// Prefix specifies all the files in the bucket to which this rule applies.
 	Prefix string
 
-	// DaysUploadedUntilHidden specifies the number of days after which a file
+	// DaysNewUntilHidden specifies the number of days after which a file
 	// will automatically be hidden.  0 means "do not automatically hide new
 	// files".
 	DaysNewUntilHidden int
@@ -230,6 +430,33 @@ type LifecycleRule struct {
 	DaysHiddenUntilDeleted int
 }
 
+// A CORSRule lets browsers make cross-origin requests of a bucket.  B2 allows
+// up to 100 rules per bucket.
+type CORSRule struct {
+	// Name identifies the rule.  It must be unique within the bucket.
+	Name string
+
+	// AllowedOrigins lists the origins, such as "https://example.com", that
+	// may make requests.  "*" allows any origin.
+	AllowedOrigins []string
+
+	// AllowedOperations lists the B2 operations the origins may use, such
+	// as "b2_download_file_by_name" or "b2_upload_file".
+	AllowedOperations []string
+
+	// AllowedHeaders lists the request headers the origins may send.  It
+	// may contain "*".
+	AllowedHeaders []string
+
+	// ExposeHeaders lists the response headers browsers may show to the
+	// origins' scripts.
+	ExposeHeaders []string
+
+	// MaxAgeSeconds is how long browsers may cache the result of a preflight
+	// request.
+	MaxAgeSeconds int
+}
+
 type b2err struct {
 	err              error
 	notFoundErr      bool
@@ -240,14 +467,69 @@ func (e b2err) Error() string {
 	return e.err.Error()
 }
 
+// Unwrap returns the details of e as an *Error if B2 returned it, so that
+// errors.As can find them, and otherwise the error e wraps.
+func (e b2err) Unwrap() error {
+	if be, ok := errorDetails(e.err); ok {
+		return be
+	}
+	return e.err
+}
+
 // IsNotExist reports whether a given error indicates that an object or bucket
 // does not exist.
 func IsNotExist(err error) bool {
-	berr, ok := err.(b2err)
+	var berr b2err
+	if errors.As(err, &berr) && berr.notFoundErr {
+		return true
+	}
+	e, ok := AsError(err)
 	if !ok {
 		return false
 	}
-	return berr.notFoundErr
+	return notExistCodes[e.Code]
+}
+
+// RequestInfo identifies a request made to B2, so that it can be referenced
+// when contacting Backblaze support.  It is attached to errors, and reported
+// by Status and OnResponse.
+type RequestInfo struct {
+	Method string // The B2 API call, e.g. "b2_upload_file".
+	Host   string // The host the request was sent to, e.g. an upload pod.
+	ID     string // Blazer's ID for the request, as shown in debug logs.
+	Status int    // The HTTP status of the response.
+
+	// Headers holds the X-Bz- headers that B2 returned, including any
+	// request identifiers.
+	Headers map[string]string
+}
+
+// responseInfo returns the details of the request that resp answers.
+func responseInfo(resp *http.Response) *RequestInfo {
+	ri := &RequestInfo{
+		Status:  resp.StatusCode,
+		Headers: make(map[string]string),
+	}
+	if req := resp.Request; req != nil {
+		ri.Method = req.Header.Get("X-Blazer-Method")
+		ri.Host = req.URL.Host
+		ri.ID = req.Header.Get("X-Blazer-Request-ID")
+	}
+	for k := range resp.Header {
+		if strings.HasPrefix(k, "X-Bz-") {
+			ri.Headers[k] = resp.Header.Get(k)
+		}
+	}
+	return ri
+}
+
+// ErrorRequest returns information about the request behind err, if err was
+// returned by B2.
+func ErrorRequest(err error) (*RequestInfo, bool) {
+	if e, ok := AsError(err); ok {
+		err = e.err
+	}
+	return requestInfo(err)
 }
 
 const uploadURLPoolSize = 100
@@ -280,10 +562,17 @@ func (p *urlPool) put(u beURLInterface) {
 	}
 }
 
-// Bucket returns a bucket if it exists.
+// Bucket returns a bucket if it exists.  If the client's application key is
+// restricted to the named bucket but may not list buckets, the bucket is
+// returned as by BucketByID.
 func (c *Client) Bucket(ctx context.Context, name string) (*Bucket, error) {
 	buckets, err := c.backend.listBuckets(ctx)
 	if err != nil {
+		// A key restricted to this bucket can use it without being
+		// allowed to list it.
+		if id, allowed := c.backend.allowedBucket(); id != "" && allowed == name && c.backend.statusCode(err) == 401 {
+			return c.BucketByID(id, name), nil
+		}
 		return nil, err
 	}
 	for _, bucket := range buckets {
@@ -302,9 +591,45 @@ func (c *Client) Bucket(ctx context.Context, name string) (*Bucket, error) {
 	}
 }
 
+// DefaultBucket returns the bucket that the client's application key is
+// restricted to, or nil if the key is not restricted to a single bucket.  It
+// does not list buckets, and so works with keys that lack the listBuckets
+// capability.
+func (c *Client) DefaultBucket() *Bucket {
+	id, name := c.backend.allowedBucket()
+	if id == "" || name == "" {
+		return nil
+	}
+	return c.BucketByID(id, name)
+}
+
+// AllowedPrefix returns the prefix that the client's application key is
+// restricted to, or an empty string if the key may use every object in its
+// buckets.  Listings that do not give a prefix of their own are limited to
+// this one, as B2 requires of such keys.
+func (c *Client) AllowedPrefix() string {
+	return c.backend.allowedPrefix()
+}
+
+// BucketByID returns a bucket with the given ID and name without contacting
+// B2, for keys that lack the listBuckets capability that Bucket requires.  The
+// ID and name are not checked; if they do not match, operations on the bucket
+// will fail.  The bucket's Attrs are unknown and will report no type, info,
+// or lifecycle rules.
+func (c *Client) BucketByID(id, name string) *Bucket {
+	return &Bucket{
+		b:       c.backend.bucket(id, name),
+		r:       c.backend,
+		c:       c,
+		urlPool: newURLPool(),
+	}
+}
+
 // NewBucket returns a bucket.  The bucket is created with the given attributes
 // if it does not already exist.  If attrs is nil, it is created as a private
-// bucket with no info metadata and no lifecycle rules.
+// bucket with no info metadata and no lifecycle rules.  The attributes of an
+// existing bucket are left alone; to change them, e.g. to manage its lifecycle
+// rules, use Update.
 func (c *Client) NewBucket(ctx context.Context, name string, attrs *BucketAttrs) (*Bucket, error) {
 	buckets, err := c.backend.listBuckets(ctx)
 	if err != nil {
@@ -323,7 +648,7 @@ func (c *Client) NewBucket(ctx context.Context, name string, attrs *BucketAttrs)
 	if attrs == nil {
 		attrs = &BucketAttrs{Type: Private}
 	}
-	b, err := c.backend.createBucket(ctx, name, string(attrs.Type), attrs.Info, attrs.LifecycleRules)
+	b, err := c.backend.createBucket(ctx, name, string(attrs.Type), attrs.Info, attrs.LifecycleRules, attrs.CORSRules)
 	if err != nil {
 		return nil, err
 	}
@@ -335,7 +660,78 @@ func (c *Client) NewBucket(ctx context.Context, name string, attrs *BucketAttrs)
 	}, err
 }
 
-// ListBuckets returns all the available buckets.
+// Health is the result of a Ping.
+type Health int
+
+const (
+	// Healthy means B2 accepted the client's credentials.
+	Healthy Health = iota
+
+	// AuthFailure means B2 rejected the client's credentials, e.g. because
+	// the application key was deleted or has expired.
+	AuthFailure
+
+	// NetworkFailure means B2 could not be reached.
+	NetworkFailure
+
+	// CapExceeded means the account has reached a usage cap.
+	CapExceeded
+
+	// UnknownFailure means B2 returned some other error, such as a
+	// temporary service outage.
+	UnknownFailure
+)
+
+func (h Health) String() string {
+	switch h {
+	case Healthy:
+		return "healthy"
+	case AuthFailure:
+		return "auth failure"
+	case NetworkFailure:
+		return "network failure"
+	case CapExceeded:
+		return "cap exceeded"
+	}
+	return "unknown failure"
+}
+
+// Ping checks that B2 can be reached and still accepts the client's
+// credentials, by authorizing the account again.  It makes a single attempt,
+// without the retries other methods use, and is suitable for readiness
+// probes.  If the result is not Healthy, the underlying error is also
+// returned.
+func (c *Client) Ping(ctx context.Context) (Health, error) {
+	err := c.backend.ping(ctx)
+	if err == nil {
+		return Healthy, nil
+	}
+	switch code := c.backend.statusCode(err); {
+	case code == 0:
+		return NetworkFailure, err
+	case code == 401:
+		return AuthFailure, err
+	case code == 403 && isCapCode(c.backend.errorCode(err)):
+		return CapExceeded, err
+	}
+	return UnknownFailure, err
+}
+
+// RawCall sends an arbitrary B2 API request, with the client's credentials
+// and with the same retries as every other request.  apiName is the name of
+// the call, such as "b2_list_file_names", and version is the version of the
+// B2 API it belongs to, such as 2 for calls under /b2api/v2/.  request is
+// encoded as its JSON body, and the JSON reply is decoded into response,
+// which may be nil.
+//
+// This is an escape hatch for calls that this package doesn't yet support.
+// Prefer the typed methods where they exist.
+func (c *Client) RawCall(ctx context.Context, version int, apiName string, request, response interface{}) error {
+	return c.backend.call(ctx, version, apiName, request, response)
+}
+
+// ListBuckets returns all the available buckets.  Their names and types are
+// available from the returned buckets without further calls to B2.
 func (c *Client) ListBuckets(ctx context.Context) ([]*Bucket, error) {
 	bs, err := c.backend.listBuckets(ctx)
 	if err != nil {
@@ -370,6 +766,33 @@ func (b *Bucket) Update(ctx context.Context, attrs *BucketAttrs) error {
 	return b.b.updateBucket(ctx, attrs)
 }
 
+// MakePublic changes the bucket's type to Public, so that its objects can be
+// downloaded without authorization.  Unlike Update, it does not fail with an
+// update conflict when the bucket has been changed elsewhere.
+func (b *Bucket) MakePublic(ctx context.Context) error {
+	return b.setType(ctx, Public)
+}
+
+// MakePrivate changes the bucket's type to Private, so that downloading its
+// objects requires authorization.  Unlike Update, it does not fail with an
+// update conflict when the bucket has been changed elsewhere.
+func (b *Bucket) MakePrivate(ctx context.Context) error {
+	return b.setType(ctx, Private)
+}
+
+func (b *Bucket) setType(ctx context.Context, t BucketType) error {
+	err := b.Update(ctx, &BucketAttrs{Type: t})
+	if !IsUpdateConflict(err) {
+		return err
+	}
+	// Only the type is being changed, so there is nothing to merge; fetch
+	// the current revision and try again.
+	if _, err := b.Attrs(ctx); err != nil {
+		return err
+	}
+	return b.Update(ctx, &BucketAttrs{Type: t})
+}
+
 // Attrs retrieves and returns the current bucket's attributes.
 func (b *Bucket) Attrs(ctx context.Context) (*BucketAttrs, error) {
 	bucket, err := b.c.Bucket(ctx, b.Name())
@@ -413,12 +836,20 @@ func (b *Bucket) Name() string {
 	return b.b.name()
 }
 
+// Type returns the bucket's type as it was when the bucket was listed,
+// created, or last updated or refreshed with Attrs, without contacting B2.
+// It is UnknownType for buckets returned by BucketByID.
+func (b *Bucket) Type() BucketType {
+	return b.b.btype()
+}
+
 // Object represents a B2 object.
 type Object struct {
-	attrs *Attrs
-	name  string
-	f     beFileInterface
-	b     *Bucket
+	attrs  *Attrs
+	name   string
+	f      beFileInterface
+	b      *Bucket
+	pinned bool // read f by ID rather than the latest version by name
 }
 
 // Attrs holds an object's metadata.
@@ -431,6 +862,52 @@ type Attrs struct {
 	SHA1            string            // Can be "none" for large files.  If set on upload, will be used for large files.
 	LastModified    time.Time         // If present, and there are fewer than 10 keys in the Info field, this is saved on upload.
 	Info            map[string]string // Save arbitrary metadata on upload, but limited to 10 keys.
+	ID              string            // Not used on upload.  Pass to ObjectByID to read this version.
+
+	// Lock holds the object's Object Lock settings, as far as B2 reported
+	// them.  It is not used on upload.
+	Lock ObjectLock
+
+	// Unknown holds any fields B2 returned for the object that this package
+	// does not yet understand.  It is only set for clients created with
+	// KeepUnknownFields, and is not used on upload.
+	Unknown map[string]interface{}
+}
+
+// A RetentionMode is the kind of Object Lock retention that protects an
+// object version from deletion.
+type RetentionMode string
+
+const (
+	// Governance retention can be lifted or shortened by keys with the
+	// bypassGovernance capability.
+	Governance RetentionMode = "governance"
+
+	// Compliance retention cannot be lifted or shortened by anyone.
+	Compliance RetentionMode = "compliance"
+)
+
+// ObjectLock describes an object version's Object Lock settings.  B2 reports
+// them only for buckets with Object Lock enabled, and only to keys with the
+// readFileRetentions and readFileLegalHolds capabilities.
+type ObjectLock struct {
+	// RetentionKnown reports whether B2 reported the retention settings.
+	// If it is false, Mode and RetainUntil are unset whether or not the
+	// version has retention.
+	RetentionKnown bool
+
+	// Mode is the version's retention mode, or "" if it has none.
+	Mode RetentionMode
+
+	// RetainUntil is when the version's retention ends.
+	RetainUntil time.Time
+
+	// LegalHoldKnown reports whether B2 reported the legal hold.
+	LegalHoldKnown bool
+
+	// LegalHold is true if the version is under a legal hold, which
+	// prevents its deletion regardless of retention.
+	LegalHold bool
 }
 
 // Name returns an object's name
@@ -438,6 +915,11 @@ func (o *Object) Name() string {
 	return o.name
 }
 
+// Bucket returns the bucket the object is in.
+func (o *Object) Bucket() *Bucket {
+	return o.b
+}
+
 // Attrs returns an object's attributes.
 func (o *Object) Attrs(ctx context.Context) (*Attrs, error) {
 	if err := o.ensure(ctx); err != nil {
@@ -448,17 +930,7 @@ func (o *Object) Attrs(ctx context.Context) (*Attrs, error) {
 		return nil, err
 	}
 	name, sha, size, ct, info, st, stamp := fi.stats()
-	var state ObjectState
-	switch st {
-	case "upload":
-		state = Uploaded
-	case "start":
-		state = Started
-	case "hide":
-		state = Hider
-	case "folder":
-		state = Folder
-	}
+	state := objectState(st)
 	var mtime time.Time
 	if v, ok := info["src_last_modified_millis"]; ok {
 		ms, err := strconv.ParseInt(v, 10, 64)
@@ -480,9 +952,181 @@ func (o *Object) Attrs(ctx context.Context) (*Attrs, error) {
 		Info:            info,
 		Status:          state,
 		LastModified:    mtime,
+		ID:              o.f.id(),
+		Lock:            fi.lock(),
+		Unknown:         fi.unknown(),
 	}, nil
 }
 
+// Exists reports whether the object exists.  It costs a single lookup.  For
+// an object made with Bucket.Object, that is a one-byte download by name, and
+// an object whose name is hidden does not exist.  For one that refers to a
+// particular version, as from a listing or ObjectByID, it is a
+// b2_get_file_info call for that version, and a hide marker does not exist.
+//
+// An error is returned only if the lookup itself fails; Attrs, by contrast,
+// returns an error for which IsNotExist is true.
+func (o *Object) Exists(ctx context.Context) (bool, error) {
+	if o.f == nil {
+		err := o.ensure(ctx)
+		switch {
+		case err == nil:
+			return true, nil
+		case err == errNoMoreContent:
+			// The name refers to an empty file.
+			return true, nil
+		case IsNotExist(err):
+			return false, nil
+		}
+		return false, err
+	}
+	fi, err := o.f.getFileInfo(ctx)
+	if err != nil {
+		if IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	_, _, _, _, _, st, _ := fi.stats()
+	return st != "hide", nil
+}
+
+// objectState returns the ObjectState for the given B2 action.
+func objectState(action string) ObjectState {
+	switch action {
+	case "upload":
+		return Uploaded
+	case "start":
+		return Started
+	case "hide":
+		return Hider
+	case "folder":
+		return Folder
+	}
+	return Unknown
+}
+
+// A Version describes one version of an object, as found in a listing.
+type Version struct {
+	ID        string      // Pass to ObjectByID to read this version.
+	Size      int64       // Zero for hide markers.
+	Timestamp time.Time   // When the version was uploaded, or the object hidden.
+	Status    ObjectState // Uploaded, or Hider for a hide marker.
+}
+
+// Versions returns every version of the object that B2 still has, newest
+// first, including hide markers and versions that have been overwritten.
+// Unlike Attrs, it does not look up each version separately; the whole
+// history costs one listing, of a page per thousand versions.  If the object
+// has no versions, Versions returns an empty list and no error.
+func (o *Object) Versions(ctx context.Context) ([]*Version, error) {
+	var vs []*Version
+	err := o.b.walkVersions(ctx, o.name, func(f beFileInterface) bool {
+		vs = append(vs, &Version{
+			ID:        f.id(),
+			Size:      f.size(),
+			Timestamp: f.timestamp(),
+			Status:    objectState(f.status()),
+		})
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return vs, nil
+}
+
+// walkVersions calls fn with each version of the named object, newest first,
+// until fn returns false.
+func (b *Bucket) walkVersions(ctx context.Context, name string, fn func(beFileInterface) bool) error {
+	iter := b.List(ctx, ListPrefix(name), ListHidden())
+	for iter.Next() {
+		obj := iter.Object()
+		if obj.name != name {
+			// Versions of a name are listed together, newest first, so
+			// any other name means there are no more.
+			if obj.name > name {
+				break
+			}
+			continue
+		}
+		if !fn(obj.f) {
+			break
+		}
+	}
+	return iter.Err()
+}
+
+// Part describes a single part of an unfinished large file.
+type Part struct {
+	Number int    // The part number, beginning at 1.
+	Size   int64  // The size of the part, in bytes.
+	SHA1   string // The SHA1 of the part's contents.
+}
+
+// Parts returns the parts that have been uploaded so far for an unfinished
+// large file, in order.
+//
+// If o refers to a specific version, as objects from listings and ObjectByID
+// do, as well as any object whose attributes have been read, that version's
+// parts are listed.  If it is not an unfinished large file, such as a simple
+// file, B2 rejects the request, and Parts returns B2's error.  Otherwise the
+// most recent version of the object is used; if that version is not an
+// unfinished large file, Parts returns an error for which IsNotExist is true.
+func (o *Object) Parts(ctx context.Context) ([]*Part, error) {
+	f := o.f
+	if f == nil {
+		uf, err := o.b.unfinishedFile(ctx, o.name)
+		if err != nil {
+			return nil, err
+		}
+		f = uf
+	}
+	ps, err := listAllParts(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+	var parts []*Part
+	for _, p := range ps {
+		parts = append(parts, &Part{
+			Number: p.number(),
+			Size:   p.size(),
+			SHA1:   p.sha1(),
+		})
+	}
+	return parts, nil
+}
+
+func (b *Bucket) unfinishedFile(ctx context.Context, name string) (beFileInterface, error) {
+	objs, _, err := b.ListObjects(ctx, 1, &Cursor{name: name})
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(objs) < 1 || objs[0].name != name || objs[0].f.status() != "start" {
+		return nil, b2err{
+			err:         fmt.Errorf("%s: no unfinished large file", name),
+			notFoundErr: true,
+		}
+	}
+	return objs[0].f, nil
+}
+
+func listAllParts(ctx context.Context, f beFileInterface) ([]beFilePartInterface, error) {
+	var parts []beFilePartInterface
+	next := 1
+	for {
+		ps, n, err := f.listParts(ctx, next, 1000)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, ps...)
+		if len(ps) == 0 || n == 0 {
+			return parts, nil
+		}
+		next = n
+	}
+}
+
 // ObjectState represents the various states an object can be in.
 type ObjectState int
 
@@ -512,6 +1156,73 @@ func (b *Bucket) Object(name string) *Object {
 	}
 }
 
+// ObjectByID returns a reference to a specific version of an object, given its
+// file ID, without contacting B2.  Readers for the object download that
+// version even if it has been overwritten or hidden.  The name is reported by
+// Name, and is not checked against the ID.
+//
+// File IDs are reported by Attrs, including for the old versions returned by
+// a listing with ListHidden.
+func (b *Bucket) ObjectByID(id, name string) *Object {
+	return &Object{
+		name:   name,
+		f:      b.b.file(id, name),
+		b:      b,
+		pinned: true,
+	}
+}
+
+// ObjectAt returns the version of the named object that was visible at t:
+// the newest version uploaded at or before t, unless it had been hidden by
+// then.  Like an object from ObjectByID, it refers to that version, so its
+// Readers read the object as it was at t even if it has since been
+// overwritten or hidden.  If no version was visible at t, ObjectAt returns an
+// error for which IsNotExist is true.
+//
+// ObjectAt lists the object's versions, and so costs a class C transaction.
+// Versions that have been deleted cannot be found.
+func (b *Bucket) ObjectAt(ctx context.Context, name string, t time.Time) (*Object, error) {
+	var found beFileInterface
+	err := b.walkVersions(ctx, name, func(f beFileInterface) bool {
+		if f.timestamp().After(t) {
+			return true
+		}
+		switch f.status() {
+		case "upload", "hide":
+			found = f
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, b2err{err: fmt.Errorf("%s: no version at %v", name, t), notFoundErr: true}
+	}
+	if found.status() == "hide" {
+		return nil, b2err{err: fmt.Errorf("%s: hidden at %v", name, t), notFoundErr: true}
+	}
+	return b.ObjectByID(found.id(), name), nil
+}
+
+// WithWriterOptions returns a copy of b whose Writers begin with the given
+// options, so that transfer settings can be configured once for a bucket.
+// They are applied after the client's DefaultWriterOptions, and before any
+// options passed to NewWriter.  b itself is unchanged.
+func (b *Bucket) WithWriterOptions(opts ...WriterOption) *Bucket {
+	nb := *b
+	nb.writerOpts = append(append([]WriterOption(nil), b.writerOpts...), opts...)
+	return &nb
+}
+
+// WithReaderOptions is like WithWriterOptions, for Readers.
+func (b *Bucket) WithReaderOptions(opts ...ReaderOption) *Bucket {
+	nb := *b
+	nb.readerOpts = append(append([]ReaderOption(nil), b.readerOpts...), opts...)
+	return &nb
+}
+
 // URL returns the full URL to the given object.
 func (o *Object) URL() string {
 	return fmt.Sprintf("%s/file/%s/%s", o.b.BaseURL(), o.b.Name(), o.name)
@@ -532,6 +1243,9 @@ func (o *Object) NewWriter(ctx context.Context, opts ...WriterOption) *Writer {
 	for _, f := range o.b.c.opts.writerOpts {
 		f(w)
 	}
+	for _, f := range o.b.writerOpts {
+		f(w)
+	}
 	for _, f := range opts {
 		f(w)
 	}
@@ -539,10 +1253,11 @@ func (o *Object) NewWriter(ctx context.Context, opts ...WriterOption) *Writer {
 }
 
 // NewRangeReader returns a reader for the given object, reading up to length
-// bytes.  If length is negative, the rest of the object is read.
-func (o *Object) NewRangeReader(ctx context.Context, offset, length int64) *Reader {
+// bytes.  If length is negative, the rest of the object is read.  The options
+// are applied after any defaults set on the client or bucket.
+func (o *Object) NewRangeReader(ctx context.Context, offset, length int64, opts ...ReaderOption) *Reader {
 	ctx, cancel := context.WithCancel(ctx)
-	return &Reader{
+	r := &Reader{
 		ctx:    ctx,
 		cancel: cancel,
 		o:      o,
@@ -550,12 +1265,26 @@ func (o *Object) NewRangeReader(ctx context.Context, offset, length int64) *Read
 		chunks: make(map[int]*rchunk),
 		length: length,
 		offset: offset,
+		whole:  offset == 0 && length < 0,
+	}
+	if o.pinned {
+		r.id = o.f.id()
+	}
+	for _, f := range o.b.c.opts.readerOpts {
+		f(r)
+	}
+	for _, f := range o.b.readerOpts {
+		f(r)
+	}
+	for _, f := range opts {
+		f(r)
 	}
+	return r
 }
 
 // NewReader returns a reader for the given object.
-func (o *Object) NewReader(ctx context.Context) *Reader {
-	return o.NewRangeReader(ctx, 0, -1)
+func (o *Object) NewReader(ctx context.Context, opts ...ReaderOption) *Reader {
+	return o.NewRangeReader(ctx, 0, -1, opts...)
 }
 
 func (o *Object) ensure(ctx context.Context) error {
@@ -602,6 +1331,21 @@ type Cursor struct {
 	id   string
 }
 
+// listed returns the objects for a page of listed files.  Each object is
+// allocated on its own, so that holding on to one doesn't keep the rest of its
+// page alive.
+func (b *Bucket) listed(fs []beFileInterface) []*Object {
+	objects := make([]*Object, len(fs))
+	for i, f := range fs {
+		objects[i] = &Object{
+			name: f.name(),
+			f:    f,
+			b:    b,
+		}
+	}
+	return objects
+}
+
 // ListObjects returns all objects in the bucket, including multiple versions
 // of the same object.  Cursor may be nil; when passed to a subsequent query,
 // it will continue the listing.
@@ -627,14 +1371,7 @@ func (b *Bucket) ListObjects(ctx context.Context, count int, c *Cursor) ([]*Obje
 			id:        id,
 		}
 	}
-	var objects []*Object
-	for _, f := range fs {
-		objects = append(objects, &Object{
-			name: f.name(),
-			f:    f,
-			b:    b,
-		})
-	}
+	objects := b.listed(fs)
 	var rtnErr error
 	if len(objects) == 0 || next == nil {
 		rtnErr = io.EOF
@@ -662,14 +1399,7 @@ func (b *Bucket) ListCurrentObjects(ctx context.Context, count int, c *Cursor) (
 			name:      name,
 		}
 	}
-	var objects []*Object
-	for _, f := range fs {
-		objects = append(objects, &Object{
-			name: f.name(),
-			f:    f,
-			b:    b,
-		})
-	}
+	objects := b.listed(fs)
 	var rtnErr error
 	if len(objects) == 0 || next == nil {
 		rtnErr = io.EOF
@@ -695,14 +1425,7 @@ func (b *Bucket) ListUnfinishedLargeFiles(ctx context.Context, count int, c *Cur
 			name: name,
 		}
 	}
-	var objects []*Object
-	for _, f := range fs {
-		objects = append(objects, &Object{
-			name: f.name(),
-			f:    f,
-			b:    b,
-		})
-	}
+	objects := b.listed(fs)
 	var rtnErr error
 	if len(objects) == 0 || next == nil {
 		rtnErr = io.EOF
@@ -710,7 +1433,10 @@ func (b *Bucket) ListUnfinishedLargeFiles(ctx context.Context, count int, c *Cur
 	return objects, next, rtnErr
 }
 
-// Hide hides the object from name-based listing.
+// Hide hides the object from name-based listing, by uploading a hide marker
+// with b2_hide_file.  This is a soft delete: the object can no longer be read
+// by name, but every earlier version is kept, and can still be listed with
+// ListHidden, read with ObjectByID, or brought back with Bucket.Reveal.
 func (o *Object) Hide(ctx context.Context) error {
 	if err := o.ensure(ctx); err != nil {
 		return err
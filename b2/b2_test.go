@@ -15,16 +15,28 @@
 package b2
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
 	"context"
 	"crypto/sha1"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -42,6 +54,8 @@ type testError struct {
 	backoff  time.Duration
 	reauth   bool
 	reupload bool
+	code     int
+	b2code   string
 }
 
 func (t testError) Error() string {
@@ -69,13 +83,66 @@ type testRoot struct {
 	errs      *errCont
 	auths     int
 	bucketMap map[string]map[string]string
+	caps      []string
+	allowed   string
+	prefix    string
 }
 
 func (t *testRoot) authorizeAccount(context.Context, string, string, clientOptions) error {
 	t.auths++
+	if t.errs != nil {
+		return t.errs.getError("authorizeAccount")
+	}
 	return nil
 }
 
+func (t *testRoot) capabilities() []string { return t.caps }
+
+// call echoes req back into resp.
+func (t *testRoot) call(_ context.Context, version int, method string, req, resp interface{}) error {
+	if version < 1 {
+		return fmt.Errorf("%s: no API version %d", method, version)
+	}
+	if t.errs != nil {
+		if err := t.errs.getError("call"); err != nil {
+			return err
+		}
+	}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, resp)
+}
+
+func (t *testRoot) allowedBucket() (string, string) { return t.allowed, t.allowed }
+func (t *testRoot) allowedPrefix() string           { return t.prefix }
+func (t *testRoot) endpoints() (string, string)     { return "", "" }
+
+func (t *testRoot) bucket(id, name string) b2BucketInterface {
+	return &testBucket{
+		n:     name,
+		errs:  t.errs,
+		files: t.bucketMap[name],
+	}
+}
+
+func (t *testRoot) statusCode(err error) int {
+	e, ok := err.(testError)
+	if !ok {
+		return 0
+	}
+	return e.code
+}
+
+func (t *testRoot) errorCode(err error) string {
+	e, ok := err.(testError)
+	if !ok {
+		return ""
+	}
+	return e.b2code
+}
+
 func (t *testRoot) backoff(err error) time.Duration {
 	e, ok := err.(testError)
 	if !ok {
@@ -115,7 +182,7 @@ func (t *testRoot) listKeys(context.Context, int, string) ([]b2KeyInterface, str
 	return nil, "", nil
 }
 
-func (t *testRoot) createBucket(_ context.Context, name, _ string, _ map[string]string, _ []LifecycleRule) (b2BucketInterface, error) {
+func (t *testRoot) createBucket(_ context.Context, name, _ string, _ map[string]string, _ []LifecycleRule, _ []CORSRule) (b2BucketInterface, error) {
 	if err := t.errs.getError("createBucket"); err != nil {
 		return nil, err
 	}
@@ -132,6 +199,11 @@ func (t *testRoot) createBucket(_ context.Context, name, _ string, _ map[string]
 }
 
 func (t *testRoot) listBuckets(context.Context) ([]b2BucketInterface, error) {
+	if t.errs != nil {
+		if err := t.errs.getError("listBuckets"); err != nil {
+			return nil, err
+		}
+	}
 	var b []b2BucketInterface
 	for k, v := range t.bucketMap {
 		b = append(b, &testBucket{
@@ -166,6 +238,9 @@ func (t *testBucket) getUploadURL(context.Context) (b2URLInterface, error) {
 }
 
 func (t *testBucket) startLargeFile(_ context.Context, name, _ string, _ map[string]string) (b2LargeFileInterface, error) {
+	gmux.Lock()
+	testUnfinished[shaKey(t.files, name)] = true
+	gmux.Unlock()
 	return &testLargeFile{
 		name:  name,
 		parts: make(map[int][]byte),
@@ -176,9 +251,16 @@ func (t *testBucket) startLargeFile(_ context.Context, name, _ string, _ map[str
 
 func (t *testBucket) listFileNames(ctx context.Context, count int, cont, pfx, del string) ([]b2FileInterface, string, error) {
 	var f []string
+	if count == 0 {
+		// B2 uses a default page size when none is given.
+		count = 100
+	}
 	gmux.Lock()
 	defer gmux.Unlock()
 	for name := range t.files {
+		if !strings.HasPrefix(name, pfx) {
+			continue
+		}
 		f = append(f, name)
 	}
 	sort.Strings(f)
@@ -213,7 +295,10 @@ func (t *testBucket) listUnfinishedLargeFiles(ctx context.Context, count int, co
 func (t *testBucket) downloadFileByName(_ context.Context, name string, offset, size int64) (b2FileReaderInterface, error) {
 	gmux.Lock()
 	defer gmux.Unlock()
-	f := t.files[name]
+	f, ok := t.files[name]
+	if !ok {
+		return nil, b2err{err: fmt.Errorf("%s: not found", name), notFoundErr: true}
+	}
 	end := int(offset + size)
 	if end >= len(f) {
 		end = len(f)
@@ -222,18 +307,32 @@ func (t *testBucket) downloadFileByName(_ context.Context, name string, offset,
 		return nil, errNoMoreContent
 	}
 	return &testFileReader{
-		b: ioutil.NopCloser(bytes.NewBufferString(f[offset:end])),
-		s: end - int(offset),
-		n: name,
+		b:   ioutil.NopCloser(bytes.NewBufferString(f[offset:end])),
+		s:   end - int(offset),
+		n:   name,
+		sha: testSHA1s[shaKey(t.files, name)],
 	}, nil
 }
 
+func (t *testBucket) downloadFileByID(ctx context.Context, id string, offset, size int64) (b2FileReaderInterface, error) {
+	if err := t.errs.getError("downloadFileByID"); err != nil {
+		return nil, err
+	}
+	return t.downloadFileByName(ctx, id, offset, size)
+}
+
 func (t *testBucket) hideFile(context.Context, string) (b2FileInterface, error) { return nil, nil }
 func (t *testBucket) getDownloadAuthorization(context.Context, string, time.Duration, string) (string, error) {
 	return "", nil
 }
-func (t *testBucket) baseURL() string                      { return "" }
-func (t *testBucket) file(id, name string) b2FileInterface { return nil }
+func (t *testBucket) baseURL() string { return "" }
+func (t *testBucket) file(id, name string) b2FileInterface {
+	// Files are identified by name, which doubles as their ID.
+	return &testFile{
+		n:     id,
+		files: t.files,
+	}
+}
 
 type testURL struct {
 	files map[string]string
@@ -241,14 +340,23 @@ type testURL struct {
 
 func (t *testURL) reload(context.Context) error { return nil }
 
-func (t *testURL) uploadFile(_ context.Context, r io.Reader, _ int, name, _, _ string, _ map[string]string) (b2FileInterface, error) {
+func (t *testURL) uploadFile(_ context.Context, r io.Reader, _ int, name, _, sum string, _ map[string]string) (b2FileInterface, error) {
 	buf := &bytes.Buffer{}
 	if _, err := io.Copy(buf, r); err != nil {
 		return nil, err
 	}
+	if sum == "hex_digits_at_end" {
+		b := buf.Bytes()
+		sum = string(b[len(b)-40:])
+		buf.Truncate(len(b) - 40)
+	}
+	if err := checkSHA1(buf.Bytes(), sum); err != nil {
+		return nil, err
+	}
 	gmux.Lock()
 	defer gmux.Unlock()
 	t.files[name] = buf.String()
+	testSHA1s[shaKey(t.files, name)] = sum
 	return &testFile{
 		n:     name,
 		s:     int64(len(t.files[name])),
@@ -267,10 +375,25 @@ func (t *testLargeFile) finishLargeFile(context.Context) (b2FileInterface, error
 	var total []byte
 	gmux.Lock()
 	defer gmux.Unlock()
+	if t.errs != nil {
+		// An error here simulates a finish that B2 did not complete.
+		if err := t.errs.getError("finishLargeFileFailed"); err != nil {
+			return nil, err
+		}
+	}
+	delete(testUnfinished, shaKey(t.files, t.name))
 	for i := 1; i <= len(t.parts); i++ {
 		total = append(total, t.parts[i]...)
 	}
 	t.files[t.name] = string(total)
+	delete(testSHA1s, shaKey(t.files, t.name))
+	if t.errs != nil {
+		// An error here simulates a response lost after the file was
+		// finished.
+		if err := t.errs.getError("finishLargeFile"); err != nil {
+			return nil, err
+		}
+	}
 	return &testFile{
 		n:     t.name,
 		s:     int64(len(total)),
@@ -278,6 +401,33 @@ func (t *testLargeFile) finishLargeFile(context.Context) (b2FileInterface, error
 	}, nil
 }
 
+func (t *testLargeFile) cancel(context.Context) error {
+	gmux.Lock()
+	defer gmux.Unlock()
+	delete(testUnfinished, shaKey(t.files, t.name))
+	for k := range t.parts {
+		delete(t.parts, k)
+	}
+	return nil
+}
+
+func (t *testLargeFile) id() string { return t.name }
+
+func (t *testLargeFile) copyPart(_ context.Context, id string, offset, size int64, index int) (string, error) {
+	if err := t.errs.getError("copyPart"); err != nil {
+		return "", err
+	}
+	gmux.Lock()
+	defer gmux.Unlock()
+	src, ok := t.files[id]
+	if !ok || offset+size > int64(len(src)) {
+		return "", testError{code: 400}
+	}
+	b := []byte(src[offset : offset+size])
+	t.parts[index] = b
+	return fmt.Sprintf("%x", sha1.Sum(b)), nil
+}
+
 func (t *testLargeFile) getUploadPartURL(context.Context) (b2FileChunkInterface, error) {
 	gmux.Lock()
 	defer gmux.Unlock()
@@ -294,7 +444,7 @@ type testFileChunk struct {
 
 func (t *testFileChunk) reload(context.Context) error { return nil }
 
-func (t *testFileChunk) uploadPart(_ context.Context, r io.Reader, _ string, _, index int) (int, error) {
+func (t *testFileChunk) uploadPart(_ context.Context, r io.Reader, sha1 string, _, index int) (int, error) {
 	if err := t.errs.getError("uploadPart"); err != nil {
 		return 0, err
 	}
@@ -303,12 +453,27 @@ func (t *testFileChunk) uploadPart(_ context.Context, r io.Reader, _ string, _,
 	if err != nil {
 		return int(i), err
 	}
+	b := buf.Bytes()
+	if sha1 == "hex_digits_at_end" {
+		b = b[:len(b)-40]
+	} else if err := checkSHA1(b, sha1); err != nil {
+		return 0, err
+	}
 	gmux.Lock()
 	defer gmux.Unlock()
-	t.parts[index] = buf.Bytes()
+	t.parts[index] = b
 	return int(i), nil
 }
 
+// checkSHA1 rejects uploads whose contents don't match their SHA1, as B2
+// does.
+func checkSHA1(b []byte, sum string) error {
+	if got := fmt.Sprintf("%x", sha1.Sum(b)); got != sum {
+		return testError{code: 400}
+	}
+	return nil
+}
+
 type testFile struct {
 	n     string
 	s     int64
@@ -318,18 +483,93 @@ type testFile struct {
 }
 
 func (t *testFile) name() string         { return t.n }
+func (t *testFile) id() string           { return t.n }
 func (t *testFile) size() int64          { return t.s }
 func (t *testFile) timestamp() time.Time { return t.t }
 func (t *testFile) status() string       { return t.a }
 
+// testCopy records the metadata given to a copied file.
+type testCopy struct {
+	replace bool
+	ct      string
+	info    map[string]string
+}
+
+// testSHA1s holds the SHA1 sent with each simple upload, which downloads
+// report like B2's X-Bz-Content-Sha1 header.  Large files have none.  It is
+// guarded by gmux.
+var testSHA1s = make(map[string]string)
+
+// testUnfinished holds the large files that have been started but not
+// finished, which getFileInfo reports as B2 does.  It is guarded by gmux.
+var testUnfinished = make(map[string]bool)
+
+// shaKey distinguishes files of the same name in different test buckets.
+func shaKey(files map[string]string, name string) string {
+	return fmt.Sprintf("%p/%s", files, name)
+}
+
+// testCopies is guarded by gmux.
+var testCopies = make(map[string]testCopy)
+
+func (t *testFile) copyFile(_ context.Context, name, _ string, replace bool, ct string, info map[string]string) (b2FileInterface, error) {
+	gmux.Lock()
+	defer gmux.Unlock()
+	f, ok := t.files[t.n]
+	if !ok {
+		return nil, b2err{err: fmt.Errorf("%s: not found", t.n), notFoundErr: true}
+	}
+	t.files[name] = f
+	delete(testSHA1s, shaKey(t.files, name))
+	testCopies[name] = testCopy{replace: replace, ct: ct, info: info}
+	return &testFile{
+		n:     name,
+		s:     int64(len(f)),
+		files: t.files,
+	}, nil
+}
+
 func (t *testFile) compileParts(int64, map[int]string) b2LargeFileInterface {
 	panic("not implemented")
 }
 
-func (t *testFile) getFileInfo(context.Context) (b2FileInfoInterface, error) {
-	return nil, nil
+func (t *testFile) getFileInfo(ctx context.Context) (b2FileInfoInterface, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	gmux.Lock()
+	defer gmux.Unlock()
+	f, ok := t.files[t.n]
+	if !ok {
+		return nil, b2err{err: fmt.Errorf("%s: not found", t.n), notFoundErr: true}
+	}
+	status := "upload"
+	if testUnfinished[shaKey(t.files, t.n)] {
+		status = "start"
+	}
+	return &testFileInfo{
+		name:   t.n,
+		sha:    testSHA1s[shaKey(t.files, t.n)],
+		size:   int64(len(f)),
+		status: status,
+	}, nil
 }
 
+type testFileInfo struct {
+	name   string
+	sha    string
+	size   int64
+	status string
+	olock  ObjectLock
+}
+
+func (t *testFileInfo) stats() (string, string, int64, string, map[string]string, string, time.Time) {
+	return t.name, t.sha, t.size, "", nil, t.status, time.Time{}
+}
+
+func (t *testFileInfo) lock() ObjectLock                { return t.olock }
+func (t *testFileInfo) unknown() map[string]interface{} { return nil }
+
 func (t *testFile) listParts(context.Context, int, int) ([]b2FilePartInterface, int, error) {
 	return nil, 0, nil
 }
@@ -342,14 +582,15 @@ func (t *testFile) deleteFileVersion(context.Context) error {
 }
 
 type testFileReader struct {
-	b io.ReadCloser
-	s int
-	n string
+	b   io.ReadCloser
+	s   int
+	n   string
+	sha string
 }
 
 func (t *testFileReader) Read(p []byte) (int, error)                      { return t.b.Read(p) }
 func (t *testFileReader) Close() error                                    { return nil }
-func (t *testFileReader) stats() (int, string, string, map[string]string) { return t.s, "", "", nil }
+func (t *testFileReader) stats() (int, string, string, map[string]string) { return t.s, "", t.sha, nil }
 func (t *testFileReader) id() string                                      { return t.n }
 
 type zReader struct{}
@@ -439,6 +680,72 @@ func TestReaderFrom(t *testing.T) {
 	}
 }
 
+func TestReadFromLarge(t *testing.T) {
+	ctx := context.Background()
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs: &errCont{
+			errMap: map[string]map[int]error{
+				"uploadPart": {1: testError{reupload: true, backoff: time.Millisecond}},
+			},
+		},
+	}
+	client := &Client{backend: &beRoot{b2i: root}}
+	bucket, err := client.NewBucket(ctx, "bucket", &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("abcdefghijklmnopqrstuvwxy")
+	w := bucket.Object("file").NewWriter(ctx)
+	w.ChunkSize = 10
+	n, err := w.ReadFrom(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(data)) {
+		t.Errorf("ReadFrom(): got %d bytes, want %d", n, len(data))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := root.bucketMap["bucket"]["file"]; got != string(data) {
+		t.Errorf("got %q, want %q", got, data)
+	}
+}
+
+func TestUploadReaderAt(t *testing.T) {
+	ctx := context.Background()
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+	}
+	client := &Client{backend: &beRoot{b2i: root}}
+	bucket, err := client.NewBucket(ctx, "bucket", &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("abcdefghijklmnopqrstuvwxy")
+	for _, size := range []int{5, len(data)} {
+		name := fmt.Sprintf("file%d", size)
+		w := bucket.Object(name).NewWriter(ctx)
+		w.ChunkSize = 10
+		// Hide bytes.Reader's other methods, so that only ReadAt is used.
+		n, err := w.UploadReaderAt(struct{ io.ReaderAt }{bytes.NewReader(data)}, int64(size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(size) {
+			t.Errorf("UploadReaderAt(): got %d bytes, want %d", n, size)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if got := root.bucketMap["bucket"][name]; got != string(data[:size]) {
+			t.Errorf("got %q, want %q", got, data[:size])
+		}
+	}
+}
+
 func TestReauth(t *testing.T) {
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
@@ -465,6 +772,97 @@ func TestReauth(t *testing.T) {
 	}
 }
 
+// slowAuthRoot blocks authorization until release is closed.
+type slowAuthRoot struct {
+	*testRoot
+	auths   int32
+	release chan struct{}
+}
+
+func (s *slowAuthRoot) authorizeAccount(context.Context, string, string, clientOptions) error {
+	atomic.AddInt32(&s.auths, 1)
+	<-s.release
+	return nil
+}
+
+func TestConcurrentReauth(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	root := &slowAuthRoot{testRoot: &testRoot{}, release: make(chan struct{})}
+	r := &beRoot{b2i: root}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := r.reauthorizeAccount(ctx); err != nil {
+				t.Errorf("reauthorizeAccount: %v", err)
+			}
+		}()
+	}
+	// Give every caller time to find the reauthorization in progress.
+	time.Sleep(100 * time.Millisecond)
+	close(root.release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&root.auths); n != 1 {
+		t.Errorf("got %d authorizations, want 1", n)
+	}
+	if err := r.reauthorizeAccount(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&root.auths); n != 2 {
+		t.Errorf("got %d authorizations after the first finished, want 2", n)
+	}
+}
+
+// ctxAuthRoot blocks authorization until release is closed or the caller's
+// context is done.
+type ctxAuthRoot struct {
+	*testRoot
+	auths   int32
+	started chan struct{}
+	release chan struct{}
+}
+
+func (c *ctxAuthRoot) authorizeAccount(ctx context.Context, _, _ string, _ clientOptions) error {
+	if atomic.AddInt32(&c.auths, 1) == 1 {
+		close(c.started)
+	}
+	select {
+	case <-c.release:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestReauthLeaderCancelled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	root := &ctxAuthRoot{testRoot: &testRoot{}, started: make(chan struct{}), release: make(chan struct{})}
+	r := &beRoot{b2i: root}
+
+	lctx, lcancel := context.WithCancel(ctx)
+	lerr := make(chan error, 1)
+	go func() { lerr <- r.reauthorizeAccount(lctx) }()
+	<-root.started
+	werr := make(chan error, 1)
+	go func() { werr <- r.reauthorizeAccount(ctx) }()
+	// Give the waiter time to find the reauthorization in progress.
+	time.Sleep(100 * time.Millisecond)
+	lcancel()
+	if err := <-lerr; err != context.Canceled {
+		t.Errorf("cancelled caller: got %v, want context.Canceled", err)
+	}
+	close(root.release)
+	if err := <-werr; err != nil {
+		t.Errorf("waiting caller: got %v, want it to reauthorize itself", err)
+	}
+	if n := atomic.LoadInt32(&root.auths); n != 2 {
+		t.Errorf("got %d authorizations, want 2", n)
+	}
+}
+
 func TestBackoff(t *testing.T) {
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
@@ -574,6 +972,66 @@ func TestBackoffWithoutRetryAfter(t *testing.T) {
 	}
 }
 
+func TestRetryPolicy(t *testing.T) {
+	ctx := context.Background()
+
+	var calls []time.Duration
+	ch := make(chan time.Time)
+	close(ch)
+	after = func(d time.Duration) <-chan time.Time {
+		calls = append(calls, d)
+		return ch
+	}
+	defer func() { after = time.After }()
+
+	table := []struct {
+		policy RetryPolicy
+		fails  int
+		want   []time.Duration
+		err    bool
+	}{
+		{
+			policy: RetryPolicy{Base: time.Second, Max: 3 * time.Second},
+			fails:  4,
+			want:   []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second},
+		},
+		{
+			policy: RetryPolicy{MaxAttempts: 3, Base: time.Millisecond},
+			fails:  4,
+			want:   []time.Duration{time.Millisecond, 2 * time.Millisecond},
+			err:    true,
+		},
+		{
+			policy: NoRetries,
+			fails:  1,
+			err:    true,
+		},
+	}
+	for _, e := range table {
+		calls = nil
+		errs := make(map[int]error)
+		for i := 0; i < e.fails; i++ {
+			errs[i] = testError{retry: true}
+		}
+		client := &Client{
+			backend: &beRoot{
+				b2i: &testRoot{
+					bucketMap: make(map[string]map[string]string),
+					errs:      &errCont{errMap: map[string]map[int]error{"createBucket": errs}},
+				},
+				options: clientOptions{retry: &e.policy},
+			},
+		}
+		_, err := client.NewBucket(ctx, "fun", &BucketAttrs{Type: Private})
+		if (err != nil) != e.err {
+			t.Errorf("%+v: got error %v, want error: %v", e.policy, err, e.err)
+		}
+		if !reflect.DeepEqual(calls, e.want) {
+			t.Errorf("%+v: got waits %v, want %v", e.policy, calls, e.want)
+		}
+	}
+}
+
 type badTransport struct{}
 
 func (badTransport) RoundTrip(r *http.Request) (*http.Response, error) {
@@ -597,90 +1055,2401 @@ func TestCustomTransport(t *testing.T) {
 	}
 }
 
-func TestReaderDoubleClose(t *testing.T) {
-	ctx := context.Background()
+type netErrTransport struct{}
 
-	client := &Client{
-		backend: &beRoot{
-			b2i: &testRoot{
-				bucketMap: make(map[string]map[string]string),
-				errs:      &errCont{},
-			},
+func (netErrTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, errors.New("network is down")
+}
+
+func TestClientStats(t *testing.T) {
+	c := &Client{}
+	ct := &clientTransport{client: c, rt: badTransport{}}
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", "http://example.com", nil)
+		req.Header.Set("X-Blazer-Method", "b2_authorize_account")
+		ct.RoundTrip(req)
+	}
+	ct.rt = netErrTransport{}
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	req.Header.Set("X-Blazer-Method", "b2_authorize_account")
+	ct.RoundTrip(req)
+
+	want := map[string]*OpStats{
+		"b2_authorize_account": {
+			Requests:      4,
+			Errors:        4,
+			NetworkErrors: 1,
+			Statuses:      map[int]int{700: 3},
 		},
 	}
-	bucket, err := client.NewBucket(ctx, "bucket", &BucketAttrs{Type: Private})
-	if err != nil {
-		t.Fatal(err)
+	if got := c.Stats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Stats: got %+v, want %+v", got["b2_authorize_account"], want["b2_authorize_account"])
 	}
-	o, _, err := writeFile(ctx, bucket, "file", 10, 10)
-	if err != nil {
-		t.Fatal(err)
+	c.ResetStats()
+	if got := c.Stats(); len(got) != 0 {
+		t.Errorf("Stats after ResetStats: got %d methods, want none", len(got))
 	}
-	r := o.NewReader(ctx)
-	// Read to EOF, and then read some more.
-	if _, err := io.Copy(ioutil.Discard, r); err != nil {
-		t.Fatal(err)
+}
+
+func TestOnResponse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Bz-Request-Id", "bz-"+r.Header.Get("X-Blazer-Request-ID"))
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	var got []*RequestInfo
+	c := &Client{opts: clientOptions{onResponse: func(ri *RequestInfo) { got = append(got, ri) }}}
+	ct := &clientTransport{client: c}
+	for _, id := range []string{"1", "2"} {
+		req, _ := http.NewRequest("POST", srv.URL, nil)
+		req.Header.Set("X-Blazer-Method", "b2_upload_part")
+		req.Header.Set("X-Blazer-Request-ID", id)
+		resp, err := ct.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
 	}
-	if _, err := io.Copy(ioutil.Discard, r); err != nil {
-		t.Fatal(err)
+	host := strings.TrimPrefix(srv.URL, "http://")
+	want := []*RequestInfo{
+		{Method: "b2_upload_part", Host: host, ID: "1", Status: 503, Headers: map[string]string{"X-Bz-Request-Id": "bz-1"}},
+		{Method: "b2_upload_part", Host: host, ID: "2", Status: 503, Headers: map[string]string{"X-Bz-Request-Id": "bz-2"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("OnResponse: got %+v, want %+v", got, want)
+	}
+	if ri := c.Status().Requests["b2_upload_part"]; !reflect.DeepEqual(ri, want[1]) {
+		t.Errorf("Status: got %+v, want %+v", ri, want[1])
 	}
 }
 
-func TestReadWrite(t *testing.T) {
-	ctx := context.Background()
-	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
-	defer cancel()
-
-	client := &Client{
-		backend: &beRoot{
-			b2i: &testRoot{
-				bucketMap: make(map[string]map[string]string),
-				errs:      &errCont{},
-			},
+func TestTLSStats(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "{}")
+	}))
+	defer srv.Close()
+
+	tr := srv.Client().Transport.(*http.Transport)
+	tr.TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	c := &Client{}
+	ct := &clientTransport{client: c, rt: tr}
+	get := func() {
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		req.Header.Set("X-Blazer-Method", "b2_download_file_by_name")
+		resp, err := ct.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	get()
+	get()
+	tr.CloseIdleConnections()
+	get()
+
+	host := strings.TrimPrefix(srv.URL, "https://")
+	want := map[string]*TLSStats{
+		host: {
+			Requests:   3,
+			Reused:     1,
+			Handshakes: 2,
+			Resumed:    1,
 		},
 	}
-
-	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
-	if err != nil {
-		t.Fatal(err)
+	got := c.TLSStats()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("TLSStats: got %+v, want %+v", got[host], want[host])
 	}
-	defer func() {
-		if err := bucket.Delete(ctx); err != nil {
-			t.Error(err)
-		}
-	}()
-
-	sobj, wsha, err := writeFile(ctx, bucket, smallFileName, 1e6+42, 1e8)
-	if err != nil {
-		t.Fatal(err)
+	if r := got[host].ResumptionRate(); r != 0.5 {
+		t.Errorf("ResumptionRate: got %v, want 0.5", r)
 	}
+	c.ResetStats()
+	if got := c.TLSStats(); len(got) != 0 {
+		t.Errorf("TLSStats after ResetStats: got %d hosts, want none", len(got))
+	}
+}
+
+func TestPing(t *testing.T) {
+	table := []struct {
+		err  error
+		want Health
+	}{
+		{want: Healthy},
+		{err: testError{code: 401}, want: AuthFailure},
+		{err: testError{code: 403, b2code: "download_cap_exceeded"}, want: CapExceeded},
+		{err: testError{code: 403, b2code: "unauthorized"}, want: UnknownFailure},
+		{err: testError{code: 503, retry: true}, want: UnknownFailure},
+		{err: errors.New("connection refused"), want: NetworkFailure},
+	}
+	for _, e := range table {
+		root := &testRoot{
+			errs: &errCont{
+				errMap: map[string]map[int]error{
+					"authorizeAccount": {0: e.err},
+				},
+			},
+		}
+		client := &Client{
+			backend: &beRoot{
+				b2i: root,
+			},
+		}
+		got, err := client.Ping(context.Background())
+		if got != e.want {
+			t.Errorf("Ping with error %v: got %v, want %v", e.err, got, e.want)
+		}
+		if err != e.err {
+			t.Errorf("Ping with error %v: got error %v", e.err, err)
+		}
+	}
+}
+
+func TestRequireCapabilities(t *testing.T) {
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{caps: []string{"listBuckets", "readFiles"}},
+		},
+	}
+	if err := client.RequireCapabilities("readFiles", "listBuckets"); err != nil {
+		t.Errorf("RequireCapabilities: %v", err)
+	}
+	err := client.RequireCapabilities("readFiles", "writeFiles", "deleteFiles")
+	if err == nil {
+		t.Fatal("RequireCapabilities: got nil error, want an error")
+	}
+	if !strings.Contains(err.Error(), "writeFiles, deleteFiles") {
+		t.Errorf("RequireCapabilities: error %q does not name the missing capabilities", err)
+	}
+}
+
+func TestDefaultBucket(t *testing.T) {
+	root := &testRoot{
+		bucketMap: map[string]map[string]string{"restricted": {"file": "contents"}},
+	}
+	client := &Client{
+		backend: &beRoot{
+			b2i: root,
+		},
+	}
+	if b := client.DefaultBucket(); b != nil {
+		t.Errorf("DefaultBucket with an unrestricted key: got %q, want nil", b.Name())
+	}
+	root.allowed = "restricted"
+	b := client.DefaultBucket()
+	if b == nil {
+		t.Fatal("DefaultBucket with a restricted key: got nil")
+	}
+	if b.Name() != "restricted" {
+		t.Errorf("DefaultBucket: got %q, want %q", b.Name(), "restricted")
+	}
+	r := b.Object("file").NewReader(context.Background())
+	defer r.Close()
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "contents" {
+		t.Errorf("reading from DefaultBucket: got %q, want %q", got, "contents")
+	}
+}
+
+func TestRestrictedKey(t *testing.T) {
+	ctx := context.Background()
+	root := &testRoot{
+		bucketMap: map[string]map[string]string{"restricted": {"logs/file": "contents"}},
+		allowed:   "restricted",
+		prefix:    "logs/",
+		errs: &errCont{
+			errMap: map[string]map[int]error{
+				"listBuckets": {0: testError{code: 401}, 1: testError{code: 401}},
+			},
+		},
+	}
+	client := &Client{
+		backend: &beRoot{
+			b2i: root,
+		},
+	}
+	if got := client.AllowedPrefix(); got != "logs/" {
+		t.Errorf("AllowedPrefix: got %q, want %q", got, "logs/")
+	}
+	if _, err := client.Bucket(ctx, "other"); err == nil {
+		t.Error("Bucket(other) without listBuckets: got no error")
+	}
+	b, err := client.Bucket(ctx, "restricted")
+	if err != nil {
+		t.Fatalf("Bucket(restricted) without listBuckets: %v", err)
+	}
+	if b.Name() != "restricted" {
+		t.Errorf("Bucket: got %q, want %q", b.Name(), "restricted")
+	}
+}
+
+func TestBucketByID(t *testing.T) {
+	ctx := context.Background()
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: map[string]map[string]string{"bucket": {}},
+				errs:      &errCont{},
+			},
+		},
+	}
+	b := client.BucketByID("bucket-id", "bucket")
+	if b.Name() != "bucket" {
+		t.Errorf("BucketByID: got name %q, want %q", b.Name(), "bucket")
+	}
+	if _, _, err := writeFile(ctx, b, "file", 100, 10); err != nil {
+		t.Fatalf("writing to BucketByID: %v", err)
+	}
+}
+
+func TestListBuckets(t *testing.T) {
+	ctx := context.Background()
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: map[string]map[string]string{"a": {}, "b": {}},
+				errs:      &errCont{},
+			},
+		},
+	}
+	buckets, err := client.ListBuckets(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, b := range buckets {
+		names = append(names, b.Name())
+		if b.Type() != Private {
+			t.Errorf("%s: got type %q, want %q", b.Name(), b.Type(), Private)
+		}
+	}
+	sort.Strings(names)
+	if want := []string{"a", "b"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("ListBuckets: got %v, want %v", names, want)
+	}
+}
+
+func TestObjectExists(t *testing.T) {
+	ctx := context.Background()
+	files := map[string]string{"full": "data", "empty": ""}
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: map[string]map[string]string{"a": files},
+				errs:      &errCont{},
+			},
+		},
+	}
+	bucket, err := client.Bucket(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{"full": true, "empty": true, "missing": false} {
+		got, err := bucket.Object(name).Exists(ctx)
+		if err != nil {
+			t.Errorf("Exists(%s): %v", name, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("Exists(%s): got %v, want %v", name, got, want)
+		}
+	}
+
+	// Once an object has been looked up, Exists checks its version.
+	o := bucket.Object("full")
+	if ok, err := o.Exists(ctx); !ok || err != nil {
+		t.Fatalf("Exists(full): got %v, %v", ok, err)
+	}
+	gmux.Lock()
+	delete(files, "full")
+	gmux.Unlock()
+	if ok, err := o.Exists(ctx); ok || err != nil {
+		t.Errorf("Exists(full) after delete: got %v, %v; want false, nil", ok, err)
+	}
+}
+
+func TestRetrier(t *testing.T) {
+	rt := retrier{p: RetryPolicy{MaxAttempts: 6, Base: time.Millisecond, Max: 10 * time.Millisecond}}
+	var got []time.Duration
+	for _, hint := range []time.Duration{0, 0, 0, time.Second, 0, 0} {
+		d, ok := rt.next(hint)
+		if !ok {
+			break
+		}
+		got = append(got, d)
+	}
+	want := []time.Duration{time.Millisecond, 2 * time.Millisecond, 4 * time.Millisecond, time.Second, 10 * time.Millisecond}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("retrier: got waits %v, want %v", got, want)
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 4, Base: time.Second, Max: 5 * time.Second}
+	for failures, want := range []time.Duration{time.Second, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if got := p.Delay(failures); got != want {
+			t.Errorf("Delay(%d): got %v, want %v", failures, got, want)
+		}
+	}
+	if got := (RetryPolicy{Base: time.Hour}).Delay(100); got <= 0 {
+		t.Errorf("Delay(100) without Max: got %v, want a positive delay", got)
+	}
+	// A policy without a Base must not retry in a tight loop.
+	for _, p := range []RetryPolicy{{}, {Max: time.Minute}} {
+		if got := p.Delay(1); got != defaultRetryBase {
+			t.Errorf("%+v.Delay(1): got %v, want %v", p, got, defaultRetryBase)
+		}
+		rt := retrier{p: p}
+		if got, ok := rt.next(0); !ok || got != defaultRetryBase {
+			t.Errorf("%+v: first retry after %v, %v; want %v, true", p, got, ok, defaultRetryBase)
+		}
+	}
+	if p.Exhausted(3) || !p.Exhausted(4) {
+		t.Errorf("Exhausted: want false after 3 failures and true after 4")
+	}
+}
+
+func TestWriteRetries(t *testing.T) {
+	var calls []time.Duration
+	ch := make(chan time.Time)
+	close(ch)
+	after = func(d time.Duration) <-chan time.Time {
+		calls = append(calls, d)
+		return ch
+	}
+	defer func() { after = time.After }()
+
+	ctx := context.Background()
+	twice := map[int]error{
+		0: testError{retry: true},
+		1: testError{retry: true},
+	}
+	for _, e := range []struct {
+		p     RetryPolicy
+		errs  map[int]error
+		waits []time.Duration
+		fail  bool
+	}{
+		{p: RetryPolicy{Base: time.Second}, errs: twice, waits: []time.Duration{time.Second, 2 * time.Second}},
+		{p: NoRetries, errs: twice, fail: true},
+		{
+			// Retry-After is honored over the policy.
+			p:     RetryPolicy{Base: time.Second},
+			errs:  map[int]error{0: testError{reupload: true, backoff: 7 * time.Second}},
+			waits: []time.Duration{7 * time.Second},
+		},
+	} {
+		calls = nil
+		root := &testRoot{
+			bucketMap: make(map[string]map[string]string),
+			errs: &errCont{
+				errMap: map[string]map[int]error{
+					"uploadPart": e.errs,
+				},
+			},
+		}
+		client := &Client{backend: &beRoot{b2i: root}}
+		bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := bucket.Object("file").NewWriter(ctx, WriteRetries(e.p))
+		w.ChunkSize = 10
+		w.Write(make([]byte, 15))
+		if err := w.Close(); (err != nil) != e.fail {
+			t.Errorf("%+v: Close(): got %v, want failure %v", e.p, err, e.fail)
+		}
+		if !reflect.DeepEqual(calls, e.waits) {
+			t.Errorf("%+v: got waits %v, want %v", e.p, calls, e.waits)
+		}
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	at := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return at }
+	defer func() { now = time.Now }()
+
+	var ko keyOptions
+	Deadline(at.Add(time.Hour))(&ko)
+	if ko.lifetime != time.Hour {
+		t.Errorf("Deadline: got lifetime %v, want %v", ko.lifetime, time.Hour)
+	}
+}
+
+type ctxKey struct{}
+
+type ctxTransport struct {
+	seen []interface{}
+}
+
+func (ct *ctxTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	ct.seen = append(ct.seen, r.Context().Value(ctxKey{}))
+	return badTransport{}.RoundTrip(r)
+}
+
+func TestTransportContextValues(t *testing.T) {
+	ctx := context.WithValue(context.Background(), ctxKey{}, "tenant")
+	ct := &ctxTransport{}
+	if _, err := NewClient(ctx, "abcd", "efgh", Transport(ct)); err == nil {
+		t.Fatal("NewClient returned successfully, expected an error")
+	}
+	if len(ct.seen) == 0 {
+		t.Fatal("transport saw no requests")
+	}
+	for _, v := range ct.seen {
+		if v != "tenant" {
+			t.Errorf("request context value: got %v, want %q", v, "tenant")
+		}
+	}
+}
+
+func TestCleanFileBufferDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cleantest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := time.Now().Add(-2 * time.Hour)
+	files := []struct {
+		name  string
+		old   bool
+		alive bool
+	}{
+		{name: fileBufferPrefix + "123", old: true},
+		{name: fileBufferPrefix + "456", alive: true},
+		{name: "other789", old: true, alive: true},
+		{name: "blazer-logsink012", old: true, alive: true},
+	}
+	for _, f := range files {
+		p := filepath.Join(dir, f.name)
+		if err := ioutil.WriteFile(p, []byte("scratch"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if f.old {
+			if err := os.Chtimes(p, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var gotFiles int
+	var gotBytes int64
+	report := func(n int, b int64) {
+		gotFiles, gotBytes = n, b
+	}
+	ctx := context.Background()
+	NewClient(ctx, "abcd", "efgh", Transport(badTransport{}), CleanFileBufferDir(dir, time.Hour, report))
+	if gotFiles != 1 || gotBytes != 7 {
+		t.Errorf("CleanFileBufferDir: reported %d files, %d bytes; want 1, 7", gotFiles, gotBytes)
+	}
+	for _, f := range files {
+		_, err := os.Stat(filepath.Join(dir, f.name))
+		if alive := err == nil; alive != f.alive {
+			t.Errorf("%s: exists = %v, want %v", f.name, alive, f.alive)
+		}
+	}
+}
+
+func TestReadAfterClose(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      &errCont{},
+			},
+		},
+	}
+	bucket, err := client.NewBucket(ctx, "bucket", &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, _, err := writeFile(ctx, bucket, "file", 100, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := o.NewReader(ctx)
+	r.ChunkSize = 10
+	if _, err := r.Read(make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if _, err := r.Read(make([]byte, 5)); err != ErrReaderClosed {
+		t.Errorf("Read after Close: got %v, want %v", err, ErrReaderClosed)
+	}
+
+	r = o.NewReader(ctx)
+	cancel()
+	if _, err := r.Read(make([]byte, 5)); err != context.Canceled {
+		t.Errorf("Read after cancel: got %v, want %v", err, context.Canceled)
+	}
+	r.Close()
+}
+
+type limitedWriter struct {
+	w io.Writer
+	n int
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if len(p) > l.n {
+		n, _ := l.w.Write(p[:l.n])
+		l.n = 0
+		return n, errors.New("writer full")
+	}
+	l.n -= len(p)
+	return l.w.Write(p)
+}
+
+func TestWriteTo(t *testing.T) {
+	ctx := context.Background()
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      &errCont{},
+			},
+		},
+	}
+	bucket, err := client.NewBucket(ctx, "bucket", &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, wsha, err := writeFile(ctx, bucket, "file", 95, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := o.NewReader(ctx)
+	r.ChunkSize = 10
+	r.ConcurrentDownloads = 3
+	hsh := sha1.New()
+	n, err := r.WriteTo(hsh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 95 {
+		t.Errorf("WriteTo: got %d bytes, want 95", n)
+	}
+	if got := fmt.Sprintf("%x", hsh.Sum(nil)); got != wsha {
+		t.Errorf("WriteTo: got SHA1 %s, want %s", got, wsha)
+	}
+	r.Close()
+
+	// A failed write is reported with the bytes actually written, and the
+	// rest can still be read.
+	r = o.NewReader(ctx)
+	r.ChunkSize = 10
+	buf := &bytes.Buffer{}
+	n, err = r.WriteTo(&limitedWriter{w: buf, n: 25})
+	if err == nil || n != 25 {
+		t.Errorf("WriteTo full writer: got (%d, %v), want 25 bytes and an error", n, err)
+	}
+	m, err := io.Copy(buf, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n+m != 95 {
+		t.Errorf("WriteTo then Copy: got %d bytes, want 95", n+m)
+	}
+	r.Close()
+}
+
+func TestCloseWithContext(t *testing.T) {
+	table := []struct {
+		size  int64
+		csize int
+	}{
+		{size: 10, csize: 100},
+		{size: 250, csize: 100},
+	}
+	for _, e := range table {
+		client := &Client{
+			backend: &beRoot{
+				b2i: &testRoot{
+					bucketMap: make(map[string]map[string]string),
+					errs:      &errCont{},
+				},
+			},
+		}
+		bucket, err := client.NewBucket(context.Background(), "bucket", &BucketAttrs{Type: Private})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		w := bucket.Object("file").NewWriter(ctx)
+		w.ChunkSize = e.csize
+		if _, err := io.Copy(w, io.LimitReader(zReader{}, e.size)); err != nil {
+			t.Fatal(err)
+		}
+		// The upload's context is gone, but the data can still be committed.
+		cancel()
+		if err := w.CloseWithContext(context.Background()); err != nil {
+			t.Errorf("CloseWithContext, %d bytes in %d byte chunks: %v", e.size, e.csize, err)
+		}
+	}
+}
+
+type blockingBuffer struct {
+	writeBuffer
+	release chan struct{}
+}
+
+func (b blockingBuffer) Reader() (readResetter, error) {
+	<-b.release
+	return b.writeBuffer.Reader()
+}
+
+func TestWriterStatus(t *testing.T) {
+	ctx := context.Background()
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      &errCont{},
+			},
+		},
+	}
+	bucket, err := client.NewBucket(ctx, "bucket", &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	w := bucket.Object("file").NewWriter(ctx)
+	w.ChunkSize = 10
+	w.ConcurrentUploads = 1
+	w.newBuffer = func() (writeBuffer, error) {
+		return blockingBuffer{writeBuffer: newMemoryBuffer(), release: release}, nil
+	}
+	done := make(chan error)
+	go func() {
+		// The first chunk occupies the only worker, and the second waits.
+		_, err := w.Write(make([]byte, 25))
+		done <- err
+	}()
+	var ws *WriterStatus
+	for i := 0; i < 1000; i++ {
+		ws = client.Status().Writers["bucket/file"]
+		if ws != nil && ws.Busy == 1 && ws.Waiting == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if ws == nil || ws.Workers != 1 || ws.Busy != 1 || ws.Waiting != 1 || ws.ChunkSize != 10 {
+		t.Errorf("WriterStatus while blocked: got %+v, want 1 worker, 1 busy, 1 waiting, 10 byte chunks", ws)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	ws = client.Status().Writers["bucket/file"]
+	if ws.Waiting != 0 || ws.Buffered != 5 {
+		t.Errorf("WriterStatus after writing: got %+v, want 0 waiting, 5 bytes buffered", ws)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriterStatusRetries(t *testing.T) {
+	ctx := context.Background()
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs: &errCont{
+					errMap: map[string]map[int]error{
+						"uploadPart": {1: testError{reupload: true, backoff: time.Millisecond}},
+					},
+				},
+			},
+		},
+	}
+	bucket, err := client.NewBucket(ctx, "bucket", &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := bucket.Object("file").NewWriter(ctx)
+	w.ChunkSize = 10
+	if _, err := w.Write(make([]byte, 25)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ws := w.Status()
+	if ws.Sent != 25 || ws.Retries != 1 {
+		t.Errorf("Status(): got %d bytes sent and %d retries, want 25 and 1", ws.Sent, ws.Retries)
+	}
+}
+
+func TestPartSHA1s(t *testing.T) {
+	ctx := context.Background()
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+	}
+	client := &Client{backend: &beRoot{b2i: root}}
+	bucket, err := client.NewBucket(ctx, "bucket", &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("abcdefghijklmnopqrstuvwxy")
+	sums := make(map[int]string)
+	for i := 0; i*10 < len(data); i++ {
+		end := (i + 1) * 10
+		if end > len(data) {
+			end = len(data)
+		}
+		sums[i+1] = fmt.Sprintf("%x", sha1.Sum(data[i*10:end]))
+	}
+	small := map[int]string{1: fmt.Sprintf("%x", sha1.Sum(data[:5]))}
+
+	table := []struct {
+		name string
+		data []byte
+		sums map[int]string
+		seek bool
+		fail bool
+	}{
+		{name: "small", data: data[:5], sums: small},
+		{name: "large", data: data, sums: sums},
+		{name: "streamed", data: data, sums: sums, seek: true},
+		{name: "small streamed", data: data[:5], sums: small, seek: true},
+		{name: "corrupt", data: []byte("abcdefghijklmnopqrstuvwxY"), sums: sums, fail: true},
+		{name: "corrupt streamed", data: []byte("abcdefghijKlmnopqrstuvwxy"), sums: sums, seek: true, fail: true},
+		{name: "corrupt small", data: []byte("abcdE"), sums: small, fail: true},
+	}
+	for _, e := range table {
+		w := bucket.Object(e.name).NewWriter(ctx)
+		w.ChunkSize = 10
+		w.PartSHA1s = e.sums
+		var r io.Reader = bytes.NewReader(e.data)
+		if !e.seek {
+			r = struct{ io.Reader }{r}
+		}
+		_, err := io.Copy(w, r)
+		if err == nil {
+			err = w.Close()
+		}
+		if e.fail {
+			if err == nil {
+				t.Errorf("%s: uploaded mismatched data without error", e.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", e.name, err)
+			continue
+		}
+		if got := root.bucketMap["bucket"][e.name]; got != string(e.data) {
+			t.Errorf("%s: got %q, want %q", e.name, got, e.data)
+		}
+	}
+}
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) { return 0, errors.New("read failed") }
+
+func TestAssemble(t *testing.T) {
+	ctx := context.Background()
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+	}
+	client := &Client{backend: &beRoot{b2i: root}}
+	bucket, err := client.NewBucket(ctx, "bucket", &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	media := bytes.Repeat([]byte("media"), 2e6)
+	w := bucket.Object("media").NewWriter(ctx)
+	if _, err := w.Write(media); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	src := bucket.Object("media")
+	header := bytes.Repeat([]byte("h"), 6e6)
+	trailer := []byte("trailer")
+
+	table := []struct {
+		name   string
+		pieces []Piece
+		want   []byte
+		fail   bool
+	}{
+		{
+			name: "mixed",
+			pieces: []Piece{
+				ReaderPiece(bytes.NewReader(header), int64(len(header))),
+				ObjectPiece(src, 0, -1),
+				SectionPiece(bytes.NewReader(trailer), 0, int64(len(trailer))),
+			},
+			want: append(append(append([]byte{}, header...), media...), trailer...),
+		},
+		{
+			name: "copies only",
+			pieces: []Piece{
+				ObjectPiece(src, 0, 5e6),
+				ObjectPiece(src, 5e6, -1),
+				ObjectPiece(src, 0, 10),
+			},
+			want: append(append([]byte{}, media...), media[:10]...),
+		},
+		{
+			name: "local only",
+			pieces: []Piece{
+				ReaderPiece(bytes.NewReader(trailer), int64(len(trailer))),
+				ObjectPiece(src, 0, 10),
+			},
+			want: append(append([]byte{}, trailer...), media[:10]...),
+		},
+		{
+			name: "small local part",
+			pieces: []Piece{
+				ReaderPiece(bytes.NewReader(trailer), int64(len(trailer))),
+				ObjectPiece(src, 0, -1),
+			},
+			fail: true,
+		},
+		{
+			name: "short reader",
+			pieces: []Piece{
+				ReaderPiece(bytes.NewReader(header), int64(len(header))+1),
+				ObjectPiece(src, 0, -1),
+			},
+			fail: true,
+		},
+		{
+			name: "failed local read",
+			pieces: []Piece{
+				ReaderPiece(io.MultiReader(bytes.NewReader(trailer), errReader{}), 100),
+			},
+			fail: true,
+		},
+	}
+	for _, e := range table {
+		err := bucket.Object(e.name).Assemble(ctx, e.pieces, func(w *Writer) { w.ConcurrentUploads = 3 })
+		if e.fail {
+			if err == nil {
+				t.Errorf("%s: Assemble succeeded, but should have failed", e.name)
+			}
+			if got, ok := root.bucketMap["bucket"][e.name]; ok {
+				t.Errorf("%s: Assemble failed, but committed %d bytes", e.name, len(got))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", e.name, err)
+			continue
+		}
+		if got := root.bucketMap["bucket"][e.name]; got != string(e.want) {
+			t.Errorf("%s: got %d bytes, want %d", e.name, len(got), len(e.want))
+		}
+	}
+}
+
+func TestCopyTo(t *testing.T) {
+	ctx := context.Background()
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+	}
+	client := &Client{backend: &beRoot{b2i: root}}
+	bucket, err := client.NewBucket(ctx, "bucket", &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := writeFile(ctx, bucket, "src", 100, 1e8); err != nil {
+		t.Fatal(err)
+	}
+	src := bucket.Object("src")
+
+	table := []struct {
+		dst  string
+		opts []CopyOption
+		want testCopy
+	}{
+		{
+			dst:  "plain",
+			want: testCopy{},
+		},
+		{
+			dst: "unchanged",
+			opts: []CopyOption{CopyAttrsFunc(func(*Attrs) (*Attrs, error) {
+				return nil, nil
+			})},
+			want: testCopy{},
+		},
+		{
+			dst: "rewritten",
+			opts: []CopyOption{CopyAttrsFunc(func(a *Attrs) (*Attrs, error) {
+				return &Attrs{ContentType: "text/plain", Info: map[string]string{"fixed": "true"}}, nil
+			})},
+			want: testCopy{replace: true, ct: "text/plain", info: map[string]string{"fixed": "true"}},
+		},
+		{
+			// Editing the source's attrs copies only the info it had.
+			dst: "edited",
+			opts: []CopyOption{CopyAttrsFunc(func(a *Attrs) (*Attrs, error) {
+				a.ContentType = "text/plain"
+				return a, nil
+			})},
+			want: testCopy{replace: true, ct: "text/plain", info: map[string]string{}},
+		},
+	}
+	for _, e := range table {
+		dst := bucket.Object(e.dst)
+		if err := src.CopyTo(ctx, dst, e.opts...); err != nil {
+			t.Errorf("CopyTo(%s): %v", e.dst, err)
+			continue
+		}
+		if root.bucketMap["bucket"][e.dst] != root.bucketMap["bucket"]["src"] {
+			t.Errorf("CopyTo(%s): contents differ", e.dst)
+		}
+		gmux.Lock()
+		got := testCopies[e.dst]
+		gmux.Unlock()
+		if got.replace != e.want.replace || got.ct != e.want.ct || !reflect.DeepEqual(got.info, e.want.info) {
+			t.Errorf("CopyTo(%s): got metadata %+v, want %+v", e.dst, got, e.want)
+		}
+	}
+
+	if _, _, err := writeFile(ctx, bucket, "big", 25e6, 1e8); err != nil {
+		t.Fatal(err)
+	}
+	big := bucket.Object("big")
+	if err := big.CopyTo(ctx, bucket.Object("big copy"), CopyPartSize(1e7), CopyConcurrency(3)); err != nil {
+		t.Fatal(err)
+	}
+	if root.bucketMap["bucket"]["big copy"] != root.bucketMap["bucket"]["big"] {
+		t.Error("CopyTo(big copy): contents differ")
+	}
+	gmux.Lock()
+	_, ok := testCopies["big copy"]
+	gmux.Unlock()
+	if ok {
+		t.Error("CopyTo(big copy): copied in one request, want parts")
+	}
+
+	fail := errors.New("no")
+	err = src.CopyTo(ctx, bucket.Object("failed"), CopyAttrsFunc(func(*Attrs) (*Attrs, error) { return nil, fail }))
+	if err != fail {
+		t.Errorf("CopyTo with failing func: got %v, want %v", err, fail)
+	}
+}
+
+func TestCopyFallback(t *testing.T) {
+	ctx := context.Background()
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+	}
+	client := &Client{backend: &beRoot{b2i: root}}
+	bucket, err := client.NewBucket(ctx, "bucket", &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := writeFile(ctx, bucket, "src", 1e6, 1e8); err != nil {
+		t.Fatal(err)
+	}
+	info := make(map[string]string)
+	for i := 0; i < 12; i++ {
+		info[fmt.Sprintf("k%02d", i)] = "v"
+	}
+	var events []*CopyFallbackEvent
+	err = bucket.Object("src").CopyTo(ctx, bucket.Object("dst"),
+		CopyAttrsFunc(func(*Attrs) (*Attrs, error) { return &Attrs{Info: info}, nil }),
+		CopyFallback(func(e *CopyFallbackEvent) { events = append(events, e) }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.bucketMap["bucket"]["dst"] != root.bucketMap["bucket"]["src"] {
+		t.Error("CopyTo(dst): contents differ")
+	}
+	gmux.Lock()
+	_, copied := testCopies["dst"]
+	gmux.Unlock()
+	if copied {
+		t.Error("CopyTo(dst): copied within B2, want streamed")
+	}
+	if len(events) != 1 {
+		t.Fatalf("CopyFallback: got %d events, want 1", len(events))
+	}
+	e := events[0]
+	if e.Err != errInfoLimits || e.Src.Name() != "src" || e.Dst.Name() != "dst" {
+		t.Errorf("CopyFallback: got event %+v", e)
+	}
+	if want := []string{"k10", "k11"}; !reflect.DeepEqual(e.Dropped, want) {
+		t.Errorf("CopyFallback: dropped %v, want %v", e.Dropped, want)
+	}
+}
+
+func TestIsInfoError(t *testing.T) {
+	for _, e := range []struct {
+		err  error
+		want bool
+	}{
+		{err: errInfoLimits, want: true},
+		{err: &Error{Status: 400, Code: "bad_request", Message: "fileInfo too large"}, want: true},
+		{err: &Error{Status: 400, Code: "bad_request", Message: "bad file name"}},
+		{err: &Error{Status: 500, Message: "info service down"}},
+		{err: errors.New("info")},
+	} {
+		if got := isInfoError(e.err); got != e.want {
+			t.Errorf("isInfoError(%v): got %v, want %v", e.err, got, e.want)
+		}
+	}
+	fit, dropped := fitInfo(map[string]string{"a": strings.Repeat("x", maxInfoBytes), "b": "y"})
+	if len(fit) != 1 || fit["b"] != "y" || !reflect.DeepEqual(dropped, []string{"a"}) {
+		t.Errorf("fitInfo: got %v, dropped %v", fit, dropped)
+	}
+}
+
+func TestExportTar(t *testing.T) {
+	ctx := context.Background()
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      &errCont{},
+			},
+		},
+	}
+	bucket, err := client.NewBucket(ctx, "bucket", &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"export/a":     "alpha",
+		"export/sub/b": "",
+		"export/c":     strings.Repeat("gamma", 1000),
+	}
+	for name, data := range want {
+		w := bucket.Object(name).NewWriter(ctx)
+		if _, err := io.WriteString(w, data); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := bucket.Object("other").NewWriter(ctx)
+	io.WriteString(w, "not exported")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := bucket.ExportTar(ctx, "export/", buf); err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	tr := tar.NewReader(buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[hdr.Name] = string(b)
+	}
+	for name, data := range want {
+		if got[name] != data {
+			t.Errorf("%s: got %d bytes, want %d", name, len(got[name]), len(data))
+		}
+		delete(got, name)
+	}
+	for name := range got {
+		t.Errorf("%s: exported, but shouldn't have been", name)
+	}
+}
+
+func TestFinishReconciles(t *testing.T) {
+	ctx := context.Background()
+	errs := &errCont{
+		errMap: map[string]map[int]error{
+			"finishLargeFile": {0: errors.New("timed out")},
+		},
+	}
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      errs,
+			},
+		},
+	}
+	bucket, err := client.NewBucket(ctx, "bucket", &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := writeFile(ctx, bucket, "file", 250, 100); err != nil {
+		t.Errorf("Close after a lost finish response: %v", err)
+	}
+
+	// A finish that B2 did not complete is not mistaken for one that it
+	// did, even though an earlier version of the file exists.
+	errs.errMap = map[string]map[int]error{
+		"finishLargeFileFailed": {0: errors.New("bad parts")},
+	}
+	errs.opMap = nil
+	if _, _, err := writeFile(ctx, bucket, "file", 250, 100); err == nil {
+		t.Errorf("Close after a failed finish: got no error")
+	}
+
+	// When the finish fails because the caller's context is done, the
+	// check still runs.
+	errs.errMap = map[string]map[int]error{
+		"finishLargeFile": {0: context.Canceled},
+	}
+	errs.opMap = nil
+	lf, err := bucket.StartLargeFile(ctx, "cancelled", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lf.UploadPart(ctx, 1, strings.NewReader("data")); err != nil {
+		t.Fatal(err)
+	}
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := lf.Finish(cctx); err != nil {
+		t.Errorf("Finish with a cancelled context after B2 finished: %v", err)
+	}
+}
+
+func TestPipe(t *testing.T) {
+	ctx := context.Background()
+
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+	}
+	client := &Client{
+		backend: &beRoot{
+			b2i: root,
+		},
+	}
+	bucket, err := client.NewBucket(ctx, "bucket", &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := PipeTo(ctx, bucket.Object("good"), func(w io.Writer) error {
+		_, err := io.WriteString(w, "hello, world")
+		return err
+	}); err != nil {
+		t.Fatalf("PipeTo: %v", err)
+	}
+	var got string
+	if err := PipeFrom(ctx, bucket.Object("good"), func(r io.Reader) error {
+		b, err := ioutil.ReadAll(r)
+		got = string(b)
+		return err
+	}); err != nil {
+		t.Fatalf("PipeFrom: %v", err)
+	}
+	if got != "hello, world" {
+		t.Errorf("PipeFrom: got %q, want %q", got, "hello, world")
+	}
+
+	bad := errors.New("producer failed")
+	if err := PipeTo(ctx, bucket.Object("bad"), func(w io.Writer) error {
+		io.WriteString(w, "partial")
+		return bad
+	}); err != bad {
+		t.Errorf("PipeTo: got %v, want %v", err, bad)
+	}
+	gmux.Lock()
+	_, ok := root.bucketMap["bucket"]["bad"]
+	gmux.Unlock()
+	if ok {
+		t.Error("PipeTo: object exists after the producer failed")
+	}
+	if err := PipeFrom(ctx, bucket.Object("good"), func(io.Reader) error { return bad }); err != bad {
+		t.Errorf("PipeFrom: got %v, want %v", err, bad)
+	}
+}
+
+func TestReaderDoubleClose(t *testing.T) {
+	ctx := context.Background()
+
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      &errCont{},
+			},
+		},
+	}
+	bucket, err := client.NewBucket(ctx, "bucket", &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, _, err := writeFile(ctx, bucket, "file", 10, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := o.NewReader(ctx)
+	// Read to EOF, and then read some more.
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      &errCont{},
+			},
+		},
+	}
+
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := bucket.Delete(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	sobj, wsha, err := writeFile(ctx, bucket, smallFileName, 1e6+42, 1e8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := sobj.Delete(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	if err := readFile(ctx, sobj, wsha, 1e5, 10); err != nil {
+		t.Error(err)
+	}
+
+	lobj, wshaL, err := writeFile(ctx, bucket, largeFileName, 1e6-1e5, 1e4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := lobj.Delete(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	if err := readFile(ctx, lobj, wshaL, 1e7, 10); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReadRangeReturnsRight(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      &errCont{},
+			},
+		},
+	}
+
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := bucket.Delete(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	obj, _, err := writeFile(ctx, bucket, "file", 1e6+42, 1e8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := obj.NewRangeReader(ctx, 200, 1400)
+	r.ChunkSize = 1000
+
+	i, err := io.Copy(ioutil.Discard, r)
+	if err != nil {
+		t.Error(err)
+	}
+	if i != 1400 {
+		t.Errorf("NewRangeReader(_, 200, 1400): want 1400, got %d", i)
+	}
+}
+
+func TestWriterReturnsError(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs: &errCont{
+					errMap: map[string]map[int]error{
+						"uploadPart": {
+							0: testError{},
+							1: testError{},
+							2: testError{},
+							3: testError{},
+							4: testError{},
+							5: testError{},
+							6: testError{},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := bucket.Object("test").NewWriter(ctx)
+	r := io.LimitReader(zReader{}, 1e7)
+	w.ChunkSize = 1e4
+	w.ConcurrentUploads = 4
+	if _, err := io.Copy(w, r); err == nil {
+		t.Fatalf("io.Copy: should have returned an error")
+	}
+}
+
+func TestFileBuffer(t *testing.T) {
+	r := io.LimitReader(zReader{}, 1e8)
+	w, err := newFileBuffer("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if _, err := io.Copy(w, r); err != nil {
+		t.Fatal(err)
+	}
+	bReader, err := w.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hsh := sha1.New()
+	if _, err := io.Copy(hsh, bReader); err != nil {
+		t.Fatal(err)
+	}
+	hshText := fmt.Sprintf("%x", hsh.Sum(nil))
+	if hshText != w.Hash() {
+		t.Errorf("hashes are not equal: bufferWriter is %q, read buffer is %q", w.Hash(), hshText)
+	}
+}
+
+func TestNonBuffer(t *testing.T) {
+	table := []struct {
+		str  string
+		off  int64
+		len  int64
+		want string
+	}{
+		{
+			str:  "a string",
+			off:  0,
+			len:  3,
+			want: "a s",
+		},
+		{
+			str:  "a string",
+			off:  3,
+			len:  1,
+			want: "t",
+		},
+		{
+			str:  "a string",
+			off:  3,
+			len:  5,
+			want: "tring",
+		},
+	}
+
+	for _, e := range table {
+		nb := newNonBuffer(strings.NewReader(e.str), e.off, e.len)
+		want := fmt.Sprintf("%s%x", e.want, sha1.Sum([]byte(e.str[int(e.off):int(e.off+e.len)])))
+		r, err := nb.Reader()
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Errorf("ioutil.ReadAll(%#v): %v", e, err)
+			continue
+		}
+		if want != string(got) {
+			t.Errorf("ioutil.ReadAll(%#v): got %q, want %q", e, string(got), want)
+		}
+	}
+}
+
+type testCounter struct {
+	mu sync.Mutex
+	n  int64
+}
+
+func (c *testCounter) Add(n int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.n += n
+}
+
+func TestProgress(t *testing.T) {
+	ctx := context.Background()
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      &errCont{},
+			},
+		},
+	}
+	bucket, err := client.NewBucket(ctx, "bucket", &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &testCounter{}
+	for _, size := range []int64{50, 350} {
+		o := bucket.Object(fmt.Sprintf("file-%d", size))
+		w := o.NewWriter(ctx)
+		w.ChunkSize = 100
+		w.ConcurrentUploads = 3
+		w.Progress = tr
+		if _, err := io.Copy(w, io.LimitReader(zReader{}, size)); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		r := o.NewReader(ctx)
+		r.ChunkSize = 30
+		r.Progress = tr
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+	}
+	if got := tr.n; got != 800 {
+		t.Errorf("Progress: got %d bytes, want 800", got)
+	}
+}
+
+func TestWriteAtomic(t *testing.T) {
+	ctx := context.Background()
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+	}
+	client := &Client{backend: &beRoot{b2i: root}}
+	bucket, err := client.NewBucket(ctx, "bucket", &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errFail := errors.New("failed")
+
+	table := []struct {
+		name string
+		size int64
+		fail bool
+	}{
+		{name: "small", size: 50},
+		{name: "large", size: 350},
+		{name: "failed-small", size: 50, fail: true},
+		{name: "failed-large", size: 350, fail: true},
+	}
+	for _, e := range table {
+		err := WriteAtomic(ctx, bucket.Object(e.name), func(w *Writer) error {
+			w.ChunkSize = 100
+			if _, err := io.Copy(w, io.LimitReader(zReader{}, e.size)); err != nil {
+				return err
+			}
+			if e.fail {
+				return errFail
+			}
+			return nil
+		})
+		if e.fail {
+			if err != errFail {
+				t.Errorf("WriteAtomic(%s): got %v, want %v", e.name, err, errFail)
+			}
+		} else if err != nil {
+			t.Errorf("WriteAtomic(%s): %v", e.name, err)
+		}
+		gmux.Lock()
+		got, ok := root.bucketMap["bucket"][e.name]
+		gmux.Unlock()
+		if ok == e.fail {
+			t.Errorf("WriteAtomic(%s): object exists: %v, want %v", e.name, ok, !e.fail)
+		}
+		if ok && int64(len(got)) != e.size {
+			t.Errorf("WriteAtomic(%s): got %d bytes, want %d", e.name, len(got), e.size)
+		}
+	}
+	gmux.Lock()
+	defer gmux.Unlock()
+	for name := range root.bucketMap["bucket"] {
+		if strings.Contains(name, ".tmp-") {
+			t.Errorf("WriteAtomic: temporary object %s was left behind", name)
+		}
+	}
+}
+
+func TestBlockReader(t *testing.T) {
+	ctx := context.Background()
+	errs := &errCont{}
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      errs,
+			},
+		},
+	}
+	bucket, err := client.NewBucket(ctx, "bucket", &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	zbuf := &bytes.Buffer{}
+	zw := zip.NewWriter(zbuf)
+	files := map[string]string{
+		"a.txt": strings.Repeat("hello ", 100),
+		"b.txt": strings.Repeat("world ", 200),
+	}
+	for name, data := range files {
+		f, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(f, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := zbuf.Bytes()
+	o := bucket.Object("archive.zip")
+	w := o.NewWriter(ctx)
+	if _, err := w.Write(want); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	br, err := o.NewReaderAt(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	br.BlockSize = 64
+	br.CacheBlocks = 2
+	if br.Size() != int64(len(want)) {
+		t.Fatalf("Size(): got %d, want %d", br.Size(), len(want))
+	}
+	for _, off := range []int64{0, 10, 63, 64, 100, int64(len(want)) - 5} {
+		p := make([]byte, 100)
+		n, err := br.ReadAt(p, off)
+		end := off + 100
+		if end > int64(len(want)) {
+			end = int64(len(want))
+			if err != io.EOF {
+				t.Errorf("ReadAt(%d): got %v, want EOF", off, err)
+			}
+		} else if err != nil {
+			t.Errorf("ReadAt(%d): %v", off, err)
+		}
+		if !bytes.Equal(p[:n], want[off:end]) {
+			t.Errorf("ReadAt(%d): got %q, want %q", off, p[:n], want[off:end])
+		}
+	}
+	if _, err := br.Seek(-10, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	tail, err := ioutil.ReadAll(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tail, want[len(want)-10:]) {
+		t.Errorf("Seek then Read: got %q, want %q", tail, want[len(want)-10:])
+	}
+
+	zr, err := zip.NewReader(br, br.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != files[f.Name] {
+			t.Errorf("zip %s: got %d bytes, want %d", f.Name, len(got), len(files[f.Name]))
+		}
+	}
+
+	// Blocks are fetched once while they stay in the cache, however far
+	// into the object they are.
+	errs.errMap = map[string]map[int]error{}
+	errs.opMap = nil
+	br, err = o.NewReaderAt(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	br.BlockSize = 64
+	br.CacheBlocks = 2
+	p := make([]byte, 4)
+	for _, e := range []struct {
+		off   int64
+		calls int
+	}{
+		{off: 0, calls: 1},
+		{off: 70, calls: 2},
+		{off: 75, calls: 2},
+		{off: 140, calls: 3},
+		{off: 150, calls: 3},
+		{off: 80, calls: 3},
+		{off: 4, calls: 4}, // evicted by the block at 128
+	} {
+		if _, err := br.ReadAt(p, e.off); err != nil {
+			t.Fatalf("ReadAt(%d): %v", e.off, err)
+		}
+		if got := errs.opMap["downloadFileByID"]; got != e.calls {
+			t.Errorf("ReadAt(%d): got %d downloads in all, want %d", e.off, got, e.calls)
+		}
+	}
+}
+
+func TestObjectByID(t *testing.T) {
+	ctx := context.Background()
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      &errCont{},
+			},
+		},
+	}
+	bucket, err := client.NewBucket(ctx, "bucket", &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, wsha, err := writeFile(ctx, bucket, "file", 95, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := o.Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.ID == "" {
+		t.Fatal("Attrs(): no ID")
+	}
+
+	// The test backend uses names as IDs, so a different name shows that the
+	// download was made by ID.
+	v := bucket.ObjectByID(attrs.ID, "renamed")
+	if v.Name() != "renamed" {
+		t.Errorf("Name(): got %q, want %q", v.Name(), "renamed")
+	}
+	if err := readFile(ctx, v, wsha, 10, 3); err != nil {
+		t.Errorf("reading by ID: %v", err)
+	}
+}
+
+func TestBucketOptions(t *testing.T) {
+	ctx := context.Background()
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      &errCont{},
+			},
+		},
+	}
+	DefaultWriterOptions(func(w *Writer) { w.ChunkSize = 1e7; w.ConcurrentUploads = 2 })(&client.opts)
+	DefaultReaderOptions(func(r *Reader) { r.ChunkSize = 1e6; r.ConcurrentDownloads = 2 })(&client.opts)
+	bucket, err := client.NewBucket(ctx, "bucket", &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tuned := bucket.WithWriterOptions(func(w *Writer) { w.ChunkSize = 2e7 }).
+		WithReaderOptions(func(r *Reader) { r.ChunkSize = 2e6 })
+
+	w := tuned.Object("file").NewWriter(ctx, func(w *Writer) { w.ConcurrentUploads = 3 })
+	if w.ChunkSize != 2e7 || w.ConcurrentUploads != 3 {
+		t.Errorf("tuned Writer: got ChunkSize %d, ConcurrentUploads %d; want 2e7, 3", w.ChunkSize, w.ConcurrentUploads)
+	}
+	r := tuned.Object("file").NewReader(ctx)
+	if r.ChunkSize != 2e6 || r.ConcurrentDownloads != 2 {
+		t.Errorf("tuned Reader: got ChunkSize %d, ConcurrentDownloads %d; want 2e6, 2", r.ChunkSize, r.ConcurrentDownloads)
+	}
+	if w := bucket.Object("file").NewWriter(ctx); w.ChunkSize != 1e7 {
+		t.Errorf("untuned Writer: got ChunkSize %d, want 1e7", w.ChunkSize)
+	}
+	if r := bucket.Object("file").NewRangeReader(ctx, 0, 10, func(r *Reader) { r.ChunkSize = 5 }); r.ChunkSize != 5 {
+		t.Errorf("Reader with options: got ChunkSize %d, want 5", r.ChunkSize)
+	}
+}
+
+func TestChecksumError(t *testing.T) {
+	ctx := context.Background()
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+	}
+	client := &Client{backend: &beRoot{b2i: root}}
+	bucket, err := client.NewBucket(ctx, "bucket", &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, _, err := writeFile(ctx, bucket, "file", 95, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := o.NewReader(ctx)
+	r.ChunkSize = 10
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		t.Fatalf("reading intact file: %v", err)
+	}
+
+	gmux.Lock()
+	root.bucketMap["bucket"]["file"] = "X" + root.bucketMap["bucket"]["file"][1:]
+	gmux.Unlock()
+
+	r = o.NewReader(ctx)
+	r.ChunkSize = 10
+	_, err = ioutil.ReadAll(r)
+	if _, ok := err.(*ChecksumError); !ok {
+		t.Errorf("Read of corrupt file: got %v, want a *ChecksumError", err)
+	}
+	r = o.NewReader(ctx)
+	r.ChunkSize = 10
+	_, err = r.WriteTo(ioutil.Discard)
+	if _, ok := err.(*ChecksumError); !ok {
+		t.Errorf("WriteTo of corrupt file: got %v, want a *ChecksumError", err)
+	}
+	r = o.NewRangeReader(ctx, 10, 20)
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		t.Errorf("ranged read of corrupt file: %v", err)
+	}
+}
+
+func TestDownloadToFile(t *testing.T) {
+	ctx := context.Background()
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      &errCont{},
+			},
+		},
+	}
+	bucket, err := client.NewBucket(ctx, "bucket", &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, wsha, err := writeFile(ctx, bucket, "file", 95, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, 95)
+	io.ReadFull(zReader{}, want)
 
-	defer func() {
-		if err := sobj.Delete(ctx); err != nil {
-			t.Error(err)
+	dir, err := ioutil.TempDir("", "b2download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "file")
+	side := path + ".b2download"
+
+	defer func(n int64) { downloadCheckpoint = n }(downloadCheckpoint)
+	downloadCheckpoint = 30
+
+	garbage := append(bytes.Repeat([]byte{'x'}, 40), want[40:]...)
+	table := []struct {
+		desc   string
+		prefix []byte // the partial download
+		state  *downloadState
+		fail   bool
+	}{
+		{desc: "fresh"},
+		{
+			desc:   "resumed",
+			prefix: want[:40],
+			state:  &downloadState{ID: "file", Size: 95, Done: 40},
+		},
+		{
+			// Resuming keeps the bytes already on disk, so bad ones are
+			// caught by the final check.
+			desc:   "resumed bad data",
+			prefix: garbage[:40],
+			state:  &downloadState{ID: "file", Size: 95, Done: 40},
+			fail:   true,
+		},
+		{
+			desc:   "changed object",
+			prefix: garbage,
+			state:  &downloadState{ID: "other", Size: 95, Done: 60},
+		},
+	}
+	for _, e := range table {
+		os.Remove(path)
+		os.Remove(side)
+		if e.prefix != nil {
+			if err := ioutil.WriteFile(path, e.prefix, 0644); err != nil {
+				t.Fatal(err)
+			}
 		}
-	}()
+		if e.state != nil {
+			if err := writeDownloadState(side, *e.state); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := o.DownloadToFile(ctx, path)
+		if e.fail {
+			if _, ok := err.(*ChecksumError); !ok {
+				t.Errorf("%s: got %v, want a *ChecksumError", e.desc, err)
+			}
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("%s: bad file was not removed", e.desc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", e.desc, err)
+			continue
+		}
+		if err := checkFileSHA1(path, "file", wsha); err != nil {
+			t.Errorf("%s: %v", e.desc, err)
+		}
+		if _, err := os.Stat(side); !os.IsNotExist(err) {
+			t.Errorf("%s: sidecar was not removed", e.desc)
+		}
+	}
+}
 
-	if err := readFile(ctx, sobj, wsha, 1e5, 10); err != nil {
-		t.Error(err)
+func TestOptionValidation(t *testing.T) {
+	ctx := context.Background()
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+	}
+	client := &Client{backend: &beRoot{b2i: root}}
+	bucket, err := client.NewBucket(ctx, "bucket", &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := []struct {
+		opt  WriterOption
+		want []string
+	}{
+		{
+			opt:  func(w *Writer) { w.ChunkSize = 6e9 },
+			want: []string{"ChunkSize"},
+		},
+		{
+			opt:  func(w *Writer) { w.FileBufferDir = os.TempDir() },
+			want: []string{"UseFileBuffer is false"},
+		},
+		{
+			opt: func(w *Writer) {
+				w.UseFileBuffer = true
+				w.FileBufferDir = filepath.Join(os.TempDir(), "no", "such", "dir")
+			},
+			want: []string{"FileBufferDir is unusable"},
+		},
+		{
+			opt: func(w *Writer) {
+				w.ChunkSize = -1
+				w.PartSHA1s = map[int]string{0: strings.Repeat("a", 40), 2: "xyz"}
+			},
+			want: []string{"ChunkSize", "parts [0 2]"},
+		},
+	}
+	for i, e := range table {
+		w := bucket.Object("file").NewWriter(ctx, e.opt)
+		_, err := w.Write([]byte("data"))
+		if err == nil {
+			t.Errorf("%d: Write: got no error", i)
+			w.Close()
+			continue
+		}
+		for _, want := range e.want {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%d: Write: got %q, want it to mention %q", i, err, want)
+			}
+		}
+		if err := w.Close(); err == nil {
+			t.Errorf("%d: Close: got no error", i)
+		}
+		gmux.Lock()
+		_, ok := root.bucketMap["bucket"]["file"]
+		gmux.Unlock()
+		if ok {
+			t.Errorf("%d: object was written", i)
+		}
+	}
+
+	r := bucket.Object("file").NewRangeReader(ctx, -1, 10)
+	if _, err := r.Read(make([]byte, 10)); err == nil || !strings.Contains(err.Error(), "offset") {
+		t.Errorf("Read with negative offset: got %v, want an error about the offset", err)
+	}
+}
+
+func TestDiagnose(t *testing.T) {
+	ctx := context.Background()
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs: &errCont{
+			errMap: map[string]map[int]error{
+				"uploadPart": {1: testError{code: 400}},
+			},
+		},
+	}
+	client := &Client{backend: &beRoot{b2i: root}}
+	bucket, err := client.NewBucket(ctx, "bucket", &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := bucket.Object("file").NewWriter(ctx)
+	w.ChunkSize = 10
+	w.Diagnose = true
+	w.Write(make([]byte, 35))
+	err = w.Close()
+	de, ok := err.(*DiagnosticError)
+	if !ok {
+		t.Fatalf("Close(): got %v, want a *DiagnosticError", err)
+	}
+	d := de.Diagnostics
+	if d.Name != "file" || len(d.Events) == 0 {
+		t.Errorf("Diagnostics: got %+v", d)
+	}
+	if len(d.Parts) < 2 {
+		t.Fatalf("Diagnostics: got %d parts, want at least 2", len(d.Parts))
+	}
+	if p := d.Parts[0]; p.Number != 1 || p.State != "done" || p.Size != 10 {
+		t.Errorf("part 1: got %+v, want done", p)
+	}
+	if p := d.Parts[1]; p.Number != 2 || p.State != "failed" || p.Err == "" {
+		t.Errorf("part 2: got %+v, want failed", p)
+	}
+	if errors.Unwrap(err) != de.Err {
+		t.Errorf("Unwrap(): got %v, want %v", errors.Unwrap(err), de.Err)
+	}
+	wrapped := &DiagnosticError{Err: b2err{err: errors.New("gone"), notFoundErr: true}}
+	if !IsNotExist(wrapped) {
+		t.Errorf("IsNotExist(%v): got false through a DiagnosticError", wrapped)
+	}
+
+	// An upload whose context is cancelled hasn't failed, and its error
+	// isn't wrapped.
+	cctx, cancel := context.WithCancel(ctx)
+	w = bucket.Object("cancelled").NewWriter(cctx)
+	w.ChunkSize = 10
+	w.Diagnose = true
+	w.Write(make([]byte, 5))
+	cancel()
+	err = w.Close()
+	if _, ok := err.(*DiagnosticError); ok || err != context.Canceled {
+		t.Errorf("Close() after cancel: got %#v, want context.Canceled", err)
+	}
+}
+
+func writeFile(ctx context.Context, bucket *Bucket, name string, size int64, csize int) (*Object, string, error) {
+	r := io.LimitReader(zReader{}, size)
+	o := bucket.Object(name)
+	f := o.NewWriter(ctx)
+	h := sha1.New()
+	w := io.MultiWriter(f, h)
+	f.ConcurrentUploads = 5
+	f.ChunkSize = csize
+	n, err := io.Copy(w, r)
+	if err != nil {
+		return nil, "", err
+	}
+	if n != size {
+		return nil, "", fmt.Errorf("io.Copy(): wrote %d bytes; wanted %d bytes", n, size)
+	}
+	if err := f.Close(); err != nil {
+		return nil, "", err
+	}
+	return o, fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+func readFile(ctx context.Context, obj *Object, sha string, chunk, concur int) error {
+	r := obj.NewReader(ctx)
+	r.ChunkSize = chunk
+	r.ConcurrentDownloads = concur
+	h := sha1.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return err
 	}
+	if err := r.Close(); err != nil {
+		return err
+	}
+	rsha := fmt.Sprintf("%x", h.Sum(nil))
+	if sha != rsha {
+		return fmt.Errorf("bad hash: got %s, want %s", rsha, sha)
+	}
+	return nil
+}
+
+func TestListUploadedWindow(t *testing.T) {
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	mkObj := func(d time.Duration) *Object {
+		return &Object{f: &beFile{b2file: &testFile{t: start.Add(d)}}}
+	}
+
+	table := []struct {
+		opts []ListOption
+		obj  *Object
+		want bool
+	}{
+		{obj: mkObj(0), want: true},
+		{opts: []ListOption{ListUploadedAfter(start)}, obj: mkObj(0), want: true},
+		{opts: []ListOption{ListUploadedAfter(start)}, obj: mkObj(-time.Second), want: false},
+		{opts: []ListOption{ListUploadedBefore(start)}, obj: mkObj(0), want: false},
+		{opts: []ListOption{ListUploadedBefore(start)}, obj: mkObj(-time.Second), want: true},
+		{opts: []ListOption{ListUploadedAfter(start), ListUploadedBefore(start.Add(time.Hour))}, obj: mkObj(time.Minute), want: true},
+		{opts: []ListOption{ListUploadedAfter(start), ListUploadedBefore(start.Add(time.Hour))}, obj: mkObj(time.Hour), want: false},
+		{opts: []ListOption{ListUploadedAfter(start)}, obj: &Object{f: &beFile{b2file: &testFile{a: "folder"}}}, want: true},
+	}
+
+	for i, e := range table {
+		var o objectIteratorOptions
+		for _, opt := range e.opts {
+			opt(&o)
+		}
+		if got := o.matches(e.obj); got != e.want {
+			t.Errorf("%d: matches(): got %v, want %v", i, got, e.want)
+		}
+	}
+}
+
+func TestListPrefixesConcurrently(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      &errCont{},
+			},
+		},
+	}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a/1", "a/2", "a/3", "b/1", "c/1", "c/2", "d/1"} {
+		if _, _, err := writeFile(ctx, bucket, name, 10, 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, workers := range []int{0, 1, 2, 10} {
+		iter := bucket.ListPrefixesConcurrently(ctx, []string{"c/", "a/", "b/", "e/"}, workers, ListPageSize(1))
+		var got []string
+		for iter.Next() {
+			got = append(got, iter.Object().Name())
+		}
+		if err := iter.Err(); err != nil {
+			t.Errorf("workers %d: %v", workers, err)
+		}
+		want := []string{"a/1", "a/2", "a/3", "b/1", "c/1", "c/2"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("workers %d: got %v, want %v", workers, got, want)
+		}
+	}
+
+	iter := bucket.ListPrefixesConcurrently(ctx, []string{"a/"}, 1, ListUnfinished())
+	if iter.Next() || iter.Err() == nil {
+		t.Errorf("ListUnfinished: got no error")
+	}
+}
+
+func TestErrorHelpers(t *testing.T) {
+	table := []struct {
+		err                                 error
+		notExist, auth, throttle, capExceed bool
+	}{
+		{err: &Error{Status: 404, Code: "file_not_present"}, notExist: true},
+		{err: &Error{Status: 401, Code: "expired_auth_token"}, auth: true},
+		{err: &Error{Status: 403, Code: "access_denied"}, auth: true},
+		{err: &Error{Status: 503, Code: "service_unavailable"}, throttle: true},
+		{err: &Error{Status: 429, Code: "too_many_requests"}, throttle: true},
+		{err: &Error{Status: 403, Code: "download_cap_exceeded"}, capExceed: true},
+		{err: &Error{Status: 403}},
+		{err: &Error{Status: 403, Code: "unauthorized"}, auth: true},
+		{err: b2err{err: errors.New("gone"), notFoundErr: true}, notExist: true},
+		{err: errors.New("network down")},
+	}
+	for _, e := range table {
+		if got := IsNotExist(e.err); got != e.notExist {
+			t.Errorf("IsNotExist(%v): got %v", e.err, got)
+		}
+		if got := IsAuth(e.err); got != e.auth {
+			t.Errorf("IsAuth(%v): got %v", e.err, got)
+		}
+		if got := IsThrottle(e.err); got != e.throttle {
+			t.Errorf("IsThrottle(%v): got %v", e.err, got)
+		}
+		if got := IsCapExceeded(e.err); got != e.capExceed {
+			t.Errorf("IsCapExceeded(%v): got %v", e.err, got)
+		}
+	}
+	if _, ok := AsError(errors.New("network down")); ok {
+		t.Error("AsError(other error): got a B2 error")
+	}
+	if err := (b2err{err: context.Canceled}); !errors.Is(err, context.Canceled) {
+		t.Errorf("errors.Is(%v, context.Canceled): got false", err)
+	}
+}
+
+func TestLocalAddr(t *testing.T) {
+	var gotAddr string
+	srv := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		gotAddr = r.RemoteAddr
+	}))
+	defer srv.Close()
+
+	for _, e := range []struct {
+		ip   string
+		fail bool
+	}{
+		{ip: "127.0.0.1"},
+		{ip: "192.0.2.1", fail: true}, // TEST-NET-1; never assigned locally
+	} {
+		var o clientOptions
+		LocalAddr(net.ParseIP(e.ip))(&o)
+		tr := o.newTransport()
+		resp, err := (&http.Client{Transport: tr}).Get(srv.URL)
+		tr.CloseIdleConnections()
+		if (err != nil) != e.fail {
+			t.Errorf("LocalAddr(%s): got %v, want failure %v", e.ip, err, e.fail)
+		}
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if host, _, _ := net.SplitHostPort(gotAddr); host != e.ip {
+			t.Errorf("LocalAddr(%s): request came from %s", e.ip, gotAddr)
+		}
+	}
+}
+
+func TestPinHosts(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer srv.Close()
+	_, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lookups []string
+	lookupIP = func(_ context.Context, host string) ([]net.IPAddr, error) {
+		lookups = append(lookups, host)
+		return []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}}, nil
+	}
+	defer func() { lookupIP = net.DefaultResolver.LookupIPAddr }()
+
+	get := func(ct *clientTransport, host, method string) error {
+		req, err := http.NewRequest("GET", "http://"+net.JoinHostPort(host, port), nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("X-Blazer-Method", method)
+		req.Close = true
+		resp, err := ct.RoundTrip(req)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	for _, uploads := range []bool{false, true} {
+		lookups = nil
+		var o clientOptions
+		PinHosts(uploads)(&o)
+		if err := o.pins.pin(ctx, "http://api.b2.test:"+port); err != nil {
+			t.Fatal(err)
+		}
+		ct := &clientTransport{rt: o.newTransport()}
+		c := &Client{opts: o}
+		for i := 0; i < 2; i++ {
+			if err := get(ct, "api.b2.test", "b2_list_buckets"); err != nil {
+				t.Errorf("uploads %v: pinned host: %v", uploads, err)
+			}
+		}
+		var hce *HostChangedError
+		if err := get(ct, "other.b2.test", "b2_list_buckets"); !errors.As(err, &hce) || hce.Host != "other.b2.test" {
+			t.Errorf("uploads %v: unpinned host: got %v, want a HostChangedError", uploads, err)
+		}
+		err := get(ct, "pod.b2.test", "b2_upload_file")
+		if uploads && err != nil {
+			t.Errorf("uploads %v: upload host: %v", uploads, err)
+		}
+		if !uploads && !errors.As(err, &hce) {
+			t.Errorf("uploads %v: upload host: got %v, want a HostChangedError", uploads, err)
+		}
+		want := []string{"api.b2.test"}
+		if uploads {
+			want = append(want, "pod.b2.test")
+		}
+		if !reflect.DeepEqual(lookups, want) {
+			t.Errorf("uploads %v: got lookups %v, want %v", uploads, lookups, want)
+		}
+		if hosts := c.Hosts(); len(hosts) != len(want) || !hosts["api.b2.test"][0].Equal(net.ParseIP("127.0.0.1")) {
+			t.Errorf("uploads %v: Hosts(): got %v", uploads, hosts)
+		}
+	}
+}
+
+func TestUploadDialContext(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer srv.Close()
+
+	var dials []string
+	mkDial := func(name string) func(context.Context, string, string) (net.Conn, error) {
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dials = append(dials, name)
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		}
+	}
+	var o clientOptions
+	DialContext(mkDial("api"))(&o)
+	UploadDialContext(mkDial("upload"))(&o)
+	tr := o.newTransport()
+	defer tr.CloseIdleConnections()
+	ct := &clientTransport{rt: tr}
+
+	for _, method := range []string{"b2_list_file_names", "b2_upload_part"} {
+		req, err := http.NewRequest("POST", srv.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Blazer-Method", method)
+		req.Close = true
+		resp, err := ct.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if want := []string{"api", "upload"}; !reflect.DeepEqual(dials, want) {
+		t.Errorf("dials: got %v, want %v", dials, want)
+	}
+}
+
+func TestRawCall(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				errs: &errCont{
+					errMap: map[string]map[int]error{
+						"call": {0: testError{retry: true}},
+					},
+				},
+			},
+		},
+	}
+	type msg struct {
+		Name string `json:"fileName"`
+	}
+	var resp msg
+	if err := client.RawCall(ctx, 2, "b2_new_call", &msg{Name: "foo"}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Name != "foo" {
+		t.Errorf("RawCall: got %+v", resp)
+	}
+}
 
-	lobj, wshaL, err := writeFile(ctx, bucket, largeFileName, 1e6-1e5, 1e4)
+func TestProxyOptions(t *testing.T) {
+	ctx := context.Background()
+	u, err := url.Parse("socks5://proxy.example.com:1080")
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer func() {
-		if err := lobj.Delete(ctx); err != nil {
-			t.Error(err)
-		}
-	}()
+	var dialed string
+	var o clientOptions
+	Proxy(u)(&o)
+	DialContext(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = addr
+		return nil, errors.New("no network")
+	})(&o)
+	tr := o.newTransport()
+	req, err := http.NewRequest("GET", "https://api.backblazeb2.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := tr.Proxy(req)
+	if err != nil || got != u {
+		t.Errorf("Proxy: got %v, %v; want %v", got, err, u)
+	}
+	tr.DialContext(ctx, "tcp", "api.backblazeb2.com:443")
+	if dialed != "api.backblazeb2.com:443" {
+		t.Errorf("DialContext: got %q", dialed)
+	}
 
-	if err := readFile(ctx, lobj, wshaL, 1e7, 10); err != nil {
-		t.Error(err)
+	if _, err := NewClient(ctx, "id", "key", Proxy(u), Transport(http.DefaultTransport)); err == nil {
+		t.Error("NewClient(Proxy, Transport): got no error")
 	}
 }
 
-func TestReadRangeReturnsRight(t *testing.T) {
+func TestListInto(t *testing.T) {
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
@@ -693,34 +3462,45 @@ func TestReadRangeReturnsRight(t *testing.T) {
 			},
 		},
 	}
-
 	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer func() {
-		if err := bucket.Delete(ctx); err != nil {
-			t.Error(err)
+	for _, name := range []string{"a/1", "a/2", "b/1", "b/2", "b/3"} {
+		if _, _, err := writeFile(ctx, bucket, name, 10, 10); err != nil {
+			t.Fatal(err)
 		}
-	}()
+	}
 
-	obj, _, err := writeFile(ctx, bucket, "file", 1e6+42, 1e8)
-	if err != nil {
+	var got []string
+	if err := bucket.ListInto(ctx, func(o *Object) error {
+		got = append(got, o.Name())
+		return nil
+	}, ListPrefix("b/"), ListPageSize(2)); err != nil {
 		t.Fatal(err)
 	}
-	r := obj.NewRangeReader(ctx, 200, 1400)
-	r.ChunkSize = 1000
+	if want := []string{"b/1", "b/2", "b/3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ListInto: got %v, want %v", got, want)
+	}
 
-	i, err := io.Copy(ioutil.Discard, r)
-	if err != nil {
-		t.Error(err)
+	stop := errors.New("stop")
+	got = nil
+	err = bucket.ListInto(ctx, func(o *Object) error {
+		got = append(got, o.Name())
+		if len(got) == 2 {
+			return stop
+		}
+		return nil
+	}, ListPageSize(1))
+	if err != stop {
+		t.Errorf("ListInto: got %v, want %v", err, stop)
 	}
-	if i != 1400 {
-		t.Errorf("NewRangeReader(_, 200, 1400): want 1400, got %d", i)
+	if want := []string{"a/1", "a/2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ListInto: got %v, want %v", got, want)
 	}
 }
 
-func TestWriterReturnsError(t *testing.T) {
+func TestLargeFile(t *testing.T) {
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
@@ -729,141 +3509,482 @@ func TestWriterReturnsError(t *testing.T) {
 		backend: &beRoot{
 			b2i: &testRoot{
 				bucketMap: make(map[string]map[string]string),
-				errs: &errCont{
-					errMap: map[string]map[int]error{
-						"uploadPart": {
-							0: testError{},
-							1: testError{},
-							2: testError{},
-							3: testError{},
-							4: testError{},
-							5: testError{},
-							6: testError{},
-						},
-					},
-				},
+				errs:      &errCont{},
 			},
 		},
 	}
-
 	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
 	if err != nil {
 		t.Fatal(err)
 	}
-	w := bucket.Object("test").NewWriter(ctx)
-	r := io.LimitReader(zReader{}, 1e7)
-	w.ChunkSize = 1e4
-	w.ConcurrentUploads = 4
-	if _, err := io.Copy(w, r); err == nil {
-		t.Fatalf("io.Copy: should have returned an error")
+	lf, err := bucket.StartLargeFile(ctx, "large", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := []string{"first part, ", "second part, ", "third part"}
+	var wg sync.WaitGroup
+	for i := len(parts) - 1; i >= 0; i-- {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := lf.UploadPart(ctx, i+1, strings.NewReader(parts[i])); err != nil {
+				t.Errorf("UploadPart(%d): %v", i+1, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	obj, err := lf.Finish(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.Name() != "large" {
+		t.Errorf("Finish(): got object %q, want %q", obj.Name(), "large")
+	}
+	r := obj.NewReader(ctx)
+	defer r.Close()
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Join(parts, ""); string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
 	}
 }
 
-func TestFileBuffer(t *testing.T) {
-	r := io.LimitReader(zReader{}, 1e8)
-	w, err := newFileBuffer("")
+// versionBucket serves a fixed list of file versions, and records what is
+// deleted and canceled.
+type versionBucket struct {
+	*testBucket
+	versions []*versionFile // sorted by name, newest first
+	removed  []string
+}
+
+type versionFile struct {
+	*testFile
+	vid string
+	b   *versionBucket
+}
+
+func (v *versionFile) id() string { return v.vid }
+
+func (v *versionFile) deleteFileVersion(context.Context) error {
+	v.b.removed = append(v.b.removed, "delete "+v.vid)
+	return nil
+}
+
+func (v *versionFile) compileParts(int64, map[int]string) b2LargeFileInterface {
+	return &versionLargeFile{testLargeFile: &testLargeFile{name: v.n}, f: v}
+}
+
+type versionLargeFile struct {
+	*testLargeFile
+	f *versionFile
+}
+
+func (v *versionLargeFile) cancel(context.Context) error {
+	v.f.b.removed = append(v.f.b.removed, "cancel "+v.f.vid)
+	return nil
+}
+
+func (v *versionBucket) list(status func(string) bool, pfx string) []b2FileInterface {
+	var fs []b2FileInterface
+	for _, f := range v.versions {
+		if status(f.a) && strings.HasPrefix(f.n, pfx) {
+			fs = append(fs, f)
+		}
+	}
+	return fs
+}
+
+func (v *versionBucket) listFileVersions(_ context.Context, _ int, _, _, pfx, _ string) ([]b2FileInterface, string, string, error) {
+	return v.list(func(string) bool { return true }, pfx), "", "", nil
+}
+
+func (v *versionBucket) listUnfinishedLargeFiles(context.Context, int, string) ([]b2FileInterface, string, error) {
+	return v.list(func(s string) bool { return s == "start" }, ""), "", nil
+}
+
+func TestEnforcePolicies(t *testing.T) {
+	at := time.Unix(1e9, 0)
+	now = func() time.Time { return at }
+	defer func() { now = time.Now }()
+	day := 24 * time.Hour
+
+	vb := &versionBucket{testBucket: &testBucket{}}
+	add := func(vid, name, status string, age time.Duration) {
+		vb.versions = append(vb.versions, &versionFile{
+			testFile: &testFile{n: name, a: status, t: at.Add(-age)},
+			vid:      vid,
+			b:        vb,
+		})
+	}
+	// Under the bucket-wide policy, hidden versions are deleted after
+	// 10 days; under keep/, after 100.
+	add("a3", "a", "upload", day)
+	add("a2", "a", "upload", 20*day) // hidden for a day: kept
+	add("a1", "a", "upload", 30*day) // hidden for 20 days: deleted
+	add("b2", "b", "hide", 20*day)   // hides only deleted versions: deleted
+	add("b1", "b", "upload", 30*day) // deleted
+	add("c2", "c", "hide", 5*day)    // too young to delete
+	add("c1", "c", "upload", 30*day) // hidden for 5 days: kept
+	add("k2", "keep/k", "upload", 20*day)
+	add("k1", "keep/k", "upload", 30*day) // hidden for 20 days: kept
+	add("s1", "s", "start", 2*day)        // unfinished: canceled
+	add("s2", "t", "start", time.Hour)    // unfinished, but recent: kept
+
+	root := &testRoot{}
+	bucket := &Bucket{
+		b: &beBucket{b2bucket: vb, ri: &beRoot{b2i: root}},
+		r: &beRoot{b2i: root},
+	}
+	bucket = bucket.WithPolicies(
+		Policy{CancelUnfinishedAfter: day, DeleteHiddenAfter: 10 * day},
+		Policy{Prefix: "keep/", DeleteHiddenAfter: 100 * day},
+	)
+	if err := bucket.EnforcePolicies(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"cancel s1", "delete a1", "delete b1", "delete b2"}
+	if !reflect.DeepEqual(vb.removed, want) {
+		t.Errorf("EnforcePolicies: got %q, want %q", vb.removed, want)
+	}
+}
+
+func TestObjectAt(t *testing.T) {
+	at := time.Unix(1e9, 0)
+	vb := &versionBucket{testBucket: &testBucket{}}
+	add := func(vid, name, status string, age time.Duration) {
+		vb.versions = append(vb.versions, &versionFile{
+			testFile: &testFile{n: name, a: status, t: at.Add(-age)},
+			vid:      vid,
+			b:        vb,
+		})
+	}
+	add("a3", "a", "hide", time.Hour)
+	add("a2", "a", "upload", 2*time.Hour)
+	add("a1", "a", "upload", 4*time.Hour)
+	add("ab1", "ab", "upload", 3*time.Hour)
+	root := &testRoot{}
+	bucket := &Bucket{
+		b: &beBucket{b2bucket: vb, ri: &beRoot{b2i: root}},
+		r: &beRoot{b2i: root},
+	}
+
+	for _, e := range []struct {
+		name string
+		age  time.Duration
+		want string // "" means not found
+	}{
+		{name: "a", age: 0},
+		{name: "a", age: time.Hour, want: ""},
+		{name: "a", age: 90 * time.Minute, want: "a2"},
+		{name: "a", age: 2 * time.Hour, want: "a2"},
+		{name: "a", age: 3 * time.Hour, want: "a1"},
+		{name: "a", age: 5 * time.Hour},
+		{name: "ab", age: 2 * time.Hour, want: "ab1"},
+		{name: "b", age: 0},
+	} {
+		o, err := bucket.ObjectAt(context.Background(), e.name, at.Add(-e.age))
+		if e.want == "" {
+			if !IsNotExist(err) {
+				t.Errorf("ObjectAt(%s, -%v): got %v, want a not-exist error", e.name, e.age, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ObjectAt(%s, -%v): %v", e.name, e.age, err)
+			continue
+		}
+		if got := o.f.id(); got != e.want || o.Name() != e.name || !o.pinned {
+			t.Errorf("ObjectAt(%s, -%v): got version %s of %s (pinned %v), want %s", e.name, e.age, got, o.Name(), o.pinned, e.want)
+		}
+	}
+}
+
+func TestObjectVersions(t *testing.T) {
+	at := time.Unix(1e9, 0)
+	vb := &versionBucket{testBucket: &testBucket{}}
+	for _, v := range []struct {
+		vid, name, status string
+		size              int64
+	}{
+		{"a3", "a", "hide", 0},
+		{"a2", "a", "upload", 2},
+		{"a1", "a", "upload", 1},
+		{"ab1", "ab", "upload", 5},
+	} {
+		vb.versions = append(vb.versions, &versionFile{
+			testFile: &testFile{n: v.name, a: v.status, s: v.size, t: at},
+			vid:      v.vid,
+			b:        vb,
+		})
+	}
+	root := &testRoot{}
+	bucket := &Bucket{
+		b: &beBucket{b2bucket: vb, ri: &beRoot{b2i: root}},
+		r: &beRoot{b2i: root},
+	}
+	vs, err := bucket.Object("a").Versions(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer w.Close()
-	if _, err := io.Copy(w, r); err != nil {
+	want := []*Version{
+		{ID: "a3", Size: 0, Timestamp: at, Status: Hider},
+		{ID: "a2", Size: 2, Timestamp: at, Status: Uploaded},
+		{ID: "a1", Size: 1, Timestamp: at, Status: Uploaded},
+	}
+	if !reflect.DeepEqual(vs, want) {
+		t.Errorf("Versions(a): got %+v, want %+v", vs, want)
+	}
+	vs, err = bucket.Object("b").Versions(context.Background())
+	if err != nil || len(vs) != 0 {
+		t.Errorf("Versions(b): got %v, %v; want none", vs, err)
+	}
+}
+
+func TestSchedulerPriority(t *testing.T) {
+	ctx := context.Background()
+	s := &scheduler{free: 1}
+	if err := s.acquire(ctx); err != nil {
 		t.Fatal(err)
 	}
-	bReader, err := w.Reader()
-	if err != nil {
+	order := make(chan string, 4)
+	var wg sync.WaitGroup
+	for _, w := range []struct {
+		name string
+		p    Priority
+	}{
+		{"background", Background},
+		{"normal", Normal},
+		{"interactive1", Interactive},
+		{"interactive2", Interactive},
+	} {
+		n := len(s.waiting)
+		wg.Add(1)
+		go func(name string, p Priority) {
+			defer wg.Done()
+			if err := s.acquire(WithPriority(ctx, p)); err != nil {
+				t.Error(err)
+				return
+			}
+			order <- name
+			s.release()
+		}(w.name, w.p)
+		// Queue the waiters one at a time, so that ties are ordered.
+		for {
+			s.mu.Lock()
+			queued := len(s.waiting) > n
+			s.mu.Unlock()
+			if queued {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	s.release()
+	wg.Wait()
+	close(order)
+	var got []string
+	for name := range order {
+		got = append(got, name)
+	}
+	want := []string{"interactive1", "interactive2", "normal", "background"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got slots in order %v, want %v", got, want)
+	}
+	if s.free != 1 {
+		t.Errorf("free slots: got %d, want 1", s.free)
+	}
+}
+
+func TestSchedulerCancel(t *testing.T) {
+	ctx := context.Background()
+	s := &scheduler{free: 1}
+	if err := s.acquire(ctx); err != nil {
 		t.Fatal(err)
 	}
-	hsh := sha1.New()
-	if _, err := io.Copy(hsh, bReader); err != nil {
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := s.acquire(cctx); err != context.Canceled {
+		t.Errorf("acquire with canceled context: got %v, want %v", err, context.Canceled)
+	}
+	if len(s.waiting) != 0 {
+		t.Errorf("canceled waiter left in queue")
+	}
+	s.release()
+	if s.free != 1 {
+		t.Errorf("free slots: got %d, want 1", s.free)
+	}
+	var nilSched *scheduler
+	if err := nilSched.acquire(cctx); err != nil {
+		t.Errorf("nil scheduler: got %v, want no limit", err)
+	}
+	nilSched.release()
+}
+
+func TestMaxTransfers(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      &errCont{},
+			},
+		},
+	}
+	MaxTransfers(1)(&client.opts)
+	bucket, err := client.NewBucket(ctx, "bucket", &BucketAttrs{Type: Private})
+	if err != nil {
 		t.Fatal(err)
 	}
-	hshText := fmt.Sprintf("%x", hsh.Sum(nil))
-	if hshText != w.Hash() {
-		t.Errorf("hashes are not equal: bufferWriter is %q, read buffer is %q", w.Hash(), hshText)
+	for _, size := range []int64{5, 100} {
+		name := fmt.Sprintf("file%d", size)
+		o, sha, err := writeFile(WithPriority(ctx, Background), bucket, name, size, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := readFile(WithPriority(ctx, Interactive), o, sha, 10, 4); err != nil {
+			t.Error(err)
+		}
+	}
+	// Readers may have been prefetching past the end of their objects when
+	// they were closed; those threads give up their slots as they exit.
+	s := client.opts.transfers
+	for {
+		s.mu.Lock()
+		free, waiting := s.free, len(s.waiting)
+		s.mu.Unlock()
+		if free == 1 && waiting == 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("after transfers: %d free slots and %d waiting, want 1 and 0", free, waiting)
+		case <-time.After(time.Millisecond):
+		}
 	}
 }
 
-func TestNonBuffer(t *testing.T) {
+func TestParseBandwidthSchedule(t *testing.T) {
 	table := []struct {
-		str  string
-		off  int64
-		len  int64
-		want string
+		in      string
+		want    *BandwidthSchedule
+		wantErr bool
 	}{
 		{
-			str:  "a string",
-			off:  0,
-			len:  3,
-			want: "a s",
+			in:   "5M",
+			want: &BandwidthSchedule{Default: 5e6},
 		},
 		{
-			str:  "a string",
-			off:  3,
-			len:  1,
-			want: "t",
+			in: "09:00-18:00=5M, 22:30-06:00=1.5K,unlimited",
+			want: &BandwidthSchedule{
+				Periods: []BandwidthPeriod{
+					{Start: 9 * time.Hour, End: 18 * time.Hour, BytesPerSecond: 5e6},
+					{Start: 22*time.Hour + 30*time.Minute, End: 6 * time.Hour, BytesPerSecond: 1500},
+				},
+			},
 		},
 		{
-			str:  "a string",
-			off:  3,
-			len:  5,
-			want: "tring",
+			in:   "00:00-01:00=unlimited,100",
+			want: &BandwidthSchedule{Periods: []BandwidthPeriod{{End: time.Hour}}, Default: 100},
 		},
+		{in: "", wantErr: true},
+		{in: "5M,6M", wantErr: true},
+		{in: "09:00=5M", wantErr: true},
+		{in: "9am-5pm=5M", wantErr: true},
+		{in: "09:00-18:00=fast", wantErr: true},
+		{in: "-5", wantErr: true},
 	}
-
 	for _, e := range table {
-		nb := newNonBuffer(strings.NewReader(e.str), e.off, e.len)
-		want := fmt.Sprintf("%s%x", e.want, sha1.Sum([]byte(e.str[int(e.off):int(e.off+e.len)])))
-		r, err := nb.Reader()
-		if err != nil {
-			t.Error(err)
-			continue
-		}
-		got, err := ioutil.ReadAll(r)
-		if err != nil {
-			t.Errorf("ioutil.ReadAll(%#v): %v", e, err)
+		got, err := ParseBandwidthSchedule(e.in)
+		if (err != nil) != e.wantErr {
+			t.Errorf("ParseBandwidthSchedule(%q): got error %v, want error %v", e.in, err, e.wantErr)
 			continue
 		}
-		if want != string(got) {
-			t.Errorf("ioutil.ReadAll(%#v): got %q, want %q", e, string(got), want)
+		if err == nil && !reflect.DeepEqual(got, e.want) {
+			t.Errorf("ParseBandwidthSchedule(%q): got %+v, want %+v", e.in, got, e.want)
 		}
 	}
 }
 
-func writeFile(ctx context.Context, bucket *Bucket, name string, size int64, csize int) (*Object, string, error) {
-	r := io.LimitReader(zReader{}, size)
-	o := bucket.Object(name)
-	f := o.NewWriter(ctx)
-	h := sha1.New()
-	w := io.MultiWriter(f, h)
-	f.ConcurrentUploads = 5
-	f.ChunkSize = csize
-	n, err := io.Copy(w, r)
-	if err != nil {
-		return nil, "", err
+func TestBandwidthScheduleLimit(t *testing.T) {
+	s := &BandwidthSchedule{
+		Periods: []BandwidthPeriod{
+			{Start: 9 * time.Hour, End: 18 * time.Hour, BytesPerSecond: 5},
+			{Start: 22 * time.Hour, End: 6 * time.Hour, BytesPerSecond: 1},
+		},
+		Default:  10,
+		Location: time.UTC,
 	}
-	if n != size {
-		return nil, "", fmt.Errorf("io.Copy(): wrote %d bytes; wanted %d bytes", n, size)
+	for hour, want := range map[int]int64{0: 1, 5: 1, 6: 10, 9: 5, 17: 5, 18: 10, 21: 10, 22: 1, 23: 1} {
+		at := time.Date(2018, 6, 1, hour, 30, 0, 0, time.UTC)
+		if got := s.Limit(at); got != want {
+			t.Errorf("Limit at %02d:30: got %d, want %d", hour, got, want)
+		}
 	}
-	if err := f.Close(); err != nil {
-		return nil, "", err
+	var none *BandwidthSchedule
+	if got := none.Limit(time.Now()); got != 0 {
+		t.Errorf("nil schedule: got limit %d, want none", got)
 	}
-	return o, fmt.Sprintf("%x", h.Sum(nil)), nil
 }
 
-func readFile(ctx context.Context, obj *Object, sha string, chunk, concur int) error {
-	r := obj.NewReader(ctx)
-	r.ChunkSize = chunk
-	r.ConcurrentDownloads = concur
-	h := sha1.New()
-	if _, err := io.Copy(h, r); err != nil {
-		return err
+func TestBandwidthWait(t *testing.T) {
+	at := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	var waits []time.Duration
+	oldNow, oldAfter := now, after
+	now = func() time.Time { return at }
+	after = func(d time.Duration) <-chan time.Time {
+		waits = append(waits, d)
+		ch := make(chan time.Time, 1)
+		ch <- at
+		return ch
 	}
-	if err := r.Close(); err != nil {
-		return err
+	defer func() { now, after = oldNow, oldAfter }()
+
+	ctx := context.Background()
+	bw := NewLimiter(&BandwidthSchedule{Default: 1000})
+	for i := 0; i < 3; i++ {
+		if err := bw.Wait(ctx, 500); err != nil {
+			t.Fatal(err)
+		}
 	}
-	rsha := fmt.Sprintf("%x", h.Sum(nil))
-	if sha != rsha {
-		return fmt.Errorf("bad hash: got %s, want %s", rsha, sha)
+	want := []time.Duration{500 * time.Millisecond, time.Second}
+	if !reflect.DeepEqual(waits, want) {
+		t.Errorf("waits: got %v, want %v", waits, want)
+	}
+
+	// A read through a meteredReader is charged, and kept to maxBurst.
+	waits = nil
+	bw = NewLimiter(&BandwidthSchedule{Default: maxBurst})
+	mr := &meteredReader{r: noopResetter{bytes.NewReader(make([]byte, 3*maxBurst))}, ctx: ctx, bw: bw}
+	n, err := mr.Read(make([]byte, 2*maxBurst))
+	if err != nil || n != maxBurst {
+		t.Errorf("Read: got %d, %v; want %d, nil", n, err, maxBurst)
+	}
+	if _, err := mr.Read(make([]byte, maxBurst)); err != nil {
+		t.Fatal(err)
+	}
+	if want := []time.Duration{time.Second}; !reflect.DeepEqual(waits, want) {
+		t.Errorf("meteredReader waits: got %v, want %v", waits, want)
+	}
+
+	// So is a read through a Limiter's Reader.
+	waits = nil
+	bw = NewLimiter(&BandwidthSchedule{Default: maxBurst})
+	lr := bw.Reader(ctx, bytes.NewReader(make([]byte, 3*maxBurst)))
+	for i := 0; i < 2; i++ {
+		if n, err := lr.Read(make([]byte, 2*maxBurst)); err != nil || n != maxBurst {
+			t.Errorf("Limiter Read: got %d, %v; want %d, nil", n, err, maxBurst)
+		}
+	}
+	if want := []time.Duration{time.Second}; !reflect.DeepEqual(waits, want) {
+		t.Errorf("Limiter waits: got %v, want %v", waits, want)
+	}
+	var unlimited *Limiter
+	if r := bytes.NewReader(nil); unlimited.Reader(ctx, r) != io.Reader(r) {
+		t.Errorf("nil Limiter: Reader wrapped its reader")
 	}
-	return nil
 }
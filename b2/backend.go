@@ -16,9 +16,12 @@ package b2
 
 import (
 	"context"
+	"errors"
 	"io"
-	"math/rand"
+	"sync"
 	"time"
+
+	"github.com/kurin/blazer/internal/blog"
 )
 
 // This file wraps the baseline interfaces with backoff and retry semantics.
@@ -28,18 +31,37 @@ type beRootInterface interface {
 	reauth(error) bool
 	transient(error) bool
 	reupload(error) bool
+	statusCode(error) int
+	errorCode(error) string
+	retryPolicy() RetryPolicy
+	capabilities() []string
+	allowedBucket() (string, string)
+	allowedPrefix() string
+	endpoints() (string, string)
+	bucket(string, string) beBucketInterface
 	authorizeAccount(context.Context, string, string, clientOptions) error
 	reauthorizeAccount(context.Context) error
-	createBucket(ctx context.Context, name, btype string, info map[string]string, rules []LifecycleRule) (beBucketInterface, error)
+	ping(context.Context) error
+	createBucket(ctx context.Context, name, btype string, info map[string]string, rules []LifecycleRule, cors []CORSRule) (beBucketInterface, error)
 	listBuckets(context.Context) ([]beBucketInterface, error)
 	createKey(context.Context, string, []string, time.Duration, string, string) (beKeyInterface, error)
 	listKeys(context.Context, int, string) ([]beKeyInterface, string, error)
+	call(context.Context, int, string, interface{}, interface{}) error
 }
 
 type beRoot struct {
 	account, key string
 	b2i          b2RootInterface
 	options      clientOptions
+
+	amu     sync.Mutex
+	authing *authCall // the reauthorization in progress, if any
+}
+
+// An authCall is a reauthorization that any number of callers may wait on.
+type authCall struct {
+	done chan struct{}
+	err  error
 }
 
 type beBucketInterface interface {
@@ -55,6 +77,7 @@ type beBucketInterface interface {
 	listFileVersions(context.Context, int, string, string, string, string) ([]beFileInterface, string, string, error)
 	listUnfinishedLargeFiles(context.Context, int, string) ([]beFileInterface, string, error)
 	downloadFileByName(context.Context, string, int64, int64) (beFileReaderInterface, error)
+	downloadFileByID(context.Context, string, int64, int64) (beFileReaderInterface, error)
 	hideFile(context.Context, string) (beFileInterface, error)
 	getDownloadAuthorization(context.Context, string, time.Duration, string) (string, error)
 	baseURL() string
@@ -77,10 +100,12 @@ type beURL struct {
 
 type beFileInterface interface {
 	name() string
+	id() string
 	size() int64
 	timestamp() time.Time
 	status() string
 	deleteFileVersion(context.Context) error
+	copyFile(ctx context.Context, name, bucketID string, replace bool, contentType string, info map[string]string) (beFileInterface, error)
 	getFileInfo(context.Context) (beFileInfoInterface, error)
 	listParts(context.Context, int, int) ([]beFilePartInterface, int, error)
 	compileParts(int64, map[int]string) beLargeFileInterface
@@ -95,6 +120,9 @@ type beFile struct {
 type beLargeFileInterface interface {
 	finishLargeFile(context.Context) (beFileInterface, error)
 	getUploadPartURL(context.Context) (beFileChunkInterface, error)
+	copyPart(ctx context.Context, id string, offset, size int64, index int) (string, error)
+	cancel(context.Context) error
+	id() string
 }
 
 type beLargeFile struct {
@@ -125,6 +153,8 @@ type beFileReader struct {
 
 type beFileInfoInterface interface {
 	stats() (string, string, int64, string, map[string]string, string, time.Time)
+	lock() ObjectLock
+	unknown() map[string]interface{}
 }
 
 type beFilePartInterface interface {
@@ -146,6 +176,8 @@ type beFileInfo struct {
 	info   map[string]string
 	status string
 	stamp  time.Time
+	olock  ObjectLock
+	extra  map[string]interface{}
 }
 
 type beKeyInterface interface {
@@ -166,29 +198,92 @@ func (r *beRoot) backoff(err error) time.Duration { return r.b2i.backoff(err) }
 func (r *beRoot) reauth(err error) bool           { return r.b2i.reauth(err) }
 func (r *beRoot) reupload(err error) bool         { return r.b2i.reupload(err) }
 func (r *beRoot) transient(err error) bool        { return r.b2i.transient(err) }
+func (r *beRoot) statusCode(err error) int        { return r.b2i.statusCode(err) }
+func (r *beRoot) errorCode(err error) string      { return r.b2i.errorCode(err) }
+func (r *beRoot) capabilities() []string          { return r.b2i.capabilities() }
+
+func (r *beRoot) retryPolicy() RetryPolicy {
+	if r.options.retry == nil {
+		return BalancedRetries
+	}
+	return *r.options.retry
+}
+func (r *beRoot) allowedBucket() (string, string) { return r.b2i.allowedBucket() }
+func (r *beRoot) allowedPrefix() string           { return r.b2i.allowedPrefix() }
+func (r *beRoot) endpoints() (string, string)     { return r.b2i.endpoints() }
+
+func (r *beRoot) bucket(id, name string) beBucketInterface {
+	return &beBucket{
+		b2bucket: r.b2i.bucket(id, name),
+		ri:       r,
+	}
+}
 
 func (r *beRoot) authorizeAccount(ctx context.Context, account, key string, c clientOptions) error {
+	// Set options first, so that the client's retry policy applies to its
+	// first authorization too.
+	r.options = c
 	f := func() error {
 		if err := r.b2i.authorizeAccount(ctx, account, key, c); err != nil {
 			return err
 		}
 		r.account = account
 		r.key = key
-		r.options = c
 		return nil
 	}
 	return withBackoff(ctx, r, f)
 }
 
+// reauthorizeAccount replaces the client's expired tokens.  When a token
+// expires, every request in flight fails at once; they all wait on the same
+// reauthorization rather than each making their own.
 func (r *beRoot) reauthorizeAccount(ctx context.Context) error {
-	return r.authorizeAccount(ctx, r.account, r.key, r.options)
+	for {
+		r.amu.Lock()
+		c := r.authing
+		if c == nil {
+			c = &authCall{done: make(chan struct{})}
+			r.authing = c
+			r.amu.Unlock()
+			c.err = withBackoff(ctx, r, func() error {
+				return r.b2i.authorizeAccount(ctx, r.account, r.key, r.options)
+			})
+			r.amu.Lock()
+			r.authing = nil
+			r.amu.Unlock()
+			close(c.done)
+			return c.err
+		}
+		r.amu.Unlock()
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if isContextErr(c.err) && ctx.Err() == nil {
+			// The reauthorization was abandoned by its own caller, not
+			// refused; make another, or wait on whoever else has.
+			continue
+		}
+		return c.err
+	}
 }
 
-func (r *beRoot) createBucket(ctx context.Context, name, btype string, info map[string]string, rules []LifecycleRule) (beBucketInterface, error) {
+func isContextErr(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// ping reauthorizes once, without retrying, so that the caller sees the first
+// error.
+func (r *beRoot) ping(ctx context.Context) error {
+	return r.b2i.authorizeAccount(ctx, r.account, r.key, r.options)
+}
+
+func (r *beRoot) createBucket(ctx context.Context, name, btype string, info map[string]string, rules []LifecycleRule, cors []CORSRule) (beBucketInterface, error) {
 	var bi beBucketInterface
 	f := func() error {
 		g := func() error {
-			bucket, err := r.b2i.createBucket(ctx, name, btype, info, rules)
+			bucket, err := r.b2i.createBucket(ctx, name, btype, info, rules, cors)
 			if err != nil {
 				return err
 			}
@@ -278,6 +373,16 @@ func (r *beRoot) listKeys(ctx context.Context, max int, next string) ([]beKeyInt
 	return keys, cur, nil
 }
 
+func (r *beRoot) call(ctx context.Context, version int, method string, req, resp interface{}) error {
+	f := func() error {
+		g := func() error {
+			return r.b2i.call(ctx, version, method, req, resp)
+		}
+		return withReauth(ctx, r, g)
+	}
+	return withBackoff(ctx, r, f)
+}
+
 func (b *beBucket) name() string        { return b.b2bucket.name() }
 func (b *beBucket) btype() BucketType   { return BucketType(b.b2bucket.btype()) }
 func (b *beBucket) attrs() *BucketAttrs { return b.b2bucket.attrs() }
@@ -347,6 +452,18 @@ func (b *beBucket) startLargeFile(ctx context.Context, name, ct string, info map
 	return file, nil
 }
 
+// wrapFiles wraps a page of listed files.
+func (b *beBucket) wrapFiles(fs []b2FileInterface) []beFileInterface {
+	files := make([]beFileInterface, len(fs))
+	for i, f := range fs {
+		files[i] = &beFile{
+			b2file: f,
+			ri:     b.ri,
+		}
+	}
+	return files
+}
+
 func (b *beBucket) listFileNames(ctx context.Context, count int, continuation, prefix, delimiter string) ([]beFileInterface, string, error) {
 	var cont string
 	var files []beFileInterface
@@ -357,12 +474,7 @@ func (b *beBucket) listFileNames(ctx context.Context, count int, continuation, p
 				return err
 			}
 			cont = c
-			for _, f := range fs {
-				files = append(files, &beFile{
-					b2file: f,
-					ri:     b.ri,
-				})
-			}
+			files = b.wrapFiles(fs)
 			return nil
 		}
 		return withReauth(ctx, b.ri, g)
@@ -384,12 +496,7 @@ func (b *beBucket) listFileVersions(ctx context.Context, count int, nextName, ne
 			}
 			name = n
 			id = d
-			for _, f := range fs {
-				files = append(files, &beFile{
-					b2file: f,
-					ri:     b.ri,
-				})
-			}
+			files = b.wrapFiles(fs)
 			return nil
 		}
 		return withReauth(ctx, b.ri, g)
@@ -410,12 +517,7 @@ func (b *beBucket) listUnfinishedLargeFiles(ctx context.Context, count int, cont
 				return err
 			}
 			cont = c
-			for _, f := range fs {
-				files = append(files, &beFile{
-					b2file: f,
-					ri:     b.ri,
-				})
-			}
+			files = b.wrapFiles(fs)
 			return nil
 		}
 		return withReauth(ctx, b.ri, g)
@@ -427,10 +529,22 @@ func (b *beBucket) listUnfinishedLargeFiles(ctx context.Context, count int, cont
 }
 
 func (b *beBucket) downloadFileByName(ctx context.Context, name string, offset, size int64) (beFileReaderInterface, error) {
+	return b.download(ctx, func() (b2FileReaderInterface, error) {
+		return b.b2bucket.downloadFileByName(ctx, name, offset, size)
+	})
+}
+
+func (b *beBucket) downloadFileByID(ctx context.Context, id string, offset, size int64) (beFileReaderInterface, error) {
+	return b.download(ctx, func() (b2FileReaderInterface, error) {
+		return b.b2bucket.downloadFileByID(ctx, id, offset, size)
+	})
+}
+
+func (b *beBucket) download(ctx context.Context, dl func() (b2FileReaderInterface, error)) (beFileReaderInterface, error) {
 	var reader beFileReaderInterface
 	f := func() error {
 		g := func() error {
-			fr, err := b.b2bucket.downloadFileByName(ctx, name, offset, size)
+			fr, err := dl()
 			if err != nil {
 				return err
 			}
@@ -533,6 +647,28 @@ func (b *beFile) deleteFileVersion(ctx context.Context) error {
 	return withBackoff(ctx, b.ri, f)
 }
 
+func (b *beFile) copyFile(ctx context.Context, name, bucketID string, replace bool, contentType string, info map[string]string) (beFileInterface, error) {
+	var file beFileInterface
+	f := func() error {
+		g := func() error {
+			f, err := b.b2file.copyFile(ctx, name, bucketID, replace, contentType, info)
+			if err != nil {
+				return err
+			}
+			file = &beFile{
+				b2file: f,
+				ri:     b.ri,
+			}
+			return nil
+		}
+		return withReauth(ctx, b.ri, g)
+	}
+	if err := withBackoff(ctx, b.ri, f); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
 func (b *beFile) size() int64 {
 	return b.b2file.size()
 }
@@ -541,6 +677,10 @@ func (b *beFile) name() string {
 	return b.b2file.name()
 }
 
+func (b *beFile) id() string {
+	return b.b2file.id()
+}
+
 func (b *beFile) timestamp() time.Time {
 	return b.b2file.timestamp()
 }
@@ -566,6 +706,8 @@ func (b *beFile) getFileInfo(ctx context.Context) (beFileInfoInterface, error) {
 				info:   info,
 				status: status,
 				stamp:  stamp,
+				olock:  fi.lock(),
+				extra:  fi.unknown(),
 			}
 			return nil
 		}
@@ -654,6 +796,37 @@ func (b *beLargeFile) finishLargeFile(ctx context.Context) (beFileInterface, err
 	return file, nil
 }
 
+func (b *beLargeFile) copyPart(ctx context.Context, id string, offset, size int64, index int) (string, error) {
+	var sha1 string
+	f := func() error {
+		g := func() error {
+			s, err := b.b2largeFile.copyPart(ctx, id, offset, size, index)
+			if err != nil {
+				return err
+			}
+			sha1 = s
+			return nil
+		}
+		return withReauth(ctx, b.ri, g)
+	}
+	if err := withBackoff(ctx, b.ri, f); err != nil {
+		return "", err
+	}
+	return sha1, nil
+}
+
+func (b *beLargeFile) cancel(ctx context.Context) error {
+	f := func() error {
+		g := func() error {
+			return b.b2largeFile.cancel(ctx)
+		}
+		return withReauth(ctx, b.ri, g)
+	}
+	return withBackoff(ctx, b.ri, f)
+}
+
+func (b *beLargeFile) id() string { return b.b2largeFile.id() }
+
 func (b *beFileChunk) reload(ctx context.Context) error {
 	f := func() error {
 		g := func() error {
@@ -703,6 +876,9 @@ func (b *beFileInfo) stats() (string, string, int64, string, map[string]string,
 	return b.name, b.sha, b.size, b.ct, b.info, b.status, b.stamp
 }
 
+func (b *beFileInfo) lock() ObjectLock                { return b.olock }
+func (b *beFileInfo) unknown() map[string]interface{} { return b.extra }
+
 func (b *beFilePart) number() int  { return b.b2filePart.number() }
 func (b *beFilePart) sha1() string { return b.b2filePart.sha1() }
 func (b *beFilePart) size() int64  { return b.b2filePart.size() }
@@ -714,39 +890,31 @@ func (b *beKey) expires() time.Time            { return b.k.expires() }
 func (b *beKey) secret() string                { return b.k.secret() }
 func (b *beKey) id() string                    { return b.k.id() }
 
-func jitter(d time.Duration) time.Duration {
-	f := float64(d)
-	f /= 50
-	f += f * (rand.Float64() - 0.5)
-	return time.Duration(f)
-}
-
-func getBackoff(d time.Duration) time.Duration {
-	if d > 30*time.Second {
-		return 30*time.Second + jitter(d)
-	}
-	return d*2 + jitter(d*2)
-}
-
-var after = time.After
+// after and now are the package's only sources of time, so that tests can
+// replace them to check retry and expiry behavior without sleeping.
+var (
+	after = time.After
+	now   = time.Now
+)
 
 func withBackoff(ctx context.Context, ri beRootInterface, f func() error) error {
-	backoff := 500 * time.Millisecond
+	rt := retrier{p: retries(ctx, ri)}
 	for {
 		err := f()
 		if !ri.transient(err) {
 			return err
 		}
-		bo := ri.backoff(err)
-		if bo > 0 {
-			backoff = bo
-		} else {
-			backoff = getBackoff(backoff)
+		wait, ok := rt.next(ri.backoff(err))
+		if !ok {
+			return err
 		}
 		select {
 		case <-ctx.Done():
+			// The caller only sees the context's error, so leave a trace
+			// of what was being retried.
+			blog.V(1).Infof("b2: giving up after %d attempts: %v; last error: %v", rt.attempts, ctx.Err(), err)
 			return ctx.Err()
-		case <-after(backoff):
+		case <-after(wait):
 		}
 	}
 }
@@ -0,0 +1,255 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A BandwidthPeriod is a part of each day with its own bandwidth limit.
+type BandwidthPeriod struct {
+	// Start and End are the times of day, as offsets from midnight, at
+	// which the period begins and ends.  If End is not after Start, the
+	// period runs past midnight.
+	Start, End time.Duration
+
+	// BytesPerSecond is the limit during the period.  0 means "no limit".
+	BytesPerSecond int64
+}
+
+func (p BandwidthPeriod) contains(d time.Duration) bool {
+	if p.Start < p.End {
+		return p.Start <= d && d < p.End
+	}
+	return d >= p.Start || d < p.End
+}
+
+// A BandwidthSchedule limits bandwidth by time of day, e.g. to 5MB/s during
+// office hours and not at all overnight.
+type BandwidthSchedule struct {
+	// Periods are consulted in order, and the first that contains the
+	// current time of day sets the limit.
+	Periods []BandwidthPeriod
+
+	// Default is the limit outside every period.  0 means "no limit".
+	Default int64
+
+	// Location is the time zone that the periods' times of day are in.  If
+	// nil, the local time zone is used.
+	Location *time.Location
+}
+
+// Limit returns the bandwidth limit, in bytes per second, at t.  0 means "no
+// limit".
+func (s *BandwidthSchedule) Limit(t time.Time) int64 {
+	if s == nil {
+		return 0
+	}
+	if s.Location != nil {
+		t = t.In(s.Location)
+	} else {
+		t = t.Local()
+	}
+	h, m, sec := t.Clock()
+	d := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(sec)*time.Second + time.Duration(t.Nanosecond())
+	for _, p := range s.Periods {
+		if p.contains(d) {
+			return p.BytesPerSecond
+		}
+	}
+	return s.Default
+}
+
+// ParseBandwidthSchedule parses a schedule written as a comma-separated list
+// of periods, each of the form "HH:MM-HH:MM=rate", and optionally one bare
+// rate for the rest of the day.  A rate is a number of bytes per second with
+// an optional K, M, or G suffix (for powers of 1000), or "unlimited".  For
+// example,
+//
+//	09:00-18:00=5M,18:00-22:00=20M,unlimited
+//
+// limits bandwidth to 5MB/s from 9am to 6pm and to 20MB/s in the evening, and
+// does not limit it overnight.  Times are in the local time zone.
+func ParseBandwidthSchedule(s string) (*BandwidthSchedule, error) {
+	sched := &BandwidthSchedule{}
+	var sawDefault bool
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		eq := strings.Index(field, "=")
+		if eq < 0 {
+			if sawDefault {
+				return nil, fmt.Errorf("b2: bandwidth schedule %q: more than one default rate", s)
+			}
+			rate, err := parseRate(field)
+			if err != nil {
+				return nil, fmt.Errorf("b2: bandwidth schedule %q: %v", s, err)
+			}
+			sched.Default, sawDefault = rate, true
+			continue
+		}
+		span := strings.SplitN(field[:eq], "-", 2)
+		if len(span) != 2 {
+			return nil, fmt.Errorf("b2: bandwidth schedule %q: %q is not a range of times", s, field[:eq])
+		}
+		start, err := parseTimeOfDay(span[0])
+		if err != nil {
+			return nil, fmt.Errorf("b2: bandwidth schedule %q: %v", s, err)
+		}
+		end, err := parseTimeOfDay(span[1])
+		if err != nil {
+			return nil, fmt.Errorf("b2: bandwidth schedule %q: %v", s, err)
+		}
+		rate, err := parseRate(field[eq+1:])
+		if err != nil {
+			return nil, fmt.Errorf("b2: bandwidth schedule %q: %v", s, err)
+		}
+		sched.Periods = append(sched.Periods, BandwidthPeriod{Start: start, End: end, BytesPerSecond: rate})
+	}
+	return sched, nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a time of day (HH:MM)", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func parseRate(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "unlimited" {
+		return 0, nil
+	}
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1e3
+	case strings.HasSuffix(s, "M"):
+		mult = 1e6
+	case strings.HasSuffix(s, "G"):
+		mult = 1e9
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a rate", s)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+// Bandwidth limits the data the client sends and receives, across all of its
+// Writers, Readers, and BlockReaders, according to s.  Uploads and downloads
+// share the limit.  The schedule is consulted as data is transferred, so a
+// change of period takes effect within moments.
+func Bandwidth(s *BandwidthSchedule) ClientOption {
+	return func(c *clientOptions) {
+		c.bandwidth = NewLimiter(s)
+	}
+}
+
+// A Limiter spreads transfers across time so that, together, they keep to a
+// schedule.  The Bandwidth option gives a client one for all of its
+// transfers; a Limiter of one's own can instead limit just some of them, by
+// reading their data through its Reader.  A nil Limiter is unlimited.
+type Limiter struct {
+	sched *BandwidthSchedule
+
+	mu   sync.Mutex
+	next time.Time // when the bytes already granted will have been sent
+}
+
+// maxBurst bounds each read of a limited transfer, so that one large read
+// does not use a whole second's allowance at once.
+const maxBurst = 32 << 10
+
+// NewLimiter returns a Limiter that keeps to s.
+func NewLimiter(s *BandwidthSchedule) *Limiter {
+	return &Limiter{sched: s}
+}
+
+// Wait blocks until n more bytes may be transferred, or until ctx is done, in
+// which case it returns ctx.Err().
+func (l *Limiter) Wait(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	t := now()
+	rate := l.sched.Limit(t)
+	if rate <= 0 {
+		l.next = t
+		l.mu.Unlock()
+		return nil
+	}
+	if l.next.Before(t) {
+		l.next = t
+	}
+	at := l.next
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / rate))
+	l.mu.Unlock()
+	d := at.Sub(t)
+	if d <= 0 {
+		return nil
+	}
+	select {
+	case <-after(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Reader returns a reader whose reads from r keep to the limit, until ctx is
+// done.  Large reads are shortened, as they are for a client's transfers.
+func (l *Limiter) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{ctx: ctx, r: r, l: l}
+}
+
+type limitedReader struct {
+	ctx context.Context
+	r   io.Reader
+	l   *Limiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > maxBurst {
+		p = p[:maxBurst]
+	}
+	n, err := lr.r.Read(p)
+	if werr := lr.l.Wait(lr.ctx, n); werr != nil && err == nil {
+		err = werr
+	}
+	return n, err
+}
+
+// bandwidth returns the client's limiter, if it has one.
+func (c *Client) bandwidth() *Limiter {
+	if c == nil {
+		return nil
+	}
+	return c.opts.bandwidth
+}
@@ -26,16 +26,26 @@ import (
 // This file wraps the base package in a thin layer, for testing.  It should be
 // the only file in b2 that imports base.
 
+const defaultAPIBase = base.APIBase
+
 type b2RootInterface interface {
 	authorizeAccount(context.Context, string, string, clientOptions) error
 	transient(error) bool
 	backoff(error) time.Duration
 	reauth(error) bool
 	reupload(error) bool
-	createBucket(context.Context, string, string, map[string]string, []LifecycleRule) (b2BucketInterface, error)
+	statusCode(error) int
+	errorCode(error) string
+	capabilities() []string
+	allowedBucket() (string, string)
+	allowedPrefix() string
+	endpoints() (string, string)
+	bucket(string, string) b2BucketInterface
+	createBucket(context.Context, string, string, map[string]string, []LifecycleRule, []CORSRule) (b2BucketInterface, error)
 	listBuckets(context.Context) ([]b2BucketInterface, error)
 	createKey(context.Context, string, []string, time.Duration, string, string) (b2KeyInterface, error)
 	listKeys(context.Context, int, string) ([]b2KeyInterface, string, error)
+	call(context.Context, int, string, interface{}, interface{}) error
 }
 
 type b2BucketInterface interface {
@@ -51,6 +61,7 @@ type b2BucketInterface interface {
 	listFileVersions(context.Context, int, string, string, string, string) ([]b2FileInterface, string, string, error)
 	listUnfinishedLargeFiles(context.Context, int, string) ([]b2FileInterface, string, error)
 	downloadFileByName(context.Context, string, int64, int64) (b2FileReaderInterface, error)
+	downloadFileByID(context.Context, string, int64, int64) (b2FileReaderInterface, error)
 	hideFile(context.Context, string) (b2FileInterface, error)
 	getDownloadAuthorization(context.Context, string, time.Duration, string) (string, error)
 	baseURL() string
@@ -64,10 +75,12 @@ type b2URLInterface interface {
 
 type b2FileInterface interface {
 	name() string
+	id() string
 	size() int64
 	timestamp() time.Time
 	status() string
 	deleteFileVersion(context.Context) error
+	copyFile(ctx context.Context, name, bucketID string, replace bool, contentType string, info map[string]string) (b2FileInterface, error)
 	getFileInfo(context.Context) (b2FileInfoInterface, error)
 	listParts(context.Context, int, int) ([]b2FilePartInterface, int, error)
 	compileParts(int64, map[int]string) b2LargeFileInterface
@@ -76,6 +89,9 @@ type b2FileInterface interface {
 type b2LargeFileInterface interface {
 	finishLargeFile(context.Context) (b2FileInterface, error)
 	getUploadPartURL(context.Context) (b2FileChunkInterface, error)
+	copyPart(ctx context.Context, id string, offset, size int64, index int) (string, error)
+	cancel(context.Context) error
+	id() string
 }
 
 type b2FileChunkInterface interface {
@@ -91,6 +107,8 @@ type b2FileReaderInterface interface {
 
 type b2FileInfoInterface interface {
 	stats() (string, string, int64, string, map[string]string, string, time.Time) // bleck
+	lock() ObjectLock
+	unknown() map[string]interface{}
 }
 
 type b2FilePartInterface interface {
@@ -170,6 +188,9 @@ func (b *b2Root) authorizeAccount(ctx context.Context, account, key string, c cl
 	for _, agent := range c.userAgents {
 		aopts = append(aopts, base.UserAgent(agent))
 	}
+	if c.keepUnknown {
+		aopts = append(aopts, base.KeepUnknownFields())
+	}
 	nb, err := base.AuthorizeAccount(ctx, account, key, aopts...)
 	if err != nil {
 		return err
@@ -189,6 +210,40 @@ func (*b2Root) backoff(err error) time.Duration {
 	return base.Backoff(err)
 }
 
+// errorDetails extracts the status and code that base attaches to B2 errors.
+func errorDetails(err error) (*Error, bool) {
+	status, msg := base.Code(err)
+	if status == 0 {
+		return nil, false
+	}
+	e := &Error{
+		Status:  status,
+		Code:    base.ErrorCode(err),
+		Message: msg,
+		err:     err,
+	}
+	if ri, ok := base.Request(err); ok {
+		e.Method = ri.Method
+	}
+	return e, true
+}
+
+// requestInfo extracts the request details that base attaches to B2 errors.
+func requestInfo(err error) (*RequestInfo, bool) {
+	ri, ok := base.Request(err)
+	if !ok {
+		return nil, false
+	}
+	code, _ := base.Code(err)
+	return &RequestInfo{
+		Method:  ri.Method,
+		Host:    ri.Host,
+		ID:      ri.ID,
+		Status:  code,
+		Headers: ri.Headers,
+	}, true
+}
+
 func (*b2Root) reauth(err error) bool {
 	return base.Action(err) == base.ReAuthenticate
 }
@@ -201,7 +256,36 @@ func (*b2Root) transient(err error) bool {
 	return base.Action(err) == base.Retry
 }
 
-func (b *b2Root) createBucket(ctx context.Context, name, btype string, info map[string]string, rules []LifecycleRule) (b2BucketInterface, error) {
+func (b *b2Root) capabilities() []string {
+	return b.b.Capabilities()
+}
+
+func (b *b2Root) allowedBucket() (string, string) {
+	return b.b.AllowedBucket()
+}
+
+func (b *b2Root) allowedPrefix() string {
+	return b.b.AllowedPrefix()
+}
+
+func (b *b2Root) endpoints() (string, string) {
+	return b.b.Endpoints()
+}
+
+func (b *b2Root) bucket(id, name string) b2BucketInterface {
+	return &b2Bucket{b.b.Bucket(id, name)}
+}
+
+func (*b2Root) statusCode(err error) int {
+	code, _ := base.Code(err)
+	return code
+}
+
+func (*b2Root) errorCode(err error) string {
+	return base.ErrorCode(err)
+}
+
+func (b *b2Root) createBucket(ctx context.Context, name, btype string, info map[string]string, rules []LifecycleRule, cors []CORSRule) (b2BucketInterface, error) {
 	var baseRules []base.LifecycleRule
 	for _, rule := range rules {
 		baseRules = append(baseRules, base.LifecycleRule{
@@ -210,7 +294,7 @@ func (b *b2Root) createBucket(ctx context.Context, name, btype string, info map[
 			Prefix:                 rule.Prefix,
 		})
 	}
-	bucket, err := b.b.CreateBucket(ctx, name, btype, info, baseRules)
+	bucket, err := b.b.CreateBucketWithCORS(ctx, name, btype, info, baseRules, corsToBase(cors))
 	if err != nil {
 		return nil, err
 	}
@@ -250,6 +334,9 @@ func (b *b2Bucket) updateBucket(ctx context.Context, attrs *BucketAttrs) error {
 		}
 		b.b.LifecycleRules = rules
 	}
+	if attrs.CORSRules != nil {
+		b.b.CORSRules = corsToBase(attrs.CORSRules)
+	}
 	newBucket, err := b.b.Update(ctx)
 	if err == nil {
 		b.b = newBucket
@@ -284,10 +371,24 @@ func (b *b2Root) listKeys(ctx context.Context, max int, next string) ([]b2KeyInt
 	return k, next, nil
 }
 
+func (b *b2Root) call(ctx context.Context, version int, method string, req, resp interface{}) error {
+	return b.b.Call(ctx, version, method, req, resp)
+}
+
 func (b *b2Bucket) deleteBucket(ctx context.Context) error {
 	return b.b.DeleteBucket(ctx)
 }
 
+// corsToBase converts rules to their base form.  The result is never nil, so
+// that updating with an empty slice removes a bucket's rules.
+func corsToBase(rules []CORSRule) []base.CORSRule {
+	baseRules := []base.CORSRule{}
+	for _, rule := range rules {
+		baseRules = append(baseRules, base.CORSRule(rule))
+	}
+	return baseRules
+}
+
 func (b *b2Bucket) name() string {
 	return b.b.Name
 }
@@ -305,10 +406,19 @@ func (b *b2Bucket) attrs() *BucketAttrs {
 			Prefix:                 rule.Prefix,
 		})
 	}
+	var cors []CORSRule
+	for _, rule := range b.b.CORSRules {
+		cors = append(cors, CORSRule(rule))
+	}
 	return &BucketAttrs{
+		Name:           b.b.Name,
+		ID:             b.b.ID,
+		Revision:       b.b.Revision(),
 		LifecycleRules: rules,
+		CORSRules:      cors,
 		Info:           b.b.Info,
 		Type:           BucketType(b.b.Type),
+		Unknown:        b.b.Unknown,
 	}
 }
 
@@ -330,16 +440,21 @@ func (b *b2Bucket) startLargeFile(ctx context.Context, name, ct string, info map
 	return &b2LargeFile{lf}, nil
 }
 
+// wrapFiles wraps a page of listed files.
+func wrapFiles(fs []*base.File) []b2FileInterface {
+	files := make([]b2FileInterface, len(fs))
+	for i, f := range fs {
+		files[i] = &b2File{f}
+	}
+	return files
+}
+
 func (b *b2Bucket) listFileNames(ctx context.Context, count int, continuation, prefix, delimiter string) ([]b2FileInterface, string, error) {
 	fs, c, err := b.b.ListFileNames(ctx, count, continuation, prefix, delimiter)
 	if err != nil {
 		return nil, "", err
 	}
-	var files []b2FileInterface
-	for _, f := range fs {
-		files = append(files, &b2File{f})
-	}
-	return files, c, nil
+	return wrapFiles(fs), c, nil
 }
 
 func (b *b2Bucket) listFileVersions(ctx context.Context, count int, nextName, nextID, prefix, delimiter string) ([]b2FileInterface, string, string, error) {
@@ -347,11 +462,7 @@ func (b *b2Bucket) listFileVersions(ctx context.Context, count int, nextName, ne
 	if err != nil {
 		return nil, "", "", err
 	}
-	var files []b2FileInterface
-	for _, f := range fs {
-		files = append(files, &b2File{f})
-	}
-	return files, name, id, nil
+	return wrapFiles(fs), name, id, nil
 }
 
 func (b *b2Bucket) listUnfinishedLargeFiles(ctx context.Context, count int, continuation string) ([]b2FileInterface, string, error) {
@@ -359,15 +470,18 @@ func (b *b2Bucket) listUnfinishedLargeFiles(ctx context.Context, count int, cont
 	if err != nil {
 		return nil, "", err
 	}
-	var files []b2FileInterface
-	for _, f := range fs {
-		files = append(files, &b2File{f})
-	}
-	return files, cont, nil
+	return wrapFiles(fs), cont, nil
 }
 
 func (b *b2Bucket) downloadFileByName(ctx context.Context, name string, offset, size int64) (b2FileReaderInterface, error) {
-	fr, err := b.b.DownloadFileByName(ctx, name, offset, size)
+	return b.download(b.b.DownloadFileByName(ctx, name, offset, size))
+}
+
+func (b *b2Bucket) downloadFileByID(ctx context.Context, id string, offset, size int64) (b2FileReaderInterface, error) {
+	return b.download(b.b.DownloadFileByID(ctx, id, offset, size))
+}
+
+func (b *b2Bucket) download(fr *base.FileReader, err error) (b2FileReaderInterface, error) {
 	if err != nil {
 		code, _ := base.Code(err)
 		switch code {
@@ -415,10 +529,22 @@ func (b *b2File) deleteFileVersion(ctx context.Context) error {
 	return b.b.DeleteFileVersion(ctx)
 }
 
+func (b *b2File) copyFile(ctx context.Context, name, bucketID string, replace bool, contentType string, info map[string]string) (b2FileInterface, error) {
+	f, err := b.b.CopyFile(ctx, name, bucketID, replace, contentType, info)
+	if err != nil {
+		return nil, err
+	}
+	return &b2File{f}, nil
+}
+
 func (b *b2File) name() string {
 	return b.b.Name
 }
 
+func (b *b2File) id() string {
+	return b.b.ID()
+}
+
 func (b *b2File) size() int64 {
 	return b.b.Size
 }
@@ -474,6 +600,16 @@ func (b *b2LargeFile) getUploadPartURL(ctx context.Context) (b2FileChunkInterfac
 	return &b2FileChunk{c}, nil
 }
 
+func (b *b2LargeFile) copyPart(ctx context.Context, id string, offset, size int64, index int) (string, error) {
+	return b.b.CopyPart(ctx, id, offset, size, index)
+}
+
+func (b *b2LargeFile) cancel(ctx context.Context) error {
+	return b.b.CancelLargeFile(ctx)
+}
+
+func (b *b2LargeFile) id() string { return b.b.ID() }
+
 func (b *b2FileChunk) reload(ctx context.Context) error {
 	return b.b.Reload(ctx)
 }
@@ -500,6 +636,19 @@ func (b *b2FileInfo) stats() (string, string, int64, string, map[string]string,
 	return b.b.Name, b.b.SHA1, b.b.Size, b.b.ContentType, b.b.Info, b.b.Status, b.b.Timestamp
 }
 
+func (b *b2FileInfo) lock() ObjectLock {
+	l := b.b.Lock
+	return ObjectLock{
+		RetentionKnown: l.RetentionKnown,
+		Mode:           RetentionMode(l.Mode),
+		RetainUntil:    l.RetainUntil,
+		LegalHoldKnown: l.LegalHoldKnown,
+		LegalHold:      l.LegalHold,
+	}
+}
+
+func (b *b2FileInfo) unknown() map[string]interface{} { return b.b.Unknown }
+
 func (b *b2FilePart) number() int  { return b.b.Number }
 func (b *b2FilePart) sha1() string { return b.b.SHA1 }
 func (b *b2FilePart) size() int64  { return b.b.Size }
@@ -0,0 +1,216 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// BlockReader provides random access to an object, for libraries that need an
+// io.ReaderAt or io.ReadSeeker, such as archive/zip.  The object is fetched
+// in blocks with range requests, and recently used blocks are cached.
+//
+// A BlockReader reads the version of the object that was current when it was
+// created, even if the object is overwritten.  ReadAt may be called
+// concurrently, but Read and Seek may not be.
+type BlockReader struct {
+	// BlockSize is the size of each range request.  The default is 1MB.
+	BlockSize int
+
+	// CacheBlocks is the number of blocks kept in memory.  The default is
+	// 16.
+	CacheBlocks int
+
+	ctx  context.Context
+	o    *Object
+	id   string
+	size int64
+	off  int64 // for Read and Seek
+
+	mu     sync.Mutex
+	blocks map[int64]*block
+	tick   uint64
+}
+
+type block struct {
+	once sync.Once
+	used uint64 // guarded by the BlockReader's mu
+	data []byte
+	err  error
+}
+
+// NewReaderAt returns a BlockReader for the object.  It fails if the object
+// does not exist.
+func (o *Object) NewReaderAt(ctx context.Context) (*BlockReader, error) {
+	attrs, err := o.Attrs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &BlockReader{
+		ctx:    ctx,
+		o:      o,
+		id:     o.f.id(),
+		size:   attrs.Size,
+		blocks: make(map[int64]*block),
+	}, nil
+}
+
+// Size returns the size of the object.
+func (b *BlockReader) Size() int64 {
+	return b.size
+}
+
+func (b *BlockReader) blockSize() int64 {
+	if b.BlockSize < 1 {
+		return 1 << 20
+	}
+	return int64(b.BlockSize)
+}
+
+// getBlock returns the block that begins at the given offset, fetching it if
+// necessary.
+func (b *BlockReader) getBlock(off int64) ([]byte, error) {
+	b.mu.Lock()
+	b.tick++
+	bl, ok := b.blocks[off]
+	if !ok {
+		// Stamp the new block before evicting, so that it isn't taken for
+		// the least recently used.
+		bl = &block{used: b.tick}
+		b.blocks[off] = bl
+		b.evict()
+	}
+	bl.used = b.tick
+	b.mu.Unlock()
+
+	bl.once.Do(func() {
+		bl.data, bl.err = b.fetch(off)
+	})
+	if bl.err != nil {
+		// Don't cache failures.
+		b.mu.Lock()
+		if b.blocks[off] == bl {
+			delete(b.blocks, off)
+		}
+		b.mu.Unlock()
+	}
+	return bl.data, bl.err
+}
+
+// evict removes the least recently used blocks until the cache is within its
+// limit.  The caller must hold mu.
+func (b *BlockReader) evict() {
+	max := b.CacheBlocks
+	if max < 1 {
+		max = 16
+	}
+	for len(b.blocks) > max {
+		var (
+			oldest int64
+			used   uint64
+			found  bool
+		)
+		for off, bl := range b.blocks {
+			if !found || bl.used < used {
+				oldest, used, found = off, bl.used, true
+			}
+		}
+		delete(b.blocks, oldest)
+	}
+}
+
+func (b *BlockReader) fetch(off int64) ([]byte, error) {
+	n := b.blockSize()
+	if off+n > b.size {
+		n = b.size - off
+	}
+	sched := b.o.b.c.transfers()
+	if err := sched.acquire(b.ctx); err != nil {
+		return nil, err
+	}
+	defer sched.release()
+	fr, err := b.o.b.b.downloadFileByID(b.ctx, b.id, off, n)
+	if err != nil {
+		return nil, err
+	}
+	defer fr.Close()
+	data, err := ioutil.ReadAll(&meteredReader{r: noopResetter{fr}, size: int(n), ctx: b.ctx, bw: b.o.b.c.bandwidth()})
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != n {
+		return nil, fmt.Errorf("%s: block at %d: got %d bytes, want %d", b.o.name, off, len(data), n)
+	}
+	return data, nil
+}
+
+// ReadAt satisfies the io.ReaderAt interface.
+func (b *BlockReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("b2: negative offset")
+	}
+	var total int
+	for len(p) > 0 {
+		if off >= b.size {
+			return total, io.EOF
+		}
+		start := off - off%b.blockSize()
+		data, err := b.getBlock(start)
+		if err != nil {
+			return total, err
+		}
+		n := copy(p, data[off-start:])
+		p = p[n:]
+		off += int64(n)
+		total += n
+	}
+	return total, nil
+}
+
+// Read satisfies the io.Reader interface.
+func (b *BlockReader) Read(p []byte) (int, error) {
+	if b.off >= b.size {
+		return 0, io.EOF
+	}
+	if rem := b.size - b.off; int64(len(p)) > rem {
+		p = p[:rem]
+	}
+	n, err := b.ReadAt(p, b.off)
+	b.off += int64(n)
+	return n, err
+}
+
+// Seek satisfies the io.Seeker interface.
+func (b *BlockReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += b.off
+	case io.SeekEnd:
+		offset += b.size
+	default:
+		return 0, fmt.Errorf("b2: invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, errors.New("b2: negative offset")
+	}
+	b.off = offset
+	return offset, nil
+}
@@ -23,8 +23,12 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/kurin/blazer/internal/blog"
 )
 
 type readResetter interface {
@@ -142,8 +146,13 @@ type fileBuffer struct {
 	s   int
 }
 
+// fileBufferPrefix begins the names of file buffers, and of nothing else, so
+// that CleanFileBufferDir can't mistake other files, such as those of
+// x/logsink, for abandoned buffers.
+const fileBufferPrefix = "blazer-filebuffer-"
+
 func newFileBuffer(loc string) (*fileBuffer, error) {
-	f, err := ioutil.TempFile(loc, "blazer")
+	f, err := ioutil.TempFile(loc, fileBufferPrefix)
 	if err != nil {
 		return nil, err
 	}
@@ -183,3 +192,57 @@ type fr struct {
 
 func (r *fr) Read(p []byte) (int, error) { return r.f.Read(p) }
 func (r *fr) Reset() error               { _, err := r.f.Seek(0, 0); return err }
+
+type scratchCleaner struct {
+	dir    string
+	age    time.Duration
+	report func(int, int64)
+}
+
+// CleanFileBufferDir returns a ClientOption that, when the client is created,
+// removes scratch files left in dir by Writers with UseFileBuffer set that
+// were interrupted, e.g. by a crash, before they could clean up after
+// themselves.  If dir is blank, os.TempDir() is used.
+//
+// Only files that have not been modified for at least age are removed, so
+// that files in use by other clients sharing dir are left alone.  If report
+// is not nil, it is called with the number of files removed and their total
+// size.  Errors are logged and otherwise ignored.
+func CleanFileBufferDir(dir string, age time.Duration, report func(files int, bytes int64)) ClientOption {
+	return func(c *clientOptions) {
+		c.scratch = &scratchCleaner{
+			dir:    dir,
+			age:    age,
+			report: report,
+		}
+	}
+}
+
+func (s *scratchCleaner) clean() {
+	dir := s.dir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		blog.V(1).Infof("b2: cleaning scratch files in %s: %v", dir, err)
+		return
+	}
+	cutoff := now().Add(-s.age)
+	var files int
+	var size int64
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() || !strings.HasPrefix(fi.Name(), fileBufferPrefix) || fi.ModTime().After(cutoff) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, fi.Name())); err != nil {
+			blog.V(1).Infof("b2: cleaning scratch files in %s: %v", dir, err)
+			continue
+		}
+		files++
+		size += fi.Size()
+	}
+	if s.report != nil {
+		s.report(files, size)
+	}
+}
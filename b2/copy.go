@@ -0,0 +1,322 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/kurin/blazer/internal/blog"
+)
+
+type copyOptions struct {
+	rewrite     func(*Attrs) (*Attrs, error)
+	partSize    int64
+	concurrency int
+	fallback    bool
+	report      func(*CopyFallbackEvent)
+}
+
+// A CopyOption alters the default behavior of CopyTo.
+type CopyOption func(*copyOptions)
+
+// CopyAttrsFunc calls f with the attributes of the source object, and gives
+// the copy the content type and info of the Attrs that f returns.  If f
+// returns nil, the copy keeps the source's attributes.  This can be used to
+// fix up metadata as objects are copied, without downloading them.
+//
+// If the returned Attrs has no content type, the source's is kept.
+func CopyAttrsFunc(f func(*Attrs) (*Attrs, error)) CopyOption {
+	return func(c *copyOptions) {
+		c.rewrite = f
+	}
+}
+
+// CopyPartSize sets the largest amount of data copied in a single request.
+// Objects larger than this are copied as large files, in parts of nearly
+// equal size.  The default, and the maximum B2 allows, is 5GB (5e9).  The
+// minimum is 10MB (1e7), so that no part is smaller than B2's minimum of 5MB.
+func CopyPartSize(size int64) CopyOption {
+	return func(c *copyOptions) {
+		c.partSize = size
+	}
+}
+
+// CopyConcurrency sets the number of parts copied at once when an object is
+// copied as a large file.  Values less than 1 are equivalent to 1.
+func CopyConcurrency(n int) CopyOption {
+	return func(c *copyOptions) {
+		c.concurrency = n
+	}
+}
+
+// A CopyFallbackEvent describes a copy that CopyTo streamed, because B2 would
+// not make it within B2; see CopyFallback.
+type CopyFallbackEvent struct {
+	Src, Dst *Object
+
+	// Err is why the copy could not be made within B2.
+	Err error
+
+	// Dropped holds the info keys, sorted, that were left off the copy so
+	// that its metadata would fit B2's limits.
+	Dropped []string
+}
+
+// CopyFallback makes CopyTo fall back to a streamed copy, downloading the
+// object and uploading it to the destination, when its metadata would keep B2
+// from copying it, as when CopyAttrsFunc adds more info than B2 allows.  The
+// streamed copy's info is trimmed to fit B2's limits, by keeping as many keys,
+// in sorted order, as will fit.  A streamed copy transfers the object's data
+// twice, and is charged as a download.  If report is not nil, it is called
+// before each fallback, so that jobs such as mirrors can log or count them.
+//
+// Without CopyFallback, such a copy fails.
+func CopyFallback(report func(*CopyFallbackEvent)) CopyOption {
+	return func(c *copyOptions) {
+		c.fallback = true
+		c.report = report
+	}
+}
+
+// B2's limits on file info, as sent in upload headers.
+const (
+	maxInfoKeys  = 10
+	maxInfoBytes = 7000
+)
+
+// errInfoLimits is the reason given for copies whose info is known, before
+// asking B2, to be over its limits.
+var errInfoLimits = errors.New("b2: file info exceeds B2's limits")
+
+// infoSize is the size of info as upload headers.
+func infoSize(info map[string]string) int {
+	var n int
+	for k, v := range info {
+		n += len("X-Bz-Info-") + len(k) + len(v)
+	}
+	return n
+}
+
+// fitInfo returns as much of info, taking keys in sorted order, as fits B2's
+// limits, and the keys that did not fit.
+func fitInfo(info map[string]string) (map[string]string, []string) {
+	var keys []string
+	for k := range info {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fit := make(map[string]string)
+	var dropped []string
+	var size int
+	for _, k := range keys {
+		n := len("X-Bz-Info-") + len(k) + len(info[k])
+		if len(fit) >= maxInfoKeys || size+n > maxInfoBytes {
+			dropped = append(dropped, k)
+			continue
+		}
+		fit[k] = info[k]
+		size += n
+	}
+	return fit, dropped
+}
+
+// isInfoError reports whether err means that B2 refused a request because of
+// its file info.
+func isInfoError(err error) bool {
+	if err == errInfoLimits {
+		return true
+	}
+	e, ok := AsError(err)
+	if !ok {
+		return false
+	}
+	return e.Status == 400 && strings.Contains(strings.ToLower(e.Message), "info")
+}
+
+// CopyTo copies o to dst, which may be in another bucket in the same account.
+// The data is copied within B2, and is not downloaded.  By default the copy
+// has the same content type and info as o.
+//
+// Objects larger than 5GB, or than the size given with CopyPartSize, are
+// copied part by part, and retried like a Writer's parts.  If that fails, the
+// partial copy is cancelled.  See CopyFallback for copies whose metadata B2
+// will not accept.
+func (o *Object) CopyTo(ctx context.Context, dst *Object, opts ...CopyOption) error {
+	c := copyOptions{
+		partSize:    maxPartSize,
+		concurrency: 1,
+	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	if c.partSize > maxPartSize {
+		c.partSize = maxPartSize
+	}
+	if c.partSize < 2*minPartSize {
+		c.partSize = 2 * minPartSize
+	}
+	if c.concurrency < 1 {
+		c.concurrency = 1
+	}
+	if err := o.ensure(ctx); err != nil {
+		return err
+	}
+	attrs, err := o.Attrs(ctx)
+	if err != nil {
+		return err
+	}
+	replace := false
+	ct, info := copyInfo(attrs)
+	if c.rewrite != nil {
+		na, err := c.rewrite(attrs)
+		if err != nil {
+			return err
+		}
+		if na != nil {
+			replace = true
+			ct, info = copyInfo(na)
+			if ct == "" {
+				ct = attrs.ContentType
+			}
+		}
+	}
+	if c.fallback && (len(info) > maxInfoKeys || infoSize(info) > maxInfoBytes) {
+		return o.streamTo(ctx, dst, ct, info, errInfoLimits, c)
+	}
+	if attrs.Size > c.partSize {
+		err = o.copyLarge(ctx, dst, attrs.Size, ct, info, c)
+	} else {
+		err = o.copyFile(ctx, dst, replace, ct, info)
+	}
+	if err != nil && c.fallback && isInfoError(err) {
+		return o.streamTo(ctx, dst, ct, info, err, c)
+	}
+	return err
+}
+
+// copyInfo is like attrsInfo, but does not add large_file_sha1 to info that
+// the source didn't have.  A source's large_file_sha1 is already in
+// attrs.Info, whereas attrs.SHA1 is set for every object.  LastModified needs
+// no such care, since Attrs sets it only from src_last_modified_millis.
+func copyInfo(attrs *Attrs) (string, map[string]string) {
+	if attrs == nil {
+		return attrsInfo(nil)
+	}
+	a := *attrs
+	a.SHA1 = ""
+	return attrsInfo(&a)
+}
+
+// copyFile copies o to dst in a single request.
+func (o *Object) copyFile(ctx context.Context, dst *Object, replace bool, ct string, info map[string]string) error {
+	if !replace {
+		ct, info = "", nil
+	}
+	f, err := o.f.copyFile(ctx, dst.name, dst.b.b.id(), replace, ct, info)
+	if err != nil {
+		return err
+	}
+	dst.f = f
+	return nil
+}
+
+// streamTo copies o to dst through the client, with as much of info as B2
+// will take, because a copy within B2 failed with cause.
+func (o *Object) streamTo(ctx context.Context, dst *Object, ct string, info map[string]string, cause error, c copyOptions) error {
+	fit, dropped := fitInfo(info)
+	if c.report != nil {
+		c.report(&CopyFallbackEvent{Src: o, Dst: dst, Err: cause, Dropped: dropped})
+	}
+	blog.V(1).Infof("b2 copy %s: streaming to %s: %v", o.name, dst.name, cause)
+
+	r := o.NewReader(ctx)
+	defer r.Close()
+	return PipeTo(ctx, dst, func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	}, WithAttrsOption(&Attrs{ContentType: ct, Info: fit}))
+}
+
+// copyLarge copies o to dst as a large file.
+func (o *Object) copyLarge(ctx context.Context, dst *Object, size int64, ct string, info map[string]string, c copyOptions) error {
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+	f, err := dst.b.b.startLargeFile(ctx, dst.name, ct, info)
+	if err != nil {
+		return err
+	}
+	lf := newLargeFile(dst.b, dst.name, f)
+	src := o.f.id()
+
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type job struct {
+		n   int
+		off int64
+		len int64
+	}
+	ch := make(chan job)
+	var (
+		wg   sync.WaitGroup
+		emux sync.Mutex
+		rerr error
+	)
+	for i := 0; i < c.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range ch {
+				if _, err := lf.f.copyPart(ctx, src, j.off, j.len, j.n); err != nil {
+					emux.Lock()
+					if rerr == nil {
+						rerr = err
+						cancel()
+					}
+					emux.Unlock()
+				}
+			}
+		}()
+	}
+	for i, r := range splitRange(size, c.partSize) {
+		select {
+		case ch <- job{n: i + 1, off: r[0], len: r[1]}:
+		case <-ctx.Done():
+		}
+	}
+	close(ch)
+	wg.Wait()
+	if rerr == nil {
+		rerr = ctx.Err()
+	}
+	if rerr == nil {
+		obj, err := lf.Finish(ctx)
+		if err == nil {
+			dst.f = obj.f
+			return nil
+		}
+		rerr = err
+	}
+	if err := lf.Cancel(parent); err != nil {
+		blog.V(1).Infof("b2 copy %s: cancel: %v", dst.name, err)
+	}
+	return rerr
+}
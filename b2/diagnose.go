@@ -0,0 +1,177 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxDiagEvents bounds the timeline kept for a single Writer.
+const maxDiagEvents = 1000
+
+// DiagnosticError is returned by a Writer with Diagnose set when the upload
+// fails.  It describes what the Writer was doing, and can be included in a
+// report to Backblaze support; it contains no credentials or data.  Uploads
+// that stop because their context is done are not failures, and their errors
+// are not wrapped.
+type DiagnosticError struct {
+	Err         error
+	Diagnostics *Diagnostics
+}
+
+func (e *DiagnosticError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the error that failed the upload, so that errors.Is,
+// errors.As, and this package's IsNotExist, AsError, and the like see through
+// a DiagnosticError.
+func (e *DiagnosticError) Unwrap() error {
+	return e.Err
+}
+
+// Diagnostics describes a failed upload.
+type Diagnostics struct {
+	Name    string
+	Started time.Time
+	Failed  time.Time
+
+	// Parts holds the state of each part when the upload failed, in order.
+	// A simple upload has a single part, numbered 1.
+	Parts []PartDiagnostic
+
+	// Events is the timeline of the upload, oldest first.  Only the first
+	// thousand events are kept.
+	Events []DiagEvent
+
+	// Request describes the request that failed, if B2 returned the error.
+	Request *RequestInfo
+}
+
+// PartDiagnostic is the state of a single part of a failed upload.
+type PartDiagnostic struct {
+	Number  int
+	Size    int
+	State   string // "sending", "done", "skipped", or "failed".
+	Retries int    // Attempts after the first.
+	Err     string // The error that failed the part, if any.
+}
+
+// DiagEvent is a single entry in an upload's timeline.  Part is 0 for events
+// that concern the whole upload.
+type DiagEvent struct {
+	Time time.Time
+	Part int
+	What string
+}
+
+// diagRecorder collects diagnostics for a Writer.  Its methods may be called
+// on a nil recorder, which does nothing.
+type diagRecorder struct {
+	mu      sync.Mutex
+	name    string
+	started time.Time
+	parts   map[int]*PartDiagnostic
+	events  []DiagEvent
+}
+
+func newDiagRecorder(name string) *diagRecorder {
+	d := &diagRecorder{
+		name:    name,
+		started: now(),
+		parts:   make(map[int]*PartDiagnostic),
+	}
+	d.event(0, "started")
+	return d
+}
+
+func (d *diagRecorder) event(part int, format string, args ...interface{}) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.events) < maxDiagEvents {
+		d.events = append(d.events, DiagEvent{Time: now(), Part: part, What: fmt.Sprintf(format, args...)})
+	}
+}
+
+func (d *diagRecorder) setPart(n, size int, state string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	p, ok := d.parts[n]
+	if !ok {
+		p = &PartDiagnostic{Number: n}
+		d.parts[n] = p
+	}
+	p.Size = size
+	p.State = state
+	d.mu.Unlock()
+	d.event(n, "%s (%d bytes)", state, size)
+}
+
+func (d *diagRecorder) retry(n int, err error) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	if p, ok := d.parts[n]; ok {
+		p.Retries++
+	}
+	d.mu.Unlock()
+	d.event(n, "retrying after error: %v", err)
+}
+
+func (d *diagRecorder) fail(n int, err error) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	if p, ok := d.parts[n]; ok {
+		p.State = "failed"
+		p.Err = err.Error()
+	}
+	d.mu.Unlock()
+	d.event(n, "failed: %v", err)
+}
+
+// wrap returns err with the diagnostics collected so far.
+func (d *diagRecorder) wrap(err error) error {
+	if d == nil || isContextErr(err) {
+		return err
+	}
+	d.event(0, "upload failed: %v", err)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	diag := &Diagnostics{
+		Name:    d.name,
+		Started: d.started,
+		Failed:  now(),
+		Events:  append([]DiagEvent(nil), d.events...),
+	}
+	for _, p := range d.parts {
+		diag.Parts = append(diag.Parts, *p)
+	}
+	sort.Slice(diag.Parts, func(i, j int) bool { return diag.Parts[i].Number < diag.Parts[j].Number })
+	if ri, ok := ErrorRequest(err); ok {
+		diag.Request = ri
+	}
+	return &DiagnosticError{Err: err, Diagnostics: diag}
+}
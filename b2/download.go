@@ -0,0 +1,162 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// downloadCheckpoint is how often, in bytes, DownloadToFile records its
+// progress.
+var downloadCheckpoint int64 = 1e8
+
+// downloadState is the contents of DownloadToFile's sidecar file.
+type downloadState struct {
+	ID   string `json:"id"`
+	Size int64  `json:"size"`
+	Done int64  `json:"done"`
+}
+
+// DownloadToFile downloads the object to the named local file.  Its progress
+// is saved every 100MB in a sidecar file, path + ".b2download", so that if
+// the download is interrupted, even by the process exiting, a later call
+// resumes from the last saved point.  Saved data is synced to disk before it
+// is recorded.  The sidecar is removed once the download is complete.
+//
+// A download is only resumed if the object has not changed.  Otherwise it
+// starts over.  When the download is complete, the whole file is checked
+// against the object's SHA1, if B2 has one; on a mismatch the file and
+// sidecar are removed and a *ChecksumError is returned.
+//
+// The options are applied to the Readers that download the object.
+func (o *Object) DownloadToFile(ctx context.Context, path string, opts ...ReaderOption) error {
+	attrs, err := o.Attrs(ctx)
+	if err != nil {
+		return err
+	}
+	src := o.b.ObjectByID(attrs.ID, o.name)
+	side := path + ".b2download"
+
+	st := downloadState{ID: attrs.ID, Size: attrs.Size}
+	if old, err := readDownloadState(side); err == nil && old.ID == st.ID && old.Size == st.Size {
+		st.Done = old.Done
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(st.Done); err != nil {
+		return err
+	}
+	if _, err := f.Seek(st.Done, io.SeekStart); err != nil {
+		return err
+	}
+
+	for st.Done < st.Size {
+		n := st.Size - st.Done
+		if n > downloadCheckpoint {
+			n = downloadCheckpoint
+		}
+		r := src.NewRangeReader(ctx, st.Done, n, opts...)
+		m, err := io.Copy(f, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+		if m != n {
+			return fmt.Errorf("%s: got %d bytes at offset %d, want %d", o.name, m, st.Done, n)
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+		st.Done += n
+		if err := writeDownloadState(side, st); err != nil {
+			return err
+		}
+	}
+
+	if len(attrs.SHA1) == 40 {
+		if err := checkFileSHA1(path, o.name, attrs.SHA1); err != nil {
+			f.Close()
+			os.Remove(path)
+			os.Remove(side)
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Remove(side); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func readDownloadState(path string) (downloadState, error) {
+	var st downloadState
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return st, err
+	}
+	err = json.Unmarshal(b, &st)
+	return st, err
+}
+
+// writeDownloadState replaces the sidecar atomically, so that an interruption
+// never leaves it half written.
+func writeDownloadState(path string, st downloadState) error {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func checkFileSHA1(path, name, want string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha1.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if got := fmt.Sprintf("%x", h.Sum(nil)); got != want {
+		return &ChecksumError{Name: name, Got: got, Want: want}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// An Error describes a request that B2 refused.  Errors returned by this
+// package are not themselves *Errors; use AsError, or errors.As, to get one.
+type Error struct {
+	Status  int    // The HTTP status, e.g. 404.
+	Code    string // B2's code for the error, e.g. "file_not_present".
+	Message string // B2's description of the error.
+	Method  string // The B2 API call, e.g. "b2_upload_file".
+
+	err error
+}
+
+func (e *Error) Error() string {
+	if e.err != nil {
+		return e.err.Error()
+	}
+	return fmt.Sprintf("%s: %d: %s", e.Method, e.Status, e.Message)
+}
+
+// AsError returns the details of err, if err was returned by B2.  Errors from
+// the network, or from this package, are not B2 errors.
+func AsError(err error) (*Error, bool) {
+	var e *Error
+	if errors.As(err, &e) {
+		return e, true
+	}
+	var be b2err
+	if errors.As(err, &be) {
+		err = be.err
+	}
+	for ; err != nil; err = errors.Unwrap(err) {
+		if e, ok := errorDetails(err); ok {
+			return e, true
+		}
+	}
+	return nil, false
+}
+
+// IsAuth reports whether err means that B2 did not accept the client's
+// credentials, or that they do not allow the request.
+func IsAuth(err error) bool {
+	e, ok := AsError(err)
+	if !ok {
+		return false
+	}
+	return e.Status == 401 || e.Code == "unauthorized" || e.Code == "access_denied"
+}
+
+// IsThrottle reports whether err means that B2 is too busy to handle the
+// request, or that the client is making requests too quickly.  Such requests
+// are retried, so callers will usually only see these errors if their
+// RetryPolicy gives up.
+func IsThrottle(err error) bool {
+	e, ok := AsError(err)
+	if !ok {
+		return false
+	}
+	return e.Status == 429 || e.Status == 503
+}
+
+// IsCapExceeded reports whether err means that the account has reached one of
+// its usage caps.  Caps are reset daily, so requests that exceed them are not
+// retried, even if B2 asks for a delay; callers will usually want to alert
+// rather than try again.
+func IsCapExceeded(err error) bool {
+	e, ok := AsError(err)
+	if !ok {
+		return false
+	}
+	return e.Status == 403 && isCapCode(e.Code)
+}
+
+// isCapCode reports whether code is one of the codes B2 gives with a 403 when
+// a cap is reached, such as download_cap_exceeded.
+func isCapCode(code string) bool {
+	return strings.HasSuffix(code, "cap_exceeded")
+}
+
+// notExistCodes are the B2 codes for missing files and buckets.
+var notExistCodes = map[string]bool{
+	"file_not_present": true,
+	"no_such_file":     true,
+	"not_found":        true,
+}
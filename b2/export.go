@@ -0,0 +1,75 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+)
+
+// ExportTar writes every current object whose name begins with prefix to w as
+// a tar archive.  Entries are named for their objects, and their modification
+// times are taken from the LastModified attribute if it was set on upload, and
+// the upload time otherwise.
+//
+// Objects are downloaded one at a time, in name order, and streamed into the
+// archive as they arrive, so w can be, e.g., an http.ResponseWriter.  If an
+// object changes size while it is being exported, ExportTar fails.
+func (b *Bucket) ExportTar(ctx context.Context, prefix string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	iter := b.List(ctx, ListPrefix(prefix))
+	for iter.Next() {
+		if err := exportObject(ctx, tw, iter.Object()); err != nil {
+			return err
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func exportObject(ctx context.Context, tw *tar.Writer, o *Object) error {
+	attrs, err := o.Attrs(ctx)
+	if err != nil {
+		return err
+	}
+	mtime := attrs.LastModified
+	if mtime.IsZero() {
+		mtime = attrs.UploadTimestamp
+	}
+	hdr := &tar.Header{
+		Name:     o.name,
+		Mode:     0644,
+		Size:     attrs.Size,
+		ModTime:  mtime,
+		Typeflag: tar.TypeReg,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	r := o.NewReader(ctx)
+	defer r.Close()
+	n, err := io.Copy(tw, r)
+	if err != nil {
+		return fmt.Errorf("%s: %v", o.name, err)
+	}
+	if n != attrs.Size {
+		return fmt.Errorf("%s: read %d of %d bytes", o.name, n, attrs.Size)
+	}
+	return nil
+}
@@ -214,6 +214,42 @@ func TestHideShowLive(t *testing.T) {
 	}
 }
 
+func TestReadHiddenLive(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+	defer cancel()
+	bucket, done := startLiveTest(ctx, t)
+	defer done()
+
+	obj, wsha, err := writeFile(ctx, bucket, smallFileName, 1e6+42, 1e8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if err := obj.Hide(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bucket.Object(smallFileName).NewReader(ctx)
+	if _, err := io.Copy(ioutil.Discard, r); !IsNotExist(err) {
+		t.Errorf("reading hidden object: got %v, want not-exist error", err)
+	}
+	r.Close()
+
+	r = bucket.Object(smallFileName).NewReader(ctx)
+	r.ReadHidden = true
+	r.ChunkSize = 1e5
+	r.ConcurrentDownloads = 3
+	defer r.Close()
+	hash := sha1.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		t.Fatal(err)
+	}
+	if rsha := fmt.Sprintf("%x", hash.Sum(nil)); rsha != wsha {
+		t.Errorf("reading hidden object: got SHA1 %s, want %s", rsha, wsha)
+	}
+}
+
 type cancelReader struct {
 	r    io.Reader
 	n, l int
@@ -280,6 +316,45 @@ func TestResumeWriter(t *testing.T) {
 	}
 }
 
+func TestPartsLive(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+	defer cancel()
+	bucket, done := startLiveTest(ctx, t)
+	defer done()
+
+	wctx, wcancel := context.WithCancel(ctx)
+	w := bucket.Object("foo").NewWriter(wctx)
+	w.ChunkSize = 5e6
+	r := &cancelReader{
+		r: io.LimitReader(zReader{}, 15e6),
+		l: 11e6,
+		c: wcancel,
+	}
+	if _, err := io.Copy(w, r); err != context.Canceled {
+		t.Fatalf("io.Copy: wanted canceled context, got: %v", err)
+	}
+
+	parts, err := bucket.Object("foo").Parts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) == 0 {
+		t.Fatal("Parts(): got no parts")
+	}
+	for i, p := range parts {
+		if p.Number != i+1 {
+			t.Errorf("part %d: got number %d", i, p.Number)
+		}
+		if p.Size != 5e6 {
+			t.Errorf("part %d: got size %d, want %d", p.Number, p.Size, int64(5e6))
+		}
+		if len(p.SHA1) != 40 {
+			t.Errorf("part %d: bad SHA1 %q", p.Number, p.SHA1)
+		}
+	}
+}
+
 func TestAttrs(t *testing.T) {
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
@@ -649,6 +724,10 @@ func compare(a, b *BucketAttrs) bool {
 		return false
 	}
 
+	if !reflect.DeepEqual(a.CORSRules, b.CORSRules) && (len(a.CORSRules) > 0 || len(b.CORSRules) > 0) {
+		return false
+	}
+
 	return reflect.DeepEqual(a.LifecycleRules, b.LifecycleRules)
 }
 
@@ -689,6 +768,19 @@ func TestNewBucket(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "only-cors",
+			attrs: &BucketAttrs{
+				CORSRules: []CORSRule{
+					{
+						Name:              "downloadFromAnyOrigin",
+						AllowedOrigins:    []string{"*"},
+						AllowedOperations: []string{"b2_download_file_by_name"},
+						MaxAgeSeconds:     3600,
+					},
+				},
+			},
+		},
 		{
 			name: "only-info",
 			attrs: &BucketAttrs{
@@ -719,6 +811,9 @@ func TestNewBucket(t *testing.T) {
 		if !compare(attrs, ent.attrs) {
 			t.Errorf("%s: attrs disagree: got %v, want %v", ent.name, attrs, ent.attrs)
 		}
+		if attrs.Name != bucket.Name() || attrs.ID == "" || attrs.Revision < 1 {
+			t.Errorf("%s: got name %q, ID %q, revision %d; want %q, an ID, and a revision", ent.name, attrs.Name, attrs.ID, attrs.Revision, bucket.Name())
+		}
 	}
 }
 
@@ -763,6 +858,40 @@ func TestDuelingBuckets(t *testing.T) {
 	}
 }
 
+func TestBucketType(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+	defer cancel()
+
+	bucket, done := startLiveTest(ctx, t)
+	defer done()
+	bucket2, done2 := startLiveTest(ctx, t)
+	defer done2()
+
+	if err := bucket.MakePublic(ctx); err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := bucket.Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.Type != Public {
+		t.Errorf("after MakePublic: got type %q, want %q", attrs.Type, Public)
+	}
+
+	// bucket2's revision is stale, which MakePrivate should survive.
+	if err := bucket2.MakePrivate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	attrs, err = bucket.Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.Type != Private {
+		t.Errorf("after MakePrivate: got type %q, want %q", attrs.Type, Private)
+	}
+}
+
 func TestNotExist(t *testing.T) {
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
@@ -16,8 +16,11 @@ package b2
 
 import (
 	"context"
+	"errors"
 	"io"
+	"sort"
 	"sync"
+	"time"
 )
 
 // List returns an iterator for selecting objects in a bucket.  The default
@@ -44,6 +47,11 @@ func (b *Bucket) List(ctx context.Context, opts ...ListOption) *ObjectIterator {
 //  if err := iter.Err(); err != nil {
 //    // handle err
 //  }
+//
+// Objects are fetched a page at a time (see ListPageSize), so the iterator
+// holds at most one page of them however long the listing is.  It lets go of
+// each object once Next has moved past it, but objects the caller keeps stay
+// alive.
 type ObjectIterator struct {
 	bucket *Bucket
 	ctx    context.Context
@@ -65,6 +73,8 @@ func (o *ObjectIterator) page(ctx context.Context) error {
 		o.opts.locker.Lock()
 		defer o.opts.locker.Unlock()
 	}
+	// Let the last page go before fetching the next one.
+	o.objs = nil
 	objs, c, err := o.l(ctx, o.count, o.c)
 	if err != nil && err != io.EOF {
 		if bNotExist.MatchString(err.Error()) {
@@ -94,42 +104,44 @@ func (o *ObjectIterator) Next() bool {
 		if o.count < 0 || o.count > 1000 {
 			o.count = 1000
 		}
-		switch {
-		case o.opts.unfinished:
-			o.l = o.bucket.ListUnfinishedLargeFiles
-			if o.count > 100 {
-				o.count = 100
-			}
-		case o.opts.hidden:
-			o.l = o.bucket.ListObjects
-		default:
-			o.l = o.bucket.ListCurrentObjects
+		if o.opts.unfinished && o.count > 100 {
+			o.count = 100
+		}
+		if o.l == nil {
+			o.l = o.opts.lister(o.bucket)
 		}
 		o.c = &Cursor{
 			Prefix:    o.opts.prefix,
 			Delimiter: o.opts.delimiter,
 		}
 	})
-	if o.err != nil {
-		return false
+	if o.idx > 0 && o.idx <= len(o.objs) {
+		o.objs[o.idx-1] = nil
 	}
-	if o.ctx.Err() != nil {
-		o.err = o.ctx.Err()
-		return false
-	}
-	if o.idx >= len(o.objs) {
-		if o.final {
-			o.err = io.EOF
+	for {
+		if o.err != nil {
 			return false
 		}
-		if err := o.page(o.ctx); err != nil {
-			o.err = err
+		if o.ctx.Err() != nil {
+			o.err = o.ctx.Err()
 			return false
 		}
-		return o.Next()
+		if o.idx >= len(o.objs) {
+			if o.final {
+				o.err = io.EOF
+				return false
+			}
+			if err := o.page(o.ctx); err != nil {
+				o.err = err
+				return false
+			}
+			continue
+		}
+		o.idx++
+		if o.opts.matches(o.objs[o.idx-1]) {
+			return true
+		}
 	}
-	o.idx++
-	return true
 }
 
 // Object returns the current object.
@@ -146,6 +158,19 @@ func (o *ObjectIterator) Err() error {
 	return o.err
 }
 
+// ListInto calls fn on each object selected by opts, in order.  It stops at,
+// and returns, the first error from fn or from the listing.  As with List, only
+// one page of objects is held at a time.
+func (b *Bucket) ListInto(ctx context.Context, fn func(*Object) error, opts ...ListOption) error {
+	iter := b.List(ctx, opts...)
+	for iter.Next() {
+		if err := fn(iter.Object()); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
+
 type objectIteratorOptions struct {
 	hidden     bool
 	unfinished bool
@@ -153,6 +178,33 @@ type objectIteratorOptions struct {
 	delimiter  string
 	pageSize   int
 	locker     sync.Locker
+	after      time.Time
+	before     time.Time
+}
+
+func (o *objectIteratorOptions) lister(b *Bucket) lister {
+	switch {
+	case o.unfinished:
+		return b.ListUnfinishedLargeFiles
+	case o.hidden:
+		return b.ListObjects
+	}
+	return b.ListCurrentObjects
+}
+
+// matches reports whether obj satisfies the client-side filters.
+func (o *objectIteratorOptions) matches(obj *Object) bool {
+	if obj.f == nil || obj.f.status() == "folder" {
+		return true
+	}
+	ts := obj.f.timestamp()
+	if !o.after.IsZero() && ts.Before(o.after) {
+		return false
+	}
+	if !o.before.IsZero() && !ts.Before(o.before) {
+		return false
+	}
+	return true
 }
 
 // A ListOption alters the default behavor of List.
@@ -215,3 +267,143 @@ func ListLocker(l sync.Locker) ListOption {
 		o.locker = l
 	}
 }
+
+// ListUploadedAfter restricts the output to objects that were uploaded at or
+// after t.  B2 cannot filter by upload time, so every object in the listing is
+// still fetched, but only matching objects are returned by the iterator.
+// Folders returned with ListDelimiter have no upload time and are always
+// returned.
+func ListUploadedAfter(t time.Time) ListOption {
+	return func(o *objectIteratorOptions) {
+		o.after = t
+	}
+}
+
+// ListUploadedBefore restricts the output to objects that were uploaded
+// strictly before t.  Like ListUploadedAfter, filtering is done on the client.
+func ListUploadedBefore(t time.Time) ListOption {
+	return func(o *objectIteratorOptions) {
+		o.before = t
+	}
+}
+
+// ListPrefixesConcurrently returns an iterator over the objects beneath each
+// of the given prefixes.  Up to workers prefixes are listed at the same time,
+// and results are returned in lexical order, as if a single listing had been
+// made.  This requires that the prefixes be disjoint; that is, no prefix may
+// itself begin with another prefix in the list.
+//
+// Listings proceed in the background until the iterator is exhausted or
+// returns an error.  Callers that stop iterating early should cancel ctx.
+//
+// Any ListPrefix option is ignored.  ListUnfinished is not supported, because
+// unfinished large files cannot be listed by prefix; with it, the iterator
+// returns an error.
+func (b *Bucket) ListPrefixesConcurrently(ctx context.Context, prefixes []string, workers int, opts ...ListOption) *ObjectIterator {
+	iter := b.List(ctx, opts...)
+	pfxs := append([]string(nil), prefixes...)
+	sort.Strings(pfxs)
+	if workers < 1 {
+		workers = 1
+	}
+	chans := make([]chan listPage, len(pfxs))
+	for i := range chans {
+		chans[i] = make(chan listPage, listPagesAhead)
+	}
+	var (
+		start  sync.Once
+		cancel context.CancelFunc
+		cur    int
+	)
+	iter.l = func(ctx context.Context, count int, _ *Cursor) ([]*Object, *Cursor, error) {
+		if iter.opts.unfinished {
+			return nil, nil, errors.New("b2: ListPrefixesConcurrently cannot list unfinished large files")
+		}
+		start.Do(func() {
+			var lctx context.Context
+			lctx, cancel = context.WithCancel(ctx)
+			listPrefixes(lctx, iter.opts, b, count, pfxs, chans, workers)
+		})
+		for cur < len(chans) {
+			select {
+			case p, ok := <-chans[cur]:
+				if !ok {
+					cur++
+					continue
+				}
+				if p.err != nil {
+					cancel()
+					return nil, nil, p.err
+				}
+				return p.objs, nil, nil
+			case <-ctx.Done():
+				cancel()
+				return nil, nil, ctx.Err()
+			}
+		}
+		cancel()
+		return nil, nil, io.EOF
+	}
+	return iter
+}
+
+// listPagesAhead is the number of pages each prefix may list before they are
+// consumed.
+const listPagesAhead = 4
+
+type listPage struct {
+	objs []*Object
+	err  error
+}
+
+// listPrefixes lists each prefix into the corresponding channel, closing it
+// when the prefix is done.  Prefixes are handed to workers in order, so the
+// earliest unfinished prefix always has a worker and the consumer, which reads
+// the channels in order, never waits on a prefix that cannot make progress.
+func listPrefixes(ctx context.Context, opts objectIteratorOptions, b *Bucket, count int, pfxs []string, chans []chan listPage, workers int) {
+	l := opts.lister(b)
+	idx := make(chan int)
+	go func() {
+		defer close(idx)
+		for i := range pfxs {
+			select {
+			case idx <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	send := func(ch chan listPage, p listPage) bool {
+		select {
+		case ch <- p:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for i := range idx {
+				c := &Cursor{
+					Prefix:    pfxs[i],
+					Delimiter: opts.delimiter,
+				}
+				for c != nil {
+					objs, next, err := l(ctx, count, c)
+					if err != nil && err != io.EOF {
+						send(chans[i], listPage{err: err})
+						return
+					}
+					if !send(chans[i], listPage{objs: objs}) {
+						return
+					}
+					if err == io.EOF {
+						break
+					}
+					c = next
+				}
+				close(chans[i])
+			}
+		}()
+	}
+}
@@ -17,7 +17,9 @@ package b2
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
+	"strings"
 	"time"
 )
 
@@ -51,6 +53,28 @@ func (k *Key) Secret() string { return k.k.secret() }
 // authenticate to B2.
 func (k *Key) ID() string { return k.k.id() }
 
+// RequireCapabilities returns an error naming any of the given capabilities,
+// e.g. "listBuckets" or "writeFiles", that were not granted to the application
+// key the client was created with.  Calling it right after NewClient catches a
+// misconfigured key at startup, rather than on the first operation that needs
+// the missing capability.
+func (c *Client) RequireCapabilities(caps ...string) error {
+	have := make(map[string]bool)
+	for _, capability := range c.backend.capabilities() {
+		have[capability] = true
+	}
+	var missing []string
+	for _, capability := range caps {
+		if !have[capability] {
+			missing = append(missing, capability)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("application key lacks required capabilities: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
 type keyOptions struct {
 	caps     []string
 	prefix   string
@@ -69,7 +93,7 @@ func Lifetime(d time.Duration) KeyOption {
 
 // Deadline requests a key that expires after the given date.
 func Deadline(t time.Time) KeyOption {
-	d := t.Sub(time.Now())
+	d := t.Sub(now())
 	return Lifetime(d)
 }
 
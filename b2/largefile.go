@@ -0,0 +1,263 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/kurin/blazer/internal/blog"
+)
+
+// LargeFile is a large file upload whose parts are managed by the caller.
+// Most users should use a Writer, which handles chunking and concurrency
+// automatically.  LargeFile is for callers that need to schedule part uploads
+// themselves.
+//
+// All of a LargeFile's methods are safe to call concurrently.
+type LargeFile struct {
+	b    *Bucket
+	name string
+	f    beLargeFileInterface
+	urls chan beFileChunkInterface
+
+	onRetry func(number int, err error) // called before a part is retried
+}
+
+func newLargeFile(b *Bucket, name string, f beLargeFileInterface) *LargeFile {
+	return &LargeFile{
+		b:    b,
+		name: name,
+		f:    f,
+		urls: make(chan beFileChunkInterface, uploadURLPoolSize),
+	}
+}
+
+// StartLargeFile begins a new large file upload for the named object.  The
+// content type and info of attrs, which may be nil, are applied to the
+// resulting object.
+//
+// The upload must be finished with Finish or abandoned with Cancel.  Until
+// then, it can be seen with ListUnfinished.
+func (b *Bucket) StartLargeFile(ctx context.Context, name string, attrs *Attrs) (*LargeFile, error) {
+	ct, info := attrsInfo(attrs)
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+	f, err := b.b.startLargeFile(ctx, name, ct, info)
+	if err != nil {
+		return nil, err
+	}
+	return newLargeFile(b, name, f), nil
+}
+
+// ResumeLargeFile returns a LargeFile for an upload that was started
+// elsewhere, e.g. by another process, given its ID and object name.  Parts
+// that have already been uploaded are included when the file is finished.
+func (b *Bucket) ResumeLargeFile(ctx context.Context, id, name string) (*LargeFile, error) {
+	f := b.b.file(id, name)
+	parts, err := listAllParts(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[int]string)
+	var size int64
+	for _, p := range parts {
+		seen[p.number()] = p.sha1()
+		size += p.size()
+	}
+	return newLargeFile(b, name, f.compileParts(size, seen)), nil
+}
+
+// Name returns the name of the object being uploaded.
+func (l *LargeFile) Name() string {
+	return l.name
+}
+
+// ID returns the file ID of the upload.  It can be passed to ResumeLargeFile
+// to continue the upload from another process.
+func (l *LargeFile) ID() string {
+	return l.f.id()
+}
+
+// Parts lists the parts that B2 has received for this upload, including any
+// uploaded by other processes.
+func (l *LargeFile) Parts(ctx context.Context) ([]*Part, error) {
+	o := &Object{
+		name: l.name,
+		f:    l.b.b.file(l.ID(), l.name),
+		b:    l.b,
+	}
+	return o.Parts(ctx)
+}
+
+// UploadPart uploads the contents of r as the given part.  Part numbers begin
+// at 1, and the parts are assembled in numerical order when the file is
+// finished.  Every part except the last must be at least 5MB.  Parts may be
+// uploaded concurrently and in any order.
+//
+// The SHA1 of the part is computed while it is sent, so r is read only once
+// unless the upload must be retried, in which case r is rewound.
+func (l *LargeFile) UploadPart(ctx context.Context, number int, r io.ReadSeeker) error {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	nb := newNonBuffer(enReaderAt(r), 0, size)
+	rr, err := nb.Reader()
+	if err != nil {
+		return err
+	}
+	return l.upload(ctx, rr, nb.Hash(), nb.Len(), number)
+}
+
+// CopyPart copies size bytes of src, beginning at offset, into the given part
+// without downloading them.  The same size limits apply as for UploadPart, and
+// the copy may not exceed 5GB.
+func (l *LargeFile) CopyPart(ctx context.Context, number int, src *Object, offset, size int64) error {
+	if err := src.ensure(ctx); err != nil {
+		return err
+	}
+	_, err := l.f.copyPart(ctx, src.f.id(), offset, size, number)
+	return err
+}
+
+// upload sends a single part, retrying with a new upload URL when B2 asks for
+// one.
+func (l *LargeFile) upload(ctx context.Context, r readResetter, sha1 string, size, number int) error {
+	fc, err := l.getURL(ctx)
+	if err != nil {
+		return err
+	}
+	rt := retrier{p: retries(ctx, l.b.r)}
+	for {
+		n, err := fc.uploadPart(ctx, r, sha1, size, number)
+		if err == nil && n == size {
+			l.putURL(fc)
+			return nil
+		}
+		if err == nil {
+			return fmt.Errorf("%s: part %d: wrote %d of %d bytes", l.name, number, n, size)
+		}
+		if !l.b.r.reupload(err) {
+			return err
+		}
+		wait, ok := rt.next(l.b.r.backoff(err))
+		if !ok {
+			return err
+		}
+		if l.onRetry != nil {
+			l.onRetry(number, err)
+		}
+		select {
+		case <-after(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		blog.V(1).Infof("b2 large file %s: part %d: wrote %d of %d: error: %v; retrying", l.name, number, n, size, err)
+		f, err := l.f.getUploadPartURL(ctx)
+		if err != nil {
+			return err
+		}
+		fc = f
+	}
+}
+
+// getURL returns an unused part upload URL, getting a new one if necessary.
+// B2 allows each URL to be used by only one upload at a time.
+func (l *LargeFile) getURL(ctx context.Context) (beFileChunkInterface, error) {
+	select {
+	case fc := <-l.urls:
+		return fc, nil
+	default:
+		return l.f.getUploadPartURL(ctx)
+	}
+}
+
+func (l *LargeFile) putURL(fc beFileChunkInterface) {
+	select {
+	case l.urls <- fc:
+	default:
+	}
+}
+
+// Finish completes the upload.  All parts must have been uploaded, and no part
+// uploads may be in progress.  It returns the resulting object.
+func (l *LargeFile) Finish(ctx context.Context) (*Object, error) {
+	f, err := l.f.finishLargeFile(ctx)
+	if err != nil {
+		// B2 may have finished the file even though we didn't hear about
+		// it, e.g. because the response timed out.  Retrying would then
+		// fail, as the file is no longer unfinished, so check first.  The
+		// check gets its own deadline, since ctx may be why the finish
+		// failed.
+		cctx, cancel := context.WithTimeout(detach(ctx), finishCheckTimeout)
+		defer cancel()
+		if o, ok := l.finished(cctx); ok {
+			blog.V(1).Infof("b2 large file %s: finish returned %v, but the file is finished", l.name, err)
+			return o, nil
+		}
+		return nil, err
+	}
+	return &Object{
+		name: l.name,
+		f:    f,
+		b:    l.b,
+	}, nil
+}
+
+// finishCheckTimeout bounds the check Finish makes after a failure.
+var finishCheckTimeout = 30 * time.Second
+
+// detached is a context that carries the values of its parent, but not its
+// deadline or cancellation.
+type detached struct {
+	context.Context
+}
+
+func (detached) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detached) Done() <-chan struct{}       { return nil }
+func (detached) Err() error                  { return nil }
+
+// detach returns a context with the values of ctx that is never done.
+func detach(ctx context.Context) context.Context {
+	return detached{ctx}
+}
+
+// finished reports whether B2 has finished the upload, and if so returns the
+// resulting object.
+func (l *LargeFile) finished(ctx context.Context) (*Object, bool) {
+	f := l.b.b.file(l.ID(), l.name)
+	fi, err := f.getFileInfo(ctx)
+	if err != nil {
+		return nil, false
+	}
+	_, _, _, _, _, status, _ := fi.stats()
+	if status != "upload" {
+		return nil, false
+	}
+	return &Object{
+		name: l.name,
+		f:    f,
+		b:    l.b,
+	}, true
+}
+
+// Cancel abandons the upload and deletes any parts that have been uploaded.
+func (l *LargeFile) Cancel(ctx context.Context) error {
+	return l.f.cancel(ctx)
+}
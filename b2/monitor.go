@@ -15,10 +15,13 @@
 package b2
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"html/template"
 	"math"
 	"net/http"
+	"net/http/httptrace"
 	"sort"
 	"time"
 
@@ -37,6 +40,10 @@ type StatusInfo struct {
 	// RPCs contains information about recently made RPC calls over the last
 	// minute, five minutes, hour, and for all time.
 	RPCs map[time.Duration]MethodList
+
+	// Requests holds, for each B2 API method, the most recent response
+	// received for it.
+	Requests map[string]*RequestInfo
 }
 
 // MethodList is an accumulation of RPC calls that have been made over a given
@@ -93,11 +100,201 @@ func newMethodCounter(d, res time.Duration) methodCounter {
 	}
 }
 
+// OpStats counts the requests made for a single B2 API method.
+type OpStats struct {
+	// Requests is the number of requests made, including retries.
+	Requests int
+
+	// Errors is the number of requests that failed, whether because the
+	// request never received a response or because the response was an
+	// error.  Failed requests that B2 marks as temporary are retried, so a
+	// high count relative to Requests indicates an unhealthy node or network.
+	Errors int
+
+	// NetworkErrors is the number of requests that received no response.
+	NetworkErrors int
+
+	// Statuses counts the HTTP status codes of responses.
+	Statuses map[int]int
+}
+
+// Stats returns cumulative request and error counts for each B2 API method
+// since the client was created or ResetStats was last called.  The result is
+// a copy and is not updated.
+func (c *Client) Stats() map[string]*OpStats {
+	c.slock.Lock()
+	defer c.slock.Unlock()
+
+	r := make(map[string]*OpStats)
+	for name, s := range c.sOps {
+		cp := *s
+		cp.Statuses = make(map[int]int)
+		for code, n := range s.Statuses {
+			cp.Statuses[code] = n
+		}
+		r[name] = &cp
+	}
+	return r
+}
+
+// ResetStats clears the counts returned by Stats.
+func (c *Client) ResetStats() {
+	c.slock.Lock()
+	defer c.slock.Unlock()
+
+	c.sOps = nil
+	c.sTLS = nil
+}
+
+// TLSStats counts the connections used to reach a single host.  Each upload
+// host B2 hands out is counted separately, which shows how well connections
+// to it are pooled over the parts of a large file.
+type TLSStats struct {
+	// Requests is the number of requests that got a connection to the host.
+	Requests int
+
+	// Reused is the number of requests sent on a connection that had
+	// already been used, and so needed no handshake.
+	Reused int
+
+	// Handshakes is the number of TLS handshakes completed with the host.
+	Handshakes int
+
+	// Resumed is the number of handshakes that resumed an earlier session
+	// rather than negotiating a new one.  Sessions are resumed only when the
+	// transport's tls.Config has a ClientSessionCache, which the default
+	// transport does not.
+	Resumed int
+}
+
+// ResumptionRate returns the fraction of handshakes that resumed a session.
+func (ts *TLSStats) ResumptionRate() float64 {
+	if ts.Handshakes == 0 {
+		return 0
+	}
+	return float64(ts.Resumed) / float64(ts.Handshakes)
+}
+
+// TLSStats returns cumulative connection and handshake counts for each host
+// since the client was created or ResetStats was last called.  Counts are
+// only kept when the transport supports net/http/httptrace, as
+// *http.Transport does.  The result is a copy and is not updated.
+func (c *Client) TLSStats() map[string]*TLSStats {
+	c.slock.Lock()
+	defer c.slock.Unlock()
+
+	r := make(map[string]*TLSStats)
+	for host, s := range c.sTLS {
+		cp := *s
+		r[host] = &cp
+	}
+	return r
+}
+
+func (c *Client) tlsStats(host string) *TLSStats {
+	if c.sTLS == nil {
+		c.sTLS = make(map[string]*TLSStats)
+	}
+	s, ok := c.sTLS[host]
+	if !ok {
+		s = &TLSStats{}
+		c.sTLS[host] = s
+	}
+	return s
+}
+
+// traceTLS returns ctx with a trace that records, for host, the connections
+// and handshakes of the request made with it.
+func (c *Client) traceTLS(ctx context.Context, host string) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			c.slock.Lock()
+			defer c.slock.Unlock()
+			s := c.tlsStats(host)
+			s.Requests++
+			if info.Reused {
+				s.Reused++
+			}
+		},
+		TLSHandshakeDone: func(cs tls.ConnectionState, err error) {
+			if err != nil {
+				return
+			}
+			c.slock.Lock()
+			defer c.slock.Unlock()
+			s := c.tlsStats(host)
+			s.Handshakes++
+			if cs.DidResume {
+				s.Resumed++
+			}
+		},
+	})
+}
+
+func (c *Client) recordOp(name string, resp *http.Response, err error) {
+	c.slock.Lock()
+	defer c.slock.Unlock()
+
+	if c.sOps == nil {
+		c.sOps = make(map[string]*OpStats)
+	}
+	s, ok := c.sOps[name]
+	if !ok {
+		s = &OpStats{Statuses: make(map[int]int)}
+		c.sOps[name] = s
+	}
+	s.Requests++
+	if err != nil || resp == nil {
+		s.Errors++
+		s.NetworkErrors++
+		return
+	}
+	s.Statuses[resp.StatusCode]++
+	if resp.StatusCode >= 400 {
+		s.Errors++
+	}
+}
+
+// A ProgressCounter is credited with the bytes moved by the Writers and
+// Readers that are given it, from as many goroutines as are moving them.  A
+// *progress.Tracker, from package x/progress, is one.
+type ProgressCounter interface {
+	Add(n int64)
+}
+
+// addProgress credits n bytes to p, if it is set.
+func addProgress(p ProgressCounter, n int) {
+	if p != nil {
+		p.Add(int64(n))
+	}
+}
+
 // WriterStatus reports the status for each writer.
 type WriterStatus struct {
 	// Progress is a slice of completion ratios.  The index of a ratio is its
 	// chunk id less one.
 	Progress []float64
+
+	// Workers is the number of threads started to send chunks, and Busy is
+	// the number of them currently sending one.  Workers are only started
+	// once a writer has more than one chunk to send.
+	Workers, Busy int
+
+	// Waiting is the number of full chunks that are waiting for a worker to
+	// become free.  While a chunk is waiting, writes block.
+	Waiting int
+
+	// Buffered is the number of bytes in the chunk currently being filled,
+	// and ChunkSize is the number it will hold before it is sent.
+	Buffered, ChunkSize int
+
+	// Sent is the number of bytes sent so far, including those of chunks
+	// still being sent.  Bytes sent again when a chunk is retried are not
+	// counted twice.
+	Sent int64
+
+	// Retries is the number of times a chunk has had to be sent again.
+	Retries int
 }
 
 // ReaderStatus reports the status for each reader.
@@ -113,9 +310,10 @@ func (c *Client) Status() *StatusInfo {
 	defer c.slock.Unlock()
 
 	si := &StatusInfo{
-		Writers: make(map[string]*WriterStatus),
-		Readers: make(map[string]*ReaderStatus),
-		RPCs:    make(map[time.Duration]MethodList),
+		Writers:  make(map[string]*WriterStatus),
+		Readers:  make(map[string]*ReaderStatus),
+		RPCs:     make(map[time.Duration]MethodList),
+		Requests: make(map[string]*RequestInfo),
 	}
 
 	for name, w := range c.sWriters {
@@ -130,6 +328,15 @@ func (c *Client) Status() *StatusInfo {
 		si.RPCs[c.d] = c.retrieve()
 	}
 
+	for name, ri := range c.sReqs {
+		cp := *ri
+		cp.Headers = make(map[string]string)
+		for k, v := range ri.Headers {
+			cp.Headers[k] = v
+		}
+		si.Requests[name] = &cp
+	}
+
 	return si
 }
 
@@ -0,0 +1,158 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CleanName returns the canonical form of an object name.  Backslashes are
+// treated as path separators and converted to "/", repeated separators are
+// collapsed, and "." and ".." elements are resolved lexically.  Leading and
+// trailing separators are removed, since B2 does not allow object names that
+// end in "/" and a leading "/" interferes with prefix listing.
+//
+// A ".." element that would climb above the root of the name is dropped.  Use
+// ScopedName to treat that as an error instead.
+func CleanName(name string) string {
+	name = strings.Replace(name, "\\", "/", -1)
+	name = path.Clean("/" + name)
+	return strings.TrimPrefix(name, "/")
+}
+
+// JoinName joins any number of elements into a single object name, separated
+// by "/".  The result is passed through CleanName.  Empty elements are
+// ignored.
+func JoinName(elem ...string) string {
+	return CleanName(strings.Join(elem, "/"))
+}
+
+// ScopedName joins name onto prefix, and returns an error if name would refer
+// to an object outside of prefix, e.g. because it begins with "..".  This is
+// useful when object names are derived from untrusted input, such as local
+// file paths or HTTP requests, and must stay beneath a given prefix.
+func ScopedName(prefix, name string) (string, error) {
+	rel := path.Clean(strings.Replace(name, "\\", "/", -1))
+	rel = strings.TrimPrefix(rel, "/")
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("%s: name escapes prefix %q", name, prefix)
+	}
+	return JoinName(prefix, rel), nil
+}
+
+// NameValues holds the values substituted into a name template by ExpandName.
+type NameValues struct {
+	Time time.Time // Formatted by date layouts.
+	SHA1 string    // Substituted for {hash}.
+	Seq  int       // Substituted for {seq}.
+}
+
+var (
+	hostOnce sync.Once
+	hostName string
+)
+
+func hostname() string {
+	hostOnce.Do(func() {
+		h, err := os.Hostname()
+		if err != nil {
+			h = "localhost"
+		}
+		hostName = h
+	})
+	return hostName
+}
+
+// ExpandName expands a name template, so that naming schemes such as
+// "logs/{host}/{2006/01/02}/{seq}.gz" can be shared by anything that writes
+// objects.  Text outside of braces is copied unchanged, and each braced
+// element is replaced:
+//
+//	{host}     the local hostname
+//	{seq}      v.Seq, padded to at least six digits
+//	{hash}     v.SHA1
+//	{hash:N}   the first N characters of v.SHA1
+//	{layout}   v.Time formatted with the given time layout, e.g. {2006-01-02}
+//
+// Braces can be included literally as {{ and }}.  Any other element is an
+// error.  The result is passed through CleanName.
+func ExpandName(tmpl string, v NameValues) (string, error) {
+	var out []string
+	for len(tmpl) > 0 {
+		i := strings.IndexAny(tmpl, "{}")
+		if i < 0 {
+			out = append(out, tmpl)
+			break
+		}
+		out = append(out, tmpl[:i])
+		if i+1 < len(tmpl) && tmpl[i+1] == tmpl[i] {
+			out = append(out, tmpl[i:i+1])
+			tmpl = tmpl[i+2:]
+			continue
+		}
+		if tmpl[i] == '}' {
+			return "", fmt.Errorf("%s: unmatched }", tmpl)
+		}
+		j := strings.IndexByte(tmpl[i:], '}')
+		if j < 0 {
+			return "", fmt.Errorf("%s: unmatched {", tmpl)
+		}
+		elem, err := expandElem(tmpl[i+1:i+j], v)
+		if err != nil {
+			return "", err
+		}
+		out = append(out, elem)
+		tmpl = tmpl[i+j+1:]
+	}
+	return CleanName(strings.Join(out, "")), nil
+}
+
+func expandElem(elem string, v NameValues) (string, error) {
+	switch {
+	case elem == "":
+		return "", fmt.Errorf("empty {} in name template")
+	case elem == "host":
+		return hostname(), nil
+	case elem == "seq":
+		return fmt.Sprintf("%06d", v.Seq), nil
+	case elem == "hash":
+		return v.SHA1, nil
+	case strings.HasPrefix(elem, "hash:"):
+		var n int
+		if _, err := fmt.Sscanf(elem, "hash:%d", &n); err != nil || n < 0 {
+			return "", fmt.Errorf("{%s}: bad hash length", elem)
+		}
+		if n > len(v.SHA1) {
+			n = len(v.SHA1)
+		}
+		return v.SHA1[:n], nil
+	}
+	if layoutProbe.Format(elem) == elem {
+		// Nothing in elem is a part of a time layout, so it is most
+		// likely a mistake, such as {hots}.
+		return "", fmt.Errorf("{%s}: unknown element", elem)
+	}
+	return v.Time.Format(elem), nil
+}
+
+// layoutProbe is a time whose every field formats differently from the
+// reference time, so that any time layout element formats differently from
+// itself.
+var layoutProbe = time.Date(1999, 11, 28, 10, 37, 48, 123456789, time.FixedZone("XYZ", 9*3600+30*60))
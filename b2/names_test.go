@@ -0,0 +1,131 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCleanName(t *testing.T) {
+	table := []struct {
+		in, want string
+	}{
+		{in: "", want: ""},
+		{in: "foo", want: "foo"},
+		{in: "/foo/bar/", want: "foo/bar"},
+		{in: "foo//bar", want: "foo/bar"},
+		{in: `foo\bar\baz`, want: "foo/bar/baz"},
+		{in: "foo/./bar", want: "foo/bar"},
+		{in: "foo/../bar", want: "bar"},
+		{in: "../../foo", want: "foo"},
+	}
+	for _, e := range table {
+		if got := CleanName(e.in); got != e.want {
+			t.Errorf("CleanName(%q): got %q, want %q", e.in, got, e.want)
+		}
+	}
+}
+
+func TestJoinName(t *testing.T) {
+	table := []struct {
+		in   []string
+		want string
+	}{
+		{in: nil, want: ""},
+		{in: []string{"foo", "bar"}, want: "foo/bar"},
+		{in: []string{"foo/", "/bar"}, want: "foo/bar"},
+		{in: []string{"", "foo", "", "bar"}, want: "foo/bar"},
+	}
+	for _, e := range table {
+		if got := JoinName(e.in...); got != e.want {
+			t.Errorf("JoinName(%q): got %q, want %q", e.in, got, e.want)
+		}
+	}
+}
+
+func TestScopedName(t *testing.T) {
+	table := []struct {
+		pfx, name string
+		want      string
+		fail      bool
+	}{
+		{pfx: "home/user", name: "file", want: "home/user/file"},
+		{pfx: "home/user", name: "a/../file", want: "home/user/file"},
+		{pfx: "home/user", name: "/file", want: "home/user/file"},
+		{pfx: "home/user", name: "../other/file", fail: true},
+		{pfx: "home/user", name: `a\..\..\file`, fail: true},
+		{pfx: "home/user", name: "..", fail: true},
+	}
+	for _, e := range table {
+		got, err := ScopedName(e.pfx, e.name)
+		if e.fail {
+			if err == nil {
+				t.Errorf("ScopedName(%q, %q): got %q, wanted an error", e.pfx, e.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ScopedName(%q, %q): %v", e.pfx, e.name, err)
+			continue
+		}
+		if got != e.want {
+			t.Errorf("ScopedName(%q, %q): got %q, want %q", e.pfx, e.name, got, e.want)
+		}
+	}
+}
+
+func TestExpandName(t *testing.T) {
+	v := NameValues{
+		Time: time.Date(2018, 3, 9, 14, 5, 0, 0, time.UTC),
+		SHA1: "2aae6c35c94fcfb415dbe95f408b9ce91ee846ed",
+		Seq:  42,
+	}
+	table := []struct {
+		in, want string
+		fail     bool
+	}{
+		{in: "plain/name", want: "plain/name"},
+		{in: "logs/{host}/{2006/01/02}/{seq}.gz", want: "logs/" + hostname() + "/2018/03/09/000042.gz"},
+		{in: "{hash:8}-{15:04}", want: "2aae6c35-14:05"},
+		{in: "{hash}", want: v.SHA1},
+		{in: "{hash:100}", want: v.SHA1},
+		{in: "{{literal}}", want: "{literal}"},
+		{in: "a//{2006}/../b", want: "a/b"},
+		{in: "{seq", fail: true},
+		{in: "seq}", fail: true},
+		{in: "{}", fail: true},
+		{in: "{hash:x}", fail: true},
+		{in: "{hots}", fail: true},
+		{in: "{sequence}", fail: true},
+		{in: "{Jan 2 PM}", want: "Mar 9 PM"},
+	}
+	for _, e := range table {
+		got, err := ExpandName(e.in, v)
+		if e.fail {
+			if err == nil {
+				t.Errorf("ExpandName(%q): got %q, wanted an error", e.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ExpandName(%q): %v", e.in, err)
+			continue
+		}
+		if got != e.want {
+			t.Errorf("ExpandName(%q): got %q, want %q", e.in, got, e.want)
+		}
+	}
+}
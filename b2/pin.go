@@ -0,0 +1,175 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"sync"
+)
+
+// PinHosts makes the client resolve the hosts it talks to once, when it is
+// created, and connect only to the addresses it found then.  The hosts and
+// addresses are reported by Client.Hosts, so that firewall rules can be
+// written for them.
+//
+// Any attempt to reach another host, as when B2 moves the account to a new
+// API or download host, fails with a *HostChangedError.  Uploads, however,
+// are sent to hosts that B2 chooses for each upload.  If uploads is true,
+// these hosts are resolved and pinned as they are first used, and added to
+// Client.Hosts; otherwise uploads fail with a *HostChangedError.
+//
+// PinHosts cannot be used with Proxy or Transport.
+func PinHosts(uploads bool) ClientOption {
+	return func(c *clientOptions) {
+		c.pins = &hostPins{
+			hosts:   make(map[string][]net.IP),
+			uploads: uploads,
+		}
+	}
+}
+
+// A HostChangedError is returned when a client created with PinHosts needs to
+// reach a host that was not pinned.
+type HostChangedError struct {
+	Host   string   // The host the client tried to reach.
+	Pinned []string // The hosts the client was pinned to.
+}
+
+func (e *HostChangedError) Error() string {
+	return fmt.Sprintf("b2: host %s is not pinned (pinned hosts are %v)", e.Host, e.Pinned)
+}
+
+// Permanent reports that retrying the request will not help.
+func (e *HostChangedError) Permanent() bool { return true }
+
+// Hosts returns the hosts that a client created with PinHosts may connect
+// to, and the addresses it connects to for each.  It returns nil for other
+// clients.
+func (c *Client) Hosts() map[string][]net.IP {
+	if c.opts.pins == nil {
+		return nil
+	}
+	return c.opts.pins.all()
+}
+
+type hostPins struct {
+	mu      sync.Mutex
+	hosts   map[string][]net.IP
+	uploads bool
+}
+
+var lookupIP = net.DefaultResolver.LookupIPAddr
+
+// pin resolves and pins the host of rawurl.
+func (p *hostPins) pin(ctx context.Context, rawurl string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	if u.Hostname() == "" {
+		return nil
+	}
+	_, err = p.add(ctx, u.Hostname())
+	return err
+}
+
+func (p *hostPins) add(ctx context.Context, host string) ([]net.IP, error) {
+	p.mu.Lock()
+	ips, ok := p.hosts[host]
+	p.mu.Unlock()
+	if ok {
+		return ips, nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := lookupIP(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pinned, ok := p.hosts[host]; ok {
+		return pinned, nil
+	}
+	p.hosts[host] = ips
+	return ips, nil
+}
+
+func (p *hostPins) lookup(host string) ([]net.IP, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ips, ok := p.hosts[host]
+	return ips, ok
+}
+
+func (p *hostPins) all() map[string][]net.IP {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m := make(map[string][]net.IP, len(p.hosts))
+	for h, ips := range p.hosts {
+		m[h] = append([]net.IP(nil), ips...)
+	}
+	return m
+}
+
+func (p *hostPins) names() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var names []string
+	for h := range p.hosts {
+		names = append(names, h)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// dialer returns a dial function that connects to the pinned addresses of
+// each host with dial.
+func (p *hostPins) dialer(dial func(context.Context, string, string) (net.Conn, error)) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		ips, ok := p.lookup(host)
+		if !ok {
+			if up, _ := ctx.Value(uploadKey{}).(bool); !up || !p.uploads {
+				return nil, &HostChangedError{Host: host, Pinned: p.names()}
+			}
+			ips, err = p.add(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+		}
+		err = fmt.Errorf("b2: no addresses pinned for %s", host)
+		for _, ip := range ips {
+			conn, derr := dial(ctx, network, net.JoinHostPort(ip.String(), port))
+			if derr == nil {
+				return conn, nil
+			}
+			err = derr
+		}
+		return nil, err
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"context"
+	"io"
+)
+
+// PipeTo writes the output of produce to o.  If produce returns an error, the
+// upload is abandoned and that error is returned; otherwise PipeTo returns
+// the result of closing the writer.  produce must not retain w.
+//
+//	err := b2.PipeTo(ctx, obj, func(w io.Writer) error {
+//		return json.NewEncoder(w).Encode(v)
+//	})
+func PipeTo(ctx context.Context, o *Object, produce func(w io.Writer) error, opts ...WriterOption) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := o.NewWriter(ctx, opts...)
+	if err := produce(w); err != nil {
+		// Cancelling the context before Close keeps the Writer from
+		// committing a partial object.
+		cancel()
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// PipeFrom passes the contents of o to consume, and returns its error.  If
+// consume reads the object to the end, PipeFrom also returns any error
+// encountered while verifying its checksum.  consume must not retain r.
+func PipeFrom(ctx context.Context, o *Object, consume func(r io.Reader) error) error {
+	r := o.NewReader(ctx)
+	defer r.Close()
+	if err := consume(r); err != nil {
+		return err
+	}
+	if r.vrfy == nil {
+		// consume never read anything.
+		return nil
+	}
+	if err, ok := r.Verify(); ok {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/kurin/blazer/internal/blog"
+)
+
+// A Policy describes the cleanup of objects beneath a prefix that the client
+// performs when EnforcePolicies is called.  Policies complement a bucket's
+// LifecycleRules: they can cancel abandoned large file uploads, which
+// lifecycle rules cannot, and their prefixes may overlap, in which case the
+// policy with the longest matching prefix governs an object.
+//
+// Like LifecycleRules, policies delete data.  Be careful.
+type Policy struct {
+	// Prefix selects the objects to which the policy applies.  The empty
+	// prefix applies to the whole bucket.
+	Prefix string
+
+	// CancelUnfinishedAfter cancels large file uploads that were started
+	// more than this long ago and have not been finished.  0 means "do not
+	// cancel unfinished uploads".
+	CancelUnfinishedAfter time.Duration
+
+	// DeleteHiddenAfter deletes versions that have been hidden for more
+	// than this long, whether by a hide marker or by the upload of a newer
+	// version.  Once every version it hides is gone, a hide marker older
+	// than this is deleted too.  0 means "do not delete hidden versions".
+	DeleteHiddenAfter time.Duration
+}
+
+// WithPolicies returns a copy of b that enforces policies, in addition to any
+// already set, when EnforcePolicies is called.  b itself is unchanged.
+func (b *Bucket) WithPolicies(policies ...Policy) *Bucket {
+	nb := *b
+	nb.policies = append(append([]Policy(nil), b.policies...), policies...)
+	return &nb
+}
+
+// EnforcePolicies applies the bucket's policies once, listing every object
+// they govern.  It is meant to be called periodically, e.g. daily.  Objects
+// that disappear while it runs, as when another process enforces the same
+// policies, are skipped.
+func (b *Bucket) EnforcePolicies(ctx context.Context) error {
+	for i := range b.policies {
+		p := &b.policies[i]
+		if p.CancelUnfinishedAfter > 0 {
+			if err := b.cancelUnfinished(ctx, p); err != nil {
+				return err
+			}
+		}
+		if p.DeleteHiddenAfter > 0 {
+			if err := b.deleteHidden(ctx, p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// governs reports whether p, of all the bucket's policies, applies to name.
+func (b *Bucket) governs(p *Policy, name string) bool {
+	if !strings.HasPrefix(name, p.Prefix) {
+		return false
+	}
+	for i := range b.policies {
+		q := &b.policies[i]
+		if len(q.Prefix) > len(p.Prefix) && strings.HasPrefix(name, q.Prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *Bucket) cancelUnfinished(ctx context.Context, p *Policy) error {
+	cutoff := now().Add(-p.CancelUnfinishedAfter)
+	iter := b.List(ctx, ListUnfinished(), ListPrefix(p.Prefix), ListUploadedBefore(cutoff))
+	for iter.Next() {
+		obj := iter.Object()
+		if !b.governs(p, obj.name) {
+			continue
+		}
+		blog.V(2).Infof("b2 policy %q: canceling upload of %s", p.Prefix, obj.name)
+		if err := obj.f.compileParts(0, nil).cancel(ctx); err != nil && !IsNotExist(err) {
+			return err
+		}
+	}
+	return iter.Err()
+}
+
+func (b *Bucket) deleteHidden(ctx context.Context, p *Policy) error {
+	cutoff := now().Add(-p.DeleteHiddenAfter)
+	var (
+		name     string
+		hiddenAt time.Time // when the last version seen was superseded
+		marker   *Object   // an expired hide marker, if name has one
+		kept     bool      // whether any hidden version of name remains
+	)
+	// Versions of a name are listed together, newest first.
+	done := func() error {
+		if marker == nil || kept {
+			return nil
+		}
+		blog.V(2).Infof("b2 policy %q: deleting hide marker for %s", p.Prefix, marker.name)
+		if err := marker.Delete(ctx); err != nil && !IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	iter := b.List(ctx, ListHidden(), ListPrefix(p.Prefix))
+	for iter.Next() {
+		obj := iter.Object()
+		if obj.f.status() == "start" {
+			continue
+		}
+		stamp := obj.f.timestamp()
+		if obj.name != name {
+			if err := done(); err != nil {
+				return err
+			}
+			name, marker, kept = obj.name, nil, false
+			if obj.f.status() == "hide" && stamp.Before(cutoff) && b.governs(p, name) {
+				marker = obj
+			}
+			hiddenAt = stamp
+			continue
+		}
+		expired := hiddenAt.Before(cutoff)
+		hiddenAt = stamp
+		if !expired || !b.governs(p, name) {
+			kept = true
+			continue
+		}
+		blog.V(2).Infof("b2 policy %q: deleting hidden version of %s", p.Prefix, name)
+		if err := obj.Delete(ctx); err != nil && !IsNotExist(err) {
+			return err
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	return done()
+}
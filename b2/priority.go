@@ -0,0 +1,149 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"context"
+	"sync"
+)
+
+// A Priority ranks transfers that compete for a client's transfer slots; see
+// MaxTransfers.  Higher priorities go first.
+type Priority int
+
+const (
+	// Background is for bulk work, such as backups, that can wait.
+	Background Priority = -1
+
+	// Normal is the priority of transfers that have not been given one.
+	Normal Priority = 0
+
+	// Interactive is for transfers that someone is waiting on, such as a
+	// restore they asked for.
+	Interactive Priority = 1
+)
+
+type priorityKey struct{}
+
+// WithPriority returns a context that gives the transfers of Writers, Readers,
+// and BlockReaders created with it priority p.
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+func priorityOf(ctx context.Context) Priority {
+	p, _ := ctx.Value(priorityKey{}).(Priority)
+	return p
+}
+
+// MaxTransfers limits the client to n data transfers at once, across all of
+// its Writers, Readers, and BlockReaders.  A transfer is one simple upload,
+// large file part, download chunk, or block.  When a transfer finishes, its
+// slot goes to the waiting transfer with the highest Priority, and among
+// those, to the one that has waited longest.  Lower priority transfers wait
+// as long as higher priority ones are queued, so a bulk backup yields to a
+// restore as soon as its current transfers finish.
+//
+// Without MaxTransfers, transfers are limited only by each Writer's
+// ConcurrentUploads and each Reader's ConcurrentDownloads, and priorities
+// have no effect.
+func MaxTransfers(n int) ClientOption {
+	return func(c *clientOptions) {
+		if n > 0 {
+			c.transfers = &scheduler{free: n}
+		}
+	}
+}
+
+// scheduler hands out a fixed number of slots in priority order.  A nil
+// scheduler has unlimited slots.
+type scheduler struct {
+	mu      sync.Mutex
+	free    int
+	waiting []*slotWaiter // highest priority first, then oldest first
+}
+
+type slotWaiter struct {
+	p     Priority
+	ready chan struct{}
+}
+
+// acquire waits for a slot, at the priority carried by ctx.  If it returns
+// nil, release must be called when the transfer is done.
+func (s *scheduler) acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	if s.free > 0 {
+		s.free--
+		s.mu.Unlock()
+		return nil
+	}
+	w := &slotWaiter{p: priorityOf(ctx), ready: make(chan struct{})}
+	i := len(s.waiting)
+	for i > 0 && s.waiting[i-1].p < w.p {
+		i--
+	}
+	s.waiting = append(s.waiting, nil)
+	copy(s.waiting[i+1:], s.waiting[i:])
+	s.waiting[i] = w
+	s.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, o := range s.waiting {
+		if o == w {
+			s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+			return ctx.Err()
+		}
+	}
+	// The slot was handed over just as ctx was done; pass it on.
+	s.releaseLocked()
+	return ctx.Err()
+}
+
+// release returns a slot acquired with acquire.
+func (s *scheduler) release() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.releaseLocked()
+}
+
+func (s *scheduler) releaseLocked() {
+	if len(s.waiting) == 0 {
+		s.free++
+		return
+	}
+	w := s.waiting[0]
+	s.waiting = s.waiting[1:]
+	close(w.ready)
+}
+
+// transfers returns the client's scheduler, if it has one.
+func (c *Client) transfers() *scheduler {
+	if c == nil {
+		return nil
+	}
+	return c.opts.transfers
+}
@@ -23,14 +23,22 @@ import (
 	"hash"
 	"io"
 	"sync"
-	"time"
 
 	"github.com/kurin/blazer/internal/blog"
 )
 
 var errNoMoreContent = errors.New("416: out of content")
 
+// ErrReaderClosed is returned by Read on a Reader that has been closed, so
+// that it can be told apart from the context.Canceled or
+// context.DeadlineExceeded returned when the caller's context is done.
+var ErrReaderClosed = errors.New("b2: read on closed Reader")
+
 // Reader reads files from B2.
+//
+// If a download fails, the Reader cancels its remaining work and every later
+// call to Read returns the error that caused the failure, not the
+// cancellation.
 type Reader struct {
 	// ConcurrentDownloads is the number of simultaneous downloads to pull from
 	// B2.  Values greater than one will cause B2 to make multiple HTTP requests
@@ -42,12 +50,22 @@ type Reader struct {
 	// 10MB.
 	ChunkSize int
 
+	// ReadHidden, if set, causes the Reader to read the most recent version of
+	// the object that is not a hide marker when the object has been hidden,
+	// e.g. by an accidental Delete in a bucket that keeps old versions.  If the
+	// object has no such version, reads fail as they otherwise would.
+	ReadHidden bool
+
+	// Progress, if set, is credited with each byte as it is read.
+	Progress ProgressCounter
+
 	ctx        context.Context
 	cancel     context.CancelFunc // cancels ctx
 	o          *Object
 	name       string
 	offset     int64 // the start of the file
 	length     int64 // the length to read, or -1
+	whole      bool  // the entire object is being read
 	csize      int   // chunk size
 	read       int   // amount read
 	chwid      int   // chunks written
@@ -56,17 +74,21 @@ type Reader struct {
 	init       sync.Once
 	chunks     map[int]*rchunk
 	vrfy       hash.Hash
-	readOffEnd bool
-	sha1       string
+	readOffEnd bool   // guarded by rmux
+	sha1       string // guarded by emux
 
 	rmux  sync.Mutex // guards rcond
 	rcond *sync.Cond
 
-	emux sync.RWMutex // guards err, believe it or not
+	emux sync.RWMutex // guards err and sha1, believe it or not
 	err  error
 
 	smux sync.Mutex
 	smap map[int]*meteredReader
+
+	hidden sync.Once // finds id when the object is hidden
+	id     string    // the ID of the version to read, if not the latest
+	iderr  error
 }
 
 type rchunk struct {
@@ -74,8 +96,23 @@ type rchunk struct {
 	final bool
 }
 
-// Close frees resources associated with the download.
+// A ReaderOption sets Reader-specific behavior.
+type ReaderOption func(*Reader)
+
+// DefaultReaderOptions returns a ClientOption that will apply the given
+// ReaderOptions to every Reader.  These options can be overridden by passing
+// new options to NewReader or NewRangeReader.
+func DefaultReaderOptions(opts ...ReaderOption) ClientOption {
+	return func(c *clientOptions) {
+		c.readerOpts = opts
+	}
+}
+
+// Close frees resources associated with the download.  It stops any chunks
+// still being fetched and makes no requests of its own, so unlike Writer,
+// Reader has no CloseWithContext.
 func (r *Reader) Close() error {
+	r.setErrNoCancel(ErrReaderClosed)
 	r.cancel()
 	r.o.b.c.removeReader(r)
 	return nil
@@ -106,6 +143,13 @@ func (r *Reader) getErr() error {
 
 func (r *Reader) thread() {
 	go func() {
+		sched := r.o.b.c.transfers()
+		var held bool // whether this thread holds a transfer slot
+		defer func() {
+			if held {
+				sched.release()
+			}
+		}()
 		for {
 			var buf *rchunk
 			select {
@@ -130,14 +174,20 @@ func (r *Reader) thread() {
 				}
 				r.length -= size
 			}
-			var b backoff
+			if err := sched.acquire(r.ctx); err != nil {
+				r.setErr(err)
+				r.rcond.Broadcast()
+				return
+			}
+			held = true
+			rt := retrier{p: retries(r.ctx, r.o.b.r)}
 		redo:
-			fr, err := r.o.b.b.downloadFileByName(r.ctx, r.name, offset, size)
+			fr, err := r.download(offset, size)
 			if err == errNoMoreContent {
 				// this read generated a 416 so we are entirely past the end of the object
-				r.readOffEnd = true
 				buf.final = true
 				r.rmux.Lock()
+				r.readOffEnd = true
 				r.chunks[chunkID] = buf
 				r.rmux.Unlock()
 				r.rcond.Broadcast()
@@ -148,11 +198,16 @@ func (r *Reader) thread() {
 				r.rcond.Broadcast()
 				return
 			}
-			rsize, _, sha1, _ := fr.stats()
-			if len(sha1) == 40 && r.sha1 != sha1 {
+			rsize, _, sha1, info := fr.stats()
+			if len(sha1) != 40 {
+				sha1 = info["large_file_sha1"]
+			}
+			if len(sha1) == 40 {
+				r.emux.Lock()
 				r.sha1 = sha1
+				r.emux.Unlock()
 			}
-			mr := &meteredReader{r: noopResetter{fr}, size: int(rsize)}
+			mr := &meteredReader{r: noopResetter{fr}, size: int(rsize), ctx: r.ctx, bw: r.o.b.c.bandwidth()}
 			r.smux.Lock()
 			r.smap[chunkID] = mr
 			r.smux.Unlock()
@@ -163,9 +218,17 @@ func (r *Reader) thread() {
 			r.smux.Unlock()
 			if i < int64(rsize) || err == io.ErrUnexpectedEOF {
 				// Probably the network connection was closed early.  Retry.
-				blog.V(1).Infof("b2 reader %d: got %dB of %dB; retrying after %v", chunkID, i, rsize, b)
-				if err := b.wait(r.ctx); err != nil {
-					r.setErr(err)
+				wait, ok := rt.next(0)
+				if !ok {
+					r.setErr(io.ErrUnexpectedEOF)
+					r.rcond.Broadcast()
+					return
+				}
+				blog.V(1).Infof("b2 reader %d: got %dB of %dB; retrying after %v", chunkID, i, rsize, wait)
+				select {
+				case <-after(wait):
+				case <-r.ctx.Done():
+					r.setErr(r.ctx.Err())
 					r.rcond.Broadcast()
 					return
 				}
@@ -177,6 +240,8 @@ func (r *Reader) thread() {
 				r.rcond.Broadcast()
 				return
 			}
+			sched.release()
+			held = false
 			r.rmux.Lock()
 			r.chunks[chunkID] = buf
 			r.rmux.Unlock()
@@ -185,6 +250,52 @@ func (r *Reader) thread() {
 	}()
 }
 
+func (r *Reader) download(offset, size int64) (beFileReaderInterface, error) {
+	// Once a version has been chosen, either by ObjectByID or by finding the
+	// last version of a hidden object, every chunk must come from it.
+	r.emux.RLock()
+	id := r.id
+	r.emux.RUnlock()
+	if id != "" {
+		return r.o.b.b.downloadFileByID(r.ctx, id, offset, size)
+	}
+	fr, err := r.o.b.b.downloadFileByName(r.ctx, r.name, offset, size)
+	if !r.ReadHidden || !IsNotExist(err) {
+		return fr, err
+	}
+	r.hidden.Do(func() {
+		id, err := r.o.b.lastLiveVersion(r.ctx, r.name)
+		r.emux.Lock()
+		r.id, r.iderr = id, err
+		r.emux.Unlock()
+	})
+	r.emux.RLock()
+	id, iderr := r.id, r.iderr
+	r.emux.RUnlock()
+	if iderr != nil {
+		return nil, iderr
+	}
+	if id == "" {
+		return nil, err
+	}
+	blog.V(1).Infof("b2 reader %s: object is hidden; reading version %s", r.name, id)
+	return r.o.b.b.downloadFileByID(r.ctx, id, offset, size)
+}
+
+// lastLiveVersion returns the ID of the most recent version of the named
+// object that is not a hide marker, or "" if there is none.
+func (b *Bucket) lastLiveVersion(ctx context.Context, name string) (string, error) {
+	var id string
+	err := b.walkVersions(ctx, name, func(f beFileInterface) bool {
+		if f.status() == "upload" {
+			id = f.id()
+			return false
+		}
+		return true
+	})
+	return id, err
+}
+
 func (r *Reader) curChunk() (*rchunk, error) {
 	ch := make(chan *rchunk)
 	go func() {
@@ -214,6 +325,10 @@ func (r *Reader) initFunc() {
 	r.smux.Lock()
 	r.smap = make(map[int]*meteredReader)
 	r.smux.Unlock()
+	if r.offset < 0 {
+		r.setErrNoCancel(fmt.Errorf("b2: invalid Reader for %s: offset %d is negative", r.name, r.offset))
+		return
+	}
 	r.o.b.c.addReader(r)
 	r.rcond = sync.NewCond(&r.rmux)
 	cr := r.ConcurrentDownloads
@@ -237,6 +352,9 @@ func (r *Reader) Read(p []byte) (int, error) {
 		return 0, err
 	}
 	r.init.Do(r.initFunc)
+	if err := r.getErr(); err != nil {
+		return 0, err
+	}
 	chunk, err := r.curChunk()
 	if err != nil {
 		r.setErrNoCancel(err)
@@ -245,9 +363,11 @@ func (r *Reader) Read(p []byte) (int, error) {
 	n, err := chunk.Read(p)
 	r.vrfy.Write(p[:n]) // Hash.Write never returns an error.
 	r.read += n
+	addProgress(r.Progress, n)
 	if err == io.EOF {
 		if chunk.final {
 			close(r.chbuf)
+			err = r.finish()
 			r.setErrNoCancel(err)
 			return n, err
 		}
@@ -260,6 +380,60 @@ func (r *Reader) Read(p []byte) (int, error) {
 	return n, err
 }
 
+// WriteTo satisfies the io.WriterTo interface.  Each chunk is written to w
+// directly from its download buffer, without being copied through an
+// intermediate slice as with Read.  It returns the number of bytes w accepted,
+// and a nil error once the whole object has been written.
+//
+// Note that io.Copy will automatically choose to use WriteTo.
+func (r *Reader) WriteTo(w io.Writer) (int64, error) {
+	if err := r.getErr(); err != nil {
+		if err == io.EOF {
+			return 0, nil
+		}
+		return 0, err
+	}
+	r.init.Do(r.initFunc)
+	if err := r.getErr(); err != nil {
+		return 0, err
+	}
+	var total int64
+	for {
+		chunk, err := r.curChunk()
+		if err != nil {
+			r.setErrNoCancel(err)
+			return total, err
+		}
+		if p := chunk.Bytes(); len(p) > 0 {
+			n, err := w.Write(p)
+			r.vrfy.Write(p[:n])
+			chunk.Next(n)
+			r.read += n
+			addProgress(r.Progress, n)
+			total += int64(n)
+			if err == nil && n < len(p) {
+				err = io.ErrShortWrite
+			}
+			if err != nil {
+				// The rest of the chunk can still be read.
+				return total, err
+			}
+		}
+		if chunk.final {
+			close(r.chbuf)
+			err := r.finish()
+			r.setErrNoCancel(err)
+			if err == io.EOF {
+				return total, nil
+			}
+			return total, err
+		}
+		r.chrid++
+		chunk.Reset()
+		r.chbuf <- chunk
+	}
+}
+
 func (r *Reader) status() *ReaderStatus {
 	r.smux.Lock()
 	defer r.smux.Unlock()
@@ -275,6 +449,41 @@ func (r *Reader) status() *ReaderStatus {
 	return rs
 }
 
+// ChecksumError is returned by Read, in place of io.EOF, when an entire object
+// has been read and its contents don't match the SHA1 that B2 has for it.
+// Ranged reads, and large files uploaded without a SHA1, are not checked.
+type ChecksumError struct {
+	Name string
+	Got  string
+	Want string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("b2: %s: bad SHA1: got %s, want %s", e.Name, e.Got, e.Want)
+}
+
+// finish is called once the last chunk has been read.  It returns io.EOF, or a
+// ChecksumError if the whole object was read and its hash is wrong.
+func (r *Reader) finish() error {
+	r.rmux.Lock()
+	end := r.readOffEnd
+	r.rmux.Unlock()
+	if !r.whole || !end {
+		return io.EOF
+	}
+	r.emux.RLock()
+	want := r.sha1
+	r.emux.RUnlock()
+	if want == "" {
+		return io.EOF
+	}
+	got := fmt.Sprintf("%x", r.vrfy.Sum(nil))
+	if got != want {
+		return &ChecksumError{Name: r.name, Got: got, Want: want}
+	}
+	return io.EOF
+}
+
 // Verify checks the SHA1 hash on download and compares it to the SHA1 hash
 // submitted on upload.  If the two differ, this returns an error.  If the
 // correct hash could not be calculated (if, for example, the entire object was
@@ -282,7 +491,10 @@ func (r *Reader) status() *ReaderStatus {
 // hash was not sent), this returns (nil, false).
 func (r *Reader) Verify() (error, bool) {
 	got := fmt.Sprintf("%x", r.vrfy.Sum(nil))
-	if r.sha1 == got {
+	r.emux.RLock()
+	want := r.sha1
+	r.emux.RUnlock()
+	if want == got {
 		return nil, true
 	}
 	// TODO: if the exact length of the file is requested AND the checksum is
@@ -290,10 +502,13 @@ func (r *Reader) Verify() (error, bool) {
 	// because there's no good way that I can tell to determine that we've hit
 	// the end of the file without reading off the end.  Consider reading N+1
 	// bytes at the very end to close this hole.
-	if r.offset > 0 || !r.readOffEnd || len(r.sha1) != 40 {
+	r.rmux.Lock()
+	end := r.readOffEnd
+	r.rmux.Unlock()
+	if r.offset > 0 || !end || len(want) != 40 {
 		return nil, false
 	}
-	return fmt.Errorf("bad hash: got %v, want %v", got, r.sha1), true
+	return fmt.Errorf("bad hash: got %v, want %v", got, want), true
 }
 
 // strip a writer of any non-Write methods
@@ -325,24 +540,3 @@ type noopResetter struct {
 }
 
 func (noopResetter) Reset() error { return nil }
-
-type backoff time.Duration
-
-func (b *backoff) wait(ctx context.Context) error {
-	if *b == 0 {
-		*b = backoff(time.Millisecond)
-	}
-	select {
-	case <-time.After(time.Duration(*b)):
-		if time.Duration(*b) < time.Second*10 {
-			*b <<= 1
-		}
-		return nil
-	case <-ctx.Done():
-		return ctx.Err()
-	}
-}
-
-func (b backoff) String() string {
-	return time.Duration(b).String()
-}
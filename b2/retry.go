@@ -0,0 +1,184 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy controls how requests that fail with temporary errors are
+// retried.  The delay between attempts starts at Base and doubles with each
+// attempt, up to Max.  When B2 asks for a specific delay, that is used
+// instead.
+//
+// Most callers should use one of the presets, such as BalancedRetries, rather
+// than writing a policy.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times a request is made,
+	// including the first.  If zero, requests are retried until their
+	// context is done.
+	MaxAttempts int
+
+	// Base is the delay before the first retry.  If zero, it is one second,
+	// so that a policy which sets only MaxAttempts or Max does not retry in
+	// a tight loop.
+	Base time.Duration
+
+	// Max is the longest delay between attempts.  If zero, delays are not
+	// capped.
+	Max time.Duration
+
+	// Jitter is the fraction, from 0 to 1, by which each delay is randomly
+	// lengthened or shortened, so that many clients that fail at once do not
+	// all retry at once.
+	Jitter float64
+}
+
+var (
+	// AggressiveRetries retries quickly, but gives up after ten attempts.  It
+	// suits interactive use, where a fast failure is better than a long
+	// wait.
+	AggressiveRetries = RetryPolicy{MaxAttempts: 10, Base: 100 * time.Millisecond, Max: 5 * time.Second, Jitter: 0.1}
+
+	// BalancedRetries is the default policy.  It retries until the context
+	// is done, backing off from one second to thirty.
+	BalancedRetries = RetryPolicy{Base: time.Second, Max: 30 * time.Second, Jitter: 0.02}
+
+	// PatientRetries retries until the context is done, backing off from five
+	// seconds to five minutes.  It suits long-running background jobs that
+	// should ride out an outage rather than fail.
+	PatientRetries = RetryPolicy{Base: 5 * time.Second, Max: 5 * time.Minute, Jitter: 0.1}
+
+	// NoRetries makes every request exactly once.
+	NoRetries = RetryPolicy{MaxAttempts: 1}
+)
+
+// Retries returns a ClientOption that sets the policy for retrying requests
+// that fail with temporary errors.  The default is BalancedRetries.  Writers
+// and Readers can override it with WriteRetries and ReadRetries.
+func Retries(p RetryPolicy) ClientOption {
+	return func(c *clientOptions) {
+		c.retry = &p
+	}
+}
+
+// WriteRetries sets the retry policy for the requests made by a Writer,
+// including the upload of each part, in place of the client's.
+//
+// Writers once backed off from 15ms to 15s between attempts to upload a part.
+// Under the default BalancedRetries they back off from one second to thirty;
+// WriteRetries(RetryPolicy{Base: 15 * time.Millisecond, Max: 15 * time.Second})
+// restores the old pacing.
+func WriteRetries(p RetryPolicy) WriterOption {
+	return func(w *Writer) {
+		w.ctx = withRetries(w.ctx, p)
+	}
+}
+
+// ReadRetries sets the retry policy for the requests made by a Reader in
+// place of the client's.  It also paces the retries of downloads that end
+// early.
+func ReadRetries(p RetryPolicy) ReaderOption {
+	return func(r *Reader) {
+		r.ctx = withRetries(r.ctx, p)
+	}
+}
+
+type retryKey struct{}
+
+func withRetries(ctx context.Context, p RetryPolicy) context.Context {
+	return context.WithValue(ctx, retryKey{}, p)
+}
+
+// retries returns the policy for requests made with ctx: the one attached by
+// WriteRetries or ReadRetries, if any, or else the client's.
+func retries(ctx context.Context, ri beRootInterface) RetryPolicy {
+	if p, ok := ctx.Value(retryKey{}).(RetryPolicy); ok {
+		return p
+	}
+	return ri.retryPolicy()
+}
+
+// A retrier paces the attempts of a single request.
+type retrier struct {
+	p        RetryPolicy
+	attempts int
+	prev     time.Duration
+}
+
+// next records a failed attempt and returns how long to wait before the next
+// one, or false if there should not be one.  If hint is positive, it is the
+// delay B2 asked for, and is used as is.
+func (r *retrier) next(hint time.Duration) (time.Duration, bool) {
+	r.attempts++
+	if r.p.Exhausted(r.attempts) {
+		return 0, false
+	}
+	if hint > 0 {
+		r.prev = hint
+		return hint, true
+	}
+	r.prev = r.p.delay(r.prev)
+	return r.p.jitter(r.prev), true
+}
+
+// Exhausted reports whether p gives up on something that has failed the
+// given number of times.
+func (p RetryPolicy) Exhausted(failures int) bool {
+	return p.MaxAttempts > 0 && failures >= p.MaxAttempts
+}
+
+// Delay returns how long p waits before trying again after the given number
+// of failures: Base after the first, doubling after each one after that, up
+// to Max, and adjusted by Jitter.  It lets work that retries on its own
+// schedule, such as a queue of uploads, back off as requests do.
+func (p RetryPolicy) Delay(failures int) time.Duration {
+	d := p.delay(0)
+	for i := 1; i < failures; i++ {
+		next := p.delay(d)
+		if next <= d {
+			// Capped, or no longer growing.
+			break
+		}
+		d = next
+	}
+	return p.jitter(d)
+}
+
+// defaultRetryBase is the first delay of a policy with no Base.
+const defaultRetryBase = time.Second
+
+// delay returns the delay that should follow a delay of prev, or the first
+// delay if prev is zero.
+func (p RetryPolicy) delay(prev time.Duration) time.Duration {
+	d := p.Base
+	if d <= 0 {
+		d = defaultRetryBase
+	}
+	if prev > 0 {
+		d = prev * 2
+	}
+	if p.Max > 0 && d > p.Max {
+		d = p.Max
+	}
+	return d
+}
+
+// jitter randomly adjusts d by up to p.Jitter of its length.
+func (p RetryPolicy) jitter(d time.Duration) time.Duration {
+	return d + time.Duration(float64(d)*p.Jitter*(2*rand.Float64()-1))
+}
@@ -16,12 +16,16 @@ package b2
 
 import (
 	"context"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
-	"time"
 
 	"github.com/kurin/blazer/internal/blog"
 )
@@ -48,7 +52,8 @@ type Writer struct {
 	// large files, and also when determining whether to upload a file normally
 	// or when to split it into parts.  The default is 100M (1e8)  The minimum is
 	// 5M (5e6); values less than this are not an error, but will fail.  The
-	// maximum is 5GB (5e9).
+	// maximum is 5GB (5e9); larger or negative values cause the first Write to
+	// fail, as do other invalid settings, before anything is sent.
 	ChunkSize int
 
 	// UseFileBuffer controls whether to use an in-memory buffer (the default) or
@@ -60,6 +65,28 @@ type Writer struct {
 	// blank, os.TempDir() is used.
 	FileBufferDir string
 
+	// PartSHA1s supplies the SHA1 of each part, as a hex string, keyed by part
+	// number.  Parts are numbered from 1, in units of ChunkSize; a file smaller
+	// than ChunkSize is uploaded as part 1.  Supplied sums are sent to B2 in
+	// place of locally computed ones, and when streaming with ReadFrom the
+	// part is not hashed at all.
+	//
+	// B2 rejects a part whose contents don't match its SHA1, failing the
+	// Writer, so this can be used to verify the source against a previously
+	// recorded manifest as it is uploaded.
+	PartSHA1s map[int]string
+
+	// Diagnose, if true, makes the Writer keep a timeline of its work, and
+	// return any failure as a *DiagnosticError describing it.  Errors from
+	// a cancelled or expired context are returned as they are.
+	Diagnose bool
+
+	// Progress, if set, is credited with the bytes of each part once B2 has
+	// accepted it.  Retried bytes are not counted twice.  Callers that know
+	// the size of the upload and use a progress.Tracker should give it to
+	// Expect themselves.
+	Progress ProgressCounter
+
 	contentType string
 	info        map[string]string
 
@@ -71,10 +98,11 @@ type Writer struct {
 	start       sync.Once
 	once        sync.Once
 	done        sync.Once
-	file        beLargeFileInterface
+	file        *LargeFile
 	seen        map[int]string
 	everStarted bool
 	newBuffer   func() (writeBuffer, error)
+	diag        *diagRecorder
 
 	o    *Object
 	name string
@@ -85,8 +113,16 @@ type Writer struct {
 	emux sync.RWMutex
 	err  error
 
-	smux sync.RWMutex
-	smap map[int]*meteredReader
+	smux     sync.RWMutex
+	smap     map[int]*meteredReader
+	buffered int   // guarded by smux
+	sent     int64 // guarded by smux; bytes in completed chunks
+	retries  int   // guarded by smux; retries of completed chunks
+
+	// These are only used for status, and are accessed atomically.
+	workers int32
+	busy    int32
+	waiting int32
 }
 
 type chunk struct {
@@ -102,7 +138,7 @@ func (w *Writer) setErr(err error) {
 	defer w.emux.Unlock()
 	if w.err == nil {
 		blog.V(1).Infof("error writing %s: %v", w.name, err)
-		w.err = err
+		w.err = w.diag.wrap(err)
 		w.cancel()
 	}
 }
@@ -119,8 +155,19 @@ func (w *Writer) registerChunk(id int, r *meteredReader) {
 	w.smux.Unlock()
 }
 
+func (w *Writer) setBuffered(n int) {
+	w.smux.Lock()
+	w.buffered = n
+	w.smux.Unlock()
+}
+
 func (w *Writer) completeChunk(id int) {
 	w.smux.Lock()
+	if mr := w.smap[id]; mr != nil {
+		read, retries := mr.stats()
+		w.sent += read
+		w.retries += retries
+	}
 	w.smap[id] = nil
 	w.smux.Unlock()
 }
@@ -129,81 +176,101 @@ var gid int32
 
 func (w *Writer) thread() {
 	w.wg.Add(1)
+	atomic.AddInt32(&w.workers, 1)
 	go func() {
 		defer w.wg.Done()
 		id := atomic.AddInt32(&gid, 1)
-		fc, err := w.file.getUploadPartURL(w.ctx)
-		if err != nil {
-			w.setErr(err)
-			return
-		}
 		for {
 			chunk, ok := <-w.ready
 			if !ok {
 				return
 			}
-			if sha, ok := w.seen[chunk.id]; ok {
-				if sha != chunk.buf.Hash() {
-					w.setErr(errors.New("resumable upload was requested, but chunks don't match"))
-					return
-				}
-				chunk.buf.Close()
-				w.completeChunk(chunk.id)
-				blog.V(2).Infof("skipping chunk %d", chunk.id)
-				continue
-			}
 			blog.V(2).Infof("thread %d handling chunk %d", id, chunk.id)
-			r, err := chunk.buf.Reader()
+			atomic.AddInt32(&w.busy, 1)
+			err := w.uploadChunk(w.ctx, chunk)
+			atomic.AddInt32(&w.busy, -1)
 			if err != nil {
 				w.setErr(err)
 				return
 			}
-			mr := &meteredReader{r: r, size: chunk.buf.Len()}
-			w.registerChunk(chunk.id, mr)
-			sleep := time.Millisecond * 15
-		redo:
-			n, err := fc.uploadPart(w.ctx, mr, chunk.buf.Hash(), chunk.buf.Len(), chunk.id)
-			if n != chunk.buf.Len() || err != nil {
-				if w.o.b.r.reupload(err) {
-					time.Sleep(sleep)
-					sleep *= 2
-					if sleep > time.Second*15 {
-						sleep = time.Second * 15
-					}
-					blog.V(1).Infof("b2 writer: wrote %d of %d: error: %v; retrying", n, chunk.buf.Len(), err)
-					f, err := w.file.getUploadPartURL(w.ctx)
-					if err != nil {
-						w.setErr(err)
-						w.completeChunk(chunk.id)
-						chunk.buf.Close() // TODO: log error
-						return
-					}
-					fc = f
-					goto redo
-				}
-				w.setErr(err)
-				w.completeChunk(chunk.id)
-				chunk.buf.Close() // TODO: log error
-				return
-			}
-			w.completeChunk(chunk.id)
-			chunk.buf.Close() // TODO: log error
-			blog.V(2).Infof("chunk %d handled", chunk.id)
 		}
 	}()
 }
 
+// partReader returns a reader for the given part, along with its SHA1 and
+// size.  If the caller supplied the part's SHA1, that is used instead of the
+// buffer's.
+func (w *Writer) partReader(id int, buf writeBuffer) (readResetter, string, int, error) {
+	sha, ok := w.PartSHA1s[id]
+	if !ok {
+		r, err := buf.Reader()
+		return r, buf.Hash(), buf.Len(), err
+	}
+	if nb, ok := buf.(*nonBuffer); ok {
+		// Skip the trailing hash that nonBuffers compute as they're read.
+		return resetter{rs: io.NewSectionReader(nb.r, 0, int64(nb.size))}, sha, nb.size, nil
+	}
+	r, err := buf.Reader()
+	return r, sha, buf.Len(), err
+}
+
+func (w *Writer) uploadChunk(ctx context.Context, chunk chunk) error {
+	r, sha, size, err := w.partReader(chunk.id, chunk.buf)
+	if err != nil {
+		return err
+	}
+	if seen, ok := w.seen[chunk.id]; ok {
+		if seen != sha {
+			return errors.New("resumable upload was requested, but chunks don't match")
+		}
+		chunk.buf.Close()
+		w.completeChunk(chunk.id)
+		w.diag.setPart(chunk.id, size, "skipped")
+		addProgress(w.Progress, size)
+		blog.V(2).Infof("skipping chunk %d", chunk.id)
+		return nil
+	}
+	mr := &meteredReader{r: r, size: size, ctx: ctx, bw: w.o.b.c.bandwidth()}
+	w.registerChunk(chunk.id, mr)
+	sched := w.o.b.c.transfers()
+	if err := sched.acquire(ctx); err != nil {
+		w.completeChunk(chunk.id)
+		chunk.buf.Close()
+		return err
+	}
+	w.diag.setPart(chunk.id, size, "sending")
+	err = w.file.upload(ctx, mr, sha, size, chunk.id)
+	sched.release()
+	w.completeChunk(chunk.id)
+	chunk.buf.Close() // TODO: log error
+	if err != nil {
+		w.diag.fail(chunk.id, err)
+		return err
+	}
+	w.diag.setPart(chunk.id, size, "done")
+	addProgress(w.Progress, size)
+	blog.V(2).Infof("chunk %d handled", chunk.id)
+	return nil
+}
+
 func (w *Writer) init() {
 	w.start.Do(func() {
 		w.everStarted = true
 		w.smux.Lock()
 		w.smap = make(map[int]*meteredReader)
 		w.smux.Unlock()
-		w.o.b.c.addWriter(w)
+		if w.Diagnose {
+			w.diag = newDiagRecorder(w.name)
+		}
+		if err := w.validate(); err != nil {
+			w.setErr(err)
+			return
+		}
 		w.csize = w.ChunkSize
 		if w.csize == 0 {
 			w.csize = 1e8
 		}
+		w.o.b.c.addWriter(w)
 		if w.newBuffer == nil {
 			w.newBuffer = func() (writeBuffer, error) { return newMemoryBuffer(), nil }
 			if w.UseFileBuffer {
@@ -219,6 +286,46 @@ func (w *Writer) init() {
 	})
 }
 
+// validate checks the Writer's settings, so that mistakes are reported before
+// anything is sent.  All problems are reported in a single error.
+func (w *Writer) validate() error {
+	var errs []string
+	if w.ChunkSize < 0 || w.ChunkSize > maxPartSize {
+		errs = append(errs, fmt.Sprintf("ChunkSize %d is outside of 0 to 5e9", w.ChunkSize))
+	}
+	if w.FileBufferDir != "" {
+		if !w.UseFileBuffer {
+			errs = append(errs, "FileBufferDir is set but UseFileBuffer is false")
+		} else if err := checkWritableDir(w.FileBufferDir); err != nil {
+			errs = append(errs, fmt.Sprintf("FileBufferDir is unusable: %v", err))
+		}
+	}
+	var bad []int
+	for n, sum := range w.PartSHA1s {
+		if _, err := hex.DecodeString(sum); n < 1 || len(sum) != 40 || err != nil {
+			bad = append(bad, n)
+		}
+	}
+	if len(bad) > 0 {
+		sort.Ints(bad)
+		errs = append(errs, fmt.Sprintf("PartSHA1s has bad parts or sums for parts %v", bad))
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("b2: invalid Writer for %s: %s", w.name, strings.Join(errs, "; "))
+}
+
+// checkWritableDir returns an error unless a file can be created in dir.
+func checkWritableDir(dir string) error {
+	f, err := ioutil.TempFile(dir, "blazer-check")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
 // Write satisfies the io.Writer interface.
 func (w *Writer) Write(p []byte) (int, error) {
 	w.init()
@@ -227,7 +334,9 @@ func (w *Writer) Write(p []byte) (int, error) {
 	}
 	left := w.csize - w.w.Len()
 	if len(p) < left {
-		return w.w.Write(p)
+		n, err := w.w.Write(p)
+		w.setBuffered(w.w.Len())
+		return n, err
 	}
 	i, err := w.w.Write(p[:left])
 	if err != nil {
@@ -248,94 +357,107 @@ func (w *Writer) Write(p []byte) (int, error) {
 func (w *Writer) getUploadURL(ctx context.Context) (beURLInterface, error) {
 	u := w.o.b.urlPool.get()
 	if u == nil {
-		return w.o.b.b.getUploadURL(w.ctx)
+		return w.o.b.b.getUploadURL(ctx)
 	}
 
 	return u, nil
 }
 
-func (w *Writer) simpleWriteFile() error {
-	ue, err := w.getUploadURL(w.ctx)
+func (w *Writer) simpleWriteFile(ctx context.Context) error {
+	ue, err := w.getUploadURL(ctx)
 	if err != nil {
 		return err
 	}
 	// This defer needs to be in a func() so that we put whatever the value of ue
 	// is at function exit.
 	defer func() { w.o.b.urlPool.put(ue) }()
-	sha1 := w.w.Hash()
 	ctype := w.contentType
 	if ctype == "" {
 		ctype = "application/octet-stream"
 	}
-	r, err := w.w.Reader()
+	r, sha1, size, err := w.partReader(1, w.w)
 	if err != nil {
 		return err
 	}
-	mr := &meteredReader{r: r, size: w.w.Len()}
+	mr := &meteredReader{r: r, size: size, ctx: ctx, bw: w.o.b.c.bandwidth()}
 	w.registerChunk(1, mr)
 	defer w.completeChunk(1)
+	sched := w.o.b.c.transfers()
+	if err := sched.acquire(ctx); err != nil {
+		return err
+	}
+	defer sched.release()
+	w.diag.setPart(1, size, "sending")
+	rt := retrier{p: retries(ctx, w.o.b.r)}
 redo:
-	f, err := ue.uploadFile(w.ctx, mr, int(w.w.Len()), w.name, ctype, sha1, w.info)
+	f, err := ue.uploadFile(ctx, mr, size, w.name, ctype, sha1, w.info)
 	if err != nil {
 		if w.o.b.r.reupload(err) {
-			blog.V(2).Infof("b2 writer: %v; retrying", err)
-			u, err := w.o.b.b.getUploadURL(w.ctx)
+			wait, ok := rt.next(w.o.b.r.backoff(err))
+			if !ok {
+				w.diag.fail(1, err)
+				return err
+			}
+			w.diag.retry(1, err)
+			blog.V(2).Infof("b2 writer: %v; retrying in %v", err, wait)
+			select {
+			case <-after(wait):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			u, err := w.o.b.b.getUploadURL(ctx)
 			if err != nil {
 				return err
 			}
 			ue = u
 			goto redo
 		}
+		w.diag.fail(1, err)
 		return err
 	}
 	w.o.f = f
+	w.diag.setPart(1, size, "done")
+	addProgress(w.Progress, size)
 	return nil
 }
 
-func (w *Writer) getLargeFile() (beLargeFileInterface, error) {
+func (w *Writer) getLargeFile() (*LargeFile, error) {
 	if !w.Resume {
 		ctype := w.contentType
 		if ctype == "" {
 			ctype = "application/octet-stream"
 		}
-		return w.o.b.b.startLargeFile(w.ctx, w.name, ctype, w.info)
-	}
-	next := 1
-	seen := make(map[int]string)
-	var size int64
-	var fi beFileInterface
-	for {
-		cur := &Cursor{name: w.name}
-		objs, _, err := w.o.b.ListObjects(w.ctx, 1, cur)
+		f, err := w.o.b.b.startLargeFile(w.ctx, w.name, ctype, w.info)
 		if err != nil {
 			return nil, err
 		}
-		if len(objs) < 1 || objs[0].name != w.name {
-			w.Resume = false
-			return w.getLargeFile()
-		}
-		fi = objs[0].f
-		parts, n, err := fi.listParts(w.ctx, next, 100)
-		if err != nil {
-			return nil, err
-		}
-		next = n
-		for _, p := range parts {
-			seen[p.number()] = p.sha1()
-			size += p.size()
-		}
-		if len(parts) == 0 {
-			break
-		}
-		if next == 0 {
-			break
-		}
+		return newLargeFile(w.o.b, w.name, f), nil
+	}
+	seen := make(map[int]string)
+	var size int64
+	cur := &Cursor{name: w.name}
+	objs, _, err := w.o.b.ListObjects(w.ctx, 1, cur)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(objs) < 1 || objs[0].name != w.name {
+		w.Resume = false
+		return w.getLargeFile()
+	}
+	fi := objs[0].f
+	parts, err := listAllParts(w.ctx, fi)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range parts {
+		seen[p.number()] = p.sha1()
+		size += p.size()
 	}
 	w.seen = make(map[int]string) // copy the map
 	for id, sha := range seen {
 		w.seen[id] = sha
 	}
-	return fi.compileParts(size, seen), nil
+	return newLargeFile(w.o.b, w.name, fi.compileParts(size, seen)), nil
 }
 
 func (w *Writer) sendChunk() error {
@@ -347,6 +469,10 @@ func (w *Writer) sendChunk() error {
 			return
 		}
 		w.file = lf
+		if w.diag != nil {
+			lf.onRetry = w.diag.retry
+			w.diag.event(0, "started large file %s", lf.ID())
+		}
 		w.ready = make(chan chunk)
 		if w.ConcurrentUploads < 1 {
 			w.ConcurrentUploads = 1
@@ -358,14 +484,18 @@ func (w *Writer) sendChunk() error {
 	if err != nil {
 		return err
 	}
+	atomic.AddInt32(&w.waiting, 1)
 	select {
 	case w.ready <- chunk{
 		id:  w.cidx + 1,
 		buf: w.w,
 	}:
 	case <-w.ctx.Done():
+		atomic.AddInt32(&w.waiting, -1)
 		return w.ctx.Err()
 	}
+	atomic.AddInt32(&w.waiting, -1)
+	w.setBuffered(0)
 	w.cidx++
 	v, err := w.newBuffer()
 	if err != nil {
@@ -385,6 +515,10 @@ func (w *Writer) sendChunk() error {
 //
 // Note that io.Copy will automatically choose to use ReadFrom.
 //
+// An *os.File opened on a block device or a volume snapshot is an io.Seeker
+// and an io.ReaderAt, so it is read in ChunkSize extents, ConcurrentUploads
+// at a time, and uploaded as a single large object without being copied.
+//
 // ReadFrom currently doesn't handle w.Resume; if w.Resume is true, ReadFrom
 // will act as if r is not an io.Seeker.
 func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
@@ -392,7 +526,6 @@ func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
 	if !ok || w.Resume {
 		return copyContext(w.ctx, w, r)
 	}
-	blog.V(2).Info("streaming without buffer")
 	size, err := rs.Seek(0, io.SeekEnd)
 	if err != nil {
 		return 0, err
@@ -403,6 +536,22 @@ func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
 	} else {
 		ra = enReaderAt(rs)
 	}
+	return w.UploadReaderAt(ra, size)
+}
+
+// UploadReaderAt reads size bytes from r into w.  Parts are read from r
+// directly as they are sent, ConcurrentUploads at a time, so unlike Write no
+// ChunkSize buffers are allocated.  Parts are read again from r if they must
+// be retried.  As with ReadFrom, Close must still be called to finish the
+// upload, and UploadReaderAt must not be mixed with other calls to Write or
+// ReadFrom.
+//
+// If w.Resume is true, r is instead read sequentially through Write.
+func (w *Writer) UploadReaderAt(r io.ReaderAt, size int64) (int64, error) {
+	if w.Resume {
+		return copyContext(w.ctx, w, io.NewSectionReader(r, 0, size))
+	}
+	blog.V(2).Info("streaming without buffer")
 	var offset int64
 	var wrote int64
 	w.newBuffer = func() (writeBuffer, error) {
@@ -418,12 +567,15 @@ func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
 		if left < csize {
 			csize = left
 		}
-		nb := newNonBuffer(ra, offset, csize)
+		nb := newNonBuffer(r, offset, csize)
 		wrote += csize // TODO: this is kind of a total lie
 		offset += csize
 		return nb, nil
 	}
 	w.init()
+	if err := w.getErr(); err != nil {
+		return 0, err
+	}
 	if size < int64(w.csize) {
 		// the magic happens on w.Close()
 		return size, nil
@@ -441,35 +593,80 @@ func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
 // Close satisfies the io.Closer interface.  It is critical to check the return
 // value of Close for all writers.
 func (w *Writer) Close() error {
+	return w.close(w.ctx)
+}
+
+// CloseWithContext is like Close, but the work Close does to finish the
+// upload, sending any buffered data and committing the object, is bound by
+// ctx rather than by the context the Writer was created with.  This lets the
+// final steps have their own deadline, so that an upload whose data has all
+// been sent can still be committed after the original context has expired.
+//
+// Parts already being sent when CloseWithContext is called still use the
+// Writer's context, and if any of them fail, so does CloseWithContext.  Any
+// WriteRetries policy still applies.
+func (w *Writer) CloseWithContext(ctx context.Context) error {
+	if p, ok := w.ctx.Value(retryKey{}).(RetryPolicy); ok {
+		ctx = withRetries(ctx, p)
+	}
+	return w.close(ctx)
+}
+
+func (w *Writer) close(ctx context.Context) error {
 	w.done.Do(func() {
 		if !w.everStarted {
 			return
 		}
 		defer w.o.b.c.removeWriter(w)
 		defer func() {
+			if w.w == nil {
+				// The Writer failed before it allocated a buffer.
+				return
+			}
 			if err := w.w.Close(); err != nil {
 				// this is non-fatal, but alarming
 				blog.V(1).Infof("close %s: %v", w.name, err)
 			}
 		}()
+		// Don't commit anything once the context is cancelled, even if
+		// the data has already been sent.
 		if w.cidx == 0 {
-			w.setErr(w.simpleWriteFile())
+			if w.getErr() != nil {
+				return
+			}
+			if err := ctx.Err(); err != nil {
+				w.setErr(err)
+				return
+			}
+			w.setErr(w.simpleWriteFile(ctx))
+			return
+		}
+		close(w.ready)
+		w.wg.Wait()
+		if w.getErr() != nil {
 			return
 		}
 		if w.w.Len() > 0 {
-			if err := w.sendChunk(); err != nil {
+			// Send the last part here rather than handing it to a
+			// thread, so that it uses ctx.
+			buf := w.w
+			w.w = newMemoryBuffer()
+			w.cidx++
+			if err := w.uploadChunk(ctx, chunk{id: w.cidx, buf: buf}); err != nil {
 				w.setErr(err)
 				return
 			}
 		}
-		close(w.ready)
-		w.wg.Wait()
-		f, err := w.file.finishLargeFile(w.ctx)
+		if err := ctx.Err(); err != nil {
+			w.setErr(err)
+			return
+		}
+		o, err := w.file.Finish(ctx)
 		if err != nil {
 			w.setErr(err)
 			return
 		}
-		w.o.f = f
+		w.o.f = o.f
 	})
 	return w.getErr()
 }
@@ -479,18 +676,27 @@ func (w *Writer) Close() error {
 //
 // DEPRECATED: Use WithAttrsOption instead.
 func (w *Writer) WithAttrs(attrs *Attrs) *Writer {
-	w.contentType = attrs.ContentType
-	w.info = make(map[string]string)
+	w.contentType, w.info = attrsInfo(attrs)
+	return w
+}
+
+// attrsInfo returns the content type and file info that should be sent to B2
+// on upload for the given attributes.
+func attrsInfo(attrs *Attrs) (string, map[string]string) {
+	info := make(map[string]string)
+	if attrs == nil {
+		return "", info
+	}
 	for k, v := range attrs.Info {
-		w.info[k] = v
+		info[k] = v
 	}
-	if len(w.info) < 10 && attrs.SHA1 != "" {
-		w.info["large_file_sha1"] = attrs.SHA1
+	if len(info) < 10 && attrs.SHA1 != "" {
+		info["large_file_sha1"] = attrs.SHA1
 	}
-	if len(w.info) < 10 && !attrs.LastModified.IsZero() {
-		w.info["src_last_modified_millis"] = fmt.Sprintf("%d", attrs.LastModified.UnixNano()/1e6)
+	if len(info) < 10 && !attrs.LastModified.IsZero() {
+		info["src_last_modified_millis"] = fmt.Sprintf("%d", attrs.LastModified.UnixNano()/1e6)
 	}
-	return w
+	return attrs.ContentType, info
 }
 
 // A WriterOption sets Writer-specific behavior.
@@ -512,33 +718,63 @@ func DefaultWriterOptions(opts ...WriterOption) ClientOption {
 	}
 }
 
+// Status returns the progress of the upload.  It may be called at any time,
+// including concurrently with Write and Close.  Client.Status reports the
+// status of every Writer in progress.
+func (w *Writer) Status() *WriterStatus {
+	return w.status()
+}
+
 func (w *Writer) status() *WriterStatus {
 	w.smux.RLock()
 	defer w.smux.RUnlock()
 
 	ws := &WriterStatus{
-		Progress: make([]float64, len(w.smap)),
+		Progress:  make([]float64, len(w.smap)),
+		Workers:   int(atomic.LoadInt32(&w.workers)),
+		Busy:      int(atomic.LoadInt32(&w.busy)),
+		Waiting:   int(atomic.LoadInt32(&w.waiting)),
+		Buffered:  w.buffered,
+		ChunkSize: w.csize,
+		Sent:      w.sent,
+		Retries:   w.retries,
 	}
 
 	for i := 1; i <= len(w.smap); i++ {
 		ws.Progress[i-1] = w.smap[i].done()
+		if mr := w.smap[i]; mr != nil {
+			read, retries := mr.stats()
+			ws.Sent += read
+			ws.Retries += retries
+		}
 	}
 
 	return ws
 }
 
 type meteredReader struct {
-	read int64
-	size int
-	r    readResetter
-	mux  sync.Mutex
+	read   int64
+	size   int
+	r      readResetter
+	mux    sync.Mutex
+	resets int
+
+	// If bw is set, reads keep to its limit until ctx is done.
+	ctx context.Context
+	bw  *Limiter
 }
 
 func (mr *meteredReader) Read(p []byte) (int, error) {
+	if mr.bw != nil && len(p) > maxBurst {
+		p = p[:maxBurst]
+	}
 	mr.mux.Lock()
-	defer mr.mux.Unlock()
 	n, err := mr.r.Read(p)
 	mr.read += int64(n)
+	mr.mux.Unlock()
+	if werr := mr.bw.Wait(mr.ctx, n); werr != nil && err == nil {
+		err = werr
+	}
 	return n, err
 }
 
@@ -546,9 +782,22 @@ func (mr *meteredReader) Reset() error {
 	mr.mux.Lock()
 	defer mr.mux.Unlock()
 	mr.read = 0
+	mr.resets++
 	return mr.r.Reset()
 }
 
+// stats returns the number of bytes read in the current attempt, and the
+// number of attempts after the first.  Each attempt begins with a Reset.
+func (mr *meteredReader) stats() (int64, int) {
+	mr.mux.Lock()
+	defer mr.mux.Unlock()
+	retries := mr.resets - 1
+	if retries < 0 {
+		retries = 0
+	}
+	return mr.read, retries
+}
+
 func (mr *meteredReader) done() float64 {
 	if mr == nil {
 		return 1
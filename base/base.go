@@ -25,10 +25,12 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
@@ -48,8 +50,32 @@ const (
 type b2err struct {
 	msg    string
 	method string
-	retry  int
+	retry  time.Duration
 	code   int
+	bzCode string
+	req    *RequestInfo
+}
+
+// RequestInfo identifies the HTTP request that produced an error, so that it
+// can be referenced when contacting Backblaze support.
+type RequestInfo struct {
+	Method string // The B2 API call, e.g. "b2_upload_file".
+	Host   string // The host the request was sent to, e.g. an upload pod.
+	ID     string // Blazer's ID for the request, as shown in debug logs.
+
+	// Headers holds the X-Bz- headers that B2 returned with the error,
+	// including any request identifiers.
+	Headers map[string]string
+}
+
+// Request returns information about the request behind err, if err was
+// returned by B2.
+func Request(err error) (*RequestInfo, bool) {
+	e, ok := err.(b2err)
+	if !ok || e.req == nil {
+		return nil, false
+	}
+	return e.req, true
 }
 
 func (e b2err) Error() string {
@@ -65,6 +91,11 @@ func Action(err error) ErrAction {
 	if !ok {
 		return Punt
 	}
+	if e.capExceeded() {
+		// Caps reset daily, so retrying is pointless even if B2 suggests a
+		// delay.
+		return Punt
+	}
 	if e.retry > 0 {
 		return Retry
 	}
@@ -94,6 +125,13 @@ func Action(err error) ErrAction {
 	return Punt
 }
 
+// capExceeded reports whether e means that the account has reached a usage
+// cap, such as download_cap_exceeded or transaction_cap_exceeded.  Other 403s,
+// such as those for keys that lack a capability, are not caps.
+func (e b2err) capExceeded() bool {
+	return e.code == 403 && strings.HasSuffix(e.bzCode, "cap_exceeded")
+}
+
 // ErrAction is an action that a caller can take when any function returns an
 // error.
 type ErrAction int
@@ -107,6 +145,16 @@ func Code(err error) (int, string) {
 	return e.code, e.msg
 }
 
+// ErrorCode returns B2's code for the error, such as "file_not_present", or ""
+// if err was not returned by B2.
+func ErrorCode(err error) string {
+	e, ok := err.(b2err)
+	if !ok {
+		return ""
+	}
+	return e.bzCode
+}
+
 const (
 	// ReAuthenticate indicates that the B2 account authentication tokens have
 	// expired, and should be refreshed with a new call to AuthorizeAccount.
@@ -142,22 +190,49 @@ func mkErr(resp *http.Response) error {
 	if msgBody == "" {
 		msgBody = msg.Msg
 	}
-	var retryAfter int
-	retry := resp.Header.Get("Retry-After")
-	if retry != "" {
-		r, err := strconv.ParseInt(retry, 10, 64)
-		if err != nil {
-			r = 0
-			blog.V(1).Infof("couldn't parse retry-after header %q: %v", retry, err)
+	retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	ri := &RequestInfo{
+		Method:  resp.Request.Header.Get("X-Blazer-Method"),
+		Host:    resp.Request.URL.Host,
+		ID:      resp.Request.Header.Get("X-Blazer-Request-ID"),
+		Headers: make(map[string]string),
+	}
+	for k := range resp.Header {
+		if strings.HasPrefix(k, "X-Bz-") {
+			ri.Headers[k] = resp.Header.Get(k)
 		}
-		retryAfter = int(r)
 	}
 	return b2err{
 		msg:    msgBody,
 		retry:  retryAfter,
 		code:   resp.StatusCode,
-		method: resp.Request.Header.Get("X-Blazer-Method"),
+		bzCode: msg.Code,
+		method: ri.Method,
+		req:    ri,
+	}
+}
+
+// parseRetryAfter returns the delay asked for by a Retry-After header, which
+// may be given either in seconds or as a date.
+func parseRetryAfter(retry string, now time.Time) time.Duration {
+	if retry == "" {
+		return 0
+	}
+	if r, err := strconv.ParseInt(retry, 10, 64); err == nil {
+		if r < 0 {
+			return 0
+		}
+		return time.Duration(r) * time.Second
+	}
+	t, err := http.ParseTime(retry)
+	if err != nil {
+		blog.V(1).Infof("couldn't parse retry-after header %q: %v", retry, err)
+		return 0
 	}
+	if d := t.Sub(now); d > 0 {
+		return d
+	}
+	return 0
 }
 
 // Backoff returns an appropriate amount of time to wait, given an error, if
@@ -169,7 +244,7 @@ func Backoff(err error) time.Duration {
 	if !ok {
 		return 0
 	}
-	return time.Duration(e.retry) * time.Second
+	return e.retry
 }
 
 func logRequest(req *http.Request, args []byte) {
@@ -224,6 +299,7 @@ type b2Options struct {
 	capExceeded     bool
 	apiBase         string
 	userAgent       string
+	keepUnknown     bool
 }
 
 func (o *b2Options) addHeaders(req *http.Request) {
@@ -269,7 +345,9 @@ type B2 struct {
 	minPartSize int
 	opts        *b2Options
 	bucket      string // restricted to this bucket if present
+	bucketName  string // the name of bucket, if known
 	pfx         string // restricted to objects with this prefix if present
+	caps        []string
 }
 
 // Update replaces the B2 object with a new one, in-place.
@@ -280,6 +358,51 @@ func (b *B2) Update(n *B2) {
 	b.downloadURI = n.downloadURI
 	b.minPartSize = n.minPartSize
 	b.opts = n.opts
+	b.bucket = n.bucket
+	b.bucketName = n.bucketName
+	b.pfx = n.pfx
+	b.caps = n.caps
+}
+
+// AllowedBucket returns the ID and name of the bucket that the application key
+// used to authorize the account is restricted to, or empty strings if it is
+// not restricted.
+func (b *B2) AllowedBucket() (string, string) {
+	return b.bucket, b.bucketName
+}
+
+// Endpoints returns the URLs that API calls and downloads are sent to.
+func (b *B2) Endpoints() (string, string) {
+	return b.apiURI, b.downloadURI
+}
+
+// Bucket returns a bare Bucket struct with the given ID and name, for use when
+// the bucket cannot be listed.  Its type, info, and lifecycle rules are
+// unknown.
+func (b *B2) Bucket(id, name string) *Bucket {
+	return &Bucket{
+		Name: name,
+		ID:   id,
+		b2:   b,
+	}
+}
+
+// AllowedPrefix returns the prefix that the application key used to authorize
+// the account is restricted to, or an empty string if it is not restricted.
+func (b *B2) AllowedPrefix() string {
+	return b.pfx
+}
+
+// Capabilities returns the capabilities granted to the application key used
+// to authorize the account.
+func (b *B2) Capabilities() []string {
+	return b.caps
+}
+
+// permanent is implemented by errors, such as those from a caller's transport,
+// that retrying the request cannot fix.  They are returned as they are.
+type permanent interface {
+	Permanent() bool
 }
 
 type httpReply struct {
@@ -296,11 +419,15 @@ func makeNetRequest(ctx context.Context, req *http.Request, rt http.RoundTripper
 	case context.Canceled, context.DeadlineExceeded:
 		return nil, err
 	default:
+		var p permanent
+		if errors.As(err, &p) && p.Permanent() {
+			return nil, err
+		}
 		method := req.Header.Get("X-Blazer-Method")
 		blog.V(2).Infof(">> %s uri: %v err: %v", method, req.URL, err)
 		return nil, b2err{
 			msg:   err.Error(),
-			retry: 1,
+			retry: time.Second,
 		}
 	}
 }
@@ -399,6 +526,11 @@ func (o *b2Options) makeRequest(ctx context.Context, method, verb, uri string, b
 			return err
 		}
 		replyArgs = rbuf.Bytes()
+		if o.keepUnknown {
+			if err := b2types.FillUnknown(replyArgs, b2resp); err != nil {
+				return err
+			}
+		}
 	} else {
 		ra, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
@@ -432,6 +564,8 @@ func AuthorizeAccount(ctx context.Context, account, key string, opts ...AuthOpti
 		minPartSize: b2resp.PartSize,
 		bucket:      b2resp.Allowed.Bucket,
 		pfx:         b2resp.Allowed.Prefix,
+		bucketName:  b2resp.Allowed.BucketName,
+		caps:        b2resp.Allowed.Capabilities,
 		opts:        b2opts,
 	}, nil
 }
@@ -491,14 +625,70 @@ func SetAPIBase(url string) AuthOption {
 	}
 }
 
+// KeepUnknownFields records response fields that this package doesn't know
+// about in the Unknown fields of Buckets and FileInfos.  This costs a second
+// decoding of every response.
+func KeepUnknownFields() AuthOption {
+	return func(o *b2Options) {
+		o.keepUnknown = true
+	}
+}
+
 type LifecycleRule struct {
 	Prefix                 string
 	DaysNewUntilHidden     int
 	DaysHiddenUntilDeleted int
 }
 
+// CORSRule allows browsers on other origins to make the listed requests of a
+// bucket.
+type CORSRule struct {
+	Name              string
+	AllowedOrigins    []string
+	AllowedOperations []string
+	AllowedHeaders    []string
+	ExposeHeaders     []string
+	MaxAgeSeconds     int
+}
+
+func corsToB2(rules []CORSRule) []b2types.CORSRule {
+	b2rules := []b2types.CORSRule{}
+	for _, rule := range rules {
+		b2rules = append(b2rules, b2types.CORSRule{
+			Name:              rule.Name,
+			AllowedOrigins:    rule.AllowedOrigins,
+			AllowedOperations: rule.AllowedOperations,
+			AllowedHeaders:    rule.AllowedHeaders,
+			ExposeHeaders:     rule.ExposeHeaders,
+			MaxAgeSeconds:     rule.MaxAgeSeconds,
+		})
+	}
+	return b2rules
+}
+
+func corsFromB2(b2rules []b2types.CORSRule) []CORSRule {
+	var rules []CORSRule
+	for _, rule := range b2rules {
+		rules = append(rules, CORSRule{
+			Name:              rule.Name,
+			AllowedOrigins:    rule.AllowedOrigins,
+			AllowedOperations: rule.AllowedOperations,
+			AllowedHeaders:    rule.AllowedHeaders,
+			ExposeHeaders:     rule.ExposeHeaders,
+			MaxAgeSeconds:     rule.MaxAgeSeconds,
+		})
+	}
+	return rules
+}
+
 // CreateBucket wraps b2_create_bucket.
 func (b *B2) CreateBucket(ctx context.Context, name, btype string, info map[string]string, rules []LifecycleRule) (*Bucket, error) {
+	return b.CreateBucketWithCORS(ctx, name, btype, info, rules, nil)
+}
+
+// CreateBucketWithCORS is like CreateBucket, but also sets the bucket's CORS
+// rules.
+func (b *B2) CreateBucketWithCORS(ctx context.Context, name, btype string, info map[string]string, rules []LifecycleRule, cors []CORSRule) (*Bucket, error) {
 	if btype != "allPublic" {
 		btype = "allPrivate"
 	}
@@ -517,6 +707,9 @@ func (b *B2) CreateBucket(ctx context.Context, name, btype string, info map[stri
 		Info:           info,
 		LifecycleRules: b2rules,
 	}
+	if len(cors) > 0 {
+		b2req.CORSRules = corsToB2(cors)
+	}
 	b2resp := &b2types.CreateBucketResponse{}
 	headers := map[string]string{
 		"Authorization": b.authToken,
@@ -534,9 +727,12 @@ func (b *B2) CreateBucket(ctx context.Context, name, btype string, info map[stri
 	}
 	return &Bucket{
 		Name:           name,
+		Type:           b2resp.Type,
 		Info:           b2resp.Info,
 		LifecycleRules: respRules,
+		CORSRules:      corsFromB2(b2resp.CORSRules),
 		ID:             b2resp.BucketID,
+		Unknown:        b2resp.Unknown,
 		rev:            b2resp.Revision,
 		b2:             b,
 	}, nil
@@ -560,12 +756,15 @@ type Bucket struct {
 	Type           string
 	Info           map[string]string
 	LifecycleRules []LifecycleRule
+	CORSRules      []CORSRule
 	ID             string
+	Unknown        map[string]interface{}
 	rev            int
 	b2             *B2
 }
 
-// Update wraps b2_update_bucket.
+// Update wraps b2_update_bucket.  The bucket's info and CORS rules are sent
+// only if they are not nil; an empty, non-nil map or slice removes them.
 func (b *Bucket) Update(ctx context.Context) (*Bucket, error) {
 	var rules []b2types.LifecycleRule
 	for _, rule := range b.LifecycleRules {
@@ -580,10 +779,17 @@ func (b *Bucket) Update(ctx context.Context) (*Bucket, error) {
 		BucketID:  b.ID,
 		// Name:           b.Name,
 		Type:           b.Type,
-		Info:           b.Info,
 		LifecycleRules: rules,
 		IfRevisionIs:   b.rev,
 	}
+	if b.Info != nil {
+		info := b.Info
+		b2req.Info = &info
+	}
+	if b.CORSRules != nil {
+		cors := corsToB2(b.CORSRules)
+		b2req.CORSRules = &cors
+	}
 	headers := map[string]string{
 		"Authorization": b.b2.authToken,
 	}
@@ -604,11 +810,20 @@ func (b *Bucket) Update(ctx context.Context) (*Bucket, error) {
 		Type:           b2resp.Type,
 		Info:           b2resp.Info,
 		LifecycleRules: respRules,
+		CORSRules:      corsFromB2(b2resp.CORSRules),
 		ID:             b2resp.BucketID,
+		Unknown:        b2resp.Unknown,
+		rev:            b2resp.Revision,
 		b2:             b.b2,
 	}, nil
 }
 
+// Revision returns the bucket's revision number, which B2 increments with
+// every update.  It is 0 if the revision is unknown.
+func (b *Bucket) Revision() int {
+	return b.rev
+}
+
 // BaseURL returns the base part of the download URLs.
 func (b *Bucket) BaseURL() string {
 	return b.b2.downloadURI
@@ -642,7 +857,9 @@ func (b *B2) ListBuckets(ctx context.Context) ([]*Bucket, error) {
 			Type:           bucket.Type,
 			Info:           bucket.Info,
 			LifecycleRules: rules,
+			CORSRules:      corsFromB2(bucket.CORSRules),
 			ID:             bucket.BucketID,
+			Unknown:        bucket.Unknown,
 			rev:            bucket.Revision,
 			b2:             b,
 		})
@@ -733,6 +950,47 @@ func (url *URL) UploadFile(ctx context.Context, r io.Reader, size int, name, con
 	}, nil
 }
 
+// ID returns the file's ID.
+func (f *File) ID() string {
+	return f.id
+}
+
+// CopyFile wraps b2_copy_file.  It copies f to the named file in the bucket
+// with the given ID, or in f's bucket if bucketID is blank.  If replace is
+// false, the new file keeps f's content type and info, and contentType and
+// info are ignored.
+func (f *File) CopyFile(ctx context.Context, name, bucketID string, replace bool, contentType string, info map[string]string) (*File, error) {
+	b2req := &b2types.CopyFileRequest{
+		SourceID:  f.id,
+		BucketID:  bucketID,
+		Name:      name,
+		Directive: "COPY",
+	}
+	if replace {
+		b2req.Directive = "REPLACE"
+		b2req.ContentType = contentType
+		b2req.Info = info
+		if b2req.Info == nil {
+			b2req.Info = map[string]string{}
+		}
+	}
+	b2resp := &b2types.CopyFileResponse{}
+	headers := map[string]string{
+		"Authorization": f.b2.authToken,
+	}
+	if err := f.b2.opts.makeRequest(ctx, "b2_copy_file", "POST", f.b2.apiURI+b2types.V2api+"b2_copy_file", b2req, b2resp, headers, nil); err != nil {
+		return nil, err
+	}
+	return &File{
+		Name:      b2resp.Name,
+		Size:      b2resp.Size,
+		Timestamp: millitime(b2resp.Timestamp),
+		Status:    b2resp.Action,
+		id:        b2resp.FileID,
+		b2:        f.b2,
+	}, nil
+}
+
 // DeleteFileVersion wraps b2_delete_file_version.
 func (f *File) DeleteFileVersion(ctx context.Context) error {
 	b2req := &b2types.DeleteFileVersionRequest{
@@ -777,6 +1035,11 @@ func (b *Bucket) StartLargeFile(ctx context.Context, name, contentType string, i
 	}, nil
 }
 
+// ID returns the large file's ID.
+func (l *LargeFile) ID() string {
+	return l.id
+}
+
 // CancelLargeFile wraps b2_cancel_large_file.
 func (l *LargeFile) CancelLargeFile(ctx context.Context) error {
 	b2req := &b2types.CancelLargeFileRequest{
@@ -906,6 +1169,30 @@ func (fc *FileChunk) UploadPart(ctx context.Context, r io.Reader, sha1 string, s
 	return size, nil
 }
 
+// CopyPart wraps b2_copy_part.  It copies size bytes, beginning at offset,
+// from the file with the given ID into the large file as the given part, and
+// returns the part's SHA1.
+func (l *LargeFile) CopyPart(ctx context.Context, sourceID string, offset, size int64, index int) (string, error) {
+	b2req := &b2types.CopyPartRequest{
+		SourceID: sourceID,
+		ID:       l.id,
+		Number:   index,
+		Range:    fmt.Sprintf("bytes=%d-%d", offset, offset+size-1),
+	}
+	b2resp := &b2types.CopyPartResponse{}
+	headers := map[string]string{
+		"Authorization": l.b2.authToken,
+	}
+	if err := l.b2.opts.makeRequest(ctx, "b2_copy_part", "POST", l.b2.apiURI+b2types.V2api+"b2_copy_part", b2req, b2resp, headers, nil); err != nil {
+		return "", err
+	}
+	l.mu.Lock()
+	l.hashes[index] = b2resp.SHA1
+	l.size += b2resp.Size
+	l.mu.Unlock()
+	return b2resp.SHA1, nil
+}
+
 // FinishLargeFile wraps b2_finish_large_file.
 func (l *LargeFile) FinishLargeFile(ctx context.Context) (*File, error) {
 	l.mu.Lock()
@@ -941,6 +1228,7 @@ func (l *LargeFile) FinishLargeFile(ctx context.Context) (*File, error) {
 func (b *Bucket) ListUnfinishedLargeFiles(ctx context.Context, count int, continuation string) ([]*File, string, error) {
 	b2req := &b2types.ListUnfinishedLargeFilesRequest{
 		BucketID:     b.ID,
+		Prefix:       b.b2.pfx,
 		Continuation: continuation,
 		Count:        count,
 	}
@@ -952,20 +1240,24 @@ func (b *Bucket) ListUnfinishedLargeFiles(ctx context.Context, count int, contin
 		return nil, "", err
 	}
 	cont := b2resp.Continuation
-	var files []*File
-	for _, f := range b2resp.Files {
-		files = append(files, &File{
+	files := make([]*File, len(b2resp.Files))
+	for i, f := range b2resp.Files {
+		lf := &listedFile{}
+		lf.fi = FileInfo{
+			Name:        f.Name,
+			ContentType: f.ContentType,
+			Info:        f.Info,
+			Timestamp:   millitime(f.Timestamp),
+			Unknown:     f.Unknown,
+		}
+		lf.f = File{
 			Name:      f.Name,
-			Timestamp: millitime(f.Timestamp),
+			Timestamp: lf.fi.Timestamp,
 			b2:        b.b2,
 			id:        f.FileID,
-			Info: &FileInfo{
-				Name:        f.Name,
-				ContentType: f.ContentType,
-				Info:        f.Info,
-				Timestamp:   millitime(f.Timestamp),
-			},
-		})
+			Info:      &lf.fi,
+		}
+		files[i] = &lf.f
 	}
 	return files, cont, nil
 }
@@ -989,28 +1281,7 @@ func (b *Bucket) ListFileNames(ctx context.Context, count int, continuation, pre
 	if err := b.b2.opts.makeRequest(ctx, "b2_list_file_names", "POST", b.b2.apiURI+b2types.V1api+"b2_list_file_names", b2req, b2resp, headers, nil); err != nil {
 		return nil, "", err
 	}
-	cont := b2resp.Continuation
-	var files []*File
-	for _, f := range b2resp.Files {
-		files = append(files, &File{
-			Name:      f.Name,
-			Size:      f.Size,
-			Status:    f.Action,
-			Timestamp: millitime(f.Timestamp),
-			Info: &FileInfo{
-				Name:        f.Name,
-				SHA1:        f.SHA1,
-				Size:        f.Size,
-				ContentType: f.ContentType,
-				Info:        f.Info,
-				Status:      f.Action,
-				Timestamp:   millitime(f.Timestamp),
-			},
-			id: f.FileID,
-			b2: b.b2,
-		})
-	}
-	return files, cont, nil
+	return b.b2.listedFiles(b2resp.Files), b2resp.Continuation, nil
 }
 
 // ListFileVersions wraps b2_list_file_versions.
@@ -1033,27 +1304,46 @@ func (b *Bucket) ListFileVersions(ctx context.Context, count int, startName, sta
 	if err := b.b2.opts.makeRequest(ctx, "b2_list_file_versions", "POST", b.b2.apiURI+b2types.V1api+"b2_list_file_versions", b2req, b2resp, headers, nil); err != nil {
 		return nil, "", "", err
 	}
-	var files []*File
-	for _, f := range b2resp.Files {
-		files = append(files, &File{
+	return b.b2.listedFiles(b2resp.Files), b2resp.NextName, b2resp.NextID, nil
+}
+
+// listedFile holds a File and its FileInfo, so that listings allocate one
+// struct per entry rather than two.
+type listedFile struct {
+	f  File
+	fi FileInfo
+}
+
+// listedFiles converts a page of listed files.  Entries are not allocated as
+// one block, since a caller that kept any one of them would then keep the
+// whole page.
+func (b *B2) listedFiles(resp []b2types.GetFileInfoResponse) []*File {
+	files := make([]*File, len(resp))
+	for i, f := range resp {
+		lf := &listedFile{}
+		lf.fi = FileInfo{
+			Name:        f.Name,
+			SHA1:        f.SHA1,
+			Size:        f.Size,
+			ContentType: f.ContentType,
+			Info:        f.Info,
+			Status:      f.Action,
+			Timestamp:   millitime(f.Timestamp),
+			Lock:        lockFromB2(f),
+			Unknown:     f.Unknown,
+		}
+		lf.f = File{
 			Name:      f.Name,
 			Size:      f.Size,
 			Status:    f.Action,
-			Timestamp: millitime(f.Timestamp),
-			Info: &FileInfo{
-				Name:        f.Name,
-				SHA1:        f.SHA1,
-				Size:        f.Size,
-				ContentType: f.ContentType,
-				Info:        f.Info,
-				Status:      f.Action,
-				Timestamp:   millitime(f.Timestamp),
-			},
-			id: f.FileID,
-			b2: b.b2,
-		})
+			Timestamp: lf.fi.Timestamp,
+			Info:      &lf.fi,
+			id:        f.FileID,
+			b2:        b,
+		}
+		files[i] = &lf.f
 	}
-	return files, b2resp.NextName, b2resp.NextID, nil
+	return files
 }
 
 // GetDownloadAuthorization wraps b2_get_download_authorization.
@@ -1097,13 +1387,23 @@ func mkRange(offset, size int64) string {
 // DownloadFileByName wraps b2_download_file_by_name.
 func (b *Bucket) DownloadFileByName(ctx context.Context, name string, offset, size int64) (*FileReader, error) {
 	uri := fmt.Sprintf("%s/file/%s/%s", b.b2.downloadURI, b.Name, escape(name))
+	return b.download(ctx, "b2_download_file_by_name", uri, offset, size)
+}
+
+// DownloadFileByID wraps b2_download_file_by_id.
+func (b *Bucket) DownloadFileByID(ctx context.Context, id string, offset, size int64) (*FileReader, error) {
+	uri := fmt.Sprintf("%s%sb2_download_file_by_id?fileId=%s", b.b2.downloadURI, b2types.V1api, url.QueryEscape(id))
+	return b.download(ctx, "b2_download_file_by_id", uri, offset, size)
+}
+
+func (b *Bucket) download(ctx context.Context, method, uri string, offset, size int64) (*FileReader, error) {
 	req, err := http.NewRequest("GET", uri, nil)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Authorization", b.b2.authToken)
 	req.Header.Set("X-Blazer-Request-ID", fmt.Sprintf("%d", atomic.AddInt64(&reqID, 1)))
-	req.Header.Set("X-Blazer-Method", "b2_download_file_by_name")
+	req.Header.Set("X-Blazer-Method", method)
 	b.b2.opts.addHeaders(req)
 	rng := mkRange(offset, size)
 	if rng != "" {
@@ -1186,6 +1486,39 @@ type FileInfo struct {
 	Info        map[string]string
 	Status      string
 	Timestamp   time.Time
+	Lock        Lock
+	Unknown     map[string]interface{}
+}
+
+// Lock holds a file's Object Lock settings.
+type Lock struct {
+	// RetentionKnown and LegalHoldKnown are false when B2 did not report the
+	// setting, either because the bucket has no Object Lock or because the
+	// key may not read it.
+	RetentionKnown bool
+	LegalHoldKnown bool
+
+	Mode        string    // "governance" or "compliance"; blank for none.
+	RetainUntil time.Time // Zero for none.
+	LegalHold   bool
+}
+
+func lockFromB2(f b2types.GetFileInfoResponse) Lock {
+	var l Lock
+	if r := f.Retention; r != nil && r.Authorized {
+		l.RetentionKnown = true
+		if r.Value != nil {
+			l.Mode = r.Value.Mode
+			if r.Value.RetainUntil != 0 {
+				l.RetainUntil = millitime(r.Value.RetainUntil)
+			}
+		}
+	}
+	if h := f.LegalHold; h != nil && h.Authorized {
+		l.LegalHoldKnown = true
+		l.LegalHold = h.Value == "on"
+	}
+	return l
 }
 
 // GetFileInfo wraps b2_get_file_info.
@@ -1211,6 +1544,8 @@ func (f *File) GetFileInfo(ctx context.Context) (*FileInfo, error) {
 		Info:        b2resp.Info,
 		Status:      b2resp.Action,
 		Timestamp:   millitime(b2resp.Timestamp),
+		Lock:        lockFromB2(*b2resp),
+		Unknown:     b2resp.Unknown,
 	}
 	return f.Info, nil
 }
@@ -1263,6 +1598,22 @@ func (k *Key) Delete(ctx context.Context) error {
 	return k.b2.opts.makeRequest(ctx, "b2_delete_key", "POST", k.b2.apiURI+b2types.V1api+"b2_delete_key", b2req, nil, headers, nil)
 }
 
+// Call sends an arbitrary API request.  The request is sent to the endpoint
+// for method, such as "b2_get_file_info", in the given version of the API, and
+// req and resp are encoded to and decoded from JSON.  This allows calls that
+// this package doesn't wrap, including those that exist only in later
+// versions of the API.
+func (b *B2) Call(ctx context.Context, version int, method string, req, resp interface{}) error {
+	if version < 1 {
+		return fmt.Errorf("%s: no API version %d", method, version)
+	}
+	headers := map[string]string{
+		"Authorization": b.authToken,
+	}
+	uri := fmt.Sprintf("%s/b2api/v%d/%s", b.apiURI, version, method)
+	return b.opts.makeRequest(ctx, method, "POST", uri, req, resp, headers, nil)
+}
+
 // ListKeys wraps b2_list_keys.
 func (b *B2) ListKeys(ctx context.Context, max int, next string) ([]*Key, string, error) {
 	b2req := &b2types.ListKeysRequest{
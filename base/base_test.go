@@ -0,0 +1,252 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kurin/blazer/internal/b2types"
+)
+
+func TestRequestInfo(t *testing.T) {
+	req, err := http.NewRequest("POST", "https://pod-000-1000-00.backblaze.com/b2api/v1/b2_upload_file", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Blazer-Method", "b2_upload_file")
+	req.Header.Set("X-Blazer-Request-ID", "17")
+	resp := &http.Response{
+		StatusCode: 503,
+		Header: http.Header{
+			"X-Bz-Request-Id": []string{"abc123"},
+			"Content-Type":    []string{"application/json"},
+		},
+		Body:    ioutil.NopCloser(strings.NewReader(`{"status": 503, "code": "service_unavailable", "message": "c001_v0001000_t0000 is too busy"}`)),
+		Request: req,
+	}
+	berr := mkErr(resp)
+	ri, ok := Request(berr)
+	if !ok {
+		t.Fatal("Request(): no request info")
+	}
+	if ri.Method != "b2_upload_file" || ri.Host != "pod-000-1000-00.backblaze.com" || ri.ID != "17" {
+		t.Errorf("Request(): got %+v", ri)
+	}
+	if len(ri.Headers) != 1 || ri.Headers["X-Bz-Request-Id"] != "abc123" {
+		t.Errorf("Request(): got headers %v, want only X-Bz-Request-Id", ri.Headers)
+	}
+	if code := ErrorCode(berr); code != "service_unavailable" {
+		t.Errorf("ErrorCode(): got %q, want service_unavailable", code)
+	}
+	if _, ok := Request(errors.New("other")); ok {
+		t.Errorf("Request(other error): got info, want none")
+	}
+}
+
+func TestCapExceededAction(t *testing.T) {
+	table := []struct {
+		status int
+		body   string
+		retry  string
+		want   ErrAction
+	}{
+		{status: 403, body: `{"status": 403, "code": "cap_exceeded", "message": "Cannot upload files, storage cap exceeded."}`, retry: "5", want: Punt},
+		{status: 403, body: `{"status": 403, "code": "transaction_cap_exceeded", "message": "Transaction cap exceeded."}`, retry: "5", want: Punt},
+		{status: 403, body: `{"status": 403, "code": "unauthorized", "message": "not entitled"}`, want: Punt},
+		{status: 403, retry: "5", want: Retry}, // HEAD responses have no body, so this is not known to be a cap
+		{status: 429, body: `{"status": 429, "code": "too_many_requests", "message": "slow down"}`, retry: "5", want: Retry},
+	}
+	for _, e := range table {
+		req, err := http.NewRequest("POST", "https://api.backblazeb2.com/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := &http.Response{
+			StatusCode: e.status,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader(e.body)),
+			Request:    req,
+		}
+		if e.retry != "" {
+			resp.Header.Set("Retry-After", e.retry)
+		}
+		if got := Action(mkErr(resp)); got != e.want {
+			t.Errorf("Action(%d %s): got %v, want %v", e.status, e.body, got, e.want)
+		}
+	}
+}
+
+func TestListedFiles(t *testing.T) {
+	b := &B2{}
+	fs := b.listedFiles([]b2types.GetFileInfoResponse{
+		{FileID: "1", Name: "a", Size: 10, SHA1: "sha", Action: "upload", Timestamp: 1500000000000, Info: map[string]string{}},
+		{FileID: "2", Name: "b", Action: "hide", Info: map[string]string{"k": "v"}},
+	})
+	if len(fs) != 2 {
+		t.Fatalf("listedFiles: got %d files, want 2", len(fs))
+	}
+	a := fs[0]
+	if a.Name != "a" || a.id != "1" || a.Size != 10 || a.Status != "upload" || a.b2 != b {
+		t.Errorf("listedFiles: got %+v", a)
+	}
+	if a.Info.SHA1 != "sha" || len(a.Info.Info) != 0 || a.Info.Info == nil || !a.Info.Timestamp.Equal(a.Timestamp) {
+		t.Errorf("listedFiles: got info %+v", a.Info)
+	}
+	if fs[1].Info.Info["k"] != "v" || fs[1].Status != "hide" {
+		t.Errorf("listedFiles: got %+v", fs[1].Info)
+	}
+}
+
+func BenchmarkListedFiles(b *testing.B) {
+	resp := make([]b2types.GetFileInfoResponse, 1000)
+	for i := range resp {
+		resp[i] = b2types.GetFileInfoResponse{FileID: fmt.Sprint(i), Name: fmt.Sprintf("file-%d", i), Action: "upload", Info: map[string]string{}}
+	}
+	b2 := &B2{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b2.listedFiles(resp)
+	}
+}
+
+func TestLockFromB2(t *testing.T) {
+	data := `{"files": [
+		{"fileId": "1", "fileRetention": {"isClientAuthorizedToRead": true, "value": {"mode": "compliance", "retainUntilTimestamp": 1500000000000}},
+		 "legalHold": {"isClientAuthorizedToRead": true, "value": "on"}},
+		{"fileId": "2", "fileRetention": {"isClientAuthorizedToRead": true, "value": {"mode": null, "retainUntilTimestamp": null}},
+		 "legalHold": {"isClientAuthorizedToRead": false, "value": null}},
+		{"fileId": "3"}
+	]}`
+	resp := &b2types.ListFileNamesResponse{}
+	if err := json.Unmarshal([]byte(data), resp); err != nil {
+		t.Fatal(err)
+	}
+	want := []Lock{
+		{RetentionKnown: true, Mode: "compliance", RetainUntil: time.Unix(1500000000, 0), LegalHoldKnown: true, LegalHold: true},
+		{RetentionKnown: true},
+		{},
+	}
+	for i, f := range (&B2{}).listedFiles(resp.Files) {
+		if got := f.Info.Lock; !got.RetainUntil.Equal(want[i].RetainUntil) || got.Mode != want[i].Mode ||
+			got.RetentionKnown != want[i].RetentionKnown || got.LegalHoldKnown != want[i].LegalHoldKnown || got.LegalHold != want[i].LegalHold {
+			t.Errorf("file %s: got lock %+v, want %+v", f.id, got, want[i])
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	table := []struct {
+		header string
+		want   time.Duration
+	}{
+		{header: "", want: 0},
+		{header: "5", want: 5 * time.Second},
+		{header: "-1", want: 0},
+		{header: "Fri, 01 Jun 2018 12:00:30 GMT", want: 30 * time.Second},
+		{header: "Fri, 01 Jun 2018 11:59:00 GMT", want: 0},
+		{header: "soon", want: 0},
+	}
+	for _, e := range table {
+		if got := parseRetryAfter(e.header, now); got != e.want {
+			t.Errorf("parseRetryAfter(%q): got %v, want %v", e.header, got, e.want)
+		}
+	}
+}
+
+type permanentErr struct{}
+
+func (permanentErr) Error() string   { return "no" }
+func (permanentErr) Permanent() bool { return true }
+
+type errTransport struct{ err error }
+
+func (t errTransport) RoundTrip(*http.Request) (*http.Response, error) { return nil, t.err }
+
+func TestMakeNetRequestErrors(t *testing.T) {
+	req, err := http.NewRequest("GET", "https://api.backblazeb2.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := makeNetRequest(ctx, req, errTransport{permanentErr{}}); err != (permanentErr{}) || Action(err) != Punt {
+		t.Errorf("permanent error: got %v, action %v", err, Action(err))
+	}
+	if _, err := makeNetRequest(ctx, req, errTransport{errors.New("reset")}); Action(err) != Retry || Backoff(err) != time.Second {
+		t.Errorf("network error: got %v, action %v, backoff %v", err, Action(err), Backoff(err))
+	}
+}
+
+// bodyTransport records the body of each request, and answers it with an
+// empty JSON object.
+type bodyTransport struct{ bodies []string }
+
+func (t *bodyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	t.bodies = append(t.bodies, string(b))
+	return &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader("{}")),
+		Request:    req,
+	}, nil
+}
+
+func TestUpdateBucketInfo(t *testing.T) {
+	table := []struct {
+		info map[string]string
+		want string
+	}{
+		{info: nil, want: ""},
+		{info: map[string]string{}, want: `"bucketInfo":{}`},
+		{info: map[string]string{"k": "v"}, want: `"bucketInfo":{"k":"v"}`},
+	}
+	for _, e := range table {
+		rt := &bodyTransport{}
+		b := &Bucket{
+			ID:   "bucket",
+			Info: e.info,
+			b2:   &B2{apiURI: "https://api.example.com", opts: &b2Options{transport: rt}},
+		}
+		if _, err := b.Update(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if len(rt.bodies) != 1 {
+			t.Fatalf("Update(): got %d requests, want 1", len(rt.bodies))
+		}
+		body := rt.bodies[0]
+		if e.want == "" {
+			if strings.Contains(body, "bucketInfo") {
+				t.Errorf("Update() with nil info: got %s, want no bucketInfo", body)
+			}
+			continue
+		}
+		if !strings.Contains(body, e.want) {
+			t.Errorf("Update() with info %v: got %s, want %s", e.info, body, e.want)
+		}
+	}
+}
@@ -21,6 +21,14 @@
 // To copy a file out:
 //
 //     B2_ACCOUNT_ID=foo B2_ACCOUNT_KEY=bar simple b2://bucket/path/to/file /path/to/dst
+//
+// To limit bandwidth to 5MB/s during office hours, but not overnight:
+//
+//     simple -bandwidth 09:00-18:00=5M,unlimited /path/to/file b2://bucket/path/to/dst
+//
+// To see roughly what a copy would cost, without copying anything:
+//
+//     simple -n /path/to/file b2://bucket/path/to/dst
 package main
 
 import (
@@ -33,6 +41,12 @@ import (
 	"strings"
 
 	"github.com/kurin/blazer/b2"
+	"github.com/kurin/blazer/x/cost"
+)
+
+var (
+	bandwidth = flag.String("bandwidth", "", "a bandwidth schedule, such as 09:00-18:00=5M,unlimited")
+	dryRun    = flag.Bool("n", false, "print an estimate of the copy's cost, and don't copy")
 )
 
 func main() {
@@ -47,13 +61,33 @@ func main() {
 	}
 	src, dst := args[0], args[1]
 
+	var opts []b2.ClientOption
+	if *bandwidth != "" {
+		sched, err := b2.ParseBandwidthSchedule(*bandwidth)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		opts = append(opts, b2.Bandwidth(sched))
+	}
+
 	ctx := context.Background()
-	c, err := b2.NewClient(ctx, b2id, b2key)
+	c, err := b2.NewClient(ctx, b2id, b2key, opts...)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 
+	if *dryRun {
+		plan, err := planCopy(ctx, c, src, dst)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println(plan.Estimate(cost.DefaultPricing))
+		return
+	}
+
 	var r io.ReadCloser
 	var w io.WriteCloser
 
@@ -104,6 +138,37 @@ func main() {
 	}
 }
 
+// planCopy returns the plan for copying src to dst.  A copy from one bucket to
+// another goes through this program, so it is both a download and an upload.
+func planCopy(ctx context.Context, c *b2.Client, src, dst string) (*cost.Plan, error) {
+	var size int64
+	if strings.HasPrefix(src, "b2://") {
+		o, err := b2Obj(ctx, c, src)
+		if err != nil {
+			return nil, err
+		}
+		attrs, err := o.Attrs(ctx)
+		if err != nil {
+			return nil, err
+		}
+		size = attrs.Size
+	} else {
+		fi, err := os.Stat(src)
+		if err != nil {
+			return nil, err
+		}
+		size = fi.Size()
+	}
+	plan := &cost.Plan{}
+	if strings.HasPrefix(src, "b2://") {
+		plan.Downloads = append(plan.Downloads, size)
+	}
+	if strings.HasPrefix(dst, "b2://") {
+		plan.Uploads = append(plan.Uploads, size)
+	}
+	return plan, nil
+}
+
 func b2Reader(ctx context.Context, c *b2.Client, path string) (io.ReadCloser, error) {
 	o, err := b2Obj(ctx, c, path)
 	if err != nil {
@@ -20,6 +20,7 @@ package b2types
 
 const (
 	V1api = "/b2api/v1/"
+	V2api = "/b2api/v2/"
 )
 
 type ErrorMessage struct {
@@ -42,6 +43,7 @@ type AuthorizeAccountResponse struct {
 type Allowance struct {
 	Capabilities []string `json:"capabilities"`
 	Bucket       string   `json:"bucketId"`
+	BucketName   string   `json:"bucketName"`
 	Prefix       string   `json:"namePrefix"`
 }
 
@@ -51,12 +53,22 @@ type LifecycleRule struct {
 	Prefix                 string `json:"fileNamePrefix"`
 }
 
+type CORSRule struct {
+	Name              string   `json:"corsRuleName"`
+	AllowedOrigins    []string `json:"allowedOrigins"`
+	AllowedOperations []string `json:"allowedOperations"`
+	AllowedHeaders    []string `json:"allowedHeaders,omitempty"`
+	ExposeHeaders     []string `json:"exposeHeaders,omitempty"`
+	MaxAgeSeconds     int      `json:"maxAgeSeconds"`
+}
+
 type CreateBucketRequest struct {
 	AccountID      string            `json:"accountId"`
 	Name           string            `json:"bucketName"`
 	Type           string            `json:"bucketType"`
 	Info           map[string]string `json:"bucketInfo"`
 	LifecycleRules []LifecycleRule   `json:"lifecycleRules"`
+	CORSRules      []CORSRule        `json:"corsRules,omitempty"`
 }
 
 type CreateBucketResponse struct {
@@ -65,7 +77,12 @@ type CreateBucketResponse struct {
 	Type           string            `json:"bucketType"`
 	Info           map[string]string `json:"bucketInfo"`
 	LifecycleRules []LifecycleRule   `json:"lifecycleRules"`
+	CORSRules      []CORSRule        `json:"corsRules"`
 	Revision       int               `json:"revision"`
+
+	// Unknown holds any fields not described above.  It is only filled in
+	// by FillUnknown.
+	Unknown map[string]interface{} `json:"-"`
 }
 
 type DeleteBucketRequest struct {
@@ -82,13 +99,16 @@ type ListBucketsResponse struct {
 	Buckets []CreateBucketResponse `json:"buckets"`
 }
 
+// UpdateBucketRequest.Info and CORSRules are pointers so that an empty map or
+// list, which removes every entry, can be told from none at all.
 type UpdateBucketRequest struct {
-	AccountID      string            `json:"accountId"`
-	BucketID       string            `json:"bucketId"`
-	Type           string            `json:"bucketType,omitempty"`
-	Info           map[string]string `json:"bucketInfo,omitempty"`
-	LifecycleRules []LifecycleRule   `json:"lifecycleRules,omitempty"`
-	IfRevisionIs   int               `json:"ifRevisionIs,omitempty"`
+	AccountID      string             `json:"accountId"`
+	BucketID       string             `json:"bucketId"`
+	Type           string             `json:"bucketType,omitempty"`
+	Info           *map[string]string `json:"bucketInfo,omitempty"`
+	LifecycleRules []LifecycleRule    `json:"lifecycleRules,omitempty"`
+	CORSRules      *[]CORSRule        `json:"corsRules,omitempty"`
+	IfRevisionIs   int                `json:"ifRevisionIs,omitempty"`
 }
 
 type UpdateBucketResponse CreateBucketResponse
@@ -104,6 +124,18 @@ type GetUploadURLResponse struct {
 
 type UploadFileResponse GetFileInfoResponse
 
+type CopyFileRequest struct {
+	SourceID    string            `json:"sourceFileId"`
+	BucketID    string            `json:"destinationBucketId,omitempty"`
+	Name        string            `json:"fileName"`
+	Range       string            `json:"range,omitempty"`
+	Directive   string            `json:"metadataDirective,omitempty"`
+	ContentType string            `json:"contentType,omitempty"`
+	Info        map[string]string `json:"fileInfo,omitempty"`
+}
+
+type CopyFileResponse GetFileInfoResponse
+
 type DeleteFileVersionRequest struct {
 	Name   string `json:"fileName"`
 	FileID string `json:"fileId"`
@@ -149,6 +181,20 @@ type getUploadPartURLResponse struct {
 	Token string `json:"authorizationToken"`
 }
 
+type CopyPartRequest struct {
+	SourceID string `json:"sourceFileId"`
+	ID       string `json:"largeFileId"`
+	Number   int    `json:"partNumber"`
+	Range    string `json:"range,omitempty"`
+}
+
+type CopyPartResponse struct {
+	ID     string `json:"fileId"`
+	Number int    `json:"partNumber"`
+	Size   int64  `json:"contentLength"`
+	SHA1   string `json:"contentSha1"`
+}
+
 type FinishLargeFileRequest struct {
 	ID     string   `json:"fileId"`
 	Hashes []string `json:"partSha1Array"`
@@ -215,6 +261,34 @@ type GetFileInfoResponse struct {
 	Info        map[string]string `json:"fileInfo,omitempty"`
 	Action      string            `json:"action,omitempty"`
 	Timestamp   int64             `json:"uploadTimestamp,omitempty"`
+
+	// Retention and LegalHold are the file's Object Lock settings.  B2
+	// omits them for buckets without Object Lock.
+	Retention *FileRetentionResponse `json:"fileRetention,omitempty"`
+	LegalHold *LegalHoldResponse     `json:"legalHold,omitempty"`
+
+	// Unknown holds any fields not described above.  It is only filled in
+	// by FillUnknown.
+	Unknown map[string]interface{} `json:"-"`
+}
+
+// FileRetentionResponse reports a file's retention setting.  Value is nil if
+// the key may not read it.
+type FileRetentionResponse struct {
+	Authorized bool           `json:"isClientAuthorizedToRead"`
+	Value      *FileRetention `json:"value"`
+}
+
+type FileRetention struct {
+	Mode        string `json:"mode"` // "governance", "compliance", or null.
+	RetainUntil int64  `json:"retainUntilTimestamp"`
+}
+
+// LegalHoldResponse reports a file's legal hold.  Value is "on", "off", or
+// null.
+type LegalHoldResponse struct {
+	Authorized bool   `json:"isClientAuthorizedToRead"`
+	Value      string `json:"value"`
 }
 
 type GetDownloadAuthorizationRequest struct {
@@ -232,6 +306,7 @@ type GetDownloadAuthorizationResponse struct {
 
 type ListUnfinishedLargeFilesRequest struct {
 	BucketID     string `json:"bucketId"`
+	Prefix       string `json:"namePrefix,omitempty"`
 	Continuation string `json:"startFileId,omitempty"`
 	Count        int    `json:"maxFileCount,omitempty"`
 }
@@ -0,0 +1,91 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2types
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+var unknownType = reflect.TypeOf(map[string]interface{}(nil))
+
+// FillUnknown records, in every Unknown field reachable from v, the fields of
+// the corresponding JSON object in data that v has no place for.  v should
+// already have been decoded from data.
+func FillUnknown(data []byte, v interface{}) error {
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	fillUnknown(raw, reflect.ValueOf(v))
+	return nil
+}
+
+func fillUnknown(raw interface{}, v reflect.Value) {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Slice:
+		arr, ok := raw.([]interface{})
+		if !ok {
+			return
+		}
+		for i := 0; i < len(arr) && i < v.Len(); i++ {
+			fillUnknown(arr[i], v.Index(i))
+		}
+	case reflect.Struct:
+		obj, ok := raw.(map[string]interface{})
+		if !ok {
+			return
+		}
+		known := make(map[string]bool)
+		var unknown reflect.Value
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			if name == "-" {
+				if f.Name == "Unknown" && f.Type == unknownType {
+					unknown = v.Field(i)
+				}
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			known[name] = true
+			if sub, ok := obj[name]; ok {
+				fillUnknown(sub, v.Field(i))
+			}
+		}
+		if !unknown.IsValid() {
+			return
+		}
+		for k, val := range obj {
+			if known[k] {
+				continue
+			}
+			if unknown.IsNil() {
+				unknown.Set(reflect.MakeMap(unknownType))
+			}
+			unknown.SetMapIndex(reflect.ValueOf(k), reflect.ValueOf(val))
+		}
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2types
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestFillUnknown(t *testing.T) {
+	data := []byte(`{
+		"files": [
+			{"fileId": "1", "fileName": "a", "fileInfo": {}, "replicationStatus": "pending", "serverSideEncryption": {"mode": "SSE-B2"}},
+			{"fileId": "2", "fileName": "b"}
+		],
+		"nextFileName": "c",
+		"somethingNew": true
+	}`)
+	resp := &ListFileNamesResponse{}
+	if err := json.Unmarshal(data, resp); err != nil {
+		t.Fatal(err)
+	}
+	if err := FillUnknown(data, resp); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"replicationStatus":    "pending",
+		"serverSideEncryption": map[string]interface{}{"mode": "SSE-B2"},
+	}
+	if got := resp.Files[0].Unknown; !reflect.DeepEqual(got, want) {
+		t.Errorf("Files[0].Unknown: got %v, want %v", got, want)
+	}
+	if got := resp.Files[1].Unknown; got != nil {
+		t.Errorf("Files[1].Unknown: got %v, want nil", got)
+	}
+	if resp.Files[0].Name != "a" || resp.Continuation != "c" {
+		t.Errorf("FillUnknown changed known fields: %+v", resp)
+	}
+}
+
+func TestFillUnknownBuckets(t *testing.T) {
+	data := []byte(`{"buckets": [{"bucketId": "x", "bucketName": "y", "revision": 3, "options": ["s3"]}]}`)
+	resp := &ListBucketsResponse{}
+	if err := json.Unmarshal(data, resp); err != nil {
+		t.Fatal(err)
+	}
+	if err := FillUnknown(data, resp); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"options": []interface{}{"s3"}}
+	if got := resp.Buckets[0].Unknown; !reflect.DeepEqual(got, want) {
+		t.Errorf("Buckets[0].Unknown: got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pointer implements the versioned documents that x/txn and x/pack
+// share: a JSON document is written under a new ID, and then a single small
+// pointer object is replaced with that ID, so that readers see either the old
+// document or the new one.
+//
+// B2 has no conditional writes, so Swap checks the pointer and then replaces
+// it in two requests.  Two writers that swap the same pointer at the same
+// moment may both succeed, and the later one wins; whatever the earlier one
+// wrote is lost.  Callers must see to it that a pointer has one writer at a
+// time.
+package pointer
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/kurin/blazer/b2"
+)
+
+// ErrMoved is returned by Swap when the pointer no longer holds the expected
+// ID.
+var ErrMoved = errors.New("pointer: moved since it was read")
+
+// NewID returns a new document ID.  IDs begin with the time they were made,
+// so they sort in the order they were made.
+func NewID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%016x-%x", time.Now().UnixNano(), b), nil
+}
+
+// A Pointer is an object that holds the ID of the latest document.
+type Pointer struct {
+	b    *b2.Bucket
+	name string
+}
+
+// New returns the Pointer held in the named object.
+func New(bucket *b2.Bucket, name string) *Pointer {
+	return &Pointer{b: bucket, name: name}
+}
+
+// Get returns the ID the pointer holds, or "" if it has never been set.
+func (p *Pointer) Get(ctx context.Context) (string, error) {
+	r := p.b.Object(p.name).NewReader(ctx)
+	defer r.Close()
+	id, err := ioutil.ReadAll(r)
+	if b2.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(id)), nil
+}
+
+// Swap points p at id, provided it still holds old.  Otherwise it returns
+// ErrMoved and leaves p alone.  The check is not atomic with the write; see
+// the package comment.
+func (p *Pointer) Swap(ctx context.Context, old, id string) error {
+	cur, err := p.Get(ctx)
+	if err != nil {
+		return err
+	}
+	if cur != old {
+		return ErrMoved
+	}
+	w := p.b.Object(p.name).NewWriter(ctx)
+	if _, err := fmt.Fprintln(w, id); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// Write encodes v as JSON to the named object.
+func Write(ctx context.Context, bucket *b2.Bucket, name string, v interface{}) error {
+	w := bucket.Object(name).NewWriter(ctx, b2.WithAttrsOption(&b2.Attrs{ContentType: "application/json"}))
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// Read decodes the JSON in the named object into v.
+func Read(ctx context.Context, bucket *b2.Bucket, name string, v interface{}) error {
+	r := bucket.Object(name).NewReader(ctx)
+	defer r.Close()
+	return json.NewDecoder(r).Decode(v)
+}
@@ -0,0 +1,415 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package b2afero provides an afero.Fs backed by the objects beneath a prefix
+// of a B2 bucket, for tools that are built around afero.
+//
+// Files opened for reading are read with a b2.BlockReader, so that seeks and
+// random reads only fetch the blocks they need.  Files opened for writing are
+// written with a b2.Writer, and replace the object when they are closed.
+// Because B2 objects cannot be modified in place, files cannot be opened for
+// both reading and writing, or for appending, and writes must be sequential.
+//
+// Directories are implicit, as described in package bucketfs, whose caching
+// options New accepts.
+package b2afero
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kurin/blazer/b2"
+	"github.com/kurin/blazer/x/bucketfs"
+	"github.com/spf13/afero"
+)
+
+// Fs is an afero.Fs over the objects beneath a prefix of a bucket.  Its
+// methods use the context it was created with.
+type Fs struct {
+	ctx    context.Context
+	bucket *b2.Bucket
+	prefix string
+	fs     *bucketfs.FS
+}
+
+var _ afero.Fs = (*Fs)(nil)
+
+// New returns an Fs over the objects in bucket whose names begin with prefix.
+// If prefix is not empty, it is treated as a directory.
+func New(ctx context.Context, bucket *b2.Bucket, prefix string, opts ...bucketfs.Option) *Fs {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &Fs{
+		ctx:    ctx,
+		bucket: bucket,
+		prefix: prefix,
+		fs:     bucketfs.New(ctx, bucket, prefix, opts...),
+	}
+}
+
+// clean converts an afero name, which may be rooted and may use the
+// platform's separator, to a valid io/fs path.
+func clean(name string) string {
+	p := path.Clean("/" + filepath.ToSlash(name))
+	if p == "/" {
+		return "."
+	}
+	return p[1:]
+}
+
+func (f *Fs) object(name string) *b2.Object {
+	return f.bucket.Object(f.prefix + name)
+}
+
+// Name implements afero.Fs.
+func (f *Fs) Name() string { return "b2afero" }
+
+// Stat implements afero.Fs.
+func (f *Fs) Stat(name string) (os.FileInfo, error) {
+	return f.fs.Stat(clean(name))
+}
+
+// Open implements afero.Fs.
+func (f *Fs) Open(name string) (afero.File, error) {
+	p := clean(name)
+	fi, err := f.fs.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return &dir{readOnly: readOnly{name}, fs: f, path: p, info: fi}, nil
+	}
+	br, err := f.object(p).NewReaderAt(f.ctx)
+	if err != nil {
+		if b2.IsNotExist(err) {
+			err = fs.ErrNotExist
+		}
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &reader{BlockReader: br, readOnly: readOnly{name}, info: fi}, nil
+}
+
+// Create implements afero.Fs.
+func (f *Fs) Create(name string) (afero.File, error) {
+	return f.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// OpenFile implements afero.Fs.  Files may be opened either for reading, or
+// for writing, when they are new or O_TRUNC is given; perm is ignored.
+func (f *Fs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	switch flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR) {
+	case os.O_RDONLY:
+		return f.Open(name)
+	case os.O_RDWR:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.ErrUnsupported}
+	}
+	if flag&os.O_APPEND != 0 {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.ErrUnsupported}
+	}
+	p := clean(name)
+	if p == "." {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	}
+	trunc, create, excl := flag&os.O_TRUNC != 0, flag&os.O_CREATE != 0, flag&os.O_EXCL != 0
+	if !trunc || !create || excl {
+		_, err := f.fs.Stat(p)
+		exists := err == nil
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		switch {
+		case exists && create && excl:
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+		case exists && !trunc:
+			// Writing into an existing object would mean modifying it.
+			return nil, &fs.PathError{Op: "open", Path: name, Err: errors.ErrUnsupported}
+		case !exists && !create:
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+	}
+	return &writer{Writer: f.object(p).NewWriter(f.ctx), fs: f, name: name, path: p}, nil
+}
+
+// Mkdir implements afero.Fs.  Since B2 has no directories, it does nothing.
+func (f *Fs) Mkdir(name string, perm os.FileMode) error { return nil }
+
+// MkdirAll implements afero.Fs.  Since B2 has no directories, it does nothing.
+func (f *Fs) MkdirAll(name string, perm os.FileMode) error { return nil }
+
+// Remove implements afero.Fs.  Like bucketfs, it hides the object.
+func (f *Fs) Remove(name string) error {
+	return f.fs.Remove(clean(name))
+}
+
+// RemoveAll implements afero.Fs.  It hides the named object, if any, and
+// every object beneath it.
+func (f *Fs) RemoveAll(name string) error {
+	p := clean(name)
+	pfx := f.prefix
+	if p != "." {
+		if err := f.fs.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		pfx += p + "/"
+	}
+	defer f.fs.Forget(p)
+	iter := f.bucket.List(f.ctx, b2.ListPrefix(pfx))
+	for iter.Next() {
+		if err := iter.Object().Hide(f.ctx); err != nil && !b2.IsNotExist(err) {
+			return &fs.PathError{Op: "removeall", Path: name, Err: err}
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return &fs.PathError{Op: "removeall", Path: name, Err: err}
+	}
+	return nil
+}
+
+// Rename implements afero.Fs.  B2 cannot rename objects, so the object is
+// copied, within B2, and the original hidden.  Directories cannot be renamed.
+func (f *Fs) Rename(oldname, newname string) error {
+	op, np := clean(oldname), clean(newname)
+	fi, err := f.fs.Stat(op)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() || np == "." {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: errors.ErrUnsupported}
+	}
+	src := f.object(op)
+	defer f.fs.Forget(op)
+	defer f.fs.Forget(np)
+	if err := src.CopyTo(f.ctx, f.object(np)); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	if err := src.Hide(f.ctx); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	return nil
+}
+
+// Chmod implements afero.Fs.  B2 does not record permissions.
+func (f *Fs) Chmod(name string, mode os.FileMode) error {
+	return &fs.PathError{Op: "chmod", Path: name, Err: errors.ErrUnsupported}
+}
+
+// Chown implements afero.Fs.  B2 does not record ownership.
+func (f *Fs) Chown(name string, uid, gid int) error {
+	return &fs.PathError{Op: "chown", Path: name, Err: errors.ErrUnsupported}
+}
+
+// Chtimes implements afero.Fs.  An object's times are fixed when it is
+// uploaded.
+func (f *Fs) Chtimes(name string, atime, mtime time.Time) error {
+	return &fs.PathError{Op: "chtimes", Path: name, Err: errors.ErrUnsupported}
+}
+
+// readOnly implements the writing methods of a file opened for reading.
+type readOnly struct{ name string }
+
+func (r readOnly) Write([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: r.name, Err: syscall.EBADF}
+}
+
+func (r readOnly) WriteAt([]byte, int64) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: r.name, Err: syscall.EBADF}
+}
+
+func (r readOnly) WriteString(string) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: r.name, Err: syscall.EBADF}
+}
+
+func (r readOnly) Truncate(int64) error {
+	return &fs.PathError{Op: "truncate", Path: r.name, Err: syscall.EBADF}
+}
+
+func (r readOnly) Sync() error { return nil }
+
+type reader struct {
+	*b2.BlockReader
+	readOnly
+	info os.FileInfo
+}
+
+func (r *reader) Name() string               { return r.name }
+func (r *reader) Stat() (os.FileInfo, error) { return r.info, nil }
+func (r *reader) Close() error               { return nil }
+
+func (r *reader) Readdir(int) ([]os.FileInfo, error) {
+	return nil, &fs.PathError{Op: "readdir", Path: r.name, Err: syscall.ENOTDIR}
+}
+
+func (r *reader) Readdirnames(int) ([]string, error) {
+	return nil, &fs.PathError{Op: "readdir", Path: r.name, Err: syscall.ENOTDIR}
+}
+
+type dir struct {
+	readOnly
+	fs   *Fs
+	path string
+	info os.FileInfo
+	ents []os.FileInfo
+	read bool
+}
+
+func (d *dir) Name() string               { return d.name }
+func (d *dir) Stat() (os.FileInfo, error) { return d.info, nil }
+func (d *dir) Close() error               { return nil }
+
+func (d *dir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: syscall.EISDIR}
+}
+
+func (d *dir) ReadAt([]byte, int64) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: syscall.EISDIR}
+}
+
+func (d *dir) Seek(int64, int) (int64, error) {
+	return 0, &fs.PathError{Op: "seek", Path: d.name, Err: syscall.EISDIR}
+}
+
+// Readdir implements afero.File, with the semantics of os.File.Readdir.
+func (d *dir) Readdir(n int) ([]os.FileInfo, error) {
+	if !d.read {
+		ents, err := d.fs.fs.ReadDir(d.path)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range ents {
+			fi, err := e.Info()
+			if err != nil {
+				return nil, err
+			}
+			d.ents = append(d.ents, fi)
+		}
+		d.read = true
+	}
+	if n <= 0 {
+		ents := d.ents
+		d.ents = nil
+		return ents, nil
+	}
+	if len(d.ents) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.ents) {
+		n = len(d.ents)
+	}
+	ents := d.ents[:n]
+	d.ents = d.ents[n:]
+	return ents, nil
+}
+
+// Readdirnames implements afero.File.
+func (d *dir) Readdirnames(n int) ([]string, error) {
+	fis, err := d.Readdir(n)
+	var names []string
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	return names, err
+}
+
+type writer struct {
+	*b2.Writer
+	fs   *Fs
+	name string
+	path string
+	off  int64
+}
+
+func (w *writer) Name() string { return w.name }
+
+func (w *writer) Close() error {
+	defer w.fs.fs.Forget(w.path)
+	return w.Writer.Close()
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.off += int64(n)
+	return n, err
+}
+
+func (w *writer) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// WriteAt supports only sequential writes, at the end of the data written so
+// far.
+func (w *writer) WriteAt(p []byte, off int64) (int, error) {
+	if off != w.off {
+		return 0, &fs.PathError{Op: "write", Path: w.name, Err: errors.ErrUnsupported}
+	}
+	return w.Write(p)
+}
+
+func (w *writer) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: w.name, Err: syscall.EBADF}
+}
+
+func (w *writer) ReadAt([]byte, int64) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: w.name, Err: syscall.EBADF}
+}
+
+func (w *writer) Seek(offset int64, whence int) (int64, error) {
+	if (whence == io.SeekCurrent && offset == 0) || (whence == io.SeekStart && offset == w.off) {
+		return w.off, nil
+	}
+	return 0, &fs.PathError{Op: "seek", Path: w.name, Err: errors.ErrUnsupported}
+}
+
+// Stat returns the size written so far.
+func (w *writer) Stat() (os.FileInfo, error) {
+	return &fileInfo{name: path.Base(w.path), size: w.off}, nil
+}
+
+// Sync does nothing; data is only durable once the file is closed.
+func (w *writer) Sync() error { return nil }
+
+func (w *writer) Truncate(size int64) error {
+	if size != w.off {
+		return &fs.PathError{Op: "truncate", Path: w.name, Err: errors.ErrUnsupported}
+	}
+	return nil
+}
+
+func (w *writer) Readdir(int) ([]os.FileInfo, error) {
+	return nil, &fs.PathError{Op: "readdir", Path: w.name, Err: syscall.ENOTDIR}
+}
+
+func (w *writer) Readdirnames(int) ([]string, error) {
+	return nil, &fs.PathError{Op: "readdir", Path: w.name, Err: syscall.ENOTDIR}
+}
+
+type fileInfo struct {
+	name string
+	size int64
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) Mode() os.FileMode  { return 0644 }
+func (fi *fileInfo) ModTime() time.Time { return time.Time{} }
+func (fi *fileInfo) IsDir() bool        { return false }
+func (fi *fileInfo) Sys() interface{}   { return nil }
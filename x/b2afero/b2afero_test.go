@@ -0,0 +1,158 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2afero
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/kurin/blazer/b2"
+	"github.com/spf13/afero"
+)
+
+const (
+	apiID      = "B2_ACCOUNT_ID"
+	apiKey     = "B2_SECRET_KEY"
+	bucketName = "aferobucket"
+)
+
+func TestClean(t *testing.T) {
+	table := map[string]string{
+		"":          ".",
+		"/":         ".",
+		".":         ".",
+		"/a/b":      "a/b",
+		"a/b/":      "a/b",
+		"a//b/../c": "a/c",
+		"../a":      "a",
+	}
+	for name, want := range table {
+		if got := clean(name); got != want {
+			t.Errorf("clean(%q): got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestOpenFileFlags(t *testing.T) {
+	f := New(context.Background(), nil, "")
+	table := []struct {
+		name string
+		flag int
+		want error
+	}{
+		{name: "a", flag: os.O_RDWR, want: errors.ErrUnsupported},
+		{name: "a", flag: os.O_WRONLY | os.O_APPEND, want: errors.ErrUnsupported},
+		{name: "/", flag: os.O_WRONLY | os.O_CREATE | os.O_TRUNC, want: syscall.EISDIR},
+	}
+	for _, e := range table {
+		_, err := f.OpenFile(e.name, e.flag, 0644)
+		if !errors.Is(err, e.want) {
+			t.Errorf("OpenFile(%q, %#x): got %v, want %v", e.name, e.flag, err, e.want)
+		}
+	}
+}
+
+func TestFsLive(t *testing.T) {
+	ctx := context.Background()
+	bucket, done := startLiveTest(ctx, t)
+	defer done()
+
+	var afs afero.Fs = New(ctx, bucket, "root")
+	if err := afero.WriteFile(afs, "/dir/a", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(afs, "/dir/sub/b", []byte("world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := afero.ReadFile(afs, "/dir/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("ReadFile: got %q, want %q", got, "hello")
+	}
+	fis, err := afero.ReadDir(afs, "/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	if want := []string{"a", "sub"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("ReadDir: got %v, want %v", names, want)
+	}
+	if err := afs.Rename("/dir/a", "/dir/c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := afs.Stat("/dir/a"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat after Rename: got %v, want ErrNotExist", err)
+	}
+	r, err := afs.Open("/dir/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || string(got) != "hello" {
+		t.Errorf("reading renamed file: got %q, %v", got, err)
+	}
+	if err := afs.RemoveAll("/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := afs.Stat("/dir"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat after RemoveAll: got %v, want ErrNotExist", err)
+	}
+}
+
+func startLiveTest(ctx context.Context, t *testing.T) (*b2.Bucket, func()) {
+	id := os.Getenv(apiID)
+	key := os.Getenv(apiKey)
+	if id == "" || key == "" {
+		t.Skipf("B2_ACCOUNT_ID or B2_SECRET_KEY unset; skipping integration tests")
+		return nil, nil
+	}
+	client, err := b2.NewClient(ctx, id, key)
+	if err != nil {
+		t.Fatal(err)
+		return nil, nil
+	}
+	bucket, err := client.NewBucket(ctx, id+"-"+bucketName, nil)
+	if err != nil {
+		t.Fatal(err)
+		return nil, nil
+	}
+	f := func() {
+		iter := bucket.List(ctx, b2.ListHidden())
+		for iter.Next() {
+			if err := iter.Object().Delete(ctx); err != nil {
+				t.Error(err)
+			}
+		}
+		if err := iter.Err(); err != nil && !b2.IsNotExist(err) {
+			t.Error(err)
+		}
+		if err := bucket.Delete(ctx); err != nil && !b2.IsNotExist(err) {
+			t.Error(err)
+		}
+	}
+	return bucket, f
+}
@@ -0,0 +1,393 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bucketfs presents the objects beneath a prefix of a B2 bucket as a
+// file system, so that code written against io/fs, or against the writable
+// extensions defined here, can read from and write to B2.
+//
+// B2 has no directories.  A directory exists when some object's name, less
+// the prefix, begins with the directory's path and a slash; MkdirAll
+// therefore has nothing to do, and a directory disappears with its last file.
+//
+// Every Stat and directory listing costs a call to B2, which adds up for
+// metadata-heavy work such as builds or walking a tree.  The AttrCacheTTL,
+// DirCacheTTL, and NegativeCacheTTL options trade freshness for fewer calls,
+// much as NFS attribute caching does.  Changes made through the file system
+// are always seen; changes made by others may not be until the cache expires.
+package bucketfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kurin/blazer/b2"
+)
+
+// WriteFileFS is a file system that can write whole files.
+type WriteFileFS interface {
+	fs.FS
+
+	// WriteFile writes data to the named file, replacing it if it exists.
+	WriteFile(name string, data []byte, perm fs.FileMode) error
+}
+
+// MkdirAllFS is a file system in which directories can be created.
+type MkdirAllFS interface {
+	fs.FS
+
+	// MkdirAll creates the named directory and any parents it lacks.
+	MkdirAll(name string, perm fs.FileMode) error
+}
+
+// CreateFS is a file system whose files can be written as streams.
+type CreateFS interface {
+	fs.FS
+
+	// Create returns a writer for the named file.  The file is replaced
+	// when the writer is closed.
+	Create(name string) (io.WriteCloser, error)
+}
+
+// RemoveFS is a file system from which files can be removed.
+type RemoveFS interface {
+	fs.FS
+
+	// Remove removes the named file.
+	Remove(name string) error
+}
+
+// FS is a file system over the objects beneath a prefix of a bucket.  Its
+// methods use the context it was created with.
+type FS struct {
+	ctx    context.Context
+	bucket *b2.Bucket
+	prefix string
+	cache  *cache
+}
+
+var (
+	_ fs.ReadDirFS = (*FS)(nil)
+	_ fs.StatFS    = (*FS)(nil)
+	_ WriteFileFS  = (*FS)(nil)
+	_ MkdirAllFS   = (*FS)(nil)
+	_ CreateFS     = (*FS)(nil)
+	_ RemoveFS     = (*FS)(nil)
+)
+
+// New returns a file system over the objects in bucket whose names begin with
+// prefix.  If prefix is not empty, it is treated as a directory: "logs" and
+// "logs/" are the same.
+func New(ctx context.Context, bucket *b2.Bucket, prefix string, opts ...Option) *FS {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &FS{
+		ctx:    ctx,
+		bucket: bucket,
+		prefix: prefix,
+		cache:  newCache(o),
+	}
+}
+
+// Forget drops anything cached about name and, if it is a directory, about
+// the files in it.  Call it after changing the bucket other than through the
+// file system, if the change must be seen before the cache expires.
+func (f *FS) Forget(name string) {
+	if fs.ValidPath(name) {
+		f.cache.forget(name)
+	}
+}
+
+// object returns the name of the object for the path name, which must be
+// valid.
+func (f *FS) object(name string) string {
+	if name == "." {
+		return f.prefix
+	}
+	return f.prefix + name
+}
+
+// dir returns the listing prefix for the directory name.
+func (f *FS) dir(name string) string {
+	if name == "." {
+		return f.prefix
+	}
+	return f.prefix + name + "/"
+}
+
+// Open implements fs.FS.
+func (f *FS) Open(name string) (fs.File, error) {
+	fi, err := f.stat("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return &dirFile{fs: f, name: name, info: fi}, nil
+	}
+	r := f.bucket.Object(f.object(name)).NewReader(f.ctx)
+	return &file{Reader: r, info: fi}, nil
+}
+
+// Stat implements fs.StatFS.
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	return f.stat("stat", name)
+}
+
+func (f *FS) stat(op, name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if fi, ok := f.cache.stat(name); ok {
+		if fi == nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		return fi, nil
+	}
+	fi, err := f.lookup(op, name)
+	switch {
+	case err == nil:
+		f.cache.setStat(name, fi)
+	case errors.Is(err, fs.ErrNotExist):
+		f.cache.setStat(name, nil)
+	}
+	return fi, err
+}
+
+// lookup is stat, without the cache.
+func (f *FS) lookup(op, name string) (fs.FileInfo, error) {
+	if name != "." {
+		attrs, err := f.bucket.Object(f.object(name)).Attrs(f.ctx)
+		if err == nil {
+			return &fileInfo{name: path.Base(name), size: attrs.Size, mtime: modTime(attrs)}, nil
+		}
+		if !b2.IsNotExist(err) {
+			return nil, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+	}
+	// Look for anything beneath name, which makes it a directory.
+	iter := f.bucket.List(f.ctx, b2.ListPrefix(f.dir(name)), b2.ListDelimiter("/"), b2.ListPageSize(1))
+	found := iter.Next()
+	if err := iter.Err(); err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	if !found && name != "." {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return &fileInfo{name: path.Base(name), dir: true}, nil
+}
+
+// ReadDir implements fs.ReadDirFS.
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	if ents, ok := f.cache.readDir(name); ok {
+		return ents, nil
+	}
+	pfx := f.dir(name)
+	var ents []fs.DirEntry
+	iter := f.bucket.List(f.ctx, b2.ListPrefix(pfx), b2.ListDelimiter("/"))
+	for iter.Next() {
+		obj := iter.Object()
+		base := strings.TrimPrefix(obj.Name(), pfx)
+		if strings.HasSuffix(base, "/") {
+			ents = append(ents, fs.FileInfoToDirEntry(&fileInfo{name: strings.TrimSuffix(base, "/"), dir: true}))
+			continue
+		}
+		if base == "" {
+			// An object named like the directory itself; it is not in it.
+			continue
+		}
+		attrs, err := obj.Attrs(f.ctx)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+		}
+		ents = append(ents, fs.FileInfoToDirEntry(&fileInfo{name: base, size: attrs.Size, mtime: modTime(attrs)}))
+	}
+	if err := iter.Err(); err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	if len(ents) == 0 && name != "." {
+		if _, err := f.stat("readdir", name); err != nil {
+			return nil, err
+		}
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	sort.Slice(ents, func(i, j int) bool { return ents[i].Name() < ents[j].Name() })
+	f.cache.setReadDir(name, ents)
+	return ents, nil
+}
+
+// WriteFile implements WriteFileFS.  B2 does not record permissions, so perm
+// is ignored.
+func (f *FS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	w, err := f.create("writefile", name)
+	if err != nil {
+		return err
+	}
+	defer f.cache.forget(name)
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return &fs.PathError{Op: "writefile", Path: name, Err: err}
+	}
+	if err := w.Close(); err != nil {
+		return &fs.PathError{Op: "writefile", Path: name, Err: err}
+	}
+	return nil
+}
+
+// Create implements CreateFS.  Until the writer is closed, the file, if it
+// exists, keeps its old contents.
+func (f *FS) Create(name string) (io.WriteCloser, error) {
+	w, err := f.create("create", name)
+	if err != nil {
+		return nil, err
+	}
+	return &writer{Writer: w, fs: f, name: name}, nil
+}
+
+func (f *FS) create(op, name string) (*b2.Writer, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return f.bucket.Object(f.object(name)).NewWriter(f.ctx), nil
+}
+
+// MkdirAll implements MkdirAllFS.  Since B2 has no directories, it only checks
+// that name is valid.
+func (f *FS) MkdirAll(name string, perm fs.FileMode) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: "mkdirall", Path: name, Err: fs.ErrInvalid}
+	}
+	return nil
+}
+
+// Remove implements RemoveFS.  The file is hidden, rather than deleted, so
+// that earlier versions remain in the bucket for its lifecycle rules to
+// handle.
+func (f *FS) Remove(name string) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrInvalid}
+	}
+	obj := f.bucket.Object(f.object(name))
+	if _, err := obj.Attrs(f.ctx); err != nil {
+		if b2.IsNotExist(err) {
+			err = fs.ErrNotExist
+		}
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	defer f.cache.forget(name)
+	if err := obj.Hide(f.ctx); err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	return nil
+}
+
+// modTime returns the time an object's contents were last modified, if it
+// was recorded, and otherwise when it was uploaded.
+func modTime(attrs *b2.Attrs) time.Time {
+	if !attrs.LastModified.IsZero() {
+		return attrs.LastModified
+	}
+	return attrs.UploadTimestamp
+}
+
+type fileInfo struct {
+	name  string
+	size  int64
+	mtime time.Time
+	dir   bool
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) ModTime() time.Time { return fi.mtime }
+func (fi *fileInfo) IsDir() bool        { return fi.dir }
+func (fi *fileInfo) Sys() interface{}   { return nil }
+
+func (fi *fileInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+// writer forgets its file once it is closed.
+type writer struct {
+	*b2.Writer
+	fs   *FS
+	name string
+}
+
+func (w *writer) Close() error {
+	defer w.fs.cache.forget(w.name)
+	return w.Writer.Close()
+}
+
+type file struct {
+	*b2.Reader
+	info fs.FileInfo
+}
+
+func (f *file) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+type dirFile struct {
+	fs   *FS
+	name string
+	info fs.FileInfo
+	ents []fs.DirEntry
+	read bool
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *dirFile) Close() error               { return nil }
+
+func (d *dirFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (d *dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		ents, err := d.fs.ReadDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.ents, d.read = ents, true
+	}
+	if n <= 0 {
+		ents := d.ents
+		d.ents = nil
+		return ents, nil
+	}
+	if len(d.ents) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.ents) {
+		n = len(d.ents)
+	}
+	ents := d.ents[:n]
+	d.ents = d.ents[n:]
+	return ents, nil
+}
@@ -0,0 +1,133 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bucketfs
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"testing"
+	"testing/fstest"
+
+	"github.com/kurin/blazer/b2"
+)
+
+const (
+	apiID      = "B2_ACCOUNT_ID"
+	apiKey     = "B2_SECRET_KEY"
+	bucketName = "bucketfsbucket"
+)
+
+func TestNames(t *testing.T) {
+	table := []struct {
+		prefix, name, object, dir string
+	}{
+		{prefix: "", name: ".", object: "", dir: ""},
+		{prefix: "", name: "a/b", object: "a/b", dir: "a/b/"},
+		{prefix: "logs", name: ".", object: "logs/", dir: "logs/"},
+		{prefix: "logs/", name: "x", object: "logs/x", dir: "logs/x/"},
+	}
+	for _, e := range table {
+		f := New(context.Background(), nil, e.prefix)
+		if got := f.object(e.name); got != e.object {
+			t.Errorf("New(%q).object(%q): got %q, want %q", e.prefix, e.name, got, e.object)
+		}
+		if got := f.dir(e.name); got != e.dir {
+			t.Errorf("New(%q).dir(%q): got %q, want %q", e.prefix, e.name, got, e.dir)
+		}
+	}
+}
+
+func TestInvalidPaths(t *testing.T) {
+	f := New(context.Background(), nil, "")
+	for _, name := range []string{"/a", "a/", "../a", "a//b", ""} {
+		if _, err := f.Open(name); !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("Open(%q): got %v, want ErrInvalid", name, err)
+		}
+		if err := f.WriteFile(name, nil, 0644); !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("WriteFile(%q): got %v, want ErrInvalid", name, err)
+		}
+		if err := f.MkdirAll(name, 0755); !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("MkdirAll(%q): got %v, want ErrInvalid", name, err)
+		}
+	}
+	for _, name := range []string{".", "a/.."} {
+		if err := f.Remove(name); !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("Remove(%q): got %v, want ErrInvalid", name, err)
+		}
+	}
+}
+
+func TestFSLive(t *testing.T) {
+	ctx := context.Background()
+	bucket, done := startLiveTest(ctx, t)
+	defer done()
+
+	f := New(ctx, bucket, "root")
+	files := map[string]string{
+		"a":       "hello",
+		"dir/b":   "world",
+		"dir/s/c": "!",
+	}
+	for name, data := range files {
+		if err := f.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fstest.TestFS(f, "a", "dir/b", "dir/s/c"); err != nil {
+		t.Error(err)
+	}
+	if err := f.Remove("dir/s/c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Stat("dir/s"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat(dir/s) after removing its only file: got %v, want ErrNotExist", err)
+	}
+}
+
+func startLiveTest(ctx context.Context, t *testing.T) (*b2.Bucket, func()) {
+	id := os.Getenv(apiID)
+	key := os.Getenv(apiKey)
+	if id == "" || key == "" {
+		t.Skipf("B2_ACCOUNT_ID or B2_SECRET_KEY unset; skipping integration tests")
+		return nil, nil
+	}
+	client, err := b2.NewClient(ctx, id, key)
+	if err != nil {
+		t.Fatal(err)
+		return nil, nil
+	}
+	bucket, err := client.NewBucket(ctx, id+"-"+bucketName, nil)
+	if err != nil {
+		t.Fatal(err)
+		return nil, nil
+	}
+	f := func() {
+		iter := bucket.List(ctx, b2.ListHidden())
+		for iter.Next() {
+			if err := iter.Object().Delete(ctx); err != nil {
+				t.Error(err)
+			}
+		}
+		if err := iter.Err(); err != nil && !b2.IsNotExist(err) {
+			t.Error(err)
+		}
+		if err := bucket.Delete(ctx); err != nil && !b2.IsNotExist(err) {
+			t.Error(err)
+		}
+	}
+	return bucket, f
+}
@@ -0,0 +1,182 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bucketfs
+
+import (
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An Option configures a file system.
+type Option func(*options)
+
+type options struct {
+	attrTTL time.Duration
+	dirTTL  time.Duration
+	negTTL  time.Duration
+}
+
+// AttrCacheTTL caches the attributes of files and directories, as reported by
+// Stat and by directory listings, for d.  Within that time, changes made to
+// the bucket other than through the file system, or through Forget, may go
+// unseen.  Attributes are not cached by default.
+func AttrCacheTTL(d time.Duration) Option {
+	return func(o *options) {
+		o.attrTTL = d
+	}
+}
+
+// DirCacheTTL caches directory listings for d.  Within that time, files
+// added to or removed from the bucket other than through the file system, or
+// through Forget, may go unseen.  Listings are not cached by default.
+func DirCacheTTL(d time.Duration) Option {
+	return func(o *options) {
+		o.dirTTL = d
+	}
+}
+
+// NegativeCacheTTL remembers for d that a name does not exist, so that
+// repeatedly looking for a missing file, as build tools tend to, costs one
+// lookup instead of many.  Missing names are not cached by default.
+func NegativeCacheTTL(d time.Duration) Option {
+	return func(o *options) {
+		o.negTTL = d
+	}
+}
+
+var now = time.Now
+
+type attrEntry struct {
+	info    fs.FileInfo // nil if the name does not exist
+	expires time.Time
+}
+
+type dirEntry struct {
+	ents    []fs.DirEntry
+	expires time.Time
+}
+
+// cache holds what the file system has learned about names, so that a stat
+// or listing need not go to B2 every time.
+type cache struct {
+	options
+
+	mu    sync.Mutex
+	attrs map[string]attrEntry
+	dirs  map[string]dirEntry
+}
+
+func newCache(o options) *cache {
+	return &cache{
+		options: o,
+		attrs:   make(map[string]attrEntry),
+		dirs:    make(map[string]dirEntry),
+	}
+}
+
+// stat returns the cached attributes of name, if there are any.  If name is
+// known not to exist, stat returns a nil FileInfo and true.
+func (c *cache) stat(name string) (fs.FileInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.attrs[name]
+	if !ok {
+		return nil, false
+	}
+	if now().After(e.expires) {
+		delete(c.attrs, name)
+		return nil, false
+	}
+	return e.info, true
+}
+
+// setStat records name's attributes, or, if fi is nil, that it does not
+// exist.
+func (c *cache) setStat(name string, fi fs.FileInfo) {
+	ttl := c.attrTTL
+	if fi == nil {
+		ttl = c.negTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.attrs[name] = attrEntry{info: fi, expires: now().Add(ttl)}
+}
+
+// readDir returns a copy of the cached listing of name, if there is one.
+func (c *cache) readDir(name string) ([]fs.DirEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.dirs[name]
+	if !ok {
+		return nil, false
+	}
+	if now().After(e.expires) {
+		delete(c.dirs, name)
+		return nil, false
+	}
+	return append([]fs.DirEntry(nil), e.ents...), true
+}
+
+// setReadDir records the listing of name, and the attributes of its entries.
+func (c *cache) setReadDir(name string, ents []fs.DirEntry) {
+	if c.dirTTL > 0 {
+		c.mu.Lock()
+		c.dirs[name] = dirEntry{ents: append([]fs.DirEntry(nil), ents...), expires: now().Add(c.dirTTL)}
+		c.mu.Unlock()
+	}
+	if c.attrTTL <= 0 {
+		return
+	}
+	for _, e := range ents {
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		c.setStat(path.Join(name, e.Name()), fi)
+	}
+}
+
+// forget drops what is cached about name, about the directories that contain
+// it, which may have appeared or disappeared, and, if name is a directory,
+// about everything in it.
+func (c *cache) forget(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pfx := name + "/"
+	if name == "." {
+		pfx = ""
+	}
+	for n := range c.attrs {
+		if n == name || strings.HasPrefix(n, pfx) {
+			delete(c.attrs, n)
+		}
+	}
+	for n := range c.dirs {
+		if n == name || strings.HasPrefix(n, pfx) {
+			delete(c.dirs, n)
+		}
+	}
+	for name != "." {
+		name = path.Dir(name)
+		delete(c.attrs, name)
+		delete(c.dirs, name)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bucketfs
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"testing"
+	"time"
+)
+
+func fakeNow(t *testing.T) *time.Time {
+	clock := time.Unix(1500000000, 0)
+	old := now
+	now = func() time.Time { return clock }
+	t.Cleanup(func() { now = old })
+	return &clock
+}
+
+func TestCacheExpiry(t *testing.T) {
+	clock := fakeNow(t)
+	c := newCache(options{attrTTL: time.Minute, negTTL: time.Second})
+	c.setStat("a", &fileInfo{name: "a", size: 5})
+	c.setStat("b", nil)
+
+	if fi, ok := c.stat("a"); !ok || fi.Size() != 5 {
+		t.Errorf("stat(a): got %v, %v; want size 5, true", fi, ok)
+	}
+	if fi, ok := c.stat("b"); !ok || fi != nil {
+		t.Errorf("stat(b): got %v, %v; want nil, true", fi, ok)
+	}
+	*clock = clock.Add(2 * time.Second)
+	if _, ok := c.stat("b"); ok {
+		t.Error("stat(b): negative entry outlived its TTL")
+	}
+	if _, ok := c.stat("a"); !ok {
+		t.Error("stat(a): entry expired early")
+	}
+	*clock = clock.Add(time.Minute)
+	if _, ok := c.stat("a"); ok {
+		t.Error("stat(a): entry outlived its TTL")
+	}
+}
+
+func TestCacheDisabled(t *testing.T) {
+	fakeNow(t)
+	c := newCache(options{})
+	c.setStat("a", &fileInfo{name: "a"})
+	c.setStat("b", nil)
+	c.setReadDir(".", []fs.DirEntry{fs.FileInfoToDirEntry(&fileInfo{name: "c"})})
+	for _, name := range []string{"a", "b", "c"} {
+		if _, ok := c.stat(name); ok {
+			t.Errorf("stat(%s): cached with no TTL", name)
+		}
+	}
+	if _, ok := c.readDir("."); ok {
+		t.Error("readDir(.): cached with no TTL")
+	}
+}
+
+func TestCacheReadDir(t *testing.T) {
+	fakeNow(t)
+	c := newCache(options{attrTTL: time.Minute, dirTTL: time.Minute})
+	ents := []fs.DirEntry{
+		fs.FileInfoToDirEntry(&fileInfo{name: "f", size: 3}),
+		fs.FileInfoToDirEntry(&fileInfo{name: "s", dir: true}),
+	}
+	c.setReadDir("d", ents)
+	ents[0] = nil
+
+	got, ok := c.readDir("d")
+	if !ok || len(got) != 2 || got[0] == nil {
+		t.Fatalf("readDir(d): got %v, %v", got, ok)
+	}
+	got[1] = nil
+	if again, _ := c.readDir("d"); again[1] == nil {
+		t.Error("readDir(d): callers share the cached listing")
+	}
+	if fi, ok := c.stat("d/f"); !ok || fi.Size() != 3 {
+		t.Errorf("stat(d/f): got %v, %v; want size 3, true", fi, ok)
+	}
+	if fi, ok := c.stat("d/s"); !ok || !fi.IsDir() {
+		t.Errorf("stat(d/s): got %v, %v; want a directory", fi, ok)
+	}
+}
+
+func TestCacheForget(t *testing.T) {
+	fakeNow(t)
+	c := newCache(options{attrTTL: time.Minute, dirTTL: time.Minute, negTTL: time.Minute})
+	for _, name := range []string{".", "a", "a/b", "a/b/c", "a/bc", "x"} {
+		c.setStat(name, &fileInfo{name: name})
+		c.setReadDir(name, nil)
+	}
+	c.forget("a/b")
+	for name, want := range map[string]bool{
+		".":     false,
+		"a":     false,
+		"a/b":   false,
+		"a/b/c": false,
+		"a/bc":  true,
+		"x":     true,
+	} {
+		if _, ok := c.stat(name); ok != want {
+			t.Errorf("after forget(a/b), stat(%s): got cached %v, want %v", name, ok, want)
+		}
+		if _, ok := c.readDir(name); ok != want {
+			t.Errorf("after forget(a/b), readDir(%s): got cached %v, want %v", name, ok, want)
+		}
+	}
+}
+
+func TestFSUsesCache(t *testing.T) {
+	fakeNow(t)
+	// With a nil bucket, anything not answered from the cache panics.
+	f := New(context.Background(), nil, "", AttrCacheTTL(time.Minute), DirCacheTTL(time.Minute), NegativeCacheTTL(time.Minute))
+	f.cache.setReadDir(".", []fs.DirEntry{fs.FileInfoToDirEntry(&fileInfo{name: "a", size: 1})})
+	f.cache.setStat("b", nil)
+
+	if fi, err := f.Stat("a"); err != nil || fi.Size() != 1 {
+		t.Errorf("Stat(a): got %v, %v", fi, err)
+	}
+	if _, err := f.Stat("b"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat(b): got %v, want ErrNotExist", err)
+	}
+	if ents, err := f.ReadDir("."); err != nil || len(ents) != 1 {
+		t.Errorf("ReadDir(.): got %v, %v", ents, err)
+	}
+}
@@ -0,0 +1,380 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cost estimates the transactions, traffic, and charges that a
+// planned set of B2 operations will incur, so that tools can report them
+// before anything is done, e.g. in a dry run.
+//
+// Estimates are approximate.  They count the calls that blazer makes with its
+// default settings, assume that nothing is retried, and ignore B2's daily
+// allowance of free transactions.
+package cost
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/kurin/blazer/x/treediff"
+)
+
+// A Class is a B2 transaction class.  Each class is priced differently.
+type Class int
+
+const (
+	// ClassA transactions, such as uploads and deletes, are free.
+	ClassA Class = iota
+
+	// ClassB transactions are downloads and file lookups.
+	ClassB
+
+	// ClassC transactions include listings and server-side copies.
+	ClassC
+)
+
+func (c Class) String() string {
+	switch c {
+	case ClassA:
+		return "class A"
+	case ClassB:
+		return "class B"
+	case ClassC:
+		return "class C"
+	}
+	return fmt.Sprintf("Class(%d)", int(c))
+}
+
+var classes = map[string]Class{
+	"b2_cancel_large_file":           ClassA,
+	"b2_delete_bucket":               ClassA,
+	"b2_delete_file_version":         ClassA,
+	"b2_delete_key":                  ClassA,
+	"b2_finish_large_file":           ClassA,
+	"b2_get_upload_part_url":         ClassA,
+	"b2_get_upload_url":              ClassA,
+	"b2_hide_file":                   ClassA,
+	"b2_start_large_file":            ClassA,
+	"b2_upload_file":                 ClassA,
+	"b2_upload_part":                 ClassA,
+	"b2_download_file_by_id":         ClassB,
+	"b2_download_file_by_name":       ClassB,
+	"b2_get_file_info":               ClassB,
+	"b2_authorize_account":           ClassC,
+	"b2_copy_file":                   ClassC,
+	"b2_copy_part":                   ClassC,
+	"b2_create_bucket":               ClassC,
+	"b2_create_key":                  ClassC,
+	"b2_get_download_authorization":  ClassC,
+	"b2_list_buckets":                ClassC,
+	"b2_list_file_names":             ClassC,
+	"b2_list_file_versions":          ClassC,
+	"b2_list_keys":                   ClassC,
+	"b2_list_parts":                  ClassC,
+	"b2_list_unfinished_large_files": ClassC,
+	"b2_update_bucket":               ClassC,
+}
+
+// ClassOf returns the transaction class of the named B2 API method, such as
+// "b2_upload_file".  It returns false if the method is not known.
+func ClassOf(method string) (Class, bool) {
+	c, ok := classes[method]
+	return c, ok
+}
+
+// Pricing holds the prices, in US dollars, that an estimate is based on.
+type Pricing struct {
+	// ClassA, ClassB, and ClassC are the prices of a single transaction of
+	// each class.
+	ClassA, ClassB, ClassC float64
+
+	// DownloadPerGB is the price of downloading 1e9 bytes.
+	DownloadPerGB float64
+
+	// StoragePerGBMonth is the price of storing 1e9 bytes for a month.
+	StoragePerGBMonth float64
+}
+
+// DefaultPricing is B2's list pricing at the time of writing.  Prices change;
+// callers that need exact figures should supply their own.
+var DefaultPricing = Pricing{
+	ClassA:            0,
+	ClassB:            0.004 / 10000,
+	ClassC:            0.004 / 1000,
+	DownloadPerGB:     0.01,
+	StoragePerGBMonth: 0.005,
+}
+
+// Defaults for the sizes in a Plan, matching those of the b2 package.
+const (
+	defaultPartSize      = 1e8
+	defaultDownloadChunk = 1e7
+	defaultCopyPartSize  = 5e9
+	listPageSize         = 1000
+)
+
+// A Plan describes operations that have not yet been run.  Sizes are in
+// bytes.
+type Plan struct {
+	// Uploads holds the size of each file to be written with a Writer.
+	Uploads []int64
+
+	// Downloads holds the size of each file to be read with a Reader.
+	Downloads []int64
+
+	// Copies holds the size of each object to be copied within B2, with
+	// Object.CopyTo.
+	Copies []int64
+
+	// Deletes holds the size of each file version to be deleted.
+	Deletes []int64
+
+	// Hides holds the size of each file to be hidden.  Hidden files are
+	// still stored, and still charged for.
+	Hides []int64
+
+	// Listed is the number of objects to be listed.
+	Listed int
+
+	// PartSize is the Writers' ChunkSize; files larger than this are
+	// uploaded in parts.  If 0, the Writer default of 1e8 is assumed.
+	PartSize int64
+
+	// DownloadChunkSize is the Readers' ChunkSize; each chunk is a separate
+	// download.  If 0, the Reader default of 1e7 is assumed.
+	DownloadChunkSize int64
+
+	// CopyPartSize is the size given with b2.CopyPartSize.  If 0, the
+	// default of 5e9 is assumed.
+	CopyPartSize int64
+}
+
+// Sync returns the plan that brings remote up to date with local, given
+// their differences: names in d.Add and d.Update are uploaded, and, if del is
+// true, names in d.Delete are deleted.  Names in d.Mismatch are left alone,
+// since it isn't known which copy is correct.
+func Sync(d *treediff.Diff, local, remote treediff.Manifest, del bool) *Plan {
+	p := &Plan{}
+	for _, list := range [][]string{d.Add, d.Update} {
+		for _, name := range list {
+			if e, ok := local[name]; ok {
+				p.Uploads = append(p.Uploads, e.Size)
+			}
+		}
+	}
+	if del {
+		for _, name := range d.Delete {
+			if e, ok := remote[name]; ok {
+				p.Deletes = append(p.Deletes, e.Size)
+			}
+		}
+	}
+	return p
+}
+
+// FromPlan returns the plan for the actions of tp that are not yet done, so
+// that a sync planned with treediff.NewPlan can be estimated before it is
+// applied, or before it is resumed.
+func FromPlan(tp *treediff.Plan) *Plan {
+	p := &Plan{}
+	for _, a := range tp.Pending() {
+		switch a.Op {
+		case treediff.Upload:
+			p.Uploads = append(p.Uploads, a.Size)
+		case treediff.Delete:
+			p.Deletes = append(p.Deletes, a.Size)
+		}
+	}
+	return p
+}
+
+// Mirror returns the plan that copies every object in m to another bucket
+// within B2.
+func Mirror(m treediff.Manifest) *Plan {
+	p := &Plan{}
+	for _, e := range m {
+		p.Copies = append(p.Copies, e.Size)
+	}
+	return p
+}
+
+// Prune returns the plan that deletes the named objects from remote.  Names
+// not in remote are ignored.
+func Prune(names []string, remote treediff.Manifest) *Plan {
+	p := &Plan{}
+	for _, name := range names {
+		if e, ok := remote[name]; ok {
+			p.Deletes = append(p.Deletes, e.Size)
+		}
+	}
+	return p
+}
+
+// An Estimate is what a plan is expected to cost.
+type Estimate struct {
+	// Calls counts the expected calls to each B2 API method.
+	Calls map[string]int64
+
+	// Transactions counts the expected calls in each class.
+	Transactions map[Class]int64
+
+	// UploadBytes, DownloadBytes, and CopyBytes are the bytes expected to
+	// be uploaded, downloaded, and copied within B2.
+	UploadBytes, DownloadBytes, CopyBytes int64
+
+	// StoredBytes is the expected change in the bytes stored.  It is
+	// negative if the plan frees more than it stores.
+	StoredBytes int64
+
+	// Cost is the approximate one-time charge, in US dollars, for the
+	// plan's transactions and downloads.
+	Cost float64
+
+	// StorageCost is the approximate change, in US dollars per month, in
+	// the cost of storage.
+	StorageCost float64
+}
+
+// Estimate returns what p is expected to cost at the given prices.
+func (p *Plan) Estimate(pr Pricing) *Estimate {
+	e := &Estimate{
+		Calls:        make(map[string]int64),
+		Transactions: make(map[Class]int64),
+	}
+	partSize := orDefault(p.PartSize, defaultPartSize)
+	chunk := orDefault(p.DownloadChunkSize, defaultDownloadChunk)
+	copySize := orDefault(p.CopyPartSize, defaultCopyPartSize)
+
+	for _, size := range p.Uploads {
+		e.UploadBytes += size
+		e.StoredBytes += size
+		if size <= partSize {
+			e.Calls["b2_get_upload_url"]++
+			e.Calls["b2_upload_file"]++
+			continue
+		}
+		n := parts(size, partSize)
+		e.Calls["b2_start_large_file"]++
+		e.Calls["b2_get_upload_part_url"] += n
+		e.Calls["b2_upload_part"] += n
+		e.Calls["b2_finish_large_file"]++
+	}
+	for _, size := range p.Downloads {
+		e.DownloadBytes += size
+		e.Calls["b2_download_file_by_name"] += parts(size, chunk)
+	}
+	for _, size := range p.Copies {
+		e.CopyBytes += size
+		e.StoredBytes += size
+		if size <= copySize {
+			e.Calls["b2_copy_file"]++
+			continue
+		}
+		e.Calls["b2_start_large_file"]++
+		e.Calls["b2_copy_part"] += parts(size, copySize)
+		e.Calls["b2_finish_large_file"]++
+	}
+	for _, size := range p.Deletes {
+		e.StoredBytes -= size
+		e.Calls["b2_delete_file_version"]++
+	}
+	if len(p.Hides) > 0 {
+		e.Calls["b2_hide_file"] += int64(len(p.Hides))
+	}
+	if p.Listed > 0 {
+		e.Calls["b2_list_file_names"] += parts(int64(p.Listed), listPageSize)
+	}
+
+	for method, n := range e.Calls {
+		c, _ := ClassOf(method)
+		e.Transactions[c] += n
+	}
+	e.Cost = float64(e.Transactions[ClassA])*pr.ClassA +
+		float64(e.Transactions[ClassB])*pr.ClassB +
+		float64(e.Transactions[ClassC])*pr.ClassC +
+		float64(e.DownloadBytes)/1e9*pr.DownloadPerGB
+	e.StorageCost = float64(e.StoredBytes) / 1e9 * pr.StoragePerGBMonth
+	return e
+}
+
+func orDefault(n, def int64) int64 {
+	if n > 0 {
+		return n
+	}
+	return def
+}
+
+// parts returns the number of pieces of at most size bytes that n bytes are
+// sent in.  Even an empty file takes one.
+func parts(n, size int64) int64 {
+	if n <= size {
+		return 1
+	}
+	return (n + size - 1) / size
+}
+
+// String summarizes the estimate in a few lines, suitable for the output of a
+// dry run.
+func (e *Estimate) String() string {
+	s := fmt.Sprintf("transactions: %d class A, %d class B, %d class C\n",
+		e.Transactions[ClassA], e.Transactions[ClassB], e.Transactions[ClassC])
+	s += fmt.Sprintf("data: %s up, %s down, %s copied; storage %s\n",
+		formatBytes(e.UploadBytes), formatBytes(e.DownloadBytes), formatBytes(e.CopyBytes), signedBytes(e.StoredBytes))
+	s += fmt.Sprintf("approximate cost: $%.4f, and %s$%.4f per month for storage", e.Cost, sign(e.StorageCost), abs(e.StorageCost))
+	return s
+}
+
+// Methods returns the methods in e.Calls, sorted, for callers that want to
+// list them.
+func (e *Estimate) Methods() []string {
+	var ms []string
+	for m := range e.Calls {
+		ms = append(ms, m)
+	}
+	sort.Strings(ms)
+	return ms
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1e12:
+		return fmt.Sprintf("%.1fTB", float64(n)/1e12)
+	case n >= 1e9:
+		return fmt.Sprintf("%.1fGB", float64(n)/1e9)
+	case n >= 1e6:
+		return fmt.Sprintf("%.1fMB", float64(n)/1e6)
+	case n >= 1e3:
+		return fmt.Sprintf("%.1fKB", float64(n)/1e3)
+	}
+	return fmt.Sprintf("%dB", n)
+}
+
+func signedBytes(n int64) string {
+	if n < 0 {
+		return "-" + formatBytes(-n)
+	}
+	return "+" + formatBytes(n)
+}
+
+func sign(f float64) string {
+	if f < 0 {
+		return "-"
+	}
+	return "+"
+}
+
+func abs(f float64) float64 {
+	if f < 0 {
+		return -f
+	}
+	return f
+}
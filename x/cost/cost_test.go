@@ -0,0 +1,177 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cost
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kurin/blazer/x/treediff"
+)
+
+func TestEstimateCalls(t *testing.T) {
+	table := []struct {
+		desc string
+		p    *Plan
+		want map[string]int64
+	}{
+		{
+			desc: "small upload",
+			p:    &Plan{Uploads: []int64{10}},
+			want: map[string]int64{"b2_get_upload_url": 1, "b2_upload_file": 1},
+		},
+		{
+			desc: "large upload",
+			p:    &Plan{Uploads: []int64{250}, PartSize: 100},
+			want: map[string]int64{
+				"b2_start_large_file":    1,
+				"b2_get_upload_part_url": 3,
+				"b2_upload_part":         3,
+				"b2_finish_large_file":   1,
+			},
+		},
+		{
+			desc: "downloads",
+			p:    &Plan{Downloads: []int64{0, 2e7 + 1}},
+			want: map[string]int64{"b2_download_file_by_name": 4},
+		},
+		{
+			desc: "copies",
+			p:    &Plan{Copies: []int64{5, 25}, CopyPartSize: 10},
+			want: map[string]int64{
+				"b2_copy_file":         1,
+				"b2_start_large_file":  1,
+				"b2_copy_part":         3,
+				"b2_finish_large_file": 1,
+			},
+		},
+		{
+			desc: "deletes, hides, and listings",
+			p:    &Plan{Deletes: []int64{1, 2}, Hides: []int64{3}, Listed: 1001},
+			want: map[string]int64{
+				"b2_delete_file_version": 2,
+				"b2_hide_file":           1,
+				"b2_list_file_names":     2,
+			},
+		},
+	}
+	for _, e := range table {
+		got := e.p.Estimate(DefaultPricing)
+		if !reflect.DeepEqual(got.Calls, e.want) {
+			t.Errorf("%s: got calls %v, want %v", e.desc, got.Calls, e.want)
+		}
+		var n int64
+		for _, c := range got.Transactions {
+			n += c
+		}
+		var want int64
+		for _, c := range e.want {
+			want += c
+		}
+		if n != want {
+			t.Errorf("%s: got %d transactions, want %d", e.desc, n, want)
+		}
+	}
+}
+
+func TestEstimateCost(t *testing.T) {
+	p := &Plan{
+		Uploads:   []int64{3e9},
+		Downloads: []int64{2e9},
+		Copies:    []int64{1e9},
+		Deletes:   []int64{5e9},
+		Listed:    10,
+	}
+	pr := Pricing{ClassA: 1, ClassB: 10, ClassC: 100, DownloadPerGB: 1000, StoragePerGBMonth: 1}
+	e := p.Estimate(pr)
+
+	// 3e9 bytes in 1e8 parts: start, 30 part URLs, 30 parts, finish, and a
+	// delete.
+	if got, want := e.Transactions[ClassA], int64(63); got != want {
+		t.Errorf("class A: got %d, want %d", got, want)
+	}
+	if got, want := e.Transactions[ClassB], int64(200); got != want {
+		t.Errorf("class B: got %d, want %d", got, want)
+	}
+	if got, want := e.Transactions[ClassC], int64(2); got != want {
+		t.Errorf("class C: got %d, want %d", got, want)
+	}
+	if e.StoredBytes != -1e9 {
+		t.Errorf("StoredBytes: got %d, want -1e9", e.StoredBytes)
+	}
+	if want := 63 + 200*10 + 2*100 + 2*1000.0; math.Abs(e.Cost-want) > 1e-9 {
+		t.Errorf("Cost: got %v, want %v", e.Cost, want)
+	}
+	if math.Abs(e.StorageCost+1) > 1e-9 {
+		t.Errorf("StorageCost: got %v, want -1", e.StorageCost)
+	}
+	s := e.String()
+	for _, want := range []string{"63 class A", "200 class B", "2 class C", "3.0GB up", "storage -1.0GB", "-$1.0000 per month"} {
+		if !strings.Contains(s, want) {
+			t.Errorf("String(): %q does not contain %q", s, want)
+		}
+	}
+}
+
+func TestPlans(t *testing.T) {
+	local := treediff.Manifest{
+		"new":  {Name: "new", Size: 1},
+		"mod":  {Name: "mod", Size: 2},
+		"same": {Name: "same", Size: 3},
+	}
+	remote := treediff.Manifest{
+		"mod":  {Name: "mod", Size: 20},
+		"same": {Name: "same", Size: 3},
+		"old":  {Name: "old", Size: 4},
+	}
+	d := &treediff.Diff{Add: []string{"new"}, Update: []string{"mod"}, Delete: []string{"old"}}
+
+	p := Sync(d, local, remote, false)
+	if !reflect.DeepEqual(p.Uploads, []int64{1, 2}) || p.Deletes != nil {
+		t.Errorf("Sync(del=false): got uploads %v, deletes %v", p.Uploads, p.Deletes)
+	}
+	p = Sync(d, local, remote, true)
+	if !reflect.DeepEqual(p.Deletes, []int64{4}) {
+		t.Errorf("Sync(del=true): got deletes %v, want [4]", p.Deletes)
+	}
+	tp := treediff.NewPlan(d, local, remote, treediff.PlanOptions{Delete: true})
+	tp.Actions[0].Done = true
+	if p := FromPlan(tp); !reflect.DeepEqual(p.Uploads, []int64{1}) || !reflect.DeepEqual(p.Deletes, []int64{4}) {
+		t.Errorf("FromPlan: got uploads %v, deletes %v; want [1], [4]", p.Uploads, p.Deletes)
+	}
+	if p := Mirror(remote); len(p.Copies) != 3 {
+		t.Errorf("Mirror: got %d copies, want 3", len(p.Copies))
+	}
+	if p := Prune([]string{"old", "missing"}, remote); !reflect.DeepEqual(p.Deletes, []int64{4}) {
+		t.Errorf("Prune: got deletes %v, want [4]", p.Deletes)
+	}
+}
+
+func TestClassOf(t *testing.T) {
+	for method, want := range map[string]Class{
+		"b2_upload_part":           ClassA,
+		"b2_download_file_by_name": ClassB,
+		"b2_list_file_names":       ClassC,
+	} {
+		if got, ok := ClassOf(method); !ok || got != want {
+			t.Errorf("ClassOf(%q): got %v, %v; want %v", method, got, ok, want)
+		}
+	}
+	if _, ok := ClassOf("b2_frobnicate"); ok {
+		t.Error("ClassOf(b2_frobnicate): got ok for an unknown method")
+	}
+}
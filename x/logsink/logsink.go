@@ -0,0 +1,328 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package logsink provides an io.WriteCloser that ships logs to B2.
+//
+// Data written to a Sink is compressed into a local segment file.  When the
+// segment grows too large or too old, it is closed and uploaded in the
+// background, and a new segment is started.  A Sink can be handed to
+// log.SetOutput or any other logger that writes to an io.Writer.
+package logsink
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kurin/blazer/b2"
+	"github.com/kurin/blazer/internal/blog"
+)
+
+var errClosed = errors.New("logsink: write on closed Sink")
+
+// A Sink compresses and uploads everything written to it.  It is safe to call
+// Write from multiple goroutines.
+//
+// Changes to public Sink attributes must be made before the first call to
+// Write.
+type Sink struct {
+	// MaxSize is the number of uncompressed bytes after which a segment is
+	// rotated.  The default is 64MB.
+	MaxSize int64
+
+	// MaxAge is how long a segment is written to before it is rotated, even
+	// if it is small.  The default is one hour.
+	MaxAge time.Duration
+
+	// Dir is where segments are kept until they are uploaded.  If blank,
+	// os.TempDir() is used.
+	Dir string
+
+	// Queue is the number of rotated segments that may wait to be uploaded
+	// before Write blocks.  The default is 16.
+	Queue int
+
+	// Retries paces the retries of failed uploads.  The default retries
+	// until the Sink's context is done, backing off from one second to a
+	// minute.
+	Retries b2.RetryPolicy
+
+	ctx    context.Context
+	bucket *b2.Bucket
+	tmpl   string
+	upload func(ctx context.Context, name, path string) error
+
+	start  sync.Once
+	mu     sync.Mutex
+	cur    *segment
+	seq    int
+	closed bool
+	ready  chan *segment
+	done   chan struct{}
+
+	emux sync.Mutex
+	err  error
+}
+
+type segment struct {
+	f     *os.File
+	gz    *gzip.Writer
+	hsh   hash.Hash
+	start time.Time
+	seq   int
+	size  int64
+	timer *time.Timer
+}
+
+// New returns a Sink that uploads segments to bucket.  Each segment is named
+// by expanding tmpl with b2.ExpandName: {seq} is the segment's sequence number,
+// date layouts are formatted with the time the segment was started, and
+// {hash} is the SHA1 of the compressed segment.  For example:
+//
+//	logs/{host}/{2006/01/02/150405}-{seq}.gz
+//
+// Uploads are retried, as the Sink's Retries allow, until they succeed or ctx
+// is done.
+func New(ctx context.Context, bucket *b2.Bucket, tmpl string) *Sink {
+	s := &Sink{
+		ctx:    ctx,
+		bucket: bucket,
+		tmpl:   tmpl,
+	}
+	s.upload = s.uploadFile
+	return s
+}
+
+func (s *Sink) init() {
+	s.start.Do(func() {
+		if s.MaxSize <= 0 {
+			s.MaxSize = 64 << 20
+		}
+		if s.MaxAge <= 0 {
+			s.MaxAge = time.Hour
+		}
+		if s.Queue <= 0 {
+			s.Queue = 16
+		}
+		if s.Retries == (b2.RetryPolicy{}) {
+			s.Retries = b2.RetryPolicy{Base: time.Second, Max: time.Minute}
+		}
+		s.ready = make(chan *segment, s.Queue)
+		s.done = make(chan struct{})
+		go s.uploader()
+	})
+}
+
+func (s *Sink) setErr(err error) {
+	s.emux.Lock()
+	defer s.emux.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+func (s *Sink) getErr() error {
+	s.emux.Lock()
+	defer s.emux.Unlock()
+	return s.err
+}
+
+// Write satisfies the io.Writer interface.  It returns an error only if the
+// local segment can't be written; upload errors are reported by Close.
+func (s *Sink) Write(p []byte) (int, error) {
+	s.init()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, errClosed
+	}
+	if s.cur == nil {
+		if err := s.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := s.cur.gz.Write(p)
+	s.cur.size += int64(n)
+	if err != nil {
+		// The segment can't be finished, and would not be uploaded.
+		s.cur.discard()
+		s.cur = nil
+		return n, err
+	}
+	if s.cur.size >= s.MaxSize {
+		if err := s.rotate(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// open starts a new segment.  The caller must hold s.mu.
+func (s *Sink) open() error {
+	f, err := ioutil.TempFile(s.Dir, "blazer-logsink")
+	if err != nil {
+		return err
+	}
+	s.seq++
+	seg := &segment{
+		f:     f,
+		hsh:   sha1.New(),
+		start: time.Now(),
+		seq:   s.seq,
+	}
+	seg.gz = gzip.NewWriter(io.MultiWriter(f, seg.hsh))
+	seg.timer = time.AfterFunc(s.MaxAge, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.cur == seg {
+			if err := s.rotate(); err != nil {
+				s.setErr(err)
+			}
+		}
+	})
+	s.cur = seg
+	return nil
+}
+
+// rotate closes the current segment and queues it for upload.  The caller
+// must hold s.mu.
+func (s *Sink) rotate() error {
+	seg := s.cur
+	s.cur = nil
+	seg.timer.Stop()
+	if err := seg.gz.Close(); err != nil {
+		seg.discard()
+		return err
+	}
+	if err := seg.f.Close(); err != nil {
+		os.Remove(seg.f.Name())
+		return err
+	}
+	s.ready <- seg
+	return nil
+}
+
+// discard abandons a segment that can't be finished, removing its file.
+func (seg *segment) discard() {
+	seg.timer.Stop()
+	seg.f.Close()
+	os.Remove(seg.f.Name())
+}
+
+// Rotate closes the current segment, if any, and queues it for upload.
+func (s *Sink) Rotate() error {
+	s.init()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errClosed
+	}
+	if s.cur == nil {
+		return nil
+	}
+	return s.rotate()
+}
+
+func (s *Sink) uploader() {
+	defer close(s.done)
+	for seg := range s.ready {
+		name, err := b2.ExpandName(s.tmpl, b2.NameValues{
+			Time: seg.start,
+			SHA1: fmt.Sprintf("%x", seg.hsh.Sum(nil)),
+			Seq:  seg.seq,
+		})
+		if err == nil {
+			err = s.retry(name, seg.f.Name())
+		}
+		if err != nil {
+			blog.V(1).Infof("logsink: segment %d: %v; leaving %s", seg.seq, err, seg.f.Name())
+			s.setErr(err)
+			continue
+		}
+		if err := os.Remove(seg.f.Name()); err != nil {
+			blog.V(1).Infof("logsink: %v", err)
+		}
+	}
+}
+
+// retry uploads the segment at path until it succeeds, Retries gives up, the
+// Sink's context is done, or the account reaches a usage cap.
+func (s *Sink) retry(name, path string) error {
+	for failures := 1; ; failures++ {
+		err := s.upload(s.ctx, name, path)
+		if err == nil {
+			return nil
+		}
+		if b2.IsCapExceeded(err) || s.Retries.Exhausted(failures) {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		sleep := s.Retries.Delay(failures)
+		blog.V(1).Infof("logsink: upload %s: %v; retrying in %v", name, err, sleep)
+		select {
+		case <-time.After(sleep):
+		case <-s.ctx.Done():
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+// uploadFile copies the segment at path to the named object.  If the segment
+// can't be read, the writer's context is cancelled before it is closed, so
+// that a truncated segment is never committed.
+func (s *Sink) uploadFile(ctx context.Context, name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := s.bucket.Object(name).NewWriter(ctx, b2.WithAttrsOption(&b2.Attrs{ContentType: "application/gzip"}))
+	if _, err := io.Copy(w, f); err != nil {
+		cancel()
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// Close rotates the current segment and waits for every segment to be
+// uploaded.  It returns the first error encountered.  Segments that could not
+// be uploaded are left in Dir.
+func (s *Sink) Close() error {
+	s.init()
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errClosed
+	}
+	s.closed = true
+	if s.cur != nil {
+		if err := s.rotate(); err != nil {
+			s.setErr(err)
+		}
+	}
+	close(s.ready)
+	s.mu.Unlock()
+	<-s.done
+	return s.getErr()
+}
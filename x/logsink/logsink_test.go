@@ -0,0 +1,224 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logsink
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kurin/blazer/b2"
+)
+
+type fakeBucket struct {
+	mu    sync.Mutex
+	files map[string][]byte
+	fail  int
+	err   error // returned instead of "upload failed"
+}
+
+func (f *fakeBucket) upload(ctx context.Context, name, path string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fail != 0 {
+		if f.fail > 0 {
+			f.fail--
+		}
+		if f.err != nil {
+			return f.err
+		}
+		return errors.New("upload failed")
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	f.files[name] = b
+	return nil
+}
+
+func (f *fakeBucket) contents(t *testing.T) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var names []string
+	for name := range f.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var out []string
+	for _, name := range names {
+		gz, err := gzip.NewReader(bytes.NewReader(f.files[name]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(gz)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, name+": "+string(b))
+	}
+	return out
+}
+
+func newSink(ctx context.Context, t *testing.T, f *fakeBucket) (*Sink, string) {
+	dir, err := ioutil.TempDir("", "logsink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(ctx, nil, "logs/{seq}")
+	s.Dir = dir
+	s.upload = f.upload
+	return s, dir
+}
+
+func leftovers(t *testing.T, dir string) int {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(fis)
+}
+
+func TestRotateBySize(t *testing.T) {
+	f := &fakeBucket{files: make(map[string][]byte)}
+	s, dir := newSink(context.Background(), t, f)
+	defer os.RemoveAll(dir)
+	s.MaxSize = 10
+	for i := 0; i < 5; i++ {
+		fmt.Fprintf(s, "line %d\n", i)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"logs/000001: line 0\nline 1\n",
+		"logs/000002: line 2\nline 3\n",
+		"logs/000003: line 4\n",
+	}
+	if got := f.contents(t); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if n := leftovers(t, dir); n != 0 {
+		t.Errorf("%d segments left in %s after upload", n, dir)
+	}
+	if _, err := s.Write([]byte("late")); err == nil {
+		t.Error("Write after Close succeeded")
+	}
+}
+
+func TestRotateByAge(t *testing.T) {
+	f := &fakeBucket{files: make(map[string][]byte)}
+	s, dir := newSink(context.Background(), t, f)
+	defer os.RemoveAll(dir)
+	s.MaxAge = time.Millisecond
+	fmt.Fprint(s, "old")
+	for i := 0; i < 1000 && len(f.contents(t)) == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	fmt.Fprint(s, "new")
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"logs/000001: old", "logs/000002: new"}
+	if got := f.contents(t); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestUploadFailure(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	f := &fakeBucket{files: make(map[string][]byte), fail: -1}
+	s, dir := newSink(ctx, t, f)
+	defer os.RemoveAll(dir)
+	fmt.Fprint(s, "lost")
+	if err := s.Close(); err == nil {
+		t.Error("Close succeeded, but uploads failed")
+	}
+	if n := leftovers(t, dir); n != 1 {
+		t.Errorf("got %d segments left in %s, want 1", n, dir)
+	}
+}
+
+func TestUploadCapExceeded(t *testing.T) {
+	f := &fakeBucket{
+		files: make(map[string][]byte),
+		fail:  -1,
+		err:   &b2.Error{Status: 403, Code: "cap_exceeded"},
+	}
+	s, dir := newSink(context.Background(), t, f)
+	defer os.RemoveAll(dir)
+	fmt.Fprint(s, "capped")
+	done := make(chan error)
+	go func() { done <- s.Close() }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Close succeeded, but the cap was exceeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close still retrying after cap exceeded")
+	}
+	if n := leftovers(t, dir); n != 1 {
+		t.Errorf("got %d segments left in %s, want 1", n, dir)
+	}
+}
+
+func TestMaxAttempts(t *testing.T) {
+	f := &fakeBucket{files: make(map[string][]byte), fail: 3}
+	s, dir := newSink(context.Background(), t, f)
+	defer os.RemoveAll(dir)
+	s.Retries = b2.RetryPolicy{MaxAttempts: 2, Base: time.Millisecond}
+	fmt.Fprint(s, "twice")
+	if err := s.Close(); err == nil {
+		t.Error("Close succeeded, but uploads failed")
+	}
+	if f.fail != 1 {
+		t.Errorf("got %d attempts, want 2", 3-f.fail)
+	}
+	if n := leftovers(t, dir); n != 1 {
+		t.Errorf("got %d segments left in %s, want 1", n, dir)
+	}
+}
+
+func TestRotateFailure(t *testing.T) {
+	f := &fakeBucket{files: make(map[string][]byte)}
+	s, dir := newSink(context.Background(), t, f)
+	defer os.RemoveAll(dir)
+	fmt.Fprint(s, "unfinished")
+	// Closing the file out from under the segment makes its gzip trailer
+	// fail to write.
+	s.mu.Lock()
+	s.cur.f.Close()
+	s.mu.Unlock()
+	if err := s.Rotate(); err == nil {
+		t.Error("Rotate succeeded, but the segment could not be written")
+	}
+	if n := leftovers(t, dir); n != 0 {
+		t.Errorf("got %d segments left in %s after a failed rotation, want 0", n, dir)
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+}
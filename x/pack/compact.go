@@ -0,0 +1,375 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"github.com/kurin/blazer/b2"
+)
+
+// Usage describes how much of a pack is still in use.
+type Usage struct {
+	Pack     string
+	Uploaded time.Time
+
+	// Size is the size of the pack, and Live the total size of the files
+	// in it that the index still refers to.
+	Size, Live int64
+
+	// Files counts the files in the pack that the index refers to.
+	Files int
+}
+
+// Dead returns the fraction of the pack that no file refers to.
+func (u *Usage) Dead() float64 {
+	if u.Size == 0 {
+		return 0
+	}
+	return float64(u.Size-u.Live) / float64(u.Size)
+}
+
+// object is an object version found by listing.
+type object struct {
+	o        *b2.Object
+	name     string
+	size     int64
+	uploaded time.Time
+}
+
+// list returns the objects beneath prefix, and, if all is set, every one of
+// their versions.
+func (s *Store) list(ctx context.Context, prefix string, all bool) ([]object, error) {
+	lopts := []b2.ListOption{b2.ListPrefix(prefix)}
+	if all {
+		lopts = append(lopts, b2.ListHidden())
+	}
+	var objs []object
+	iter := s.b.List(ctx, lopts...)
+	for iter.Next() {
+		// Listed objects carry their attributes, so this costs nothing
+		// more.
+		attrs, err := iter.Object().Attrs(ctx)
+		if err != nil {
+			return nil, err
+		}
+		objs = append(objs, object{o: iter.Object(), name: attrs.Name, size: attrs.Size, uploaded: attrs.UploadTimestamp})
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	return objs, nil
+}
+
+// usage returns the usage of each pack by idx, by name.
+func usage(idx *Index, packs []object) []*Usage {
+	byName := make(map[string]*Usage)
+	var us []*Usage
+	for _, p := range packs {
+		u := &Usage{Pack: p.name, Uploaded: p.uploaded, Size: p.size}
+		byName[p.name] = u
+		us = append(us, u)
+	}
+	for _, e := range idx.Entries {
+		if u, ok := byName[e.Pack]; ok {
+			u.Live += e.Size
+			u.Files++
+		}
+	}
+	sort.Slice(us, func(i, j int) bool { return us[i].Pack < us[j].Pack })
+	return us
+}
+
+// Usage returns how much of each pack in the store is used by idx.
+func (s *Store) Usage(ctx context.Context, idx *Index) ([]*Usage, error) {
+	packs, err := s.list(ctx, s.packName("")+"/", false)
+	if err != nil {
+		return nil, err
+	}
+	return usage(idx, packs), nil
+}
+
+// CompactOptions adjusts what Compact rewrites and removes.
+type CompactOptions struct {
+	// Threshold is the fraction of a pack that must be dead before it is
+	// rewritten.  If 0, 0.5 is used, which bounds the space held by
+	// deleted files at about the space of the live ones.
+	Threshold float64
+
+	// Grace is how long Compact waits before it touches an object.
+	// Packs are uploaded before they are indexed, so Compact does not
+	// rewrite a pack until it is this old.  Readers may hold an older
+	// index for some time, so Compact does not delete a pack until the
+	// index has not referred to it for this long, nor an index until it
+	// has been replaced for this long.  It should be longer than any
+	// Packer goes between flushes, and any reader keeps an index.  If 0,
+	// one hour is used.
+	Grace time.Duration
+
+	// PackSize and WriterOptions are used for the packs that live files
+	// are moved to, as in Options.
+	PackSize      int64
+	WriterOptions []b2.WriterOption
+}
+
+func (o CompactOptions) threshold() float64 {
+	if o.Threshold > 0 {
+		return o.Threshold
+	}
+	return 0.5
+}
+
+func (o CompactOptions) grace() time.Duration {
+	if o.Grace > 0 {
+		return o.Grace
+	}
+	return time.Hour
+}
+
+// CompactResult reports what Compact did.
+type CompactResult struct {
+	// Rewritten lists the packs whose live files were moved.
+	Rewritten []string
+
+	// Files and Bytes count the files moved, and their total size.
+	Files int
+	Bytes int64
+
+	// Deleted lists the packs and indexes that were deleted.
+	Deleted []string
+}
+
+var now = time.Now
+
+// Compact rewrites the live files of mostly dead packs into new packs, and
+// then deletes the packs and indexes that are no longer needed.  It may run
+// alongside readers, and alongside a Packer as long as their index updates do
+// not overlap; see the package comment.  Moved files are swapped into the
+// index only if their entries are unchanged since Compact read them, so that
+// files added or deleted in the meantime are not disturbed.
+func (s *Store) Compact(ctx context.Context, opts CompactOptions) (*CompactResult, error) {
+	res := &CompactResult{}
+	idx, err := s.Latest(ctx)
+	if err == ErrNoIndex {
+		return res, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	us, err := s.Usage(ctx, idx)
+	if err != nil {
+		return nil, err
+	}
+	cutoff := now().Add(-opts.grace())
+	byPack := make(map[string][]string)
+	for name, e := range idx.Entries {
+		byPack[e.Pack] = append(byPack[e.Pack], name)
+	}
+
+	p := s.NewPacker(Options{PackSize: opts.PackSize, WriterOptions: opts.WriterOptions})
+	moved := make(map[string]Entry) // the entries being replaced
+	for _, u := range us {
+		if u.Files == 0 || u.Dead() < opts.threshold() || u.Uploaded.After(cutoff) {
+			continue
+		}
+		if err := s.rewrite(ctx, p, u.Pack, idx, byPack[u.Pack]); err != nil {
+			return nil, err
+		}
+		for _, name := range byPack[u.Pack] {
+			moved[name] = idx.Entries[name]
+		}
+		res.Rewritten = append(res.Rewritten, u.Pack)
+	}
+	if err := p.upload(ctx); err != nil {
+		return nil, err
+	}
+	if len(p.written) > 0 {
+		var files int
+		var size int64
+		_, err := s.update(ctx, func(idx *Index) error {
+			files, size = swap(idx, moved, p.written)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		res.Files, res.Bytes = files, size
+	}
+
+	deleted, err := s.collect(ctx, cutoff)
+	res.Deleted = deleted
+	return res, err
+}
+
+// rewrite adds the named files in pack to p.  The pack is downloaded whole,
+// since most of a pack worth rewriting is still read in one request.
+func (s *Store) rewrite(ctx context.Context, p *Packer, pack string, idx *Index, names []string) error {
+	r := s.b.Object(pack).NewReader(ctx)
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	sort.Slice(names, func(i, j int) bool { return idx.Entries[names[i]].Offset < idx.Entries[names[j]].Offset })
+	for _, name := range names {
+		e := idx.Entries[name]
+		if e.Offset+e.Size > int64(len(data)) {
+			return fmt.Errorf("%s: pack is shorter than its index says", pack)
+		}
+		if err := p.add(name, bytes.NewReader(data[e.Offset:e.Offset+e.Size])); err != nil {
+			return err
+		}
+		if int64(p.buf.Len()) >= p.opts.PackSize {
+			if err := p.upload(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// swap points the files in written at their new entries, if their entries
+// in idx are still those in old.  It returns the number and size of the
+// files swapped.
+func swap(idx *Index, old, written map[string]Entry) (int, int64) {
+	var n int
+	var size int64
+	for name, e := range written {
+		if cur, ok := idx.Entries[name]; !ok || cur != old[name] {
+			continue
+		}
+		idx.Entries[name] = e
+		n++
+		size += e.Size
+	}
+	return n, size
+}
+
+// collect deletes the objects that have not been needed since cutoff: packs
+// that the latest index stopped referring to before then, every index that
+// was replaced before then, and the old versions of INDEX.  Deleted packs are
+// then forgotten by the index.
+func (s *Store) collect(ctx context.Context, cutoff time.Time) ([]string, error) {
+	head, err := s.head(ctx)
+	if err != nil || head == "" {
+		return nil, err
+	}
+	idx, err := s.index(ctx, head)
+	if err != nil {
+		return nil, err
+	}
+	packs, err := s.list(ctx, s.packName("")+"/", false)
+	if err != nil {
+		return nil, err
+	}
+	indexes, err := s.list(ctx, s.indexName("")+"/", false)
+	if err != nil {
+		return nil, err
+	}
+	heads, err := s.list(ctx, s.headName(), true)
+	if err != nil {
+		return nil, err
+	}
+	var deleted []string
+	for _, obj := range garbage(idx, s.headName(), s.indexName(head), packs, indexes, heads, cutoff) {
+		if err := obj.o.Delete(ctx); err != nil && !b2.IsNotExist(err) {
+			return deleted, err
+		}
+		deleted = append(deleted, obj.name)
+	}
+	var forget bool
+	for _, name := range deleted {
+		if _, ok := idx.Dropped[name]; ok {
+			forget = true
+		}
+	}
+	if forget {
+		_, err := s.update(ctx, func(idx *Index) error {
+			for _, name := range deleted {
+				delete(idx.Dropped, name)
+			}
+			return nil
+		})
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+// garbage returns the objects that collect deletes.  headName is the name of
+// INDEX, and cur the name of the index it points to.
+//
+// A pack is garbage once it was dropped from the index before cutoff, or, if
+// the index never referred to it, once it was uploaded before cutoff.  An
+// index is garbage once the index written after it was uploaded before
+// cutoff, since that is when readers stopped being given it.
+func garbage(idx *Index, headName, cur string, packs, indexes, heads []object, cutoff time.Time) []object {
+	refs := idx.packs()
+	var objs []object
+	for _, p := range packs {
+		if refs[p.name] {
+			continue
+		}
+		t, ok := idx.Dropped[p.name]
+		if !ok {
+			t = p.uploaded
+		}
+		if t.Before(cutoff) {
+			objs = append(objs, p)
+		}
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i].uploaded.Before(indexes[j].uploaded) })
+	for i, x := range indexes {
+		if x.name != cur && i+1 < len(indexes) && indexes[i+1].uploaded.Before(cutoff) {
+			objs = append(objs, x)
+		}
+	}
+	var newest time.Time
+	for _, h := range heads {
+		if h.name == headName && h.uploaded.After(newest) {
+			newest = h.uploaded
+		}
+	}
+	for _, h := range heads {
+		if h.name == headName && h.uploaded.Before(newest) && h.uploaded.Before(cutoff) {
+			objs = append(objs, h)
+		}
+	}
+	return objs
+}
+
+// Maintain compacts the store every interval, until ctx is done, and then
+// returns ctx.Err().  It is meant to be run in its own goroutine.  The result
+// of each run is passed to report, if it is not nil; errors do not stop
+// Maintain.
+func (s *Store) Maintain(ctx context.Context, every time.Duration, opts CompactOptions, report func(*CompactResult, error)) error {
+	for {
+		res, err := s.Compact(ctx, opts)
+		if report != nil {
+			report(res, err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(every):
+		}
+	}
+}
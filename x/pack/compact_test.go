@@ -0,0 +1,173 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUsage(t *testing.T) {
+	idx := &Index{Entries: map[string]Entry{
+		"a": {Pack: "p/1", Offset: 0, Size: 10},
+		"b": {Pack: "p/1", Offset: 30, Size: 20},
+		"c": {Pack: "p/2", Offset: 0, Size: 100},
+		"d": {Pack: "p/missing", Size: 1},
+	}}
+	us := usage(idx, []object{
+		{name: "p/2", size: 100},
+		{name: "p/1", size: 100},
+		{name: "p/3", size: 50},
+	})
+	want := []*Usage{
+		{Pack: "p/1", Size: 100, Live: 30, Files: 2},
+		{Pack: "p/2", Size: 100, Live: 100, Files: 1},
+		{Pack: "p/3", Size: 50},
+	}
+	if !reflect.DeepEqual(us, want) {
+		t.Fatalf("usage(): got %+v, want %+v", us, want)
+	}
+	for i, dead := range []float64{0.7, 0, 1} {
+		if got := us[i].Dead(); got != dead {
+			t.Errorf("%s: Dead(): got %v, want %v", us[i].Pack, got, dead)
+		}
+	}
+}
+
+func TestSwap(t *testing.T) {
+	idx := &Index{Entries: map[string]Entry{
+		"same":    {Pack: "old", Offset: 0, Size: 1},
+		"changed": {Pack: "newer", Offset: 0, Size: 2},
+	}}
+	old := map[string]Entry{
+		"same":    {Pack: "old", Offset: 0, Size: 1},
+		"changed": {Pack: "old", Offset: 1, Size: 2},
+		"deleted": {Pack: "old", Offset: 3, Size: 3},
+	}
+	written := map[string]Entry{
+		"same":    {Pack: "compact", Offset: 0, Size: 1},
+		"changed": {Pack: "compact", Offset: 1, Size: 2},
+		"deleted": {Pack: "compact", Offset: 3, Size: 3},
+	}
+	n, size := swap(idx, old, written)
+	if n != 1 || size != 1 {
+		t.Errorf("swap(): got %d files of %d bytes, want 1 of 1", n, size)
+	}
+	want := map[string]Entry{
+		"same":    {Pack: "compact", Offset: 0, Size: 1},
+		"changed": {Pack: "newer", Offset: 0, Size: 2},
+	}
+	if !reflect.DeepEqual(idx.Entries, want) {
+		t.Errorf("swap(): got entries %v, want %v", idx.Entries, want)
+	}
+}
+
+func TestGarbage(t *testing.T) {
+	cutoff := time.Unix(1500000000, 0)
+	old, recent := cutoff.Add(-time.Minute), cutoff.Add(time.Minute)
+	idx := &Index{
+		Entries: map[string]Entry{"a": {Pack: "s/packs/live"}},
+		Dropped: map[string]time.Time{
+			"s/packs/dropped":  old,
+			"s/packs/dropping": recent,
+		},
+	}
+	packs := []object{
+		{name: "s/packs/live", uploaded: old.Add(-time.Hour)},
+		{name: "s/packs/dropped", uploaded: old.Add(-time.Hour)},
+		{name: "s/packs/dropping", uploaded: old.Add(-time.Hour)},
+		{name: "s/packs/orphan", uploaded: old},
+		{name: "s/packs/unindexed", uploaded: recent},
+	}
+	indexes := []object{
+		{name: "s/index/3", uploaded: recent},
+		{name: "s/index/1", uploaded: old.Add(-time.Hour)},
+		{name: "s/index/2", uploaded: old},
+	}
+	heads := []object{
+		{name: "s/INDEX", uploaded: old.Add(-time.Hour)},
+		{name: "s/INDEX", uploaded: old},
+		{name: "s/INDEXES", uploaded: old.Add(-time.Hour)},
+	}
+	var got []string
+	for _, obj := range garbage(idx, "s/INDEX", "s/index/3", packs, indexes, heads, cutoff) {
+		got = append(got, obj.name+"@"+obj.uploaded.Sub(cutoff).String())
+	}
+	// Index 2 was replaced after cutoff, and index 3 is current.
+	want := []string{"s/packs/dropped@-1h1m0s", "s/packs/orphan@-1m0s", "s/index/1@-1h1m0s", "s/INDEX@-1h1m0s"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("garbage(): got %v, want %v", got, want)
+	}
+}
+
+func TestMarkDropped(t *testing.T) {
+	at := time.Unix(1500000000, 0)
+	parent := &Index{ID: "1", Entries: map[string]Entry{
+		"a": {Pack: "p/1"},
+		"b": {Pack: "p/2"},
+	}}
+	idx := parent.child("2", at)
+	idx.Entries["b"] = Entry{Pack: "p/3"}
+	idx.Dropped["p/3"] = at.Add(-time.Hour)
+	markDropped(parent, idx, at)
+	want := map[string]time.Time{"p/2": at}
+	if !reflect.DeepEqual(idx.Dropped, want) {
+		t.Errorf("markDropped(): got %v, want %v", idx.Dropped, want)
+	}
+	c := idx.child("3", at.Add(time.Hour))
+	markDropped(idx, c, c.Time)
+	if !reflect.DeepEqual(c.Dropped, want) {
+		t.Errorf("markDropped() with nothing dropped: got %v, want %v", c.Dropped, want)
+	}
+}
+
+// TestCompactKeepsOldIndex checks that what a compaction replaces stays
+// readable through the index from before it, until Grace has passed.
+func TestCompactKeepsOldIndex(t *testing.T) {
+	grace := time.Hour
+	compacted := time.Unix(1500000000, 0)
+	prev := &Index{ID: "1", Entries: map[string]Entry{
+		"a": {Pack: "s/packs/old", Offset: 0, Size: 1},
+	}}
+	cur := prev.child("2", compacted)
+	swap(cur, map[string]Entry{"a": prev.Entries["a"]}, map[string]Entry{"a": {Pack: "s/packs/new", Size: 1}})
+	markDropped(prev, cur, cur.Time)
+
+	packs := []object{
+		{name: "s/packs/old", uploaded: compacted.Add(-24 * time.Hour)},
+		{name: "s/packs/new", uploaded: compacted},
+	}
+	indexes := []object{
+		{name: "s/index/1", uploaded: compacted.Add(-24 * time.Hour)},
+		{name: "s/index/2", uploaded: compacted},
+	}
+	for _, e := range []struct {
+		at   time.Time
+		want []string
+	}{
+		{at: compacted, want: nil},
+		{at: compacted.Add(grace / 2), want: nil},
+		{at: compacted.Add(grace + time.Second), want: []string{"s/packs/old", "s/index/1"}},
+	} {
+		var got []string
+		for _, obj := range garbage(cur, "s/INDEX", "s/index/2", packs, indexes, nil, e.at.Add(-grace)) {
+			got = append(got, obj.name)
+		}
+		if !reflect.DeepEqual(got, e.want) {
+			t.Errorf("garbage() at %v after compaction: got %v, want %v", e.at.Sub(compacted), got, e.want)
+		}
+	}
+}
@@ -0,0 +1,435 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pack stores many small files in a few large B2 objects.
+//
+// Every B2 object costs an upload transaction, a listing entry, and a
+// download transaction to read back, whatever its size.  For millions of files
+// of a few kilobytes each, that overhead dominates.  A Packer instead
+// concatenates files into packs of a few megabytes, and records where each
+// file landed in an index.  Files are read back with ranged downloads of the
+// pack that holds them.
+//
+// Objects are laid out beneath the store's prefix as
+//
+//	<prefix>/INDEX            the ID of the latest index
+//	<prefix>/index/<id>       an index, as JSON
+//	<prefix>/packs/<id>       a pack: the contents of its files, end to end
+//
+// As in package txn, the index is replaced by writing a new one and then
+// pointing INDEX at it, so readers see either all of a flush or none of it.
+// Older indexes are left in place for readers that still hold them, until
+// Compact removes them.
+//
+// Only one writer may update a store at a time: one Packer, and no Delete or
+// Compact while it is flushing.  B2 has no conditional writes, so an update
+// checks INDEX and then replaces it in separate requests.  An update that
+// sees INDEX change is made again on the newer index, but two updates that
+// check at the same moment may both succeed, and then the earlier one's index
+// is lost.
+//
+// Deleting a file only removes it from the index.  Compact reclaims the
+// space, by moving the live files out of packs that are mostly dead, and
+// deleting the packs and indexes that nothing refers to any longer.
+package pack
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kurin/blazer/b2"
+	"github.com/kurin/blazer/internal/pointer"
+)
+
+var (
+	// ErrNoIndex is returned by Latest when nothing has been flushed.
+	ErrNoIndex = errors.New("pack: no index")
+
+	// ErrConflict is returned when the index keeps changing while an
+	// update is being written.
+	ErrConflict = errors.New("pack: index changed during update")
+
+	errClosed = errors.New("pack: packer closed")
+)
+
+// updateRetries is how many times an update is attempted before it gives up
+// with ErrConflict.
+const updateRetries = 5
+
+// A Store is a set of small files packed into objects beneath a prefix.
+type Store struct {
+	b      *b2.Bucket
+	prefix string
+}
+
+// New returns a Store for the objects beneath prefix.
+func New(bucket *b2.Bucket, prefix string) *Store {
+	return &Store{
+		b:      bucket,
+		prefix: b2.CleanName(prefix),
+	}
+}
+
+// An Entry locates a file within a pack.
+type Entry struct {
+	Pack   string // The name of the pack object.
+	Offset int64
+	Size   int64
+}
+
+// An Index maps file names to the packs that hold them.
+type Index struct {
+	ID     string
+	Parent string // The ID of the previous index, if any.
+	Time   time.Time
+
+	Entries map[string]Entry
+
+	// Dropped records when each pack stopped being referred to, so that
+	// Compact can leave it for readers of older indexes for a while.
+	Dropped map[string]time.Time
+}
+
+// Names returns the file names in the index, sorted.
+func (idx *Index) Names() []string {
+	var names []string
+	for name := range idx.Entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Lookup returns the named file's entry, and whether there is one.
+func (idx *Index) Lookup(name string) (Entry, bool) {
+	e, ok := idx.Entries[b2.CleanName(name)]
+	return e, ok
+}
+
+// child returns a copy of idx, to be modified and written as its successor.
+func (idx *Index) child(id string, t time.Time) *Index {
+	c := &Index{
+		ID:      id,
+		Time:    t,
+		Entries: make(map[string]Entry),
+		Dropped: make(map[string]time.Time),
+	}
+	if idx != nil {
+		c.Parent = idx.ID
+		for name, e := range idx.Entries {
+			c.Entries[name] = e
+		}
+		for pack, t := range idx.Dropped {
+			c.Dropped[pack] = t
+		}
+	}
+	return c
+}
+
+// packs returns the set of packs that idx refers to.
+func (idx *Index) packs() map[string]bool {
+	refs := make(map[string]bool)
+	for _, e := range idx.Entries {
+		refs[e.Pack] = true
+	}
+	return refs
+}
+
+// markDropped records in idx, as of t, the packs that its parent referred to
+// and it does not.
+func markDropped(parent, idx *Index, t time.Time) {
+	refs := idx.packs()
+	if parent != nil {
+		for pack := range parent.packs() {
+			if !refs[pack] {
+				idx.Dropped[pack] = t
+			}
+		}
+	}
+	for pack := range idx.Dropped {
+		if refs[pack] {
+			delete(idx.Dropped, pack)
+		}
+	}
+}
+
+func (s *Store) headName() string {
+	return b2.JoinName(s.prefix, "INDEX")
+}
+
+func (s *Store) indexName(id string) string {
+	return b2.JoinName(s.prefix, "index", id)
+}
+
+func (s *Store) packName(id string) string {
+	return b2.JoinName(s.prefix, "packs", id)
+}
+
+// head returns the ID of the latest index, or "" if there is none.
+func (s *Store) head(ctx context.Context) (string, error) {
+	return pointer.New(s.b, s.headName()).Get(ctx)
+}
+
+func (s *Store) index(ctx context.Context, id string) (*Index, error) {
+	idx := &Index{}
+	if err := pointer.Read(ctx, s.b, s.indexName(id), idx); err != nil {
+		return nil, err
+	}
+	if idx.Entries == nil {
+		idx.Entries = make(map[string]Entry)
+	}
+	if idx.Dropped == nil {
+		idx.Dropped = make(map[string]time.Time)
+	}
+	return idx, nil
+}
+
+// Latest returns the most recently written index.
+func (s *Store) Latest(ctx context.Context) (*Index, error) {
+	id, err := s.head(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if id == "" {
+		return nil, ErrNoIndex
+	}
+	return s.index(ctx, id)
+}
+
+// update writes a successor to the latest index, as modified by fn, and
+// points the store at it.  If the latest index changes while the successor
+// is being written, fn is applied again to the newer index.  That narrows,
+// but does not close, the window in which a concurrent update is lost; see
+// the package comment.
+func (s *Store) update(ctx context.Context, fn func(*Index) error) (*Index, error) {
+	head := pointer.New(s.b, s.headName())
+	for i := 0; i < updateRetries; i++ {
+		cur, err := head.Get(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var base *Index
+		if cur != "" {
+			base, err = s.index(ctx, cur)
+			if err != nil {
+				return nil, err
+			}
+		}
+		id, err := pointer.NewID()
+		if err != nil {
+			return nil, err
+		}
+		idx := base.child(id, time.Now())
+		if err := fn(idx); err != nil {
+			return nil, err
+		}
+		markDropped(base, idx, idx.Time)
+		if err := pointer.Write(ctx, s.b, s.indexName(id), idx); err != nil {
+			return nil, err
+		}
+		err = head.Swap(ctx, cur, id)
+		if err == pointer.ErrMoved {
+			s.b.Object(s.indexName(id)).Delete(ctx)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return idx, nil
+	}
+	return nil, ErrConflict
+}
+
+// Delete removes the named files from the index.  Their contents stay in
+// their packs until Compact rewrites the packs.
+func (s *Store) Delete(ctx context.Context, names ...string) error {
+	_, err := s.update(ctx, func(idx *Index) error {
+		for _, name := range names {
+			delete(idx.Entries, b2.CleanName(name))
+		}
+		return nil
+	})
+	return err
+}
+
+// NewReader returns a reader for the named file as of the given index.  The
+// file is read with a ranged download of its pack.
+func (s *Store) NewReader(ctx context.Context, idx *Index, name string) (io.ReadCloser, error) {
+	e, ok := idx.Lookup(name)
+	if !ok {
+		return nil, fmt.Errorf("%s: not in index %s", name, idx.ID)
+	}
+	if e.Size == 0 {
+		// A zero-length range would be read as the rest of the pack.
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+	return s.b.Object(e.Pack).NewRangeReader(ctx, e.Offset, e.Size), nil
+}
+
+// Options adjusts how a Packer packs files.
+type Options struct {
+	// PackSize is the size at which a pack is uploaded and a new one
+	// begun.  Files are never split, so a pack may be larger than this by
+	// up to the size of its last file.  If 0, 16MB is used.
+	PackSize int64
+
+	// WriterOptions are applied to the Writer for each pack.
+	WriterOptions []b2.WriterOption
+}
+
+const defaultPackSize = 16 << 20
+
+// A Packer adds files to a store.  Files are buffered in memory until a pack
+// is full, and are not visible to readers until the Packer is flushed.  Its
+// methods are safe to call concurrently.
+type Packer struct {
+	s    *Store
+	opts Options
+
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	cur     map[string]Entry // files in buf; Pack is not yet set
+	written map[string]Entry // files in uploaded packs, not yet indexed
+	closed  bool
+}
+
+// NewPacker returns a Packer that adds files to s.
+func (s *Store) NewPacker(opts Options) *Packer {
+	if opts.PackSize <= 0 {
+		opts.PackSize = defaultPackSize
+	}
+	return &Packer{
+		s:       s,
+		opts:    opts,
+		cur:     make(map[string]Entry),
+		written: make(map[string]Entry),
+	}
+}
+
+// Add reads the named file from r and adds it to the current pack, uploading
+// the pack if it is full.  A file added more than once is indexed as the
+// last one added.
+func (p *Packer) Add(ctx context.Context, name string, r io.Reader) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return errClosed
+	}
+	if err := p.add(name, r); err != nil {
+		return err
+	}
+	if int64(p.buf.Len()) >= p.opts.PackSize {
+		return p.upload(ctx)
+	}
+	return nil
+}
+
+// add appends r to the current pack.  The caller must hold mu.
+func (p *Packer) add(name string, r io.Reader) error {
+	name = b2.CleanName(name)
+	off := int64(p.buf.Len())
+	n, err := p.buf.ReadFrom(r)
+	if err != nil {
+		p.buf.Truncate(int(off))
+		return err
+	}
+	p.cur[name] = Entry{Offset: off, Size: n}
+	return nil
+}
+
+// upload writes the current pack, if it holds anything, and begins another.
+// The caller must hold mu.
+func (p *Packer) upload(ctx context.Context) error {
+	if p.buf.Len() == 0 {
+		return nil
+	}
+	id, err := pointer.NewID()
+	if err != nil {
+		return err
+	}
+	name := p.s.packName(id)
+	w := p.s.b.Object(name).NewWriter(ctx, p.opts.WriterOptions...)
+	if _, err := w.Write(p.buf.Bytes()); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	p.seal(name)
+	return nil
+}
+
+// seal records that the current pack was uploaded as name, and empties it.
+// The caller must hold mu.
+func (p *Packer) seal(name string) {
+	for file, e := range p.cur {
+		e.Pack = name
+		p.written[file] = e
+	}
+	p.cur = make(map[string]Entry)
+	p.buf.Reset()
+}
+
+// Flush uploads the current pack and writes an index that includes every
+// file added so far.
+func (p *Packer) Flush(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return errClosed
+	}
+	return p.flush(ctx)
+}
+
+func (p *Packer) flush(ctx context.Context) error {
+	if err := p.upload(ctx); err != nil {
+		return err
+	}
+	if len(p.written) == 0 {
+		return nil
+	}
+	_, err := p.s.update(ctx, func(idx *Index) error {
+		for name, e := range p.written {
+			idx.Entries[name] = e
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	p.written = make(map[string]Entry)
+	return nil
+}
+
+// Close flushes the Packer.  A Packer cannot be used after it is closed.
+func (p *Packer) Close(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return errClosed
+	}
+	if err := p.flush(ctx); err != nil {
+		return err
+	}
+	p.closed = true
+	return nil
+}
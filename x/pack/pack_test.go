@@ -0,0 +1,211 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pack
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kurin/blazer/b2"
+)
+
+const (
+	apiID      = "B2_ACCOUNT_ID"
+	apiKey     = "B2_SECRET_KEY"
+	bucketName = "packbucket"
+)
+
+func TestPackerEntries(t *testing.T) {
+	p := New(nil, "/files/").NewPacker(Options{})
+	for _, f := range []struct{ name, data string }{
+		{"a", "aaa"},
+		{"/dir/b", "bb"},
+		{"empty", ""},
+		{"a", "AAAA"},
+	} {
+		if err := p.add(f.name, strings.NewReader(f.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.seal("files/packs/1")
+	want := map[string]Entry{
+		"a":     {Pack: "files/packs/1", Offset: 5, Size: 4},
+		"dir/b": {Pack: "files/packs/1", Offset: 3, Size: 2},
+		"empty": {Pack: "files/packs/1", Offset: 5, Size: 0},
+	}
+	if !reflect.DeepEqual(p.written, want) {
+		t.Errorf("entries: got %v, want %v", p.written, want)
+	}
+	if p.buf.Len() != 0 || len(p.cur) != 0 {
+		t.Errorf("seal() left %d bytes and %d files in the current pack", p.buf.Len(), len(p.cur))
+	}
+
+	// A file added again in a later pack replaces the earlier entry.
+	if err := p.add("dir/b", strings.NewReader("BBB")); err != nil {
+		t.Fatal(err)
+	}
+	p.seal("files/packs/2")
+	if e := p.written["dir/b"]; e != (Entry{Pack: "files/packs/2", Offset: 0, Size: 3}) {
+		t.Errorf("dir/b: got %+v after re-adding", e)
+	}
+}
+
+func TestIndexChild(t *testing.T) {
+	var nilIdx *Index
+	if c := nilIdx.child("1", time.Time{}); c.Parent != "" || c.Entries == nil {
+		t.Errorf("child of no index: got %+v", c)
+	}
+	idx := &Index{ID: "1", Entries: map[string]Entry{"a": {Pack: "p", Size: 1}}}
+	c := idx.child("2", time.Time{})
+	c.Entries["b"] = Entry{Pack: "p", Offset: 1, Size: 1}
+	if c.Parent != "1" || len(c.Entries) != 2 || len(idx.Entries) != 1 {
+		t.Errorf("child(): got %+v from %+v", c, idx)
+	}
+	if _, ok := c.Lookup("/a"); !ok {
+		t.Errorf("Lookup(/a): not found")
+	}
+}
+
+func read(ctx context.Context, s *Store, idx *Index, name string) (string, error) {
+	r, err := s.NewReader(ctx, idx, name)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	return string(b), err
+}
+
+func TestStore(t *testing.T) {
+	id := os.Getenv(apiID)
+	key := os.Getenv(apiKey)
+	if id == "" || key == "" {
+		t.Skipf("B2_ACCOUNT_ID or B2_SECRET_KEY unset; skipping integration tests")
+	}
+	ctx := context.Background()
+	client, err := b2.NewClient(ctx, id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket, err := client.NewBucket(ctx, fmt.Sprintf("%s-%s", id, bucketName), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bucket.Delete(ctx)
+	defer func() {
+		iter := bucket.List(ctx, b2.ListHidden())
+		for iter.Next() {
+			iter.Object().Delete(ctx)
+		}
+	}()
+
+	s := New(bucket, "files")
+	if _, err := s.Latest(ctx); err != ErrNoIndex {
+		t.Fatalf("Latest(): got %v, want ErrNoIndex", err)
+	}
+	p := s.NewPacker(Options{PackSize: 10})
+	files := map[string]string{
+		"a": "apple",
+		"b": "banana",
+		"c": "cherry",
+		"d": "",
+	}
+	for name, data := range files {
+		if err := p.Add(ctx, name, strings.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := s.Latest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range files {
+		got, err := read(ctx, s, idx, name)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+
+	if err := s.Delete(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	idx, err = s.Latest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := idx.Names(), []string{"a", "c", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Names() after Delete: got %v, want %v", got, want)
+	}
+
+	// A reader holding the index from before a compaction can still read
+	// from it until Grace has passed.
+	opts := CompactOptions{Threshold: 0.01, Grace: 2 * time.Second}
+	prev := idx
+	time.Sleep(3 * time.Second)
+	res, err := s.Compact(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewritten := res.Rewritten
+	if len(rewritten) == 0 {
+		t.Errorf("Compact(): got %+v, want packs rewritten", res)
+	}
+	for _, name := range prev.Names() {
+		if got, err := read(ctx, s, prev, name); err != nil || got != files[name] {
+			t.Errorf("%s from the index before Compact: got %q, %v; want %q", name, got, err, files[name])
+		}
+	}
+	time.Sleep(3 * time.Second)
+	res, err = s.Compact(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted := make(map[string]bool)
+	for _, name := range res.Deleted {
+		deleted[name] = true
+	}
+	for _, pack := range rewritten {
+		if !deleted[pack] {
+			t.Errorf("Compact() after Grace: %s was not deleted", pack)
+		}
+	}
+	idx, err = s.Latest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range idx.Names() {
+		got, err := read(ctx, s, idx, name)
+		if err != nil {
+			t.Errorf("%s after Compact: %v", name, err)
+			continue
+		}
+		if got != files[name] {
+			t.Errorf("%s after Compact: got %q, want %q", name, got, files[name])
+		}
+	}
+}
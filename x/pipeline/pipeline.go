@@ -0,0 +1,309 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pipeline composes streaming transformations, such as compression
+// and encryption, over B2 objects.
+//
+// A Pipeline is a list of stages that data passes through, in order, on its
+// way to B2.  The stages used are recorded in the object's info, so that a
+// reader need only supply stages that can undo them (and any keys they
+// need); they are applied in reverse automatically.
+//
+//	p := pipeline.Pipeline{pipeline.Gzip(gzip.BestSpeed), pipeline.AESGCM("k1", key)}
+//	w, err := p.NewWriter(ctx, obj, nil)
+//	...
+//	r, err := pipeline.NewReader(ctx, obj, pipeline.Gzip(0), pipeline.AESGCM("k1", key))
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/kurin/blazer/b2"
+)
+
+// InfoKey is the file info key that records an object's stages.
+const InfoKey = "pipeline"
+
+// SampleKey is the file info key that records what stages such as AutoGzip,
+// which decide from a sample of the data whether to apply themselves,
+// decided.
+const SampleKey = "pipeline-sample"
+
+// sampleSize is the amount of data that sampling stages judge.
+const sampleSize = 1 << 20
+
+// A sampler is a stage that need not be applied to every object.
+type sampler interface {
+	// sample reports whether the stage is worth applying to data that
+	// begins with b, and notes why, for SampleKey.
+	sample(b []byte) (apply bool, note string)
+}
+
+// A Stage is a single transformation.
+type Stage interface {
+	// Spec identifies the stage, and is recorded in the object's info.  A
+	// stage can undo data written by any stage with the same Spec.  Specs
+	// may not contain spaces.
+	Spec() string
+
+	// NewWriter returns a writer that transforms data and writes it to w.
+	// Closing it must flush any buffered data, but not close w.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+
+	// NewReader returns a reader that undoes the transformation of the data
+	// read from r.
+	NewReader(r io.Reader) (io.Reader, error)
+}
+
+// A Pipeline is a list of stages that data passes through on its way to B2.
+type Pipeline []Stage
+
+// Spec returns the value recorded under InfoKey for objects written by p.
+func (p Pipeline) Spec() string {
+	var specs []string
+	for _, s := range p {
+		specs = append(specs, s.Spec())
+	}
+	return strings.Join(specs, " ")
+}
+
+type writer struct {
+	stages []io.WriteCloser
+	w      *b2.Writer
+	cancel context.CancelFunc
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	return w.stages[0].Write(p)
+}
+
+// Close flushes each stage, in order, and then closes the underlying
+// b2.Writer.
+func (w *writer) Close() error {
+	for _, s := range w.stages {
+		if err := s.Close(); err != nil {
+			// Cancel first, so that what the stages did write isn't
+			// committed as though it were the whole object.
+			w.cancel()
+			w.w.Close()
+			return err
+		}
+	}
+	err := w.w.Close()
+	w.cancel()
+	return err
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// NewWriter returns a writer that passes data through every stage of p and
+// uploads the result to o.  The pipeline's Spec is added to the info of
+// attrs, which may be nil.  Opts are passed to NewWriter, and so may alter
+// the b2.Writer's behavior, but must not set attributes.
+//
+// If p has stages, such as AutoGzip, that decide whether to apply themselves,
+// the first 1MB of data is held back until they have judged it, and nothing is
+// uploaded until then.  Such stages judge the data as it is given to the
+// pipeline, and so belong at its start.  Stages that decline are left out of
+// the object's Spec, and every decision is recorded under SampleKey.
+//
+// The returned writer must be closed to finish the upload.
+func (p Pipeline) NewWriter(ctx context.Context, o *b2.Object, attrs *b2.Attrs, opts ...b2.WriterOption) (io.WriteCloser, error) {
+	for _, s := range p {
+		if _, ok := s.(sampler); ok {
+			open := func(p Pipeline, note string) (io.WriteCloser, error) {
+				return p.newWriter(ctx, o, attrs, note, opts)
+			}
+			return &sampleWriter{p: p, open: open}, nil
+		}
+	}
+	return p.newWriter(ctx, o, attrs, "", opts)
+}
+
+// newWriter is NewWriter, once it is settled which stages apply.  If note is
+// not blank, it is recorded under SampleKey.
+func (p Pipeline) newWriter(ctx context.Context, o *b2.Object, attrs *b2.Attrs, note string, opts []b2.WriterOption) (io.WriteCloser, error) {
+	a := &b2.Attrs{}
+	if attrs != nil {
+		*a = *attrs
+	}
+	a.Info = make(map[string]string)
+	if attrs != nil {
+		for k, v := range attrs.Info {
+			a.Info[k] = v
+		}
+	}
+	if len(p) > 0 {
+		a.Info[InfoKey] = p.Spec()
+	}
+	if note != "" {
+		a.Info[SampleKey] = note
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	bw := o.NewWriter(ctx, append(opts, b2.WithAttrsOption(a))...)
+	stages, err := p.chain(bw)
+	if err != nil {
+		// A stage that was built may already have written a header; cancel
+		// so that Close discards it instead of committing it.
+		cancel()
+		bw.Close()
+		return nil, err
+	}
+	return &writer{stages: stages, w: bw, cancel: cancel}, nil
+}
+
+// chain returns the writers for each stage of p, the last of which writes to
+// w.  Writes to the first pass through every stage.
+func (p Pipeline) chain(w io.Writer) ([]io.WriteCloser, error) {
+	if len(p) == 0 {
+		return []io.WriteCloser{nopCloser{w}}, nil
+	}
+	// Build from the end of the pipeline back, so that each stage writes
+	// into the one after it.
+	stages := make([]io.WriteCloser, len(p))
+	next := w
+	for i := len(p) - 1; i >= 0; i-- {
+		sw, err := p[i].NewWriter(next)
+		if err != nil {
+			return nil, err
+		}
+		stages[i] = sw
+		next = sw
+	}
+	return stages, nil
+}
+
+// sampleWriter holds back the start of the data until the pipeline's sampling
+// stages have judged it.
+type sampleWriter struct {
+	p    Pipeline
+	open func(p Pipeline, note string) (io.WriteCloser, error)
+	buf  []byte
+	w    io.WriteCloser // nil until the stages have been judged
+}
+
+func (s *sampleWriter) Write(b []byte) (int, error) {
+	if s.w != nil {
+		return s.w.Write(b)
+	}
+	s.buf = append(s.buf, b...)
+	if len(s.buf) < sampleSize {
+		return len(b), nil
+	}
+	if err := s.start(); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// start judges the held data, opens the writer for the stages that apply,
+// and writes the data to it.
+func (s *sampleWriter) start() error {
+	sample := s.buf
+	if len(sample) > sampleSize {
+		sample = sample[:sampleSize]
+	}
+	var (
+		kept  Pipeline
+		notes []string
+	)
+	for _, st := range s.p {
+		if sm, ok := st.(sampler); ok {
+			apply, note := sm.sample(sample)
+			notes = append(notes, note)
+			if !apply {
+				continue
+			}
+		}
+		kept = append(kept, st)
+	}
+	w, err := s.open(kept, strings.Join(notes, " "))
+	if err != nil {
+		return err
+	}
+	s.w = w
+	buf := s.buf
+	s.buf = nil
+	_, err = w.Write(buf)
+	return err
+}
+
+func (s *sampleWriter) Close() error {
+	if s.w == nil {
+		if err := s.start(); err != nil {
+			return err
+		}
+	}
+	return s.w.Close()
+}
+
+// afterAttrs is called by NewReader once it has read the object's info, so
+// that tests can overwrite the object before it is downloaded.
+var afterAttrs = func() {}
+
+type reader struct {
+	io.Reader
+	r *b2.Reader
+}
+
+func (r *reader) Close() error { return r.r.Close() }
+
+// NewReader returns a reader that downloads o and undoes each stage recorded
+// in its info, in reverse order.  Stages must include a stage matching each
+// recorded Spec; it is not an error to supply stages that aren't needed.
+//
+// The version whose info is read is the one downloaded, even if o is
+// overwritten in the meantime.
+func NewReader(ctx context.Context, o *b2.Object, stages ...Stage) (io.ReadCloser, error) {
+	attrs, err := o.Attrs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	afterAttrs()
+	br := o.Bucket().ObjectByID(attrs.ID, attrs.Name).NewReader(ctx)
+	r, err := decode(br, attrs.Info[InfoKey], stages)
+	if err != nil {
+		br.Close()
+		return nil, err
+	}
+	return &reader{Reader: r, r: br}, nil
+}
+
+// decode undoes the stages in spec, reading from r.
+func decode(r io.Reader, spec string, stages []Stage) (io.Reader, error) {
+	specs := strings.Fields(spec)
+	for i := len(specs) - 1; i >= 0; i-- {
+		var stage Stage
+		for _, s := range stages {
+			if s.Spec() == specs[i] {
+				stage = s
+				break
+			}
+		}
+		if stage == nil {
+			return nil, fmt.Errorf("pipeline: no stage for %q", specs[i])
+		}
+		sr, err := stage.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		r = sr
+	}
+	return r, nil
+}
@@ -0,0 +1,259 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/kurin/blazer/b2"
+)
+
+const (
+	apiID      = "B2_ACCOUNT_ID"
+	apiKey     = "B2_SECRET_KEY"
+	bucketName = "pipelinebucket"
+)
+
+// encode runs data through each stage of p, as NewWriter does.
+func encode(t *testing.T, p Pipeline, data []byte) []byte {
+	buf := &bytes.Buffer{}
+	stages, err := p.chain(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stages[0].Write(data); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range stages {
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	big := bytes.Repeat([]byte("pipeline "), segSize/4)
+	table := []struct {
+		p    Pipeline
+		spec string
+		data []byte
+	}{
+		{p: Pipeline{}, spec: "", data: []byte("plain")},
+		{p: Pipeline{Gzip(gzip.BestSpeed)}, spec: "gzip", data: big},
+		{p: Pipeline{AESGCM("k1", key)}, spec: "aes-gcm:k1", data: nil},
+		{p: Pipeline{AESGCM("k1", key)}, spec: "aes-gcm:k1", data: big[:segSize]},
+		{p: Pipeline{Gzip(0), AESGCM("k1", key)}, spec: "gzip aes-gcm:k1", data: big},
+	}
+	for _, e := range table {
+		if got := e.p.Spec(); got != e.spec {
+			t.Errorf("Spec(): got %q, want %q", got, e.spec)
+		}
+		enc := encode(t, e.p, e.data)
+		r, err := decode(bytes.NewReader(enc), e.spec, []Stage{AESGCM("k0", nil), AESGCM("k1", key), Gzip(0)})
+		if err != nil {
+			t.Errorf("%s: %v", e.spec, err)
+			continue
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Errorf("%s: %v", e.spec, err)
+			continue
+		}
+		if !bytes.Equal(got, e.data) {
+			t.Errorf("%s: got %d bytes back, want %d", e.spec, len(got), len(e.data))
+		}
+	}
+}
+
+func TestAESGCMTampering(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 16)
+	stage := AESGCM("k", key)
+	data := bytes.Repeat([]byte("secret"), segSize/2)
+	enc := encode(t, Pipeline{stage}, data)
+
+	table := map[string][]byte{
+		"flipped":   append(append([]byte{}, enc[:100]...), append([]byte{enc[100] ^ 1}, enc[101:]...)...),
+		"truncated": enc[:8+segSize+16],
+		"shortened": enc[:len(enc)-1],
+	}
+	for name, bad := range table {
+		r, err := decode(bytes.NewReader(bad), stage.Spec(), []Stage{stage})
+		if err == nil {
+			_, err = ioutil.ReadAll(r)
+		}
+		if err == nil {
+			t.Errorf("%s: read tampered data without error", name)
+		}
+	}
+
+	if _, err := decode(bytes.NewReader(enc), stage.Spec(), []Stage{AESGCM("other", key)}); err == nil {
+		t.Error("decode without a matching stage: got no error")
+	}
+}
+
+func TestAutoGzip(t *testing.T) {
+	random := make([]byte, sampleSize+100)
+	rand.New(rand.NewSource(1)).Read(random)
+	text := bytes.Repeat([]byte("pipeline "), sampleSize/4)
+	table := []struct {
+		desc string
+		data []byte
+		spec string
+		note string
+	}{
+		{desc: "text", data: text, spec: "gzip aes-gcm:k", note: ":apply"},
+		{desc: "random", data: random, spec: "aes-gcm:k", note: ":skip"},
+		{desc: "empty", spec: "aes-gcm:k", note: "gzip:-:skip"},
+	}
+	key := bytes.Repeat([]byte{7}, 16)
+	for _, e := range table {
+		var (
+			spec, note string
+			buf        bytes.Buffer
+		)
+		open := func(p Pipeline, n string) (io.WriteCloser, error) {
+			spec, note = p.Spec(), n
+			return nopCloser{&buf}, nil
+		}
+		w := &sampleWriter{p: Pipeline{AutoGzip(0, 0), AESGCM("k", key)}, open: open}
+		for data := e.data; len(data) > 0; {
+			n := 1000
+			if n > len(data) {
+				n = len(data)
+			}
+			if _, err := w.Write(data[:n]); err != nil {
+				t.Fatal(err)
+			}
+			data = data[n:]
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if spec != e.spec {
+			t.Errorf("%s: got spec %q, want %q", e.desc, spec, e.spec)
+		}
+		if !strings.HasPrefix(note, "gzip:") || !strings.HasSuffix(note, e.note) {
+			t.Errorf("%s: got note %q, want one ending %q", e.desc, note, e.note)
+		}
+		if !bytes.Equal(buf.Bytes(), e.data) {
+			t.Errorf("%s: got %d bytes through, want %d", e.desc, buf.Len(), len(e.data))
+		}
+	}
+	if got := AutoGzip(0, 0).Spec(); got != "gzip" {
+		t.Errorf("AutoGzip Spec: got %q, want gzip", got)
+	}
+}
+
+func TestBucket(t *testing.T) {
+	id := os.Getenv(apiID)
+	key := os.Getenv(apiKey)
+	if id == "" || key == "" {
+		t.Skipf("B2_ACCOUNT_ID or B2_SECRET_KEY unset; skipping integration tests")
+	}
+	ctx := context.Background()
+	client, err := b2.NewClient(ctx, id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket, err := client.NewBucket(ctx, fmt.Sprintf("%s-%s", id, bucketName), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bucket.Delete(ctx)
+	defer func() {
+		iter := bucket.List(ctx, b2.ListHidden())
+		for iter.Next() {
+			iter.Object().Delete(ctx)
+		}
+	}()
+
+	aesKey := bytes.Repeat([]byte{7}, 16)
+	stages := []Stage{Gzip(0), AESGCM("k", aesKey)}
+	put := func(name string, p Pipeline, data []byte) error {
+		w, err := p.NewWriter(ctx, bucket.Object(name), nil)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			w.Close()
+			return err
+		}
+		return w.Close()
+	}
+	get := func(name string) ([]byte, error) {
+		r, err := NewReader(ctx, bucket.Object(name), stages...)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	}
+
+	text := bytes.Repeat([]byte("pipeline "), sampleSize/4)
+	if err := put("auto", Pipeline{AutoGzip(0, 0), AESGCM("k", aesKey)}, text); err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := bucket.Object("auto").Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := attrs.Info[InfoKey]; got != "gzip aes-gcm:k" {
+		t.Errorf("auto: got spec %q, want %q", got, "gzip aes-gcm:k")
+	}
+	got, err := get("auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, text) {
+		t.Errorf("auto: got %d bytes back, want %d", len(got), len(text))
+	}
+
+	// AESGCM is built first, and writes its header, before Gzip rejects its
+	// level; nothing should be committed.
+	if err := put("bad", Pipeline{Gzip(42), AESGCM("k", aesKey)}, text); err == nil {
+		t.Error("NewWriter with a bad stage: got no error")
+	}
+	if _, err := bucket.Object("bad").Attrs(ctx); !b2.IsNotExist(err) {
+		t.Errorf("bad: got %v, want a missing object", err)
+	}
+
+	if err := put("pinned", Pipeline{Gzip(0)}, []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	afterAttrs = func() {
+		if err := put("pinned", Pipeline{}, []byte("second")); err != nil {
+			t.Error(err)
+		}
+	}
+	got, err = get("pinned")
+	afterAttrs = func() {}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "first" {
+		t.Errorf("pinned: got %q, want %q", got, "first")
+	}
+}
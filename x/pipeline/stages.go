@@ -0,0 +1,258 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+type gzipStage struct {
+	level int
+}
+
+// Gzip returns a stage that compresses data with the given gzip level.  A
+// level of 0 selects gzip.DefaultCompression.  The level does not affect
+// decompression.
+func Gzip(level int) Stage {
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	return gzipStage{level: level}
+}
+
+func (gzipStage) Spec() string { return "gzip" }
+
+func (g gzipStage) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, g.level)
+}
+
+func (gzipStage) NewReader(r io.Reader) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
+
+type autoGzipStage struct {
+	gzipStage
+	maxRatio float64
+}
+
+// AutoGzip returns a gzip stage, like Gzip, that first compresses the start
+// of the data, and is not applied if that does not shrink it to at most
+// maxRatio of its size.  This spares the work of compressing data, such as
+// media or archives, that is compressed already.  A maxRatio of 0 selects
+// 0.9.  Objects written with AutoGzip are read with Gzip, and the ratio of the
+// sample, and whether gzip was applied, is recorded under SampleKey as, for
+// example, "gzip:0.998:skip".
+func AutoGzip(level int, maxRatio float64) Stage {
+	if maxRatio <= 0 {
+		maxRatio = 0.9
+	}
+	return autoGzipStage{gzipStage: Gzip(level).(gzipStage), maxRatio: maxRatio}
+}
+
+func (g autoGzipStage) sample(b []byte) (bool, string) {
+	if len(b) == 0 {
+		return false, "gzip:-:skip"
+	}
+	cw := &countWriter{}
+	zw, err := gzip.NewWriterLevel(cw, g.level)
+	if err != nil {
+		return true, "gzip:-:apply"
+	}
+	zw.Write(b)
+	zw.Close()
+	ratio := float64(cw.n) / float64(len(b))
+	if ratio > g.maxRatio {
+		return false, fmt.Sprintf("gzip:%.3f:skip", ratio)
+	}
+	return true, fmt.Sprintf("gzip:%.3f:apply", ratio)
+}
+
+type countWriter struct{ n int }
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	c.n += len(p)
+	return len(p), nil
+}
+
+// segSize is the amount of plaintext sealed at a time by AESGCM.
+const segSize = 64 << 10
+
+type aesStage struct {
+	id  string
+	key []byte
+}
+
+// AESGCM returns a stage that encrypts and authenticates data with AES-GCM
+// using the given 16, 24, or 32 byte key.  The key itself is never stored;
+// keyID is recorded instead, so that readers can pick the right key.
+//
+// Data is sealed in 64KB segments, so it can be streamed, and the stream is
+// terminated so that a truncated object is detected as well as a modified
+// one.
+func AESGCM(keyID string, key []byte) Stage {
+	return aesStage{id: keyID, key: key}
+}
+
+func (a aesStage) Spec() string { return "aes-gcm:" + a.id }
+
+func (a aesStage) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(a.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// nonce returns the nonce for the given segment: a random per-object prefix
+// followed by the segment number.
+func nonce(prefix []byte, seg uint32) []byte {
+	n := make([]byte, 12)
+	copy(n, prefix)
+	binary.BigEndian.PutUint32(n[8:], seg)
+	return n
+}
+
+// additional data marks the last segment, so that truncation is detected.
+var (
+	notLast = []byte{0}
+	last    = []byte{1}
+)
+
+type sealer struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	seg    uint32
+	buf    []byte
+}
+
+func (a aesStage) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	aead, err := a.aead()
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(prefix); err != nil {
+		return nil, err
+	}
+	return &sealer{w: w, aead: aead, prefix: prefix, buf: make([]byte, 0, segSize)}, nil
+}
+
+func (s *sealer) seal(ad []byte) error {
+	ct := s.aead.Seal(nil, nonce(s.prefix, s.seg), s.buf, ad)
+	s.seg++
+	s.buf = s.buf[:0]
+	_, err := s.w.Write(ct)
+	return err
+}
+
+func (s *sealer) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		if len(s.buf) == segSize {
+			if err := s.seal(notLast); err != nil {
+				return n, err
+			}
+		}
+		k := copy(s.buf[len(s.buf):segSize], p)
+		s.buf = s.buf[:len(s.buf)+k]
+		p = p[k:]
+		n += k
+	}
+	return n, nil
+}
+
+// Close seals the final segment, which is shorter than the others and may be
+// empty.
+func (s *sealer) Close() error {
+	if len(s.buf) == segSize {
+		if err := s.seal(notLast); err != nil {
+			return err
+		}
+	}
+	return s.seal(last)
+}
+
+var errTruncated = errors.New("pipeline: encrypted stream is truncated")
+
+type opener struct {
+	r      io.Reader
+	aead   cipher.AEAD
+	prefix []byte
+	seg    uint32
+	ct     []byte
+	pt     []byte
+	done   bool
+}
+
+func (a aesStage) NewReader(r io.Reader) (io.Reader, error) {
+	aead, err := a.aead()
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, 8)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		if err == io.EOF {
+			err = errTruncated
+		}
+		return nil, err
+	}
+	return &opener{
+		r:      r,
+		aead:   aead,
+		prefix: prefix,
+		ct:     make([]byte, segSize+aead.Overhead()),
+	}, nil
+}
+
+func (o *opener) Read(p []byte) (int, error) {
+	for len(o.pt) == 0 {
+		if o.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(o.r, o.ct)
+		ad := notLast
+		switch err {
+		case nil:
+		case io.ErrUnexpectedEOF:
+			// Only the last segment is short.
+			ad = last
+			o.done = true
+		case io.EOF:
+			return 0, errTruncated
+		default:
+			return 0, err
+		}
+		pt, err := o.aead.Open(o.ct[:0], nonce(o.prefix, o.seg), o.ct[:n], ad)
+		if err != nil {
+			return 0, err
+		}
+		o.seg++
+		o.pt = pt
+	}
+	n := copy(p, o.pt)
+	o.pt = o.pt[n:]
+	return n, nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package posix records POSIX file metadata in B2 object attributes, so that
+// backup tools can restore a file's permissions, ownership, and extended
+// attributes along with its contents.
+//
+// Metadata is only recorded when the caller asks for it:
+//
+//	attrs, err := posix.Attrs(path)
+//	...
+//	w := obj.NewWriter(ctx, b2.WithAttrsOption(attrs))
+//
+// and restored with
+//
+//	attrs, err := obj.Attrs(ctx)
+//	...
+//	err = posix.Restore(path, attrs)
+//
+// Files with holes, such as VM images, can be uploaded without them through
+// SparseReader, and restored with SparseRestorer.
+//
+// B2 allows at most 10 info keys per object, of which this package uses up to
+// six.
+package posix
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/kurin/blazer/b2"
+)
+
+const (
+	modeKey   = "posix-mode"
+	uidKey    = "posix-uid"
+	gidKey    = "posix-gid"
+	xattrsKey = "posix-xattrs"
+
+	// B2 limits the total size of an upload's headers to 7000 bytes.  Keep
+	// well under that, leaving room for the object's other info.
+	maxXattrs = 4096
+)
+
+// Attrs returns attributes for the file at path suitable for passing to
+// b2.WithAttrsOption.  They record the file's modification time, permission
+// bits, and, where the platform supports them, its owner and extended
+// attributes.  Extended attributes are omitted if together they would be
+// too large to store.
+func Attrs(path string) (*b2.Attrs, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	info := map[string]string{
+		modeKey: strconv.FormatUint(uint64(fi.Mode().Perm()), 8),
+	}
+	if uid, gid, ok := owner(fi); ok {
+		info[uidKey] = strconv.Itoa(uid)
+		info[gidKey] = strconv.Itoa(gid)
+	}
+	xs, err := getXattrs(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(xs) > 0 {
+		buf, err := json.Marshal(xs)
+		if err != nil {
+			return nil, err
+		}
+		if enc := base64.StdEncoding.EncodeToString(buf); len(enc) <= maxXattrs {
+			info[xattrsKey] = enc
+		}
+	}
+	return &b2.Attrs{
+		LastModified: fi.ModTime(),
+		Info:         info,
+	}, nil
+}
+
+// Restore applies the metadata recorded in attrs by Attrs to the file at
+// path.  Metadata that attrs does not contain is left unchanged.  Ownership
+// and privileged extended attributes are only restored if the process is
+// permitted to change them, which usually requires root; otherwise they are
+// silently skipped.
+func Restore(path string, attrs *b2.Attrs) error {
+	if attrs == nil {
+		return nil
+	}
+	if v, ok := attrs.Info[xattrsKey]; ok {
+		buf, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return fmt.Errorf("%s: %v", xattrsKey, err)
+		}
+		xs := make(map[string][]byte)
+		if err := json.Unmarshal(buf, &xs); err != nil {
+			return fmt.Errorf("%s: %v", xattrsKey, err)
+		}
+		if err := setXattrs(path, xs); err != nil {
+			return err
+		}
+	}
+	uid, uerr := strconv.Atoi(attrs.Info[uidKey])
+	gid, gerr := strconv.Atoi(attrs.Info[gidKey])
+	if uerr == nil && gerr == nil {
+		if err := os.Chown(path, uid, gid); err != nil && !os.IsPermission(err) {
+			return err
+		}
+	}
+	if v, ok := attrs.Info[modeKey]; ok {
+		mode, err := strconv.ParseUint(v, 8, 32)
+		if err != nil {
+			return fmt.Errorf("%s: %v", modeKey, err)
+		}
+		if err := os.Chmod(path, os.FileMode(mode).Perm()); err != nil {
+			return err
+		}
+	}
+	if !attrs.LastModified.IsZero() {
+		if err := os.Chtimes(path, attrs.LastModified, attrs.LastModified); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package posix
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kurin/blazer/b2"
+)
+
+func TestRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "posixtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	if err := ioutil.WriteFile(src, []byte("hello"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(src, 0640); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Unix(1464370149, 142000000)
+	if err := os.Chtimes(src, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := Attrs(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := attrs.Info[modeKey]; got != "640" {
+		t.Errorf("Attrs: got mode %q, want %q", got, "640")
+	}
+
+	// Objects in B2 only keep millisecond precision.
+	attrs = &b2.Attrs{
+		LastModified: attrs.LastModified.Truncate(time.Millisecond),
+		Info:         attrs.Info,
+	}
+	dst := filepath.Join(dir, "dst")
+	if err := ioutil.WriteFile(dst, []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := Restore(dst, attrs); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Errorf("Restore: got mode %v, want %v", fi.Mode().Perm(), os.FileMode(0640))
+	}
+	if !fi.ModTime().Equal(mtime.Truncate(time.Millisecond)) {
+		t.Errorf("Restore: got mtime %v, want %v", fi.ModTime(), mtime)
+	}
+}
+
+func TestRestoreBadInfo(t *testing.T) {
+	attrs := &b2.Attrs{
+		Info: map[string]string{modeKey: "rwxr-xr-x"},
+	}
+	if err := Restore(os.DevNull, attrs); err == nil {
+		t.Error("Restore with a bad mode: got nil error, want an error")
+	}
+}
+
+func TestSparseWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "posixtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	want := make([]byte, 5*sparseBlock+17)
+	copy(want[sparseBlock+100:], "hello")
+	copy(want[4*sparseBlock-2:], "block boundary")
+	f, err := os.Create(filepath.Join(dir, "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewSparseWriter(f)
+	// Write in odd sizes, so that writes don't line up with blocks.
+	if _, err := io.CopyBuffer(w, struct{ io.Reader }{bytes.NewReader(want)}, make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("SparseWriter: got %d bytes, want %d; contents differ", len(got), len(want))
+	}
+}
+
+func TestSparseRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "posixtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A file with data around a hole of a megabyte, and a trailing hole.
+	src, err := os.Create(filepath.Join(dir, "src"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	if _, err := src.WriteAt([]byte("head"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.WriteAt([]byte("tail"), 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Truncate(2 << 20); err != nil {
+		t.Fatal(err)
+	}
+	want, err := ioutil.ReadFile(src.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attrs := &b2.Attrs{}
+	r, err := SparseReader(src, attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := attrs.Info[sparseKey]; ok && len(data) >= len(want) {
+		t.Errorf("SparseReader: recorded holes, but read %d bytes of %d", len(data), len(want))
+	}
+
+	dst, err := os.Create(filepath.Join(dir, "dst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := SparseRestorer(dst, attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(dst.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("restored %d bytes, want %d; contents differ", len(got), len(want))
+	}
+}
+
+func TestSparseMap(t *testing.T) {
+	es := []extent{{Off: 0, Len: 4096}, {Off: 1 << 20, Len: 4096}}
+	enc := formatSparse(2<<20, es)
+	if want := "2097152:0+4096,1048576+4096"; enc != want {
+		t.Errorf("formatSparse: got %q, want %q", enc, want)
+	}
+	size, got, err := parseSparse(enc)
+	if err != nil || size != 2<<20 || !reflect.DeepEqual(got, es) {
+		t.Errorf("parseSparse(%q): got %d, %v, %v", enc, size, got, err)
+	}
+	for _, bad := range []string{"", "10", "x:0+1", "10:0+20", "10:5+1,0+1", "10:a+b"} {
+		if _, _, err := parseSparse(bad); err == nil {
+			t.Errorf("parseSparse(%q): got no error", bad)
+		}
+	}
+
+	// Data is placed at its extents, and too much or too little is an
+	// error.
+	dir, err := ioutil.TempDir("", "posixtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, e := range []struct {
+		data string
+		ok   bool
+	}{
+		{data: "abcdef", ok: true},
+		{data: "abcdefg"},
+		{data: "abc"},
+	} {
+		f, err := os.Create(filepath.Join(dir, "f"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := SparseRestorer(f, &b2.Attrs{Info: map[string]string{sparseKey: "10:1+2,6+4"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, werr := w.Write([]byte(e.data))
+		cerr := w.Close()
+		if ok := werr == nil && cerr == nil; ok != e.ok {
+			t.Errorf("restoring %q: got errors %v, %v", e.data, werr, cerr)
+			continue
+		}
+		if !e.ok {
+			continue
+		}
+		got, err := ioutil.ReadFile(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "\x00ab\x00\x00\x00cdef"; string(got) != want {
+			t.Errorf("restoring %q: got %q, want %q", e.data, got, want)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package posix
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/kurin/blazer/b2"
+)
+
+const (
+	sparseKey = "posix-sparse"
+
+	// maxSparse bounds the recorded map, for the same reason as maxXattrs.
+	// Files with more extents than fit are uploaded whole.
+	maxSparse = 2048
+)
+
+// sparseBlock is the granularity at which SparseWriter looks for zeros.  It
+// matches the block size of most file systems; smaller holes would not save
+// any space.
+const sparseBlock = 4096
+
+// SparseWriter writes to a file, skipping over blocks that are entirely zero
+// instead of writing them.  On file systems that support sparse files, the
+// skipped blocks become holes that take up no space, so that restoring e.g. a
+// mostly empty VM image does not write gigabytes of zeros.
+//
+// SparseWriter takes ownership of the file, which should be empty.
+type SparseWriter struct {
+	f   *os.File
+	off int64
+}
+
+// NewSparseWriter returns a SparseWriter that writes to f.
+func NewSparseWriter(f *os.File) *SparseWriter {
+	return &SparseWriter{f: f}
+}
+
+// Write implements io.Writer.
+func (s *SparseWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		// Keep blocks aligned to the file, so that holes line up with the
+		// file system's blocks.
+		size := sparseBlock - int(s.off%sparseBlock)
+		if size > len(p) {
+			size = len(p)
+		}
+		if !zero(p[:size]) {
+			if _, err := s.f.WriteAt(p[:size], s.off); err != nil {
+				return n, err
+			}
+		}
+		s.off += int64(size)
+		n += size
+		p = p[size:]
+	}
+	return n, nil
+}
+
+func zero(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Close sets the file's size to the number of bytes written, which creates
+// any trailing hole, and closes the file.
+func (s *SparseWriter) Close() error {
+	if err := s.f.Truncate(s.off); err != nil {
+		s.f.Close()
+		return err
+	}
+	return s.f.Close()
+}
+
+// An extent is a run of a file's bytes.
+type extent struct {
+	Off, Len int64
+}
+
+// SparseReader returns a reader over the data in f, leaving out its holes, so
+// that uploading e.g. a mostly empty VM image does not send gigabytes of
+// zeros.  Where the data belongs is recorded in attrs, which should then be
+// used for the upload, and which SparseRestorer needs to put the data back.
+// If f has no holes, or the file system can't find them, or there are too
+// many to record, the reader reads all of f and attrs is unchanged.
+//
+// Holes are found with SEEK_DATA and SEEK_HOLE, which only Linux is supported
+// for.
+func SparseReader(f *os.File, attrs *b2.Attrs) (io.Reader, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+	es, err := dataExtents(f, size)
+	if err != nil {
+		return nil, err
+	}
+	if size == 0 || len(es) == 1 && es[0] == (extent{Off: 0, Len: size}) {
+		return f, nil
+	}
+	enc := formatSparse(size, es)
+	if len(enc) > maxSparse {
+		return f, nil
+	}
+	if attrs.Info == nil {
+		attrs.Info = make(map[string]string)
+	}
+	attrs.Info[sparseKey] = enc
+	rs := make([]io.Reader, len(es))
+	for i, e := range es {
+		rs[i] = io.NewSectionReader(f, e.Off, e.Len)
+	}
+	return io.MultiReader(rs...), nil
+}
+
+// formatSparse records a file's size and data extents as
+// "size:off+len,off+len,...".
+func formatSparse(size int64, es []extent) string {
+	parts := make([]string, len(es))
+	for i, e := range es {
+		parts[i] = fmt.Sprintf("%d+%d", e.Off, e.Len)
+	}
+	return fmt.Sprintf("%d:%s", size, strings.Join(parts, ","))
+}
+
+func parseSparse(v string) (int64, []extent, error) {
+	i := strings.Index(v, ":")
+	if i < 0 {
+		return 0, nil, fmt.Errorf("%s: %q has no size", sparseKey, v)
+	}
+	size, err := strconv.ParseInt(v[:i], 10, 64)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s: %v", sparseKey, err)
+	}
+	var es []extent
+	var end int64
+	for _, p := range strings.Split(v[i+1:], ",") {
+		if p == "" {
+			continue
+		}
+		var e extent
+		if _, err := fmt.Sscanf(p, "%d+%d", &e.Off, &e.Len); err != nil {
+			return 0, nil, fmt.Errorf("%s: %q: %v", sparseKey, p, err)
+		}
+		if e.Off < end || e.Len < 0 || e.Off+e.Len > size {
+			return 0, nil, fmt.Errorf("%s: extent %q is out of order or out of bounds", sparseKey, p)
+		}
+		end = e.Off + e.Len
+		if e.Len > 0 {
+			es = append(es, e)
+		}
+	}
+	return size, es, nil
+}
+
+// SparseRestorer returns a writer that restores a file uploaded through
+// SparseReader into f, which should be empty: the data is written where
+// attrs records it belongs, and the rest of the file is left as holes.  If
+// attrs records nothing, as for files uploaded whole, it returns a
+// SparseWriter instead.  Either way, the writer takes ownership of f.
+func SparseRestorer(f *os.File, attrs *b2.Attrs) (io.WriteCloser, error) {
+	v, ok := attrs.Info[sparseKey]
+	if !ok {
+		return NewSparseWriter(f), nil
+	}
+	size, es, err := parseSparse(v)
+	if err != nil {
+		return nil, err
+	}
+	return &sparseRestorer{f: f, size: size, es: es}, nil
+}
+
+type sparseRestorer struct {
+	f    *os.File
+	size int64
+	es   []extent // the extents not yet written, the first perhaps in part
+}
+
+func (s *sparseRestorer) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		if len(s.es) == 0 {
+			return n, errors.New("posix: more data than the sparse map records")
+		}
+		e := &s.es[0]
+		size := len(p)
+		if int64(size) > e.Len {
+			size = int(e.Len)
+		}
+		if _, err := s.f.WriteAt(p[:size], e.Off); err != nil {
+			return n, err
+		}
+		e.Off += int64(size)
+		e.Len -= int64(size)
+		if e.Len == 0 {
+			s.es = s.es[1:]
+		}
+		n += size
+		p = p[size:]
+	}
+	return n, nil
+}
+
+// Close sets the file's size, which creates any trailing hole, and closes the
+// file.  It is an error if less data was written than the map records.
+func (s *sparseRestorer) Close() error {
+	if len(s.es) > 0 {
+		s.f.Close()
+		return errors.New("posix: less data than the sparse map records")
+	}
+	if err := s.f.Truncate(s.size); err != nil {
+		s.f.Close()
+		return err
+	}
+	return s.f.Close()
+}
@@ -0,0 +1,58 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package posix
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+// Whence values for lseek that find data and holes.
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// dataExtents returns the extents of f, which is size bytes long, that hold
+// data.  If the file system can't report holes, the whole file is one extent.
+func dataExtents(f *os.File, size int64) ([]extent, error) {
+	defer f.Seek(0, io.SeekStart)
+	var es []extent
+	for off := int64(0); off < size; {
+		data, err := f.Seek(off, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			// The rest of the file is a hole.
+			break
+		}
+		if errors.Is(err, syscall.EINVAL) {
+			return []extent{{Off: 0, Len: size}}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		hole, err := f.Seek(data, seekHole)
+		if err != nil {
+			return nil, err
+		}
+		if hole > size {
+			hole = size
+		}
+		es = append(es, extent{Off: data, Len: hole - data})
+		off = hole
+	}
+	return es, nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package posix
+
+import (
+	"bytes"
+	"syscall"
+)
+
+func getXattrs(path string) (map[string][]byte, error) {
+	names, err := xattrCall(func(buf []byte) (int, error) { return syscall.Listxattr(path, buf) })
+	if err != nil {
+		if err == syscall.ENOTSUP {
+			return nil, nil
+		}
+		return nil, err
+	}
+	xs := make(map[string][]byte)
+	for _, name := range bytes.Split(names, []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		n := string(name)
+		val, err := xattrCall(func(buf []byte) (int, error) { return syscall.Getxattr(path, n, buf) })
+		if err != nil {
+			return nil, err
+		}
+		xs[n] = val
+	}
+	return xs, nil
+}
+
+// xattrCall calls f first to size the buffer and then to fill it.
+func xattrCall(f func([]byte) (int, error)) ([]byte, error) {
+	for {
+		n, err := f(nil)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n)
+		n, err = f(buf)
+		if err == syscall.ERANGE {
+			// The attribute grew between calls.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+func setXattrs(path string, xs map[string][]byte) error {
+	for name, val := range xs {
+		// Attributes outside the "user" namespace may require privileges
+		// we don't have; skip them as with ownership.
+		if err := syscall.Setxattr(path, name, val, 0); err != nil && err != syscall.EPERM {
+			return err
+		}
+	}
+	return nil
+}
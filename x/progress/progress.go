@@ -0,0 +1,167 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package progress provides a Tracker that adds up the bytes moved by any
+// number of transfers, so that a single progress bar can represent a whole
+// job.
+//
+// A b2.Writer or b2.Reader reports to the Tracker given in its Progress field.
+// Anything else can report through Add, or by wrapping its readers and
+// writers.
+package progress
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+var now = time.Now
+
+// A Tracker accumulates progress.  It is safe to use concurrently, and all of
+// its methods may be called on a nil Tracker, which does nothing.
+type Tracker struct {
+	// Window is the span of time over which Rate is measured.  The default is
+	// ten seconds.
+	Window time.Duration
+
+	mu      sync.Mutex
+	start   time.Time
+	done    int64
+	total   int64
+	samples []sample
+}
+
+type sample struct {
+	t    time.Time
+	done int64
+}
+
+// New returns a Tracker whose clock starts now.
+func New() *Tracker {
+	return &Tracker{start: now()}
+}
+
+// Snapshot is the state of a Tracker at a point in time.
+type Snapshot struct {
+	Done      int64         // Bytes moved so far.
+	Total     int64         // Bytes expected in all, as given to Expect.
+	Elapsed   time.Duration // Time since the Tracker was created.
+	Rate      float64       // Bytes per second over the recent window.
+	Remaining time.Duration // Estimated time to finish, or 0 if unknown.
+}
+
+// Fraction returns the fraction of the expected bytes that have been moved,
+// or 0 if nothing is expected.
+func (s Snapshot) Fraction() float64 {
+	if s.Total <= 0 {
+		return 0
+	}
+	return float64(s.Done) / float64(s.Total)
+}
+
+// Expect adds n to the number of bytes expected.  Callers that discover work
+// as they go, e.g. by listing a bucket, can call it repeatedly.
+func (t *Tracker) Expect(n int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.total += n
+	t.mu.Unlock()
+}
+
+// Add records that n bytes have been moved.
+func (t *Tracker) Add(n int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.done += n
+	t.mu.Unlock()
+}
+
+// Snapshot returns the current state of the Tracker.
+func (t *Tracker) Snapshot() Snapshot {
+	if t == nil {
+		return Snapshot{}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := now()
+	if t.start.IsZero() {
+		t.start = n
+	}
+	win := t.Window
+	if win <= 0 {
+		win = 10 * time.Second
+	}
+	t.samples = append(t.samples, sample{t: n, done: t.done})
+	// Keep one sample from before the window, so that the rate always covers
+	// at least the whole window once it has passed.
+	var drop int
+	for drop+1 < len(t.samples) && n.Sub(t.samples[drop+1].t) >= win {
+		drop++
+	}
+	t.samples = t.samples[drop:]
+
+	s := Snapshot{
+		Done:    t.done,
+		Total:   t.total,
+		Elapsed: n.Sub(t.start),
+	}
+	from := sample{t: t.start}
+	if n.Sub(t.samples[0].t) >= win {
+		from = t.samples[0]
+	}
+	if d := n.Sub(from.t); d > 0 {
+		s.Rate = float64(t.done-from.done) / d.Seconds()
+	}
+	if s.Rate > 0 && s.Total > s.Done {
+		s.Remaining = time.Duration(float64(s.Total-s.Done) / s.Rate * float64(time.Second))
+	}
+	return s
+}
+
+// Reader returns a reader that records each byte read from r.
+func (t *Tracker) Reader(r io.Reader) io.Reader {
+	return reader{r: r, t: t}
+}
+
+type reader struct {
+	r io.Reader
+	t *Tracker
+}
+
+func (r reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.t.Add(int64(n))
+	return n, err
+}
+
+// Writer returns a writer that records each byte written to w.
+func (t *Tracker) Writer(w io.Writer) io.Writer {
+	return writer{w: w, t: t}
+}
+
+type writer struct {
+	w io.Writer
+	t *Tracker
+}
+
+func (w writer) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.t.Add(int64(n))
+	return n, err
+}
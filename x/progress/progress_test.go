@@ -0,0 +1,89 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package progress
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/kurin/blazer/b2"
+)
+
+// A Tracker can be given to a b2.Writer or b2.Reader.
+var _ b2.ProgressCounter = (*Tracker)(nil)
+
+func TestTracker(t *testing.T) {
+	clock := time.Unix(1e9, 0)
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+
+	tr := New()
+	tr.Window = 10 * time.Second
+	tr.Expect(1000)
+
+	table := []struct {
+		after     time.Duration
+		add       int64
+		rate      float64
+		remaining time.Duration
+	}{
+		{after: 2 * time.Second, add: 200, rate: 100, remaining: 8 * time.Second},
+		{after: 8 * time.Second, add: 300, rate: 50, remaining: 10 * time.Second},
+		// The window reaches back to the newest sample at least ten seconds
+		// old, here the first.
+		{after: 5 * time.Second, add: 0, rate: 300.0 / 13, remaining: 21666666666 * time.Nanosecond},
+		{after: 10 * time.Second, add: 500, rate: 50},
+	}
+	var done int64
+	for i, e := range table {
+		clock = clock.Add(e.after)
+		tr.Add(e.add)
+		done += e.add
+		s := tr.Snapshot()
+		if s.Done != done || s.Total != 1000 {
+			t.Errorf("%d: got %d of %d bytes, want %d of 1000", i, s.Done, s.Total, done)
+		}
+		if s.Rate != e.rate {
+			t.Errorf("%d: got rate %v, want %v", i, s.Rate, e.rate)
+		}
+		if s.Remaining != e.remaining {
+			t.Errorf("%d: got %v remaining, want %v", i, s.Remaining, e.remaining)
+		}
+	}
+}
+
+func TestWrappers(t *testing.T) {
+	tr := New()
+	buf := &bytes.Buffer{}
+	if _, err := io.Copy(tr.Writer(buf), tr.Reader(bytes.NewReader(make([]byte, 40)))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(ioutil.Discard, tr.Reader(buf)); err != nil {
+		t.Fatal(err)
+	}
+	if got := tr.Snapshot().Done; got != 120 {
+		t.Errorf("got %d bytes, want 120", got)
+	}
+
+	var nilTracker *Tracker
+	nilTracker.Add(1)
+	nilTracker.Expect(1)
+	if s := nilTracker.Snapshot(); s != (Snapshot{}) {
+		t.Errorf("nil Tracker: got %+v, want zero", s)
+	}
+}
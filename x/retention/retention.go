@@ -0,0 +1,171 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package retention reports on the Object Lock retention and legal holds of
+// the objects beneath a prefix, for compliance reviews, and to find what
+// would stand in the way of deleting data.
+//
+// The report is built from a listing, and costs no more than one.  B2 reports
+// Object Lock settings only to keys with the readFileRetentions and
+// readFileLegalHolds capabilities; versions whose settings were not reported
+// are counted as unknown, and are not assumed to be unprotected.
+package retention
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/kurin/blazer/b2"
+)
+
+// Options adjusts what Walk reports.
+type Options struct {
+	// Within is how far ahead to look for retention that is about to end.
+	// Versions whose retention ends within this time of the report are
+	// listed in Expiring.
+	Within time.Duration
+
+	// CurrentOnly limits the report to the current version of each
+	// object.  By default every version is included, since data is not
+	// gone until all of its versions are.
+	CurrentOnly bool
+}
+
+// A Version is an object version named in a report.
+type Version struct {
+	Name string
+	ID   string
+	Size int64
+	Lock b2.ObjectLock
+}
+
+// A Report summarizes the Object Lock settings of a set of object versions.
+type Report struct {
+	// At is when the report was made.  Retention is judged as of At.
+	At time.Time
+
+	// Versions and Bytes count the object versions examined, and their
+	// total size.
+	Versions int
+	Bytes    int64
+
+	// Modes counts versions by their current retention mode.  Versions
+	// with no retention, or whose retention has ended, are counted under
+	// "".  Versions whose retention is unknown are not counted.
+	Modes map[b2.RetentionMode]int
+
+	// LegalHolds counts versions under a legal hold.
+	LegalHolds int
+
+	// Unknown counts versions whose retention or legal hold B2 did not
+	// report.
+	Unknown int
+
+	// Expiring lists versions whose retention ends within Options.Within,
+	// soonest first.
+	Expiring []*Version
+
+	// Blocking lists versions that cannot be deleted as of At, because
+	// their retention has not ended or they are under a legal hold, by
+	// name.  Versions in governance mode can be deleted by a key that may
+	// bypass governance; they are listed all the same.
+	Blocking []*Version
+}
+
+var now = time.Now
+
+// Walk lists the object versions beneath prefix in bucket and reports on
+// their Object Lock settings.
+func Walk(ctx context.Context, bucket *b2.Bucket, prefix string, opts Options) (*Report, error) {
+	lopts := []b2.ListOption{b2.ListPrefix(prefix)}
+	if !opts.CurrentOnly {
+		lopts = append(lopts, b2.ListHidden())
+	}
+	r := newReport(now())
+	iter := bucket.List(ctx, lopts...)
+	for iter.Next() {
+		// Listed objects carry their attributes, so this costs nothing
+		// more.
+		attrs, err := iter.Object().Attrs(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if attrs.Status != b2.Uploaded {
+			continue
+		}
+		r.add(&Version{Name: attrs.Name, ID: attrs.ID, Size: attrs.Size, Lock: attrs.Lock}, opts.Within)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	r.sort()
+	return r, nil
+}
+
+func newReport(at time.Time) *Report {
+	return &Report{
+		At:    at,
+		Modes: make(map[b2.RetentionMode]int),
+	}
+}
+
+func (r *Report) add(v *Version, within time.Duration) {
+	r.Versions++
+	r.Bytes += v.Size
+	l := v.Lock
+	if !l.RetentionKnown || !l.LegalHoldKnown {
+		r.Unknown++
+	}
+	if l.LegalHold {
+		r.LegalHolds++
+	}
+	retained := l.Mode != "" && l.RetainUntil.After(r.At)
+	if l.RetentionKnown {
+		if retained {
+			r.Modes[l.Mode]++
+		} else {
+			r.Modes[""]++
+		}
+	}
+	if retained && l.RetainUntil.Before(r.At.Add(within)) {
+		r.Expiring = append(r.Expiring, v)
+	}
+	if retained || l.LegalHold {
+		r.Blocking = append(r.Blocking, v)
+	}
+}
+
+func (r *Report) sort() {
+	sort.SliceStable(r.Expiring, func(i, j int) bool {
+		return r.Expiring[i].Lock.RetainUntil.Before(r.Expiring[j].Lock.RetainUntil)
+	})
+	sort.SliceStable(r.Blocking, func(i, j int) bool {
+		return r.Blocking[i].Name < r.Blocking[j].Name
+	})
+}
+
+// String summarizes the report in a few lines.  The versions in Expiring and
+// Blocking are counted, not listed.
+func (r *Report) String() string {
+	s := fmt.Sprintf("%d versions, %d bytes, as of %s\n", r.Versions, r.Bytes, r.At.Format(time.RFC3339))
+	s += fmt.Sprintf("retention: %d compliance, %d governance, %d none\n",
+		r.Modes[b2.Compliance], r.Modes[b2.Governance], r.Modes[""])
+	s += fmt.Sprintf("legal holds: %d\n", r.LegalHolds)
+	s += fmt.Sprintf("settings not reported: %d\n", r.Unknown)
+	s += fmt.Sprintf("retention ending soon: %d\n", len(r.Expiring))
+	s += fmt.Sprintf("blocking deletion: %d", len(r.Blocking))
+	return s
+}
@@ -0,0 +1,79 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retention
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kurin/blazer/b2"
+)
+
+func TestReport(t *testing.T) {
+	at := time.Unix(1500000000, 0)
+	day := 24 * time.Hour
+	known := func(mode b2.RetentionMode, until time.Duration, hold bool) b2.ObjectLock {
+		l := b2.ObjectLock{RetentionKnown: true, LegalHoldKnown: true, Mode: mode, LegalHold: hold}
+		if mode != "" {
+			l.RetainUntil = at.Add(until)
+		}
+		return l
+	}
+	r := newReport(at)
+	for _, v := range []*Version{
+		{Name: "none", Size: 1, Lock: known("", 0, false)},
+		{Name: "soon", Size: 2, Lock: known(b2.Compliance, 2*day, false)},
+		{Name: "later", Size: 3, Lock: known(b2.Governance, 100*day, false)},
+		{Name: "ended", Size: 4, Lock: known(b2.Compliance, -day, false)},
+		{Name: "held", Size: 5, Lock: known("", 0, true)},
+		{Name: "sooner", Size: 6, Lock: known(b2.Governance, day, true)},
+		{Name: "secret", Size: 7},
+	} {
+		r.add(v, 7*day)
+	}
+	r.sort()
+
+	if r.Versions != 7 || r.Bytes != 28 {
+		t.Errorf("got %d versions of %d bytes, want 7 of 28", r.Versions, r.Bytes)
+	}
+	wantModes := map[b2.RetentionMode]int{"": 3, b2.Compliance: 1, b2.Governance: 2}
+	if !reflect.DeepEqual(r.Modes, wantModes) {
+		t.Errorf("Modes: got %v, want %v", r.Modes, wantModes)
+	}
+	if r.LegalHolds != 2 || r.Unknown != 1 {
+		t.Errorf("got %d legal holds and %d unknown, want 2 and 1", r.LegalHolds, r.Unknown)
+	}
+	names := func(vs []*Version) []string {
+		var ns []string
+		for _, v := range vs {
+			ns = append(ns, v.Name)
+		}
+		return ns
+	}
+	if got, want := names(r.Expiring), []string{"sooner", "soon"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expiring: got %v, want %v", got, want)
+	}
+	if got, want := names(r.Blocking), []string{"held", "later", "soon", "sooner"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Blocking: got %v, want %v", got, want)
+	}
+	s := r.String()
+	for _, want := range []string{"1 compliance, 2 governance, 3 none", "legal holds: 2", "not reported: 1", "ending soon: 2", "blocking deletion: 4"} {
+		if !strings.Contains(s, want) {
+			t.Errorf("String(): %q does not contain %q", s, want)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package shard implements an experimental interface for uploading a single
+// large B2 object from several machines at once.
+//
+// A coordinator calls New to start the upload and divide it into shards.  The
+// resulting Plan can be serialized (e.g. as JSON) and sent to workers, each of
+// which calls Upload with its shard number and its own view of the source.
+// Once every worker has finished, the coordinator calls Finish.
+package shard
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/kurin/blazer/b2"
+)
+
+const (
+	// maxParts is the largest number of parts B2 allows in a single large
+	// file.
+	maxParts = 10000
+
+	// minPartSize is the smallest size B2 allows for any part but the last.
+	minPartSize = 5e6
+)
+
+// Plan describes a large file upload that has been divided among workers.
+type Plan struct {
+	Bucket   string  // The name of the bucket.
+	Name     string  // The name of the object.
+	FileID   string  // The ID of the large file upload.
+	Size     int64   // The total size of the object.
+	PartSize int64   // The size of every part but the last.
+	Shards   []Shard // The ranges of parts assigned to each worker.
+}
+
+// Shard is a contiguous range of parts uploaded by a single worker.
+type Shard struct {
+	FirstPart int // The first part number, inclusive.
+	LastPart  int // The last part number, inclusive.
+}
+
+// New starts a large file upload of the given size, and divides it into
+// parts of partSize bytes spread as evenly as possible over the given number
+// of shards.  B2 requires that every part except the last be at least 5MB, so
+// New returns an error if partSize is smaller and the object needs more than
+// one part, rather than leave workers to find out.
+func New(ctx context.Context, bucket *b2.Bucket, name string, attrs *b2.Attrs, size, partSize int64, shards int) (*Plan, error) {
+	if partSize < minPartSize && size > partSize {
+		return nil, fmt.Errorf("%s: part size %d is below B2's minimum of %d bytes", name, partSize, int64(minPartSize))
+	}
+	ss, err := divide(size, partSize, shards)
+	if err != nil {
+		return nil, err
+	}
+	lf, err := bucket.StartLargeFile(ctx, name, attrs)
+	if err != nil {
+		return nil, err
+	}
+	return &Plan{
+		Bucket:   bucket.Name(),
+		Name:     name,
+		FileID:   lf.ID(),
+		Size:     size,
+		PartSize: partSize,
+		Shards:   ss,
+	}, nil
+}
+
+func divide(size, partSize int64, shards int) ([]Shard, error) {
+	if size <= 0 || partSize <= 0 {
+		return nil, errors.New("size and part size must be positive")
+	}
+	parts := int((size + partSize - 1) / partSize)
+	if parts > maxParts {
+		return nil, fmt.Errorf("%d parts of %d bytes exceeds the limit of %d parts", parts, partSize, maxParts)
+	}
+	if shards < 1 {
+		shards = 1
+	}
+	if shards > parts {
+		shards = parts
+	}
+	var ss []Shard
+	next := 1
+	for i := 0; i < shards; i++ {
+		n := parts / shards
+		if i < parts%shards {
+			n++
+		}
+		ss = append(ss, Shard{FirstPart: next, LastPart: next + n - 1})
+		next += n
+	}
+	return ss, nil
+}
+
+// parts returns the total number of parts in the plan.
+func (p *Plan) parts() int {
+	return int((p.Size + p.PartSize - 1) / p.PartSize)
+}
+
+// section returns the offset and length of the given part.
+func (p *Plan) section(part int) (int64, int64) {
+	off := int64(part-1) * p.PartSize
+	n := p.PartSize
+	if off+n > p.Size {
+		n = p.Size - off
+	}
+	return off, n
+}
+
+// Upload uploads the parts of the given shard, using up to concurrency
+// simultaneous connections.  The source r must contain the entire object, not
+// just the shard, although only the shard's byte range will be read.
+//
+// Parts that B2 already has with the same contents are skipped, so Upload can
+// safely be called again for a shard that previously failed.
+func Upload(ctx context.Context, bucket *b2.Bucket, p *Plan, shard int, r io.ReaderAt, concurrency int) error {
+	if shard < 0 || shard >= len(p.Shards) {
+		return fmt.Errorf("%s: no shard %d", p.Name, shard)
+	}
+	s := p.Shards[shard]
+	lf, err := bucket.ResumeLargeFile(ctx, p.FileID, p.Name)
+	if err != nil {
+		return err
+	}
+	have, err := lf.Parts(ctx)
+	if err != nil {
+		return err
+	}
+	done := make(map[int]*b2.Part)
+	for _, part := range have {
+		done[part.Number] = part
+	}
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ch := make(chan int)
+	var (
+		wg   sync.WaitGroup
+		emux sync.Mutex
+		rerr error
+	)
+	setErr := func(err error) {
+		emux.Lock()
+		defer emux.Unlock()
+		if rerr == nil {
+			rerr = err
+			cancel()
+		}
+	}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range ch {
+				off, size := p.section(n)
+				sr := io.NewSectionReader(r, off, size)
+				ok, err := matches(done[n], sr)
+				if err == nil && !ok {
+					err = lf.UploadPart(ctx, n, sr)
+				}
+				if err != nil {
+					setErr(err)
+				}
+			}
+		}()
+	}
+	for n := s.FirstPart; n <= s.LastPart; n++ {
+		select {
+		case ch <- n:
+		case <-ctx.Done():
+		}
+	}
+	close(ch)
+	wg.Wait()
+	if rerr != nil {
+		return rerr
+	}
+	return ctx.Err()
+}
+
+// matches reports whether part, which may be nil, has the same contents as
+// the section.
+func matches(part *b2.Part, sr *io.SectionReader) (bool, error) {
+	if part == nil || part.Size != sr.Size() {
+		return false, nil
+	}
+	h := sha1.New()
+	if _, err := io.Copy(h, sr); err != nil {
+		return false, err
+	}
+	if _, err := sr.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)) == part.SHA1, nil
+}
+
+// Missing returns the part numbers that B2 has not yet received, in order.
+func Missing(ctx context.Context, bucket *b2.Bucket, p *Plan) ([]int, error) {
+	lf, err := bucket.ResumeLargeFile(ctx, p.FileID, p.Name)
+	if err != nil {
+		return nil, err
+	}
+	have, err := lf.Parts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	got := make(map[int]bool)
+	for _, part := range have {
+		_, size := p.section(part.Number)
+		if part.Size == size {
+			got[part.Number] = true
+		}
+	}
+	var missing []int
+	for n := 1; n <= p.parts(); n++ {
+		if !got[n] {
+			missing = append(missing, n)
+		}
+	}
+	return missing, nil
+}
+
+// Finish completes the upload once every worker has uploaded its shard.  If
+// any parts are missing, Finish returns an error and the upload is left
+// unfinished.
+func Finish(ctx context.Context, bucket *b2.Bucket, p *Plan) (*b2.Object, error) {
+	missing, err := Missing(ctx, bucket, p)
+	if err != nil {
+		return nil, err
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("%s: %d of %d parts missing, beginning with part %d", p.Name, len(missing), p.parts(), missing[0])
+	}
+	lf, err := bucket.ResumeLargeFile(ctx, p.FileID, p.Name)
+	if err != nil {
+		return nil, err
+	}
+	return lf.Finish(ctx)
+}
+
+// Cancel abandons the upload, deleting any parts that workers have sent.
+func Cancel(ctx context.Context, bucket *b2.Bucket, p *Plan) error {
+	lf, err := bucket.ResumeLargeFile(ctx, p.FileID, p.Name)
+	if err != nil {
+		return err
+	}
+	return lf.Cancel(ctx)
+}
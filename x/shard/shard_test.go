@@ -0,0 +1,186 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shard
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kurin/blazer/b2"
+)
+
+const (
+	apiID      = "B2_ACCOUNT_ID"
+	apiKey     = "B2_SECRET_KEY"
+	bucketName = "shardbucket"
+)
+
+func TestDivide(t *testing.T) {
+	table := []struct {
+		size, psize int64
+		shards      int
+		want        []Shard
+		fail        bool
+	}{
+		{
+			size:   10,
+			psize:  10,
+			shards: 1,
+			want:   []Shard{{1, 1}},
+		},
+		{
+			size:   100,
+			psize:  10,
+			shards: 3,
+			want:   []Shard{{1, 4}, {5, 7}, {8, 10}},
+		},
+		{
+			size:   25,
+			psize:  10,
+			shards: 5,
+			want:   []Shard{{1, 1}, {2, 2}, {3, 3}},
+		},
+		{
+			size:   25,
+			psize:  10,
+			shards: 0,
+			want:   []Shard{{1, 3}},
+		},
+		{
+			size:  10001,
+			psize: 1,
+			fail:  true,
+		},
+		{
+			size: 10,
+			fail: true,
+		},
+	}
+
+	for _, e := range table {
+		got, err := divide(e.size, e.psize, e.shards)
+		if e.fail {
+			if err == nil {
+				t.Errorf("divide(%d, %d, %d): expected an error", e.size, e.psize, e.shards)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("divide(%d, %d, %d): %v", e.size, e.psize, e.shards, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, e.want) {
+			t.Errorf("divide(%d, %d, %d): got %v, want %v", e.size, e.psize, e.shards, got, e.want)
+		}
+	}
+}
+
+func TestNewPartSize(t *testing.T) {
+	// New checks the part size before it touches the bucket.
+	if _, err := New(context.Background(), nil, "small", nil, 25e6, 1e6, 5); err == nil {
+		t.Error("New with 1MB parts: got no error")
+	}
+}
+
+func TestSection(t *testing.T) {
+	p := &Plan{Size: 25, PartSize: 10}
+	for part, want := range map[int][2]int64{1: {0, 10}, 2: {10, 10}, 3: {20, 5}} {
+		off, n := p.section(part)
+		if off != want[0] || n != want[1] {
+			t.Errorf("section(%d): got (%d, %d), want (%d, %d)", part, off, n, want[0], want[1])
+		}
+	}
+}
+
+func TestShardedUploadLive(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+	defer cancel()
+	bucket, done := startLiveTest(ctx, t)
+	defer done()
+
+	data := make([]byte, 12e6)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	p, err := New(ctx, bucket, "sharded", nil, int64(len(data)), 5e6, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Finish(ctx, bucket, p); err == nil {
+		t.Error("Finish(): expected an error before any shards are uploaded")
+	}
+	for i := range p.Shards {
+		if err := Upload(ctx, bucket, p, i, bytes.NewReader(data), 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	obj, err := Finish(ctx, bucket, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := obj.NewReader(ctx)
+	defer r.Close()
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("downloaded object does not match upload")
+	}
+}
+
+func startLiveTest(ctx context.Context, t *testing.T) (*b2.Bucket, func()) {
+	id := os.Getenv(apiID)
+	key := os.Getenv(apiKey)
+	if id == "" || key == "" {
+		t.Skipf("B2_ACCOUNT_ID or B2_SECRET_KEY unset; skipping integration tests")
+		return nil, nil
+	}
+	client, err := b2.NewClient(ctx, id, key)
+	if err != nil {
+		t.Fatal(err)
+		return nil, nil
+	}
+	bucket, err := client.NewBucket(ctx, fmt.Sprintf("%s-%s", id, bucketName), nil)
+	if err != nil {
+		t.Fatal(err)
+		return nil, nil
+	}
+	f := func() {
+		for _, opt := range []b2.ListOption{b2.ListHidden(), b2.ListUnfinished()} {
+			iter := bucket.List(ctx, opt)
+			for iter.Next() {
+				if err := iter.Object().Delete(ctx); err != nil {
+					t.Error(err)
+				}
+			}
+			if err := iter.Err(); err != nil && !b2.IsNotExist(err) {
+				t.Error(err)
+			}
+		}
+		if err := bucket.Delete(ctx); err != nil && !b2.IsNotExist(err) {
+			t.Error(err)
+		}
+	}
+	return bucket, f
+}
@@ -0,0 +1,575 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package spool implements a durable queue of uploads to B2, for programs
+// that need to say "eventually upload this" and carry on.
+//
+// A Spool keeps its state in a local directory.  Enqueue and EnqueueFile
+// place the data in the directory and record the upload before they return,
+// so that a queued upload survives the program restarting.  Run drains the
+// queue in the background, limiting its bandwidth if asked, and retries
+// failed uploads with increasing delays that also survive restarts.
+//
+// The directory is laid out as:
+//
+//	<dir>/data/<id>      the data to upload
+//	<dir>/jobs/<id>      a queued upload, as JSON
+//	<dir>/failed/<id>    an upload that ran out of attempts, as JSON
+//	<dir>/tmp/           files being written
+//	<dir>/lock           held by the Spool that has the directory open
+//
+// IDs begin with the time the upload was queued, so that uploads are
+// attempted in the order they were queued.  A crash during an upload means
+// the upload is made again, so an object may be written more than once.
+//
+// Only one Spool may use a spool directory at a time.  Open takes a lock on
+// the directory, and fails with ErrLocked if another Spool, in this process or
+// another, holds it.
+package spool
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kurin/blazer/b2"
+)
+
+// ErrLocked is returned by Open when another Spool has the directory open.
+var ErrLocked = errors.New("spool: directory is in use by another spool")
+
+// A Job is an upload in the spool.
+type Job struct {
+	// ID identifies the job within the spool.
+	ID string
+
+	// Name is the name of the object to write.
+	Name string
+
+	// Queued is when the job was enqueued.
+	Queued time.Time
+
+	// Attempts counts the failed attempts to upload the data.
+	Attempts int
+
+	// NextAttempt is the earliest time the job will be tried again.
+	NextAttempt time.Time
+
+	// LastError is the error from the most recent failed attempt.
+	LastError string
+}
+
+// A Result reports a job that has left the spool.
+type Result struct {
+	Job Job
+
+	// Err is nil if the job's object was written, and otherwise the error
+	// from its final attempt.
+	Err error
+}
+
+// An Option configures a Spool.
+type Option func(*Spool)
+
+// Workers sets the number of uploads Run makes at once.  The default is one.
+func Workers(n int) Option {
+	return func(s *Spool) {
+		s.workers = n
+	}
+}
+
+// RateLimit limits the bytes per second that Run uploads, across all of its
+// workers.  By default uploads are not limited.  It replaces any
+// RateSchedule.
+func RateLimit(bytesPerSecond int64) Option {
+	return func(s *Spool) {
+		s.limit = b2.NewLimiter(&b2.BandwidthSchedule{Default: bytesPerSecond})
+	}
+}
+
+// RateSchedule limits the bytes per second that Run uploads, across all of
+// its workers, according to the time of day.  It replaces any RateLimit.  A
+// client's own Bandwidth option, by contrast, limits every transfer the client
+// makes.
+func RateSchedule(sched *b2.BandwidthSchedule) Option {
+	return func(s *Spool) {
+		s.limit = b2.NewLimiter(sched)
+	}
+}
+
+// MaxAttempts gives up on a job after it has failed n times, moving it to the
+// failed directory and reporting it to OnDone.  By default jobs are retried
+// forever.
+func MaxAttempts(n int) Option {
+	return func(s *Spool) {
+		s.retry.MaxAttempts = n
+	}
+}
+
+// RetryDelay sets the delay before a failed job is tried again.  The delay
+// starts at min and doubles with each failure, up to max.  The default is
+// from one second to one hour.
+func RetryDelay(min, max time.Duration) Option {
+	return func(s *Spool) {
+		s.retry.Base, s.retry.Max = min, max
+	}
+}
+
+// Retries sets how failed jobs are retried, as MaxAttempts and RetryDelay do,
+// but with a b2.RetryPolicy, so that it can also add jitter.  It replaces
+// both.
+func Retries(p b2.RetryPolicy) Option {
+	return func(s *Spool) {
+		s.retry = p
+	}
+}
+
+// OnDone calls f whenever a job leaves the spool, whether its upload
+// succeeded, it ran out of attempts, or its data went missing.  Calls are
+// made from Run's workers, one at a time.  Jobs that finish in a later run of
+// the program are reported to the callback registered in that run.
+func OnDone(f func(Result)) Option {
+	return func(s *Spool) {
+		s.done = f
+	}
+}
+
+// WriterOptions sets options for the writers that upload each job.
+func WriterOptions(opts ...b2.WriterOption) Option {
+	return func(s *Spool) {
+		s.wopts = append(s.wopts, opts...)
+	}
+}
+
+// A Spool is a durable queue of uploads to a bucket.
+type Spool struct {
+	dir     string
+	workers int
+	limit   *b2.Limiter
+	retry   b2.RetryPolicy
+	done    func(Result)
+	wopts   []b2.WriterOption
+	lock    *os.File
+
+	// upload writes r to the named object.
+	upload func(ctx context.Context, name string, r io.Reader) error
+
+	wake chan struct{}
+	mu   sync.Mutex // serializes calls to done
+}
+
+// Open returns a spool that keeps its state in dir, creating the directory if
+// necessary, and uploads to bucket.  Jobs left in dir by an earlier run are
+// picked up by Run.  The spool holds dir until it is closed.
+func Open(dir string, bucket *b2.Bucket, opts ...Option) (*Spool, error) {
+	s := &Spool{
+		dir:     dir,
+		workers: 1,
+		retry:   b2.RetryPolicy{Base: time.Second, Max: time.Hour},
+		wake:    make(chan struct{}, 1),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.workers < 1 {
+		s.workers = 1
+	}
+	s.upload = func(ctx context.Context, name string, r io.Reader) error {
+		return writeObject(ctx, func(ctx context.Context) io.WriteCloser {
+			return bucket.Object(name).NewWriter(ctx, s.wopts...)
+		}, r)
+	}
+	for _, sub := range []string{"data", "jobs", "failed", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, err
+		}
+	}
+	l, err := lock(filepath.Join(dir, "lock"))
+	if err != nil {
+		return nil, err
+	}
+	s.lock = l
+	// Anything in tmp was being written when the last run stopped, and was
+	// never queued.
+	tmps, err := ioutil.ReadDir(filepath.Join(dir, "tmp"))
+	if err != nil {
+		unlock(l)
+		return nil, err
+	}
+	for _, t := range tmps {
+		os.Remove(filepath.Join(dir, "tmp", t.Name()))
+	}
+	// Likewise data without a job was never queued.
+	data, err := ioutil.ReadDir(filepath.Join(dir, "data"))
+	if err != nil {
+		unlock(l)
+		return nil, err
+	}
+	for _, d := range data {
+		id := d.Name()
+		if exists(s.jobPath(id)) || exists(filepath.Join(dir, "failed", id)) {
+			continue
+		}
+		os.Remove(s.dataPath(id))
+	}
+	return s, nil
+}
+
+// Close releases the spool's directory, so that another Spool may open it.
+// It should not be called until Run has returned.
+func (s *Spool) Close() error {
+	return unlock(s.lock)
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// writeObject copies r to the writer that open returns.  If r fails, the
+// writer's context is cancelled before it is closed, so that truncated spool
+// data is never committed.
+func writeObject(ctx context.Context, open func(context.Context) io.WriteCloser, r io.Reader) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := open(ctx)
+	if err := writeAll(w, r); err != nil {
+		cancel()
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// writeAll copies r to w with Write, so that the writer's own context governs
+// the upload.
+func writeAll(w io.Writer, r io.Reader) error {
+	buf := make([]byte, 1<<20)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+var now = time.Now
+
+func newID() string {
+	var b [4]byte
+	rand.Read(b[:])
+	return fmt.Sprintf("%016x-%s", now().UnixNano(), hex.EncodeToString(b[:]))
+}
+
+// Enqueue copies r into the spool, to be uploaded as the named object, and
+// returns the job's ID.  Once Enqueue returns, the upload will be made even if
+// the program restarts.
+func (s *Spool) Enqueue(name string, r io.Reader) (string, error) {
+	id := newID()
+	tmp := filepath.Join(s.dir, "tmp", id)
+	f, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, s.dataPath(id)); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return id, s.queue(id, name)
+}
+
+// EnqueueFile queues the file at path to be uploaded as the named object, and
+// returns the job's ID.  The file is hard linked into the spool, or copied if
+// it cannot be, so it may be removed once EnqueueFile returns.  A linked file
+// must not be modified until it has been uploaded.
+func (s *Spool) EnqueueFile(name, path string) (string, error) {
+	id := newID()
+	if err := os.Link(path, s.dataPath(id)); err == nil {
+		return id, s.queue(id, name)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return s.Enqueue(name, f)
+}
+
+func (s *Spool) dataPath(id string) string { return filepath.Join(s.dir, "data", id) }
+func (s *Spool) jobPath(id string) string  { return filepath.Join(s.dir, "jobs", id) }
+
+// queue records a job for data that is already in place.
+func (s *Spool) queue(id, name string) error {
+	j := Job{ID: id, Name: name, Queued: now()}
+	if err := s.writeJob(s.jobPath(id), j); err != nil {
+		os.Remove(s.dataPath(id))
+		return err
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// writeJob replaces the record at path with j.
+func (s *Spool) writeJob(path string, j Job) error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(s.dir, "tmp", filepath.Base(path)+".json")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func readJobs(dir string) ([]Job, error) {
+	ents, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var jobs []Job
+	for _, e := range ents {
+		data, err := ioutil.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		var j Job
+		if err := json.Unmarshal(data, &j); err != nil {
+			return nil, fmt.Errorf("spool: %s: %v", e.Name(), err)
+		}
+		jobs = append(jobs, j)
+	}
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].ID < jobs[k].ID })
+	return jobs, nil
+}
+
+// Pending returns the jobs waiting to be uploaded, in the order they were
+// queued.
+func (s *Spool) Pending() ([]Job, error) {
+	return readJobs(filepath.Join(s.dir, "jobs"))
+}
+
+// Failed returns the jobs that ran out of attempts.  Their data is kept until
+// they are retried or removed.
+func (s *Spool) Failed() ([]Job, error) {
+	return readJobs(filepath.Join(s.dir, "failed"))
+}
+
+// Retry returns a failed job to the queue, to be attempted again as soon as
+// possible.
+func (s *Spool) Retry(id string) error {
+	failed := filepath.Join(s.dir, "failed", id)
+	data, err := ioutil.ReadFile(failed)
+	if err != nil {
+		return err
+	}
+	var j Job
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	j.Attempts, j.NextAttempt = 0, time.Time{}
+	if err := s.writeJob(s.jobPath(id), j); err != nil {
+		return err
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return os.Remove(failed)
+}
+
+// Remove discards a failed job and its data.  A job that failed because its
+// data was lost is removed all the same.
+func (s *Spool) Remove(id string) error {
+	if err := os.Remove(filepath.Join(s.dir, "failed", id)); err != nil {
+		return err
+	}
+	if err := os.Remove(s.dataPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Run uploads queued jobs until ctx is done, and then returns ctx's error.
+// Jobs being uploaded when ctx is done are left in the queue.  Run returns
+// early only if the spool directory cannot be read.
+func (s *Spool) Run(ctx context.Context) error {
+	// Workers stop when Run returns, however it returns.
+	ctx, cancel := context.WithCancel(ctx)
+	ch := make(chan Job)
+	finished := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < s.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range ch {
+				s.attempt(ctx, j)
+				select {
+				case finished <- j.ID:
+				case <-ctx.Done():
+				}
+			}
+		}()
+	}
+	defer wg.Wait()
+	defer close(ch)
+	defer cancel()
+
+	busy := make(map[string]bool)
+	for {
+		jobs, err := s.Pending()
+		if err != nil {
+			return err
+		}
+		t := now()
+		next := t.Add(time.Minute)
+		var due []Job
+		for _, j := range jobs {
+			if busy[j.ID] {
+				continue
+			}
+			if j.NextAttempt.After(t) {
+				if j.NextAttempt.Before(next) {
+					next = j.NextAttempt
+				}
+				continue
+			}
+			due = append(due, j)
+		}
+		timer := time.NewTimer(next.Sub(t))
+	dispatch:
+		for len(due) > 0 {
+			select {
+			case ch <- due[0]:
+				busy[due[0].ID] = true
+				due = due[1:]
+			case id := <-finished:
+				delete(busy, id)
+			case <-ctx.Done():
+				break dispatch
+			}
+		}
+		select {
+		case id := <-finished:
+			delete(busy, id)
+		case <-s.wake:
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+		timer.Stop()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+// attempt uploads j once, and records the outcome.
+func (s *Spool) attempt(ctx context.Context, j Job) {
+	err := s.send(ctx, j)
+	if ctx.Err() != nil {
+		// Shutting down; the job stays as it was.
+		return
+	}
+	if err == nil {
+		os.Remove(s.jobPath(j.ID))
+		os.Remove(s.dataPath(j.ID))
+		s.report(Result{Job: j})
+		return
+	}
+	j.Attempts++
+	j.LastError = err.Error()
+	// Without its data, a job can never succeed.
+	lost := os.IsNotExist(err)
+	if lost || s.retry.Exhausted(j.Attempts) {
+		if werr := s.writeJob(filepath.Join(s.dir, "failed", j.ID), j); werr == nil {
+			os.Remove(s.jobPath(j.ID))
+		}
+		s.report(Result{Job: j, Err: err})
+		return
+	}
+	j.NextAttempt = now().Add(s.retry.Delay(j.Attempts))
+	s.writeJob(s.jobPath(j.ID), j)
+}
+
+func (s *Spool) send(ctx context.Context, j Job) error {
+	f, err := os.Open(s.dataPath(j.ID))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return s.upload(ctx, j.Name, s.limit.Reader(ctx, f))
+}
+
+func (s *Spool) report(r Result) {
+	if s.done == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.done(r)
+}
@@ -0,0 +1,400 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spool
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kurin/blazer/b2"
+)
+
+// fakeBucket records uploads, failing them while fail is set.
+type fakeBucket struct {
+	mu      sync.Mutex
+	objects map[string]string
+	fail    bool
+	calls   int
+}
+
+func (f *fakeBucket) upload(ctx context.Context, name string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.fail {
+		return errors.New("upload failed")
+	}
+	if f.objects == nil {
+		f.objects = make(map[string]string)
+	}
+	f.objects[name] = string(data)
+	return nil
+}
+
+func open(t *testing.T, dir string, fb *fakeBucket, opts ...Option) *Spool {
+	s, err := Open(dir, nil, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.upload = fb.upload
+	return s
+}
+
+// run runs s until n jobs have finished, and returns their results.
+func run(t *testing.T, s *Spool, n int) []Result {
+	var (
+		mu      sync.Mutex
+		results []Result
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s.done = func(r Result) {
+		mu.Lock()
+		defer mu.Unlock()
+		results = append(results, r)
+		if len(results) == n {
+			cancel()
+		}
+	}
+	s.Run(ctx)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(results) != n {
+		t.Fatalf("got %d results before timing out, want %d", len(results), n)
+	}
+	return results
+}
+
+func empty(t *testing.T, dir string) {
+	ents, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 0 {
+		t.Errorf("%s: got %d entries, want none", dir, len(ents))
+	}
+}
+
+func TestEnqueueRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	if err := ioutil.WriteFile(src, []byte("from a file"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fb := &fakeBucket{}
+	s := open(t, filepath.Join(dir, "spool"), fb, Workers(2))
+	if _, err := s.Enqueue("a", strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Enqueue("b", strings.NewReader("world")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.EnqueueFile("c", src); err != nil {
+		t.Fatal(err)
+	}
+	// The spool keeps its own link, so the source may go.
+	if err := os.Remove(src); err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := s.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, j := range jobs {
+		names = append(names, j.Name)
+	}
+	if got := strings.Join(names, ","); got != "a,b,c" {
+		t.Errorf("Pending: got %s, want a,b,c", got)
+	}
+
+	for _, r := range run(t, s, 3) {
+		if r.Err != nil {
+			t.Errorf("%s: %v", r.Job.Name, r.Err)
+		}
+	}
+	want := map[string]string{"a": "hello", "b": "world", "c": "from a file"}
+	for name, data := range want {
+		if fb.objects[name] != data {
+			t.Errorf("%s: got %q, want %q", name, fb.objects[name], data)
+		}
+	}
+	empty(t, filepath.Join(dir, "spool", "jobs"))
+	empty(t, filepath.Join(dir, "spool", "data"))
+}
+
+func TestRunStopsWorkersOnError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := open(t, dir, &fakeBucket{}, Workers(2))
+	for _, name := range []string{"a", "b"} {
+		if _, err := s.Enqueue(name, strings.NewReader(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Uploading a makes the queue unreadable, while b is still being
+	// uploaded, and b's upload only ends when its context does.
+	s.upload = func(ctx context.Context, name string, r io.Reader) error {
+		if name == "a" {
+			return os.RemoveAll(filepath.Join(dir, "jobs"))
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() { errc <- s.Run(ctx) }()
+	select {
+	case err := <-errc:
+		if err == nil || err == ctx.Err() {
+			t.Errorf("Run(): got %v, want the error reading the queue", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not return after the queue became unreadable")
+	}
+}
+
+type commitWriter struct {
+	ctx       context.Context
+	committed bool
+}
+
+func (w *commitWriter) Write(p []byte) (int, error) { return len(p), nil }
+
+func (w *commitWriter) Close() error {
+	w.committed = w.ctx.Err() == nil
+	return nil
+}
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) { return 0, errors.New("read failed") }
+
+func TestWriteObjectFailure(t *testing.T) {
+	var w *commitWriter
+	open := func(ctx context.Context) io.WriteCloser {
+		w = &commitWriter{ctx: ctx}
+		return w
+	}
+	src := io.MultiReader(strings.NewReader("partial"), errReader{})
+	if err := writeObject(context.Background(), open, src); err == nil {
+		t.Fatal("writeObject() from a failing reader: got no error")
+	}
+	if w.committed {
+		t.Error("writeObject() from a failing reader committed the object")
+	}
+	if err := writeObject(context.Background(), open, strings.NewReader("whole")); err != nil || !w.committed {
+		t.Errorf("writeObject(): got %v, committed=%v; want the object committed", err, w.committed)
+	}
+}
+
+func TestRetryAcrossRestarts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fb := &fakeBucket{fail: true}
+	s := open(t, dir, fb, RetryDelay(time.Hour, time.Hour))
+	if _, err := s.Enqueue("a", strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for {
+			jobs, _ := s.Pending()
+			if len(jobs) == 1 && jobs[0].Attempts == 1 {
+				cancel()
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	s.Run(ctx)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new spool over the same directory sees the failure, and waits out
+	// the delay before trying again.
+	fb.fail = false
+	s = open(t, dir, fb)
+	jobs, err := s.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].Attempts != 1 || jobs[0].LastError != "upload failed" {
+		t.Fatalf("Pending after restart: got %+v", jobs)
+	}
+	if !jobs[0].NextAttempt.After(time.Now().Add(50 * time.Minute)) {
+		t.Errorf("NextAttempt: got %v, want about an hour from now", jobs[0].NextAttempt)
+	}
+	later := time.Now().Add(2 * time.Hour)
+	now = func() time.Time { return later }
+	defer func() { now = time.Now }()
+	if r := run(t, s, 1)[0]; r.Err != nil || r.Job.Attempts != 1 {
+		t.Errorf("got %+v, want success after one failed attempt", r)
+	}
+	if fb.objects["a"] != "hello" {
+		t.Errorf("a: got %q, want %q", fb.objects["a"], "hello")
+	}
+}
+
+func TestMaxAttempts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fb := &fakeBucket{fail: true}
+	s := open(t, dir, fb, MaxAttempts(3), RetryDelay(0, 0))
+	id, err := s.Enqueue("a", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := run(t, s, 1)[0]
+	if r.Err == nil || r.Job.Attempts != 3 || fb.calls != 3 {
+		t.Errorf("got %+v after %d calls, want failure after 3", r, fb.calls)
+	}
+	failed, err := s.Failed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 1 || failed[0].ID != id {
+		t.Fatalf("Failed: got %+v", failed)
+	}
+
+	fb.fail = false
+	if err := s.Retry(id); err != nil {
+		t.Fatal(err)
+	}
+	if r := run(t, s, 1)[0]; r.Err != nil {
+		t.Errorf("after Retry: %v", r.Err)
+	}
+	empty(t, filepath.Join(dir, "failed"))
+	empty(t, filepath.Join(dir, "data"))
+
+	// A job whose data is lost fails at once, and can still be removed.
+	id, err = s.Enqueue("b", strings.NewReader("lost"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(s.dataPath(id)); err != nil {
+		t.Fatal(err)
+	}
+	if r := run(t, s, 1)[0]; !os.IsNotExist(r.Err) {
+		t.Errorf("lost data: got %v, want a missing file", r.Err)
+	}
+	if err := s.Remove(id); err != nil {
+		t.Errorf("Remove(%s): %v", id, err)
+	}
+	empty(t, filepath.Join(dir, "failed"))
+}
+
+func TestOpenCleansUp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := open(t, dir, &fakeBucket{})
+	if _, err := s.Enqueue("a", strings.NewReader("kept")); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate a crash after writing data but before queueing it.
+	for _, p := range []string{filepath.Join(dir, "tmp", "partial"), filepath.Join(dir, "data", "orphan")} {
+		if err := ioutil.WriteFile(p, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	open(t, dir, &fakeBucket{})
+	empty(t, filepath.Join(dir, "tmp"))
+	ents, err := ioutil.ReadDir(filepath.Join(dir, "data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 1 || ents[0].Name() == "orphan" {
+		t.Errorf("data after Open: got %v, want only the queued job's data", ents)
+	}
+}
+
+func TestLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := open(t, dir, &fakeBucket{})
+	if _, err := s.Enqueue("a", strings.NewReader("kept")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(dir, nil); err != ErrLocked {
+		t.Errorf("Open of a directory in use: got %v, want ErrLocked", err)
+	}
+	jobs, err := s.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 {
+		t.Errorf("Pending after a second Open: got %d jobs, want 1", len(jobs))
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s = open(t, dir, &fakeBucket{})
+	s.Close()
+}
+
+func TestOptions(t *testing.T) {
+	s := &Spool{}
+	RetryDelay(time.Second, 5*time.Second)(s)
+	MaxAttempts(3)(s)
+	if want := (b2.RetryPolicy{MaxAttempts: 3, Base: time.Second, Max: 5 * time.Second}); s.retry != want {
+		t.Errorf("MaxAttempts and RetryDelay: got %+v, want %+v", s.retry, want)
+	}
+	RateSchedule(&b2.BandwidthSchedule{Default: 100})(s)
+	if s.limit == nil {
+		t.Errorf("RateSchedule: got no limiter")
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package treediff
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kurin/blazer/b2"
+)
+
+// An Op is what an Action does.
+type Op string
+
+const (
+	// Upload writes a local file to its object.
+	Upload Op = "upload"
+
+	// Delete removes an object that no longer exists locally.
+	Delete Op = "delete"
+)
+
+// An Action is one step of a Plan.
+type Action struct {
+	Op      Op        `json:"op"`
+	Name    string    `json:"name"` // Relative to the root and prefix.
+	Size    int64     `json:"size"`
+	SHA1    string    `json:"sha1,omitempty"`
+	ModTime time.Time `json:"mtime,omitempty"`
+
+	// Done is set once the action has been applied.
+	Done bool `json:"done,omitempty"`
+}
+
+// A Plan lists the actions that bring the objects beneath a prefix up to
+// date with a local tree.  Making a plan does nothing, so a plan can be
+// encoded with encoding/json, reviewed or approved, and applied later with
+// Apply.  A plan records which of its actions are done, so that a sync that
+// is interrupted can be resumed by applying the same plan again.
+type Plan struct {
+	Actions []*Action `json:"actions"`
+}
+
+// PlanOptions adjusts what NewPlan includes.
+type PlanOptions struct {
+	// Delete includes the removal of objects that exist only remotely.
+	// Without it, a plan only uploads.
+	Delete bool
+}
+
+// NewPlan returns the plan that applies d, the differences between local and
+// remote as returned by Compare.  Names in d.Add and d.Update are uploaded
+// from local.  Names in d.Mismatch are left alone, since it isn't known which
+// copy is correct.  Actions are ordered by name, uploads first.
+func NewPlan(d *Diff, local, remote Manifest, opts PlanOptions) *Plan {
+	p := &Plan{}
+	var up []string
+	up = append(up, d.Add...)
+	up = append(up, d.Update...)
+	sort.Strings(up)
+	for _, name := range up {
+		e, ok := local[name]
+		if !ok {
+			continue
+		}
+		p.Actions = append(p.Actions, &Action{Op: Upload, Name: name, Size: e.Size, SHA1: e.SHA1, ModTime: e.ModTime})
+	}
+	if opts.Delete {
+		for _, name := range d.Delete {
+			e, ok := remote[name]
+			if !ok {
+				continue
+			}
+			p.Actions = append(p.Actions, &Action{Op: Delete, Name: name, Size: e.Size, SHA1: e.SHA1})
+		}
+	}
+	return p
+}
+
+// Pending returns the actions that are not yet done.
+func (p *Plan) Pending() []*Action {
+	var as []*Action
+	for _, a := range p.Actions {
+		if !a.Done {
+			as = append(as, a)
+		}
+	}
+	return as
+}
+
+// ApplyOptions adjusts how Apply carries out a plan.
+type ApplyOptions struct {
+	// Workers is the number of actions applied at once.  It defaults to
+	// one.
+	Workers int
+
+	// Progress, if set, is called after each action is done, one call at a
+	// time.  While it runs no action is marked done, so it may save the
+	// plan, to be resumed after an interruption.
+	Progress func(*Action)
+
+	// WriterOptions are given to each upload's Writer.
+	WriterOptions []b2.WriterOption
+}
+
+// Apply carries out the pending actions of p, uploading from the tree rooted
+// at dir to the objects beneath prefix, and marks each done as it finishes.
+// It stops at the first error.  An upload whose local file has changed size
+// since the plan was made fails, so that stale plans are not applied.  A
+// delete of an object that is already gone succeeds.
+func Apply(ctx context.Context, bucket *b2.Bucket, prefix, dir string, p *Plan, opts ApplyOptions) error {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	do := func(ctx context.Context, a *Action) error {
+		o := bucket.Object(prefix + a.Name)
+		switch a.Op {
+		case Upload:
+			return uploadFile(ctx, o, dir, a, opts.WriterOptions)
+		case Delete:
+			if err := o.Delete(ctx); err != nil && !b2.IsNotExist(err) {
+				return err
+			}
+			return nil
+		}
+		return fmt.Errorf("treediff: %s: unknown op %q", a.Name, a.Op)
+	}
+	return apply(ctx, do, p, opts)
+}
+
+// apply is Apply, with each action carried out by do.
+func apply(ctx context.Context, do func(context.Context, *Action) error, p *Plan, opts ApplyOptions) error {
+	workers := opts.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	for _, a := range p.Actions {
+		if clean := path.Clean("/" + a.Name); clean[1:] != a.Name {
+			return fmt.Errorf("treediff: %q is not a clean relative name", a.Name)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ch := make(chan *Action)
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex // guards rerr, and each action's Done
+		rerr error
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for a := range ch {
+				err := do(ctx, a)
+				mu.Lock()
+				switch {
+				case err != nil:
+					if rerr == nil {
+						rerr = err
+						cancel()
+					}
+				default:
+					a.Done = true
+					if opts.Progress != nil {
+						opts.Progress(a)
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, a := range p.Pending() {
+		select {
+		case ch <- a:
+		case <-ctx.Done():
+		}
+	}
+	close(ch)
+	wg.Wait()
+	if rerr != nil {
+		return rerr
+	}
+	return ctx.Err()
+}
+
+func uploadFile(ctx context.Context, o *b2.Object, dir string, a *Action, wopts []b2.WriterOption) error {
+	f, err := os.Open(filepath.Join(dir, filepath.FromSlash(a.Name)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() != a.Size {
+		return fmt.Errorf("treediff: %s: size is %d, but was %d when planned", a.Name, fi.Size(), a.Size)
+	}
+	attrs := &b2.Attrs{SHA1: a.SHA1, LastModified: a.ModTime}
+	opts := append([]b2.WriterOption{b2.WithAttrsOption(attrs)}, wopts...)
+	return b2.PipeTo(ctx, o, func(w io.Writer) error {
+		_, err := io.Copy(w, f)
+		return err
+	}, opts...)
+}
@@ -0,0 +1,227 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package treediff
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/kurin/blazer/b2"
+)
+
+// RestoreOptions adjusts how Restore writes a tree.
+type RestoreOptions struct {
+	// Workers is the number of objects downloaded at once.  It defaults to
+	// one.
+	Workers int
+
+	// Hardlink makes Restore download only one of each set of objects with
+	// the same size and hash, and hard link the others to it.  Linked files
+	// share their contents, permissions, and times, so a change to one is a
+	// change to all.  Where a link cannot be made, as across file systems,
+	// the downloaded copy is copied instead.  Objects whose hash is unknown
+	// are always downloaded.
+	Hardlink bool
+}
+
+// Restore downloads the objects in m, a manifest of the objects beneath
+// prefix as returned by Remote, into the tree rooted at dir.  Existing files
+// are overwritten, and each file's modification time is set from its entry.
+func Restore(ctx context.Context, bucket *b2.Bucket, prefix string, m Manifest, dir string, opts RestoreOptions) error {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	open := func(ctx context.Context, name string) io.ReadCloser {
+		return bucket.Object(prefix + name).NewReader(ctx)
+	}
+	return restore(ctx, open, m, dir, opts)
+}
+
+// restore is Restore, with the objects read by open.
+func restore(ctx context.Context, open func(context.Context, string) io.ReadCloser, m Manifest, dir string, opts RestoreOptions) error {
+	workers := opts.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	for _, e := range m {
+		if p := path.Clean("/" + e.Name); p[1:] != e.Name {
+			return fmt.Errorf("treediff: %q is not a clean relative name", e.Name)
+		}
+	}
+	fetch, links := plan(m, opts.Hardlink)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ch := make(chan *Entry)
+	var (
+		wg   sync.WaitGroup
+		emux sync.Mutex
+		rerr error
+	)
+	setErr := func(err error) {
+		emux.Lock()
+		defer emux.Unlock()
+		if rerr == nil {
+			rerr = err
+			cancel()
+		}
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range ch {
+				if err := download(ctx, open, e, dir); err != nil {
+					setErr(err)
+				}
+			}
+		}()
+	}
+	for _, e := range fetch {
+		select {
+		case ch <- e:
+		case <-ctx.Done():
+		}
+	}
+	close(ch)
+	wg.Wait()
+	if rerr != nil {
+		return rerr
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for _, l := range links {
+		if err := link(ctx, filepath.Join(dir, filepath.FromSlash(l.src)), l.e, dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type restoreLink struct {
+	e   *Entry
+	src string // the name of the downloaded copy
+}
+
+// plan splits m into the entries that must be downloaded and those that can
+// be linked to a downloaded copy.  Of each set of duplicates, the first name
+// is downloaded.
+func plan(m Manifest, hardlink bool) ([]*Entry, []restoreLink) {
+	var names []string
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	type key struct {
+		size int64
+		sum  string
+	}
+	first := make(map[key]string) // names of the downloaded copies
+	var (
+		fetch []*Entry
+		links []restoreLink
+	)
+	for _, name := range names {
+		e := m[name]
+		if !hardlink || e.SHA1 == "" {
+			fetch = append(fetch, e)
+			continue
+		}
+		k := key{e.Size, e.SHA1}
+		if src, ok := first[k]; ok {
+			links = append(links, restoreLink{e: e, src: src})
+			continue
+		}
+		first[k] = e.Name
+		fetch = append(fetch, e)
+	}
+	return fetch, links
+}
+
+func download(ctx context.Context, open func(context.Context, string) io.ReadCloser, e *Entry, dir string) error {
+	r := open(ctx, e.Name)
+	defer r.Close()
+	return writeFile(ctx, r, e, dir)
+}
+
+// link makes the file for e a hard link to src, or a copy of it.
+func link(ctx context.Context, src string, e *Entry, dir string) error {
+	dst := filepath.Join(dir, filepath.FromSlash(e.Name))
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return writeFile(ctx, f, e, dir)
+}
+
+func writeFile(ctx context.Context, r io.Reader, e *Entry, dir string) error {
+	dst := filepath.Join(dir, filepath.FromSlash(e.Name))
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	// An earlier restore may have linked dst to other files; writing through
+	// the link would change them too.
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 1<<16)
+	for {
+		if err := ctx.Err(); err != nil {
+			f.Close()
+			return err
+		}
+		n, rerr := r.Read(buf)
+		if _, err := f.Write(buf[:n]); err != nil {
+			f.Close()
+			return err
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			f.Close()
+			return fmt.Errorf("%s: %v", e.Name, rerr)
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if e.ModTime.IsZero() {
+		return nil
+	}
+	return os.Chtimes(dst, e.ModTime, e.ModTime)
+}
@@ -0,0 +1,259 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package treediff compares a local directory tree with the objects beneath a
+// B2 prefix, so that tools which sync, verify, or restore trees can share one
+// idea of what differs.
+package treediff
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kurin/blazer/b2"
+)
+
+// An Entry describes a single file or object.
+type Entry struct {
+	Name    string // Slash-separated, and relative to the root or prefix.
+	Size    int64
+	SHA1    string // Blank if unknown, e.g. for some large files.
+	ModTime time.Time
+}
+
+// A Manifest is a set of entries, keyed by name.
+type Manifest map[string]*Entry
+
+// Local walks the tree rooted at dir and hashes every regular file in it,
+// using the given number of concurrent workers.
+func Local(ctx context.Context, dir string, workers int) (Manifest, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ch := make(chan *Entry)
+	var (
+		wg   sync.WaitGroup
+		emux sync.Mutex
+		rerr error
+	)
+	setErr := func(err error) {
+		emux.Lock()
+		defer emux.Unlock()
+		if rerr == nil {
+			rerr = err
+			cancel()
+		}
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range ch {
+				sum, err := hashFile(ctx, filepath.Join(dir, filepath.FromSlash(e.Name)))
+				if err != nil {
+					setErr(err)
+					continue
+				}
+				e.SHA1 = sum
+			}
+		}()
+	}
+	m := make(Manifest)
+	walkErr := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		e := &Entry{
+			Name:    filepath.ToSlash(rel),
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+		}
+		m[e.Name] = e
+		select {
+		case ch <- e:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	close(ch)
+	wg.Wait()
+	if rerr != nil {
+		return nil, rerr
+	}
+	if walkErr != nil {
+		return nil, walkErr
+	}
+	return m, nil
+}
+
+func hashFile(ctx context.Context, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha1.New()
+	buf := make([]byte, 1<<16)
+	for {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		n, err := f.Read(buf)
+		h.Write(buf[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// Remote lists the current objects beneath prefix, fetching their attributes
+// with the given number of concurrent workers.  Names in the manifest are
+// relative to prefix.
+func Remote(ctx context.Context, bucket *b2.Bucket, prefix string, workers int) (Manifest, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ch := make(chan *b2.Object)
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		rerr error
+	)
+	m := make(Manifest)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for o := range ch {
+				attrs, err := o.Attrs(ctx)
+				mu.Lock()
+				if err != nil {
+					if rerr == nil {
+						rerr = err
+						cancel()
+					}
+					mu.Unlock()
+					continue
+				}
+				sum := attrs.SHA1
+				if sum == "none" {
+					sum = ""
+				}
+				mtime := attrs.LastModified
+				if mtime.IsZero() {
+					mtime = attrs.UploadTimestamp
+				}
+				name := strings.TrimPrefix(o.Name(), prefix)
+				m[name] = &Entry{
+					Name:    name,
+					Size:    attrs.Size,
+					SHA1:    sum,
+					ModTime: mtime,
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	iter := bucket.List(ctx, b2.ListPrefix(prefix))
+	for iter.Next() {
+		select {
+		case ch <- iter.Object():
+		case <-ctx.Done():
+		}
+	}
+	close(ch)
+	wg.Wait()
+	if rerr != nil {
+		return nil, rerr
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// A Diff lists the names that differ between a local and a remote manifest.
+// Each list is sorted.
+type Diff struct {
+	// Add holds names that exist only locally.
+	Add []string
+
+	// Update holds names whose local copy has changed: the sizes differ, or
+	// the remote hash is unknown and the local copy is newer.
+	Update []string
+
+	// Delete holds names that exist only remotely.
+	Delete []string
+
+	// Mismatch holds names whose sizes agree but whose hashes don't.  Unlike
+	// an Update, this may mean that either copy is corrupt.
+	Mismatch []string
+}
+
+// Compare returns the differences between local and remote.
+func Compare(local, remote Manifest) *Diff {
+	d := &Diff{}
+	for name, l := range local {
+		r, ok := remote[name]
+		switch {
+		case !ok:
+			d.Add = append(d.Add, name)
+		case l.Size != r.Size:
+			d.Update = append(d.Update, name)
+		case l.SHA1 == "" || r.SHA1 == "":
+			if l.ModTime.After(r.ModTime) {
+				d.Update = append(d.Update, name)
+			}
+		case l.SHA1 != r.SHA1:
+			d.Mismatch = append(d.Mismatch, name)
+		}
+	}
+	for name := range remote {
+		if _, ok := local[name]; !ok {
+			d.Delete = append(d.Delete, name)
+		}
+	}
+	sort.Strings(d.Add)
+	sort.Strings(d.Update)
+	sort.Strings(d.Delete)
+	sort.Strings(d.Mismatch)
+	return d
+}
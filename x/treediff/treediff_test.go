@@ -0,0 +1,295 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package treediff
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "treediff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"a":     "hello\n",
+		"sub/b": "",
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, err := Local(context.Background(), dir, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"a":     "f572d396fae9206628714fb2ce00f72e94f2258f",
+		"sub/b": "da39a3ee5e6b4b0d3255bfef95601890afd80709",
+	}
+	if len(m) != len(want) {
+		t.Errorf("Local(): got %d entries, want %d", len(m), len(want))
+	}
+	for name, sum := range want {
+		e, ok := m[name]
+		if !ok {
+			t.Errorf("Local(): missing %s", name)
+			continue
+		}
+		if e.SHA1 != sum || e.Size != int64(len(files[name])) {
+			t.Errorf("Local(): %s: got %+v, want SHA1 %s", name, e, sum)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	old := time.Unix(1e9, 0)
+	young := old.Add(time.Hour)
+	local := Manifest{
+		"new":       {Size: 1, SHA1: "x", ModTime: young},
+		"same":      {Size: 1, SHA1: "x", ModTime: young},
+		"grown":     {Size: 2, SHA1: "y", ModTime: young},
+		"corrupt":   {Size: 1, SHA1: "x", ModTime: old},
+		"nohash":    {Size: 1, SHA1: "x", ModTime: young},
+		"nohashold": {Size: 1, SHA1: "x", ModTime: old},
+	}
+	remote := Manifest{
+		"same":      {Size: 1, SHA1: "x", ModTime: old},
+		"grown":     {Size: 1, SHA1: "x", ModTime: old},
+		"corrupt":   {Size: 1, SHA1: "z", ModTime: young},
+		"nohash":    {Size: 1, ModTime: old},
+		"nohashold": {Size: 1, ModTime: young},
+		"gone":      {Size: 1, SHA1: "x", ModTime: old},
+	}
+	got := Compare(local, remote)
+	want := &Diff{
+		Add:      []string{"new"},
+		Update:   []string{"grown", "nohash"},
+		Delete:   []string{"gone"},
+		Mismatch: []string{"corrupt"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Compare(): got %+v, want %+v", got, want)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "treediff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mtime := time.Unix(1e9, 0)
+	objects := map[string]string{
+		"a":       "hello\n",
+		"dup/a":   "hello\n",
+		"dup/b/a": "hello\n",
+		"b":       "world\n",
+		"nohash":  "hello\n",
+	}
+	m := make(Manifest)
+	for name, data := range objects {
+		sum := "x"
+		if data != "hello\n" {
+			sum = "y"
+		}
+		if name == "nohash" {
+			sum = ""
+		}
+		m[name] = &Entry{Name: name, Size: int64(len(data)), SHA1: sum, ModTime: mtime}
+	}
+	var (
+		mu   sync.Mutex
+		read []string
+	)
+	open := func(ctx context.Context, name string) io.ReadCloser {
+		mu.Lock()
+		defer mu.Unlock()
+		read = append(read, name)
+		return ioutil.NopCloser(strings.NewReader(objects[name]))
+	}
+	if err := restore(context.Background(), open, m, dir, RestoreOptions{Workers: 3, Hardlink: true}); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(read)
+	if want := []string{"a", "b", "nohash"}; !reflect.DeepEqual(read, want) {
+		t.Errorf("restore: downloaded %v, want %v", read, want)
+	}
+	first, err := os.Stat(filepath.Join(dir, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range objects {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		got, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if string(got) != data {
+			t.Errorf("restore: %s: got %q, want %q", name, got, data)
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fi.ModTime().Equal(mtime) {
+			t.Errorf("restore: %s: got mtime %v, want %v", name, fi.ModTime(), mtime)
+		}
+		if linked := os.SameFile(first, fi); linked != strings.HasSuffix(name, "a") {
+			t.Errorf("restore: %s: linked to a: got %v", name, linked)
+		}
+	}
+
+	// Restoring again, after the copies have drifted apart, must not write
+	// through the links the first restore made.
+	objects["dup/a"] = "drift\n"
+	m["dup/a"] = &Entry{Name: "dup/a", Size: int64(len(objects["dup/a"])), SHA1: "z", ModTime: mtime}
+	if err := restore(context.Background(), open, m, dir, RestoreOptions{Workers: 3, Hardlink: true}); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range objects {
+		got, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if string(got) != data {
+			t.Errorf("second restore: %s: got %q, want %q", name, got, data)
+		}
+	}
+
+	bad := Manifest{"../x": {Name: "../x"}}
+	if err := restore(context.Background(), open, bad, dir, RestoreOptions{}); err == nil {
+		t.Error("restore: ../x: got no error")
+	}
+}
+
+func TestNewPlan(t *testing.T) {
+	mtime := time.Unix(1e9, 0).UTC()
+	local := Manifest{
+		"new": {Name: "new", Size: 1, SHA1: "n", ModTime: mtime},
+		"mod": {Name: "mod", Size: 2, SHA1: "m", ModTime: mtime},
+	}
+	remote := Manifest{
+		"mod": {Name: "mod", Size: 20},
+		"old": {Name: "old", Size: 4},
+	}
+	d := Compare(local, remote)
+
+	p := NewPlan(d, local, remote, PlanOptions{})
+	want := []*Action{
+		{Op: Upload, Name: "mod", Size: 2, SHA1: "m", ModTime: mtime},
+		{Op: Upload, Name: "new", Size: 1, SHA1: "n", ModTime: mtime},
+	}
+	if !reflect.DeepEqual(p.Actions, want) {
+		t.Errorf("NewPlan(): got %+v, want %+v", p.Actions, want)
+	}
+	p = NewPlan(d, local, remote, PlanOptions{Delete: true})
+	want = append(want, &Action{Op: Delete, Name: "old", Size: 4})
+	if !reflect.DeepEqual(p.Actions, want) {
+		t.Errorf("NewPlan(Delete): got %+v, want %+v", p.Actions, want)
+	}
+
+	b, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := &Plan{}
+	if err := json.Unmarshal(b, got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, p) {
+		t.Errorf("json round trip: got %+v, want %+v", got, p)
+	}
+}
+
+func TestApply(t *testing.T) {
+	p := &Plan{Actions: []*Action{
+		{Op: Upload, Name: "a"},
+		{Op: Upload, Name: "b", Done: true},
+		{Op: Delete, Name: "c"},
+		{Op: Upload, Name: "d"},
+	}}
+	var (
+		mu    sync.Mutex
+		did   []string
+		saved []string
+	)
+	fail := errors.New("d failed")
+	do := func(ctx context.Context, a *Action) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if a.Name == "d" && fail != nil {
+			return fail
+		}
+		did = append(did, a.Name)
+		return nil
+	}
+	progress := func(a *Action) {
+		b, err := json.Marshal(p)
+		if err != nil {
+			t.Error(err)
+		}
+		saved = append(saved, string(b))
+	}
+	if err := apply(context.Background(), do, p, ApplyOptions{Workers: 3, Progress: progress}); err == nil || err.Error() != "d failed" {
+		t.Errorf("apply: got %v, want d failed", err)
+	}
+	sort.Strings(did)
+	if want := []string{"a", "c"}; !reflect.DeepEqual(did, want) {
+		t.Errorf("apply: did %v, want %v", did, want)
+	}
+	if len(saved) != 2 {
+		t.Errorf("apply: got %d progress calls, want 2", len(saved))
+	}
+	pending := p.Pending()
+	if len(pending) != 1 || pending[0].Name != "d" {
+		t.Fatalf("after apply: pending %+v, want only d", pending)
+	}
+
+	// Resuming does only what is left.
+	did = nil
+	fail = nil
+	if err := apply(context.Background(), do, p, ApplyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(did, []string{"d"}) || len(p.Pending()) != 0 {
+		t.Errorf("resume: did %v, pending %v", did, p.Pending())
+	}
+
+	bad := &Plan{Actions: []*Action{{Op: Upload, Name: "../x"}}}
+	if err := apply(context.Background(), do, bad, ApplyOptions{}); err == nil {
+		t.Error("apply: ../x: got no error")
+	}
+}
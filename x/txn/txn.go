@@ -0,0 +1,297 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package txn implements an experimental two-phase commit for updating several
+// B2 objects at once.
+//
+// Writes in a transaction are staged under a private prefix, where readers
+// don't look.  Committing writes a manifest that maps each logical name to
+// its staged object, and then replaces a single pointer object with the
+// manifest's ID.  Since the pointer is one small object, readers that resolve
+// names through Latest see either all of a transaction's writes or none of
+// them.
+//
+// Objects are laid out beneath the store's prefix as
+//
+//	<prefix>/HEAD                  the ID of the latest manifest
+//	<prefix>/manifests/<id>        a committed manifest, as JSON
+//	<prefix>/staged/<id>/<name>    an object written by transaction <id>
+//
+// Committers are not serialized.  Commit refuses to replace a pointer that
+// has changed since the transaction began, but the check and the replacement
+// are separate requests, so two commits that check at the same moment may both
+// succeed, and the later one wins: the earlier transaction's writes are lost.
+// A store should have one committer at a time.
+package txn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kurin/blazer/b2"
+	"github.com/kurin/blazer/internal/pointer"
+)
+
+var (
+	// ErrNoManifest is returned by Latest when nothing has been committed.
+	ErrNoManifest = errors.New("txn: no committed manifest")
+
+	// ErrConflict is returned by Commit when another transaction has
+	// committed since this one began.
+	ErrConflict = errors.New("txn: another transaction has committed")
+
+	errDone = errors.New("txn: transaction already committed or aborted")
+)
+
+// A Store is a set of objects updated together by transactions.
+type Store struct {
+	b      *b2.Bucket
+	prefix string
+}
+
+// New returns a Store for the objects beneath prefix.
+func New(bucket *b2.Bucket, prefix string) *Store {
+	return &Store{
+		b:      bucket,
+		prefix: b2.CleanName(prefix),
+	}
+}
+
+// A Manifest describes the objects in a committed transaction, along with
+// those it inherited from the transactions before it.
+type Manifest struct {
+	ID     string
+	Parent string // The ID of the previous manifest, if any.
+	Time   time.Time
+
+	// Objects maps logical names to the B2 objects that hold them.
+	Objects map[string]string
+}
+
+// Names returns the logical names in the manifest.
+func (m *Manifest) Names() []string {
+	var names []string
+	for name := range m.Objects {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (s *Store) head() *pointer.Pointer {
+	return pointer.New(s.b, b2.JoinName(s.prefix, "HEAD"))
+}
+
+func (s *Store) manifestName(id string) string {
+	return b2.JoinName(s.prefix, "manifests", id)
+}
+
+func (s *Store) stagedName(id, name string) (string, error) {
+	return b2.ScopedName(b2.JoinName(s.prefix, "staged", id), name)
+}
+
+func (s *Store) manifest(ctx context.Context, id string) (*Manifest, error) {
+	m := &Manifest{}
+	if err := pointer.Read(ctx, s.b, s.manifestName(id), m); err != nil {
+		return nil, err
+	}
+	if m.Objects == nil {
+		m.Objects = make(map[string]string)
+	}
+	return m, nil
+}
+
+// Latest returns the most recently committed manifest.
+func (s *Store) Latest(ctx context.Context) (*Manifest, error) {
+	id, err := s.head().Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if id == "" {
+		return nil, ErrNoManifest
+	}
+	return s.manifest(ctx, id)
+}
+
+// NewReader returns a reader for the named object as of the given manifest.
+func (s *Store) NewReader(ctx context.Context, m *Manifest, name string) (*b2.Reader, error) {
+	obj, ok := m.Objects[b2.CleanName(name)]
+	if !ok {
+		return nil, fmt.Errorf("%s: not in manifest %s", name, m.ID)
+	}
+	return s.b.Object(obj).NewReader(ctx), nil
+}
+
+// A Txn is a set of writes and deletes that are committed together.  Its
+// methods are safe to call concurrently, but all writes must be closed
+// before Commit is called.
+type Txn struct {
+	s    *Store
+	id   string
+	base *Manifest // nil if there was no manifest when the Txn began
+
+	mu        sync.Mutex
+	staged    map[string]string
+	deleted   map[string]bool
+	done      bool // committed or aborted
+	committed bool
+}
+
+// Begin starts a transaction based on the latest committed manifest.
+func (s *Store) Begin(ctx context.Context) (*Txn, error) {
+	base, err := s.Latest(ctx)
+	if err != nil && err != ErrNoManifest {
+		return nil, err
+	}
+	id, err := pointer.NewID()
+	if err != nil {
+		return nil, err
+	}
+	return &Txn{
+		s:       s,
+		id:      id,
+		base:    base,
+		staged:  make(map[string]string),
+		deleted: make(map[string]bool),
+	}, nil
+}
+
+// ID returns the transaction's ID, which becomes the ID of its manifest.
+func (t *Txn) ID() string {
+	return t.id
+}
+
+// NewWriter returns a Writer that stages the named object.  The object is not
+// visible through the store until the transaction commits, and the Writer
+// must be closed before then.
+func (t *Txn) NewWriter(ctx context.Context, name string, opts ...b2.WriterOption) (*b2.Writer, error) {
+	name = b2.CleanName(name)
+	obj, err := t.s.stagedName(t.id, name)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return nil, errDone
+	}
+	t.staged[name] = obj
+	delete(t.deleted, name)
+	return t.s.b.Object(obj).NewWriter(ctx, opts...), nil
+}
+
+// Delete removes the named object from the store when the transaction
+// commits.  The underlying B2 object is left in place for readers of older
+// manifests.
+func (t *Txn) Delete(name string) error {
+	name = b2.CleanName(name)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return errDone
+	}
+	delete(t.staged, name)
+	t.deleted[name] = true
+	return nil
+}
+
+// manifest returns the manifest that the transaction would commit.  The
+// caller must hold mu.
+func (t *Txn) manifest() *Manifest {
+	m := &Manifest{
+		ID:      t.id,
+		Time:    time.Now(),
+		Objects: make(map[string]string),
+	}
+	if t.base != nil {
+		m.Parent = t.base.ID
+		for name, obj := range t.base.Objects {
+			m.Objects[name] = obj
+		}
+	}
+	for name := range t.deleted {
+		delete(m.Objects, name)
+	}
+	for name, obj := range t.staged {
+		m.Objects[name] = obj
+	}
+	return m
+}
+
+// Commit writes the transaction's manifest and points the store at it.  It
+// returns ErrConflict, and commits nothing, if another transaction has
+// committed since this one began; the staged objects are kept, so the caller
+// may Abort.
+func (t *Txn) Commit(ctx context.Context) (*Manifest, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return nil, errDone
+	}
+	var parent string
+	if t.base != nil {
+		parent = t.base.ID
+	}
+	head := t.s.head()
+	cur, err := head.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if cur != parent {
+		return nil, ErrConflict
+	}
+
+	m := t.manifest()
+	name := t.s.manifestName(m.ID)
+	if err := pointer.Write(ctx, t.s.b, name, m); err != nil {
+		return nil, err
+	}
+	if err := head.Swap(ctx, parent, m.ID); err != nil {
+		if err == pointer.ErrMoved {
+			t.s.b.Object(name).Delete(ctx)
+			err = ErrConflict
+		}
+		return nil, err
+	}
+	t.done = true
+	t.committed = true
+	return m, nil
+}
+
+// Abort deletes the transaction's staged objects.  A transaction cannot be
+// used after it is aborted.  Abort does nothing once Commit has succeeded, so
+// it may be deferred:
+//
+//	tx, err := s.Begin(ctx)
+//	...
+//	defer tx.Abort(ctx)
+func (t *Txn) Abort(ctx context.Context) error {
+	t.mu.Lock()
+	if t.committed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.done = true
+	t.mu.Unlock()
+	pfx := b2.JoinName(t.s.prefix, "staged", t.id) + "/"
+	iter := t.s.b.List(ctx, b2.ListPrefix(pfx), b2.ListHidden())
+	for iter.Next() {
+		if err := iter.Object().Delete(ctx); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
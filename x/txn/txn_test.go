@@ -0,0 +1,197 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package txn
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/kurin/blazer/b2"
+)
+
+const (
+	apiID      = "B2_ACCOUNT_ID"
+	apiKey     = "B2_SECRET_KEY"
+	bucketName = "txnbucket"
+)
+
+func TestManifest(t *testing.T) {
+	s := New(nil, "/data/")
+	tx := &Txn{
+		s:  s,
+		id: "2",
+		base: &Manifest{
+			ID: "1",
+			Objects: map[string]string{
+				"keep":   "data/staged/1/keep",
+				"gone":   "data/staged/1/gone",
+				"change": "data/staged/1/change",
+			},
+		},
+		staged: map[string]string{
+			"change": "data/staged/2/change",
+			"new":    "data/staged/2/new",
+		},
+		deleted: map[string]bool{"gone": true},
+	}
+	m := tx.manifest()
+	want := map[string]string{
+		"keep":   "data/staged/1/keep",
+		"change": "data/staged/2/change",
+		"new":    "data/staged/2/new",
+	}
+	if m.ID != "2" || m.Parent != "1" || !reflect.DeepEqual(m.Objects, want) {
+		t.Errorf("manifest(): got %+v, want objects %v", m, want)
+	}
+	if _, err := s.stagedName("2", "../../HEAD"); err == nil {
+		t.Errorf("stagedName(../../HEAD): got no error")
+	}
+}
+
+func TestAbortAfterCommit(t *testing.T) {
+	// The Store has no bucket, so an Abort that tried to delete anything
+	// would panic.
+	tx := &Txn{
+		s:         New(nil, "data"),
+		id:        "1",
+		done:      true,
+		committed: true,
+	}
+	if err := tx.Abort(context.Background()); err != nil {
+		t.Errorf("Abort() after Commit: got %v, want nil", err)
+	}
+	if !tx.committed {
+		t.Errorf("Abort() after Commit: transaction no longer marked committed")
+	}
+	if err := tx.Delete("a"); err != errDone {
+		t.Errorf("Delete() after Commit: got %v, want errDone", err)
+	}
+}
+
+func write(ctx context.Context, tx *Txn, name, data string) error {
+	w, err := tx.NewWriter(ctx, name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func read(ctx context.Context, s *Store, m *Manifest, name string) (string, error) {
+	r, err := s.NewReader(ctx, m, name)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	return string(b), err
+}
+
+func TestStore(t *testing.T) {
+	id := os.Getenv(apiID)
+	key := os.Getenv(apiKey)
+	if id == "" || key == "" {
+		t.Skipf("B2_ACCOUNT_ID or B2_SECRET_KEY unset; skipping integration tests")
+	}
+	ctx := context.Background()
+	client, err := b2.NewClient(ctx, id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket, err := client.NewBucket(ctx, fmt.Sprintf("%s-%s", id, bucketName), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bucket.Delete(ctx)
+	defer func() {
+		iter := bucket.List(ctx, b2.ListHidden())
+		for iter.Next() {
+			iter.Object().Delete(ctx)
+		}
+	}()
+
+	s := New(bucket, "data")
+	if _, err := s.Latest(ctx); err != ErrNoManifest {
+		t.Fatalf("Latest(): got %v, want ErrNoManifest", err)
+	}
+	tx, err := s.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b"} {
+		if err := write(ctx, tx, name, "one "+name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.Latest(ctx); err != ErrNoManifest {
+		t.Errorf("Latest() before commit: got %v, want ErrNoManifest", err)
+	}
+	if _, err := tx.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	tx1, err := s.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx2, err := s.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := write(ctx, tx1, "b", "two b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx1.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx1.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx1.Abort(ctx); err != nil {
+		t.Errorf("Abort() after Commit: %v", err)
+	}
+	if err := write(ctx, tx2, "a", "lost a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx2.Commit(ctx); err != ErrConflict {
+		t.Errorf("Commit() after another commit: got %v, want ErrConflict", err)
+	}
+	if err := tx2.Abort(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := s.Latest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Objects) != 1 {
+		t.Errorf("Latest(): got objects %v, want only b", m.Objects)
+	}
+	got, err := read(ctx, s, m, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "two b" {
+		t.Errorf("read b: got %q, want %q", got, "two b")
+	}
+}
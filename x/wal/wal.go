@@ -0,0 +1,315 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package wal replicates databases that are made of a snapshot and an
+// append-only write-ahead log, such as SQLite in WAL mode, to B2.
+//
+// Replicas are divided into generations.  Each generation begins with a full
+// snapshot of the database, followed by the WAL segments written after it,
+// in order.  Restoring to a point in time applies the snapshot of the newest
+// generation that began before then, followed by every segment in that
+// generation that was appended before then.
+//
+// Objects are laid out as:
+//
+//	<prefix>/<generation>/snapshot
+//	<prefix>/<generation>/wal/<index>-<time>
+//
+// where generation and time are hex nanosecond timestamps, so that lexical
+// and chronological order agree.
+package wal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kurin/blazer/b2"
+)
+
+// ErrNoGeneration is returned when a replica has no generation to resume or
+// restore from.
+var ErrNoGeneration = errors.New("wal: no generation")
+
+// A Replica is a set of generations stored beneath a prefix.
+type Replica struct {
+	b      *b2.Bucket
+	prefix string
+}
+
+// New returns a Replica stored in bucket beneath prefix.
+func New(bucket *b2.Bucket, prefix string) *Replica {
+	return &Replica{
+		b:      bucket,
+		prefix: b2.CleanName(prefix),
+	}
+}
+
+// A Generation is a snapshot followed by the WAL segments appended to it.
+type Generation struct {
+	r     *Replica
+	id    string
+	start time.Time
+
+	mu   sync.Mutex
+	next int
+}
+
+// ID returns the generation's name.
+func (g *Generation) ID() string { return g.id }
+
+// Start returns the time the generation's snapshot was taken.
+func (g *Generation) Start() time.Time { return g.start }
+
+func stamp(t time.Time) string {
+	return fmt.Sprintf("%016x", t.UnixNano())
+}
+
+func parseStamp(s string) (time.Time, error) {
+	var nanos int64
+	if len(s) != 16 {
+		return time.Time{}, fmt.Errorf("%q: not a timestamp", s)
+	}
+	if _, err := fmt.Sscanf(s, "%016x", &nanos); err != nil {
+		return time.Time{}, fmt.Errorf("%q: not a timestamp: %v", s, err)
+	}
+	return time.Unix(0, nanos), nil
+}
+
+// segment is a WAL segment's place in its generation.
+type segment struct {
+	index int
+	t     time.Time
+	name  string
+}
+
+func segmentName(index int, t time.Time) string {
+	return fmt.Sprintf("%08d-%s", index, stamp(t))
+}
+
+func parseSegment(name string) (segment, error) {
+	base := name[strings.LastIndex(name, "/")+1:]
+	parts := strings.Split(base, "-")
+	if len(parts) != 2 {
+		return segment{}, fmt.Errorf("%s: not a WAL segment", name)
+	}
+	var index int
+	if _, err := fmt.Sscanf(parts[0], "%d", &index); err != nil {
+		return segment{}, fmt.Errorf("%s: not a WAL segment: %v", name, err)
+	}
+	t, err := parseStamp(parts[1])
+	if err != nil {
+		return segment{}, fmt.Errorf("%s: %v", name, err)
+	}
+	return segment{index: index, t: t, name: name}, nil
+}
+
+// dir returns the prefix that generations are listed under.  A replica at the
+// root of its bucket has none.
+func (r *Replica) dir() string {
+	if r.prefix == "" {
+		return ""
+	}
+	return r.prefix + "/"
+}
+
+func (r *Replica) genPrefix(id string) string {
+	return b2.JoinName(r.prefix, id) + "/"
+}
+
+func (r *Replica) upload(ctx context.Context, name string, src io.Reader) error {
+	return upload(ctx, func(ctx context.Context) io.WriteCloser {
+		return r.b.Object(name).NewWriter(ctx)
+	}, src)
+}
+
+// upload copies src to the writer that open returns.  If src fails, the
+// writer's context is cancelled before it is closed, so that a truncated
+// snapshot or segment is never committed in place of a whole one.
+func upload(ctx context.Context, open func(context.Context) io.WriteCloser, src io.Reader) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := open(ctx)
+	if _, err := io.Copy(w, src); err != nil {
+		cancel()
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// Begin starts a new generation by uploading a snapshot of the database.
+// WAL segments written after the snapshot was taken should be passed to the
+// new generation's Append method.
+func (r *Replica) Begin(ctx context.Context, snapshot io.Reader) (*Generation, error) {
+	start := time.Now()
+	g := &Generation{
+		r:     r,
+		id:    stamp(start),
+		start: start,
+		next:  1,
+	}
+	if err := r.upload(ctx, r.genPrefix(g.id)+"snapshot", snapshot); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Append uploads the next WAL segment in the generation.  Calls to Append
+// must not be made concurrently, since segments are numbered in the order
+// they are appended.
+func (g *Generation) Append(ctx context.Context, seg io.Reader) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	name := g.r.genPrefix(g.id) + "wal/" + segmentName(g.next, time.Now())
+	if err := g.r.upload(ctx, name, seg); err != nil {
+		return err
+	}
+	g.next++
+	return nil
+}
+
+func (g *Generation) segments(ctx context.Context) ([]segment, error) {
+	var segs []segment
+	iter := g.r.b.List(ctx, b2.ListPrefix(g.r.genPrefix(g.id)+"wal/"))
+	for iter.Next() {
+		s, err := parseSegment(iter.Object().Name())
+		if err != nil {
+			return nil, err
+		}
+		segs = append(segs, s)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i].index < segs[j].index })
+	return segs, nil
+}
+
+// Generations returns the replica's generations, oldest first.
+func (r *Replica) Generations(ctx context.Context) ([]*Generation, error) {
+	var gens []*Generation
+	iter := r.b.List(ctx, b2.ListPrefix(r.dir()), b2.ListDelimiter("/"))
+	for iter.Next() {
+		name := strings.TrimSuffix(strings.TrimPrefix(iter.Object().Name(), r.dir()), "/")
+		start, err := parseStamp(name)
+		if err != nil {
+			continue
+		}
+		gens = append(gens, &Generation{r: r, id: name, start: start})
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(gens, func(i, j int) bool { return gens[i].start.Before(gens[j].start) })
+	return gens, nil
+}
+
+// Resume returns the newest generation, ready to have more segments appended,
+// e.g. after a restart.
+func (r *Replica) Resume(ctx context.Context) (*Generation, error) {
+	gens, err := r.Generations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(gens) == 0 {
+		return nil, ErrNoGeneration
+	}
+	g := gens[len(gens)-1]
+	segs, err := g.segments(ctx)
+	if err != nil {
+		return nil, err
+	}
+	g.next = 1
+	if len(segs) > 0 {
+		g.next = segs[len(segs)-1].index + 1
+	}
+	return g, nil
+}
+
+// Restore rebuilds the database as it was at time t.  It passes the snapshot
+// of the newest generation that began at or before t to apply, followed by
+// each of that generation's WAL segments that was appended at or before t,
+// in order.  If t is zero, the newest generation is restored in full.
+func (r *Replica) Restore(ctx context.Context, t time.Time, apply func(src io.Reader, snapshot bool) error) error {
+	gens, err := r.Generations(ctx)
+	if err != nil {
+		return err
+	}
+	var g *Generation
+	for _, gen := range gens {
+		if t.IsZero() || !gen.start.After(t) {
+			g = gen
+		}
+	}
+	if g == nil {
+		return ErrNoGeneration
+	}
+	segs, err := g.segments(ctx)
+	if err != nil {
+		return err
+	}
+	if err := r.apply(ctx, g.r.genPrefix(g.id)+"snapshot", true, apply); err != nil {
+		return err
+	}
+	for i, s := range segs {
+		if !t.IsZero() && s.t.After(t) {
+			break
+		}
+		if s.index != i+1 {
+			return fmt.Errorf("%s: missing segment %d", g.id, i+1)
+		}
+		if err := r.apply(ctx, s.name, false, apply); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Replica) apply(ctx context.Context, name string, snapshot bool, apply func(io.Reader, bool) error) error {
+	rd := r.b.Object(name).NewReader(ctx)
+	defer rd.Close()
+	return apply(rd, snapshot)
+}
+
+// Prune deletes all but the newest keep generations.
+func (r *Replica) Prune(ctx context.Context, keep int) error {
+	gens, err := r.Generations(ctx)
+	if err != nil {
+		return err
+	}
+	if keep < 0 {
+		keep = 0
+	}
+	if len(gens) <= keep {
+		return nil
+	}
+	for _, g := range gens[:len(gens)-keep] {
+		iter := r.b.List(ctx, b2.ListPrefix(r.genPrefix(g.id)), b2.ListHidden())
+		for iter.Next() {
+			if err := iter.Object().Delete(ctx); err != nil && !b2.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+// Copyright 2018, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kurin/blazer/b2"
+)
+
+const (
+	apiID      = "B2_ACCOUNT_ID"
+	apiKey     = "B2_SECRET_KEY"
+	bucketName = "walbucket"
+)
+
+func TestSegmentNames(t *testing.T) {
+	now := time.Unix(1520000000, 123456789)
+	name := "db/" + stamp(now) + "/wal/" + segmentName(12, now)
+	s, err := parseSegment(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.index != 12 || !s.t.Equal(now) || s.name != name {
+		t.Errorf("parseSegment(%q): got %+v", name, s)
+	}
+	if segmentName(2, now) > segmentName(10, now) {
+		t.Errorf("segment names don't sort by index")
+	}
+	for _, bad := range []string{"db/x/wal/1", "db/x/wal/a-0000000000000001", "db/x/wal/1-xyz"} {
+		if _, err := parseSegment(bad); err == nil {
+			t.Errorf("parseSegment(%q): got no error", bad)
+		}
+	}
+}
+
+// commitWriter records whether it was closed with its context still live,
+// which is when a b2.Writer commits what it was given.
+type commitWriter struct {
+	ctx       context.Context
+	buf       bytes.Buffer
+	committed bool
+}
+
+func (w *commitWriter) Write(p []byte) (int, error) { return w.buf.Write(p) }
+
+func (w *commitWriter) Close() error {
+	w.committed = w.ctx.Err() == nil
+	return nil
+}
+
+type failReader struct{ n int }
+
+func (f *failReader) Read(p []byte) (int, error) {
+	if f.n == 0 {
+		return 0, errors.New("read failed")
+	}
+	n := len(p)
+	if n > f.n {
+		n = f.n
+	}
+	f.n -= n
+	return n, nil
+}
+
+func TestDir(t *testing.T) {
+	for prefix, want := range map[string]string{
+		"":      "",
+		"/":     "",
+		"db":    "db/",
+		"/a/b/": "a/b/",
+	} {
+		if got := New(nil, prefix).dir(); got != want {
+			t.Errorf("New(%q).dir(): got %q, want %q", prefix, got, want)
+		}
+	}
+}
+
+func TestUploadFailure(t *testing.T) {
+	ctx := context.Background()
+	var w *commitWriter
+	open := func(ctx context.Context) io.WriteCloser {
+		w = &commitWriter{ctx: ctx}
+		return w
+	}
+	if err := upload(ctx, open, &failReader{n: 10}); err == nil {
+		t.Fatal("upload() from a failing reader: got no error")
+	}
+	if w.committed {
+		t.Errorf("upload() from a failing reader committed %d bytes", w.buf.Len())
+	}
+	if err := upload(ctx, open, strings.NewReader("whole")); err != nil {
+		t.Fatal(err)
+	}
+	if !w.committed || w.buf.String() != "whole" {
+		t.Errorf("upload(): got committed=%v with %q, want the whole source committed", w.committed, w.buf.String())
+	}
+}
+
+func TestReplica(t *testing.T) {
+	id := os.Getenv(apiID)
+	key := os.Getenv(apiKey)
+	if id == "" || key == "" {
+		t.Skipf("B2_ACCOUNT_ID or B2_SECRET_KEY unset; skipping integration tests")
+	}
+	ctx := context.Background()
+	client, err := b2.NewClient(ctx, id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket, err := client.NewBucket(ctx, fmt.Sprintf("%s-%s", id, bucketName), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bucket.Delete(ctx)
+
+	r := New(bucket, "db")
+	defer r.Prune(ctx, 0)
+	if _, err := r.Begin(ctx, &failReader{n: 10}); err == nil {
+		t.Fatal("Begin() from a failing reader: got no error")
+	}
+	if gens, err := r.Generations(ctx); err != nil || len(gens) != 0 {
+		t.Fatalf("Generations() after a failed Begin: got %d, %v; want none", len(gens), err)
+	}
+	g, err := r.Begin(ctx, strings.NewReader("snap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, seg := range []string{"a", "b"} {
+		if err := g.Append(ctx, strings.NewReader(seg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mid := time.Now()
+	time.Sleep(time.Second)
+	g, err = r.Resume(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Append(ctx, strings.NewReader("c")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range []struct {
+		at   time.Time
+		want string
+	}{
+		{want: "snap|a|b|c"},
+		{at: mid, want: "snap|a|b"},
+	} {
+		var got []string
+		err := r.Restore(ctx, e.at, func(src io.Reader, _ bool) error {
+			b, err := ioutil.ReadAll(src)
+			got = append(got, string(bytes.TrimSpace(b)))
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := strings.Join(got, "|"); s != e.want {
+			t.Errorf("Restore(%v): got %q, want %q", e.at, s, e.want)
+		}
+	}
+}